@@ -1,5 +1,10 @@
 package api
 
+import (
+	"errors"
+	"time"
+)
+
 // SendRequest sends a new transaction to the enclave for storage and propagation to the provided
 // recipients.
 type SendRequest struct {
@@ -9,12 +14,20 @@ type SendRequest struct {
 	From string `json:"from"`
 	// To is a list of the recipient nodes that should be privy to this transaction payload.
 	To []string `json:"to"`
+	// DeliveryPolicy is the policy propagation to the recipients must satisfy for the request to
+	// succeed. It should be either "all", "quorum" or "best-effort", if omitted the node's
+	// configured policy is used.
+	DeliveryPolicy string `json:"deliveryPolicy,omitempty"`
 }
 
 // SendResponse is the response to the SendRequest
 type SendResponse struct {
 	// Key is the key that can be used to retrieve the submitted transaction.
 	Key string `json:"key"`
+	// Delivered lists the recipients whose nodes have acknowledged the transaction.
+	Delivered []string `json:"delivered,omitempty"`
+	// Failed lists the recipients the transaction could not yet be propagated to.
+	Failed []string `json:"failed,omitempty"`
 }
 
 // ReceiveRequest
@@ -43,6 +56,96 @@ type ResendRequest struct {
 	Type      string `json:"type"`
 	PublicKey string `json:"publicKey"`
 	Key       string `json:"key,omitempty"`
+	// Cursor resumes a resend of all transactions following the last transaction reported by an
+	// earlier resend job.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// ResendStatusRequest requests the progress of the resend job with the given ID.
+type ResendStatusRequest struct {
+	Id string `json:"id"`
+}
+
+// ResendStatus is the progress of a job resending all transactions associated with a node.
+type ResendStatus struct {
+	Id string `json:"id"`
+	// PublicKey is the base64 encoded public key of the recipient.
+	PublicKey string `json:"publicKey"`
+	// Sent is the number of transactions the recipient's node has acknowledged.
+	Sent int `json:"sent"`
+	// Failed is the number of transactions which could not be propagated.
+	Failed int `json:"failed"`
+	// Cursor is the base64 encoded key of the transaction up to which all transactions have been
+	// processed, which can be provided to a new resend request to resume from that point.
+	Cursor string `json:"cursor,omitempty"`
+	// Done is set once all transactions have been processed.
+	Done bool `json:"done"`
+	// Error is the reason the job was abandoned, if any.
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// ErrResendLimit is returned when a resend job cannot be started, as too many are already running
+// for the recipient or the node.
+var ErrResendLimit = errors.New("too many resend jobs are running")
+
+// RetentionReport describes the payloads removed, or which would be removed, by enforcing the
+// retention policy of a node.
+type RetentionReport struct {
+	// DryRun is set if the payloads were not removed.
+	DryRun bool `json:"dryRun"`
+	// Removed is the number of payloads removed.
+	Removed int `json:"removed"`
+	// RemovedBytes is the total size of the payloads removed.
+	RemovedBytes int64 `json:"removedBytes"`
+	// Retained is the number of payloads retained.
+	Retained int `json:"retained"`
+	// RetainedBytes is the total size of the payloads retained.
+	RetainedBytes int64 `json:"retainedBytes"`
+	// Payloads are the payloads removed.
+	Payloads []ExpiredPayload `json:"payloads"`
+}
+
+// ExpiredPayload is a payload removed by a retention policy.
+type ExpiredPayload struct {
+	// Key is the base64 encoded digest of the payload.
+	Key    string    `json:"key"`
+	Stored time.Time `json:"stored"`
+	Size   int       `json:"size"`
+	// Reason is the rule of the retention policy the payload was removed by, either "age" or
+	// "size".
+	Reason string `json:"reason"`
+}
+
+// BackupManifest describes the contents of a backup archive of a node's storage, so that the
+// archive can be verified before it is restored.
+type BackupManifest struct {
+	// Version is the version of the archive format.
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Consistent is set if the archive is a snapshot of storage at the time it was created, rather
+	// than of records which may have been written while it was created.
+	Consistent bool `json:"consistent"`
+	// Payloads is the number of payloads in the archive.
+	Payloads int `json:"payloads"`
+	// Records is the number of other records in the archive, excluding party info.
+	Records int `json:"records"`
+	// PartyInfo is set if the archive includes the party info of the node.
+	PartyInfo bool `json:"partyInfo"`
+	// Digests are the base64 encoded digests of the payloads, in the order they are archived.
+	Digests []string `json:"digests"`
+	// Checksum is the hex encoded SHA3-512 hash of the names and contents of the entries of the
+	// archive preceding the manifest.
+	Checksum string `json:"checksum"`
+}
+
+// BackupRequest is used to request a backup archive of a node's storage via gRPC.
+type BackupRequest struct{}
+
+// BackupChunk contains the next part of a backup archive streamed via gRPC.
+type BackupChunk struct {
+	Data []byte `json:"data"`
 }
 
 type UpdatePartyInfo struct {
@@ -55,7 +158,24 @@ type PartyInfoResponse struct {
 	Payload []byte `json:"payload"`
 }
 type PrivateKeyBytes struct {
-	Bytes string `json:"bytes"`
+	// Bytes is the base64 encoded private key of an unlocked key.
+	Bytes string `json:"bytes,omitempty"`
+	// The Argon2 options, salt, secretbox nonce and sealed private key of a key locked with a
+	// password, whose type is "argon2sbox". The salt, nonce and sealed key are base64 encoded.
+	ArgonOptions *ArgonOptions `json:"aopts,omitempty"`
+	Salt         string        `json:"asalt,omitempty"`
+	Nonce        string        `json:"snonce,omitempty"`
+	SealedKey    string        `json:"sbox,omitempty"`
+}
+
+// ArgonOptions are the parameters of the Argon2 key derivation function used to derive the key
+// which locks a private key from its password. Memory is in KiB.
+type ArgonOptions struct {
+	Variant     string  `json:"variant"`
+	Memory      uint32  `json:"memory"`
+	Iterations  uint32  `json:"iterations"`
+	Parallelism uint8   `json:"parallelism"`
+	Version     float64 `json:"version,omitempty"`
 }
 
 // PrivateKey is a container for a private key.
@@ -63,3 +183,68 @@ type PrivateKey struct {
 	Data PrivateKeyBytes `json:"data"`
 	Type string          `json:"type"`
 }
+
+// KeyPairRequest provides a key pair for a node to host.
+type KeyPairRequest struct {
+	// PublicKey is the base64 encoded public key.
+	PublicKey string `json:"publicKey"`
+	// PrivateKey is the private key, in the format of private key files.
+	PrivateKey PrivateKey `json:"privateKey"`
+	// Password unlocks the private key, if it is locked.
+	Password string `json:"password,omitempty"`
+}
+
+// RetireKeyRequest requests that a node stops using the key pair with the given public key.
+type RetireKeyRequest struct {
+	PublicKey string `json:"publicKey"`
+}
+
+// KeysResponse lists the base64 encoded public keys of the key pairs hosted by a node, and of
+// those which have been retired. Payloads exchanged with retired keys can still be retrieved.
+type KeysResponse struct {
+	Active  []string `json:"active"`
+	Retired []string `json:"retired"`
+}
+
+// DeliveryStatusRequest requests the propagation state of the payload with the given key.
+type DeliveryStatusRequest struct {
+	Key string `json:"key"`
+}
+
+// DeliveryStatusResponse reports the propagation state of a payload for each of its recipients.
+type DeliveryStatusResponse struct {
+	Key        string           `json:"key"`
+	Recipients []DeliveryStatus `json:"recipients"`
+}
+
+// DeliveryStatus is the propagation state of a payload to a single recipient.
+type DeliveryStatus struct {
+	// Recipient is the base64 encoded public key of the recipient.
+	Recipient string `json:"recipient"`
+	// Delivered is set once the recipient's node has acknowledged the payload.
+	Delivered bool `json:"delivered"`
+	// Attempts is the number of times propagation has been attempted, which is not retained once
+	// the payload has been delivered.
+	Attempts int `json:"attempts"`
+	// LastError is the reason the most recent attempt failed, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// PeersRequest is used to request the liveness state of the other nodes on the network.
+type PeersRequest struct{}
+
+// PeersResponse contains the liveness state of the other nodes on the network.
+type PeersResponse struct {
+	Peers []PeerStatus `json:"peers"`
+}
+
+// PeerStatus is the liveness state of another node on the network.
+type PeerStatus struct {
+	Url                 string    `json:"url"`
+	LastSeen            time.Time `json:"lastSeen"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LatencyMillis       int64     `json:"latencyMs"`
+	NextAttempt         time.Time `json:"nextAttempt"`
+	LastError           string    `json:"lastError,omitempty"`
+	Stale               bool      `json:"stale,omitempty"` // Restored from a previous run and not yet reached
+}
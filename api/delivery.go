@@ -0,0 +1,53 @@
+package api
+
+import "fmt"
+
+// Delivery policies which determine whether a transaction has been propagated to enough of its
+// recipients to be considered sent.
+const (
+	DeliverAll        = "all"         // Every recipient must acknowledge the transaction
+	DeliverQuorum     = "quorum"      // A majority of recipients must acknowledge the transaction
+	DeliverBestEffort = "best-effort" // The transaction is sent regardless of acknowledgements
+)
+
+// ValidateDeliveryPolicy returns an error if policy is not a supported delivery policy.
+func ValidateDeliveryPolicy(policy string) error {
+	switch policy {
+	case DeliverAll, DeliverQuorum, DeliverBestEffort:
+		return nil
+	default:
+		return fmt.Errorf("invalid delivery policy: %s", policy)
+	}
+}
+
+// CheckDelivery partitions the recipients of a transaction into those which have and have not
+// acknowledged it, returning an error if the provided delivery policy is not satisfied.
+func CheckDelivery(policy string, statuses []DeliveryStatus) ([]string, []string, error) {
+	var delivered, failed []string
+	for _, status := range statuses {
+		if status.Delivered {
+			delivered = append(delivered, status.Recipient)
+		} else {
+			failed = append(failed, status.Recipient)
+		}
+	}
+
+	var satisfied bool
+	switch policy {
+	case DeliverAll:
+		satisfied = len(failed) == 0
+	case DeliverQuorum:
+		satisfied = len(delivered)*2 > len(statuses) || len(statuses) == 0
+	case DeliverBestEffort:
+		satisfied = true
+	default:
+		return delivered, failed, ValidateDeliveryPolicy(policy)
+	}
+
+	if !satisfied {
+		return delivered, failed, fmt.Errorf(
+			"delivery policy %s not satisfied, %d of %d recipients acknowledged the transaction",
+			policy, len(delivered), len(statuses))
+	}
+	return delivered, failed, nil
+}
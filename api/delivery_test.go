@@ -0,0 +1,57 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckDelivery(t *testing.T) {
+	statuses := []DeliveryStatus{
+		{Recipient: "rcpt1", Delivered: true},
+		{Recipient: "rcpt2", Delivered: true},
+		{Recipient: "rcpt3", Delivered: false},
+	}
+
+	expected := map[string]bool{
+		DeliverAll:        false,
+		DeliverQuorum:     true,
+		DeliverBestEffort: true,
+	}
+
+	for policy, satisfied := range expected {
+		delivered, failed, err := CheckDelivery(policy, statuses)
+		if (err == nil) != satisfied {
+			t.Errorf("Policy %s satisfied should be %t, error: %v", policy, satisfied, err)
+		}
+		if !reflect.DeepEqual(delivered, []string{"rcpt1", "rcpt2"}) {
+			t.Errorf("Unexpected delivered recipients: %v", delivered)
+		}
+		if !reflect.DeepEqual(failed, []string{"rcpt3"}) {
+			t.Errorf("Unexpected failed recipients: %v", failed)
+		}
+	}
+}
+
+func TestCheckDeliveryQuorum(t *testing.T) {
+	statuses := []DeliveryStatus{
+		{Recipient: "rcpt1", Delivered: true},
+		{Recipient: "rcpt2", Delivered: false},
+	}
+
+	_, _, err := CheckDelivery(DeliverQuorum, statuses)
+	if err == nil {
+		t.Error("Quorum requires a majority of recipients to acknowledge the transaction")
+	}
+
+	_, _, err = CheckDelivery(DeliverQuorum, []DeliveryStatus{})
+	if err != nil {
+		t.Errorf("Transactions without recipients should satisfy a quorum, error: %v", err)
+	}
+}
+
+func TestCheckDeliveryInvalidPolicy(t *testing.T) {
+	_, _, err := CheckDelivery("some", []DeliveryStatus{})
+	if err == nil {
+		t.Error("Invalid delivery policy should be rejected")
+	}
+}
@@ -2,10 +2,16 @@ package api
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
 )
 
+// bindingContext separates signatures of recipient bindings from any other use of the keys.
+const bindingContext = "crux-partyinfo-binding"
+
 func EncodePayload(ep EncryptedPayload) []byte {
 	// constant fields are 216 bytes
 	encoded := make([]byte, 512)
@@ -61,16 +67,20 @@ func DecodePayloadWithRecipients(encoded []byte) (EncryptedPayload, [][]byte) {
 	return ep, recipients
 }
 
-func EncodePartyInfo(pi PartyInfo) []byte {
+// EncodePartyInfo encodes the provided party details in Constellation's binary format.
+//
+// Signatures of the recipient bindings are appended to the Constellation fields, where they are
+// ignored by nodes which do not support them.
+func EncodePartyInfo(pi PartySnapshot) []byte {
 
 	encoded := make([]byte, 256)
 
 	offset := 0
 
-	encoded, offset = writeSlice([]byte(pi.url), encoded, offset)
-	encoded, offset = writeInt(len(pi.recipients), encoded, offset)
+	encoded, offset = writeSlice([]byte(pi.Url), encoded, offset)
+	encoded, offset = writeInt(len(pi.Recipients), encoded, offset)
 
-	for recipient, url := range pi.recipients {
+	for recipient, url := range pi.Recipients {
 		tuple := [][]byte{
 			recipient[:],
 			[]byte(url),
@@ -78,48 +88,158 @@ func EncodePartyInfo(pi PartyInfo) []byte {
 		encoded, offset = writeSliceOfSlice(tuple, encoded, offset)
 	}
 
-	parties := make([][]byte, len(pi.parties))
+	parties := make([][]byte, len(pi.Parties))
 	i := 0
-	for party := range pi.parties {
+	for party := range pi.Parties {
 		parties[i] = []byte(party)
 		i += 1
 	}
 	encoded, offset = writeSliceOfSlice(parties, encoded, offset)
 
-	return encoded
+	encoded, offset = writeInt(len(pi.Signatures), encoded, offset)
+	for recipient, sig := range pi.Signatures {
+		issued := make([]byte, 8)
+		binary.BigEndian.PutUint64(issued, uint64(sig.Issued))
+		tuple := [][]byte{
+			recipient[:],
+			issued,
+			sig.Signature,
+		}
+		encoded, offset = writeSliceOfSlice(tuple, encoded, offset)
+	}
+
+	return encoded[:offset]
 }
 
-func DecodePartyInfo(encoded []byte) (PartyInfo, error) {
-	pi := PartyInfo{
-		recipients: make(map[[nacl.KeySize]byte]string),
-		parties:    make(map[string]bool),
+// DecodePartyInfo decodes binary encoded party details, verifying the signatures of any signed
+// recipient bindings. Bindings with an invalid signature, or which conflict with another binding
+// for the same recipient, are dropped along with signatures for unknown recipients, keeping the
+// remaining details. Truncated party details are rejected.
+func DecodePartyInfo(encoded []byte) (pi PartySnapshot, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pi, err = PartySnapshot{}, fmt.Errorf("malformed party info: %v", r)
+		}
+	}()
+
+	// reads beyond the end of the encoded data must fail rather than reaching into its capacity
+	encoded = encoded[:len(encoded):len(encoded)]
+
+	pi = PartySnapshot{
+		Recipients: make(map[[nacl.KeySize]byte]string),
+		Parties:    make(map[string]bool),
+		Signatures: make(map[[nacl.KeySize]byte]KeySignature),
 	}
 
 	url, offset := readSlice(encoded, 0)
-	pi.url = string(url)
+	pi.Url = string(url)
 
 	var size int
 	size, offset = readInt(encoded, offset)
 
+	conflicting := make(map[[nacl.KeySize]byte]bool)
 	for i := 0; i < size; i++ {
 		var kv [][]byte
 		kv, offset = readSliceOfSlice(encoded, offset)
+		if len(kv) != 2 {
+			return PartySnapshot{}, errors.New("malformed recipient")
+		}
 		key, err := utils.ToKey(kv[0])
 		if err != nil {
-			return PartyInfo{}, err
+			dropClaim(pi.Url, "invalid recipient", err)
+			continue
+		}
+		if conflicting[*key] {
+			continue
 		}
-		pi.recipients[*key] = string(kv[1])
+		if url, ok := pi.Recipients[*key]; ok && url != string(kv[1]) {
+			dropClaim(pi.Url, "conflicting recipient", fmt.Errorf(
+				"conflicting urls %s and %s for recipient", url, string(kv[1])))
+			delete(pi.Recipients, *key)
+			conflicting[*key] = true
+			continue
+		}
+		pi.Recipients[*key] = string(kv[1])
 	}
 
 	var parties [][]byte
 	parties, offset = readSliceOfSlice(encoded, offset)
 	for _, party := range parties {
-		pi.parties[string(party)] = true
+		pi.Parties[string(party)] = true
+	}
+
+	// Nodes which do not sign their party details may pad the encoded data with zeros
+	if len(encoded)-offset < 8 {
+		return pi, nil
+	}
+
+	size, offset = readInt(encoded, offset)
+	for i := 0; i < size; i++ {
+		var tuple [][]byte
+		tuple, offset = readSliceOfSlice(encoded, offset)
+		if len(tuple) != 3 || len(tuple[1]) != 8 {
+			return PartySnapshot{}, errors.New("malformed recipient signature")
+		}
+		key, err := utils.ToKey(tuple[0])
+		if err != nil {
+			dropClaim(pi.Url, "invalid recipient signature", err)
+			continue
+		}
+		url, ok := pi.Recipients[*key]
+		if !ok {
+			if !conflicting[*key] {
+				dropClaim(pi.Url, "recipient signature",
+					errors.New("signature provided for unknown recipient"))
+			}
+			continue
+		}
+
+		sig := KeySignature{
+			Issued:    int64(binary.BigEndian.Uint64(tuple[1])),
+			Signature: tuple[2],
+		}
+		if !VerifyBinding(key, url, sig) {
+			// The binding is not trusted without a valid signature, as it may be forged
+			dropClaim(pi.Url, "recipient", fmt.Errorf("invalid signature for recipient at %s", url))
+			delete(pi.Recipients, *key)
+			delete(pi.Signatures, *key)
+			continue
+		}
+		pi.Signatures[*key] = sig
 	}
 
 	return pi, nil
 }
 
+// dropClaim logs a claim within party details received from the node at url which is ignored.
+func dropClaim(url, claim string, err error) {
+	log.WithField("url", url).Warnf("Ignoring %s in party info, %v", claim, err)
+}
+
+// SignBinding signs the binding of the public key to the URL of the node hosting it, using the
+// corresponding private key.
+func SignBinding(pubKey, privKey nacl.Key, url string, issued int64) (KeySignature, error) {
+	signature, err := utils.Sign(privKey, bindingMessage(pubKey, url, issued))
+	if err != nil {
+		return KeySignature{}, err
+	}
+	return KeySignature{Issued: issued, Signature: signature}, nil
+}
+
+// VerifyBinding reports whether sig is a valid signature of the binding of the public key to the
+// provided URL.
+func VerifyBinding(pubKey nacl.Key, url string, sig KeySignature) bool {
+	return utils.Verify(pubKey, bindingMessage(pubKey, url, sig.Issued), sig.Signature)
+}
+
+func bindingMessage(pubKey nacl.Key, url string, issued int64) []byte {
+	encoded, offset := writeSlice([]byte(bindingContext), make([]byte, 128), 0)
+	encoded, offset = writeSlice(pubKey[:], encoded, offset)
+	encoded, offset = writeSlice([]byte(url), encoded, offset)
+	encoded, offset = writeInt(int(issued), encoded, offset)
+	return encoded[:offset]
+}
+
 func writeInt(v int, dest []byte, offset int) ([]byte, int) {
 	dest = confirmCapacity(dest, offset, 8)
 	binary.BigEndian.PutUint64(dest[offset:], uint64(v))
@@ -180,6 +300,10 @@ func writeSliceOfSlice(src [][]byte, dest []byte, offset int) ([]byte, int) {
 
 func readSliceOfSlice(src []byte, offset int) ([][]byte, int) {
 	arraySize, offset := readInt(src, offset)
+	// each slice is prefixed with its length, which bounds the number that can be present
+	if arraySize < 0 || arraySize > (len(src)-offset)/8 {
+		panic(fmt.Sprintf("invalid slice count %d at offset %d", arraySize, offset))
+	}
 
 	result := make([][]byte, arraySize)
 	for i := 0; i < arraySize; i++ {
@@ -1,10 +1,13 @@
 package api
 
 import (
+	"crypto/rand"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestEncodePayload(t *testing.T) {
@@ -70,9 +73,9 @@ func TestEncodePayloadWithRecipients(t *testing.T) {
 
 func TestEncodePartyInfo(t *testing.T) {
 
-	pi := PartyInfo{
-		url: "https://127.0.0.4:9004/",
-		recipients: map[[nacl.KeySize]byte]string{
+	pi := PartySnapshot{
+		Url: "https://127.0.0.4:9004/",
+		Recipients: map[[nacl.KeySize]byte]string{
 			toKey("ROAZBWtSacxXQrOe3FGAqJDyJjFePR5ce4TSIzmJ0Bc="): "https://127.0.0.7:9007/",
 			toKey("BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="): "https://127.0.0.1:9001/",
 			toKey("QfeDAys9MPDs2XHExtc84jKGHxZg/aj52DTh0vtA3Xc="): "https://127.0.0.2:9002/",
@@ -81,7 +84,7 @@ func TestEncodePartyInfo(t *testing.T) {
 			toKey("oNspPPgszVUFw0qmGFfWwh1uxVUXgvBxleXORHj07g8="): "https://127.0.0.4:9004/",
 			toKey("R56gy4dn24YOjwyesTczYa8m5xhP6hF2uTMCju/1xkY="): "https://127.0.0.5:9005/",
 		},
-		parties: map[string]bool{
+		Parties: map[string]bool{
 			"https://127.0.0.5:9005/": true,
 			"https://127.0.0.3:9003/": true,
 			"https://127.0.0.1:9001/": true,
@@ -90,12 +93,158 @@ func TestEncodePartyInfo(t *testing.T) {
 			"https://127.0.0.4:9004/": true,
 			"https://127.0.0.2:9002/": true,
 		},
+		Signatures: map[[nacl.KeySize]byte]KeySignature{},
 	}
 
 	runEncodePartyInfoTest(t, pi)
 }
 
-func runEncodePartyInfoTest(t *testing.T, pi PartyInfo) {
+func TestEncodeSignedPartyInfo(t *testing.T) {
+	pi, pubKey, _ := signedPartyInfo(t)
+	runEncodePartyInfoTest(t, pi)
+
+	decoded, _ := DecodePartyInfo(EncodePartyInfo(pi))
+	if _, ok := decoded.Signatures[*pubKey]; !ok {
+		t.Errorf("Signature missing from decoded partyInfo: %v", decoded)
+	}
+}
+
+func TestDecodeLegacyPartyInfo(t *testing.T) {
+	pi, _, _ := signedPartyInfo(t)
+	encoded := EncodePartyInfo(pi)
+
+	// Strip the signatures, leaving the zero padding legacy nodes add to their party info
+	legacy := EncodePartyInfo(PartySnapshot{Url: pi.Url, Recipients: pi.Recipients, Parties: pi.Parties})
+	legacy = append(legacy[:len(legacy)-8], make([]byte, 5)...)
+	if len(legacy) >= len(encoded) {
+		t.Fatalf("Legacy encoding should be shorter than signed encoding")
+	}
+
+	decoded, err := DecodePartyInfo(legacy)
+	if err != nil {
+		t.Fatalf("Unable to decode party info: %v", err)
+	}
+	if len(decoded.Signatures) != 0 || !reflect.DeepEqual(pi.Recipients, decoded.Recipients) {
+		t.Errorf("Decoded partyInfo: %v does not match input %v", decoded, pi)
+	}
+}
+
+func TestDecodePartyInfoInvalidSignature(t *testing.T) {
+	other := toKey("ROAZBWtSacxXQrOe3FGAqJDyJjFePR5ce4TSIzmJ0Bc=")
+
+	// Another node claiming the key, reusing its owner's signature
+	pi, pubKey, _ := signedPartyInfo(t)
+	pi.Recipients[*pubKey] = "https://127.0.0.2:9002/"
+	pi.Recipients[other] = pi.Url
+	runDroppedClaimTest(t, pi, *pubKey, other)
+
+	pi, pubKey, _ = signedPartyInfo(t)
+	sig := pi.Signatures[*pubKey]
+	sig.Issued += 1
+	pi.Signatures[*pubKey] = sig
+	pi.Recipients[other] = pi.Url
+	runDroppedClaimTest(t, pi, *pubKey, other)
+
+	// A signature for a recipient which is not listed is ignored
+	pi, pubKey, _ = signedPartyInfo(t)
+	pi.Signatures[other] = pi.Signatures[*pubKey]
+	decoded, err := DecodePartyInfo(EncodePartyInfo(pi))
+	if err != nil {
+		t.Fatalf("Unable to decode party info: %v", err)
+	}
+	if _, ok := decoded.Signatures[other]; ok || decoded.Recipients[*pubKey] != pi.Url {
+		t.Errorf("Only the signature for the unknown recipient should be dropped: %v", decoded)
+	}
+}
+
+// runDroppedClaimTest checks that the binding of dropped is removed from the decoded party info,
+// whereas the binding of kept remains.
+func runDroppedClaimTest(t *testing.T, pi PartySnapshot, dropped, kept [nacl.KeySize]byte) {
+	decoded, err := DecodePartyInfo(EncodePartyInfo(pi))
+	if err != nil {
+		t.Fatalf("Unable to decode party info: %v", err)
+	}
+	if _, ok := decoded.Recipients[dropped]; ok {
+		t.Errorf("Binding with an invalid signature should be dropped: %v", decoded)
+	}
+	if _, ok := decoded.Signatures[dropped]; ok {
+		t.Errorf("Invalid signature should be dropped: %v", decoded)
+	}
+	if decoded.Recipients[kept] != pi.Recipients[kept] || !reflect.DeepEqual(decoded.Parties, pi.Parties) {
+		t.Errorf("Remaining party info should be kept: %v", decoded)
+	}
+}
+
+func TestDecodePartyInfoConflict(t *testing.T) {
+	key := toKey("ROAZBWtSacxXQrOe3FGAqJDyJjFePR5ce4TSIzmJ0Bc=")
+	other := toKey("BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo=")
+
+	encoded, offset := writeSlice([]byte("https://127.0.0.1:9001/"), make([]byte, 512), 0)
+	encoded, offset = writeInt(4, encoded, offset)
+	encoded, offset = writeSliceOfSlice(
+		[][]byte{key[:], []byte("https://127.0.0.1:9001/")}, encoded, offset)
+	encoded, offset = writeSliceOfSlice(
+		[][]byte{key[:], []byte("https://127.0.0.2:9002/")}, encoded, offset)
+	encoded, offset = writeSliceOfSlice(
+		[][]byte{key[:], []byte("https://127.0.0.1:9001/")}, encoded, offset)
+	encoded, offset = writeSliceOfSlice(
+		[][]byte{other[:], []byte("https://127.0.0.1:9001/")}, encoded, offset)
+	encoded, offset = writeSliceOfSlice([][]byte{}, encoded, offset)
+
+	decoded, err := DecodePartyInfo(encoded[:offset])
+	if err != nil {
+		t.Fatalf("Unable to decode party info: %v", err)
+	}
+	expected := map[[nacl.KeySize]byte]string{other: "https://127.0.0.1:9001/"}
+	if !reflect.DeepEqual(decoded.Recipients, expected) {
+		t.Errorf("Conflicting bindings should be dropped, recipients: %v", decoded.Recipients)
+	}
+}
+
+func TestDecodePartyInfoTruncated(t *testing.T) {
+	pi, _, _ := signedPartyInfo(t)
+	encoded := EncodePartyInfo(pi)
+
+	// Dropping the signatures entirely leaves the legacy format, which is accepted
+	legacy := len(EncodePartyInfo(PartySnapshot{Url: pi.Url, Recipients: pi.Recipients, Parties: pi.Parties})) - 8
+	for i := 0; i < len(encoded); i++ {
+		if i >= legacy && i <= legacy+8 {
+			continue
+		}
+		if _, err := DecodePartyInfo(encoded[:i]); err == nil {
+			t.Errorf("Party info truncated to %d bytes should be rejected", i)
+		}
+	}
+
+	huge, offset := writeSlice([]byte("https://127.0.0.1:9001/"), make([]byte, 64), 0)
+	huge, offset = writeInt(1, huge, offset)
+	huge, offset = writeInt(1<<40, huge, offset)
+	if _, err := DecodePartyInfo(huge[:offset]); err == nil {
+		t.Error("Party info with an invalid recipient count should be rejected")
+	}
+}
+
+func signedPartyInfo(t *testing.T) (PartySnapshot, nacl.Key, nacl.Key) {
+	pubKey, privKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := "https://127.0.0.1:9001/"
+	sig, err := SignBinding(pubKey, privKey, url, time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return PartySnapshot{
+		Url:        url,
+		Recipients: map[[nacl.KeySize]byte]string{*pubKey: url},
+		Parties:    map[string]bool{url: true},
+		Signatures: map[[nacl.KeySize]byte]KeySignature{*pubKey: sig},
+	}, pubKey, privKey
+}
+
+func runEncodePartyInfoTest(t *testing.T, pi PartySnapshot) {
 	encoded := EncodePartyInfo(pi)
 	decoded, err := DecodePartyInfo(encoded)
 
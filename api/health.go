@@ -0,0 +1,169 @@
+package api
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+const (
+	peerMinBackoff       = time.Minute    // Delay before polling a peer again after a failure
+	peerMaxBackoff       = time.Hour      // Upper bound on the delay between polls of a failing peer
+	peerEvictionFailures = 5              // Consecutive failures before a peer may be evicted
+	peerEvictionAge      = 24 * time.Hour // Time since a peer was last seen before it is evicted
+)
+
+// peerHealth is the liveness state of another node on the network.
+type peerHealth struct {
+	since       time.Time // When tracking of the peer began
+	lastSeen    time.Time
+	failures    int // Consecutive failures to reach the peer
+	latency     time.Duration
+	nextAttempt time.Time
+	lastError   string
+}
+
+// lastContact provides the time from which a peer has been unreachable.
+func (h *peerHealth) lastContact() time.Time {
+	if h.lastSeen.IsZero() {
+		return h.since
+	}
+	return h.lastSeen
+}
+
+func (s *PartyInfo) peerHealth(url string, now time.Time) *peerHealth {
+	h, ok := s.health[url]
+	if !ok {
+		h = &peerHealth{since: now}
+		s.health[url] = h
+	}
+	return h
+}
+
+// shouldPoll reports whether the peer is not currently backing off following a failure.
+func (s *PartyInfo) shouldPoll(url string, now time.Time) bool {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	h, ok := s.health[url]
+	return !ok || !now.Before(h.nextAttempt)
+}
+
+// recordSuccess records a successful request to a peer, taking the provided time to complete.
+func (s *PartyInfo) recordSuccess(url string, latency time.Duration, now time.Time) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	delete(s.stale, url)
+	h := s.peerHealth(url, now)
+	h.lastSeen = now
+	h.failures = 0
+	h.latency = latency
+	h.nextAttempt = time.Time{}
+	h.lastError = ""
+}
+
+// recordSeen records a request from a peer, which shows that it remains on the network.
+func (s *PartyInfo) recordSeen(url string, now time.Time) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	delete(s.evicted, url)
+	delete(s.stale, url)
+	if h, ok := s.health[url]; ok {
+		h.lastSeen = now
+		h.failures = 0
+		h.nextAttempt = time.Time{}
+	}
+}
+
+// recordFailure records a failed request to a peer, evicting it from the network if it has been
+// unreachable for long enough. Nodes provided on startup are never evicted.
+func (s *PartyInfo) recordFailure(url string, err error, now time.Time) {
+	s.healthMu.Lock()
+	h := s.peerHealth(url, now)
+	h.failures += 1
+	h.lastError = err.Error()
+	h.nextAttempt = now.Add(peerBackoff(h.failures))
+
+	evict := !s.bootNodes[url] &&
+		h.failures >= peerEvictionFailures &&
+		now.Sub(h.lastContact()) >= peerEvictionAge
+	if evict {
+		delete(s.health, url)
+		delete(s.stale, url)
+		s.evicted[url] = now
+	}
+	s.healthMu.Unlock()
+
+	if evict {
+		log.WithField("url", url).Warnf(
+			"Evicting node unreachable since %v", h.lastContact().Format(time.RFC3339))
+		s.update(func(ps *PartySnapshot) {
+			delete(ps.Parties, url)
+			for key, recipientUrl := range ps.Recipients {
+				if recipientUrl == url {
+					delete(ps.Recipients, key)
+					delete(ps.Signatures, key)
+				}
+			}
+		})
+	}
+}
+
+// isEvicted reports whether the peer has recently been evicted, in which case it should not be
+// added back to the network on the word of other nodes.
+func (s *PartyInfo) isEvicted(url string, now time.Time) bool {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	// Evicted peers are remembered for as long as it takes other nodes to evict them too
+	evicted, ok := s.evicted[url]
+	if ok && now.Sub(evicted) >= peerEvictionAge {
+		delete(s.evicted, url)
+		return false
+	}
+	return ok
+}
+
+// peerBackoff provides the delay before polling a peer which has failed the given number of
+// consecutive times.
+func peerBackoff(failures int) time.Duration {
+	delay := peerMinBackoff
+	for i := 1; i < failures && delay < peerMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > peerMaxBackoff {
+		delay = peerMaxBackoff
+	}
+	return delay
+}
+
+// Peers provides the liveness state of all other nodes on the network, ordered by URL.
+func (s *PartyInfo) Peers() []PeerStatus {
+	ps := s.snapshot()
+
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	peers := make([]PeerStatus, 0, len(ps.Parties))
+	for url := range ps.Parties {
+		if url == s.url {
+			continue
+		}
+		status := PeerStatus{Url: url, Stale: s.stale[url]}
+		if h, ok := s.health[url]; ok {
+			status.LastSeen = h.lastSeen
+			status.ConsecutiveFailures = h.failures
+			status.LatencyMillis = int64(h.latency / time.Millisecond)
+			status.NextAttempt = h.nextAttempt
+			status.LastError = h.lastError
+		}
+		peers = append(peers, status)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Url < peers[j].Url
+	})
+	return peers
+}
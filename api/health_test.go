@@ -0,0 +1,154 @@
+package api
+
+import (
+	"errors"
+	"github.com/kevinburke/nacl"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingClient is a HttpClient which is unable to reach any node.
+type failingClient struct {
+	requests int
+}
+
+func (c *failingClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests += 1
+	return nil, errors.New("connection refused")
+}
+
+func TestPeerBackoff(t *testing.T) {
+	client := &failingClient{}
+	pi := InitPartyInfo(
+		"http://localhost:9000", []string{"http://localhost:9001"}, client, false, false, nil)
+	defer pi.Close()
+
+	pi.GetPartyInfo()
+	pi.GetPartyInfo()
+
+	if client.requests != 1 {
+		t.Errorf("Peer should not be polled while backing off, requests: %d", client.requests)
+	}
+
+	peers := pi.Peers()
+	if len(peers) != 1 || peers[0].ConsecutiveFailures != 1 || peers[0].LastError == "" ||
+		!peers[0].NextAttempt.After(time.Now()) {
+		t.Errorf("Failure not recorded: %v", peers)
+	}
+}
+
+func TestPeerHealth(t *testing.T) {
+	remote := InitPartyInfo(
+		"http://localhost:9001", []string{"http://localhost:9001"}, http.DefaultClient, false, false, nil)
+	defer remote.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write(EncodePartyInfo(remote.Snapshot()))
+		}))
+	defer server.Close()
+
+	pi := InitPartyInfo("http://localhost:9000", []string{server.URL}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	now := time.Now()
+	pi.recordFailure(server.URL, errors.New("connection refused"), now)
+	pi.recordFailure(server.URL, errors.New("connection refused"), now)
+
+	if pi.shouldPoll(server.URL, now.Add(peerMinBackoff)) {
+		t.Error("Peer should back off for longer following consecutive failures")
+	}
+	if !pi.shouldPoll(server.URL, now.Add(2*peerMinBackoff)) {
+		t.Error("Peer should be polled once backoff has elapsed")
+	}
+
+	pi.healthMu.Lock()
+	pi.health[server.URL].nextAttempt = time.Time{}
+	pi.healthMu.Unlock()
+
+	pi.GetPartyInfo()
+
+	peers := pi.Peers()
+	expUrls := []string{"http://localhost:9001", server.URL}
+	if len(peers) != 2 {
+		t.Fatalf("Peers %v do not match expected %v", peers, expUrls)
+	}
+	for _, peer := range peers {
+		if peer.Url == server.URL &&
+			(peer.ConsecutiveFailures != 0 || peer.LastSeen.IsZero() || peer.LastError != "") {
+			t.Errorf("Success not recorded: %v", peer)
+		}
+	}
+	if peers[0].Url > peers[1].Url {
+		t.Errorf("Peers should be ordered by URL: %v", peers)
+	}
+}
+
+func TestPeerEviction(t *testing.T) {
+	pi := InitPartyInfo(
+		"http://localhost:9000", []string{"http://localhost:9001"}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	deadKey := nacl.NewKey()
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9002",
+		map[[nacl.KeySize]byte]string{*deadKey: "http://localhost:9003"},
+		map[string]bool{"http://localhost:9002": true, "http://localhost:9003": true})
+
+	start := time.Now()
+	for i := 0; i < peerEvictionFailures; i++ {
+		now := start.Add(time.Duration(i) * peerEvictionAge / (peerEvictionFailures - 1))
+		for _, url := range []string{"http://localhost:9001", "http://localhost:9003"} {
+			pi.recordFailure(url, errors.New("connection refused"), now)
+		}
+		if i == peerEvictionFailures-2 && !pi.Snapshot().Parties["http://localhost:9003"] {
+			t.Fatal("Peer should not be evicted before it has been unreachable for long enough")
+		}
+	}
+
+	ps := pi.Snapshot()
+	if ps.Parties["http://localhost:9003"] {
+		t.Error("Unreachable peer should be evicted")
+	}
+	if _, ok := pi.GetRecipient(deadKey); ok {
+		t.Error("Keys of evicted peer should be removed")
+	}
+	if !ps.Parties["http://localhost:9001"] {
+		t.Error("Boot nodes should not be evicted")
+	}
+
+	// Other nodes may not have evicted the peer yet
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9002",
+		map[[nacl.KeySize]byte]string{*deadKey: "http://localhost:9003"},
+		map[string]bool{"http://localhost:9003": true})
+	if pi.Snapshot().Parties["http://localhost:9003"] {
+		t.Error("Evicted peer should not be added back by other nodes")
+	}
+
+	// Unless it rejoins the network itself
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9003",
+		map[[nacl.KeySize]byte]string{*deadKey: "http://localhost:9003"},
+		map[string]bool{"http://localhost:9003": true})
+	verifyRecipient(t, pi, deadKey, "http://localhost:9003")
+	if !pi.Snapshot().Parties["http://localhost:9003"] {
+		t.Error("Evicted peer should be added back once it rejoins the network")
+	}
+}
+
+func TestPeerBackoffDelay(t *testing.T) {
+	expected := []time.Duration{
+		peerMinBackoff, 2 * peerMinBackoff, 4 * peerMinBackoff, 8 * peerMinBackoff,
+	}
+	for i, exp := range expected {
+		if delay := peerBackoff(i + 1); delay != exp {
+			t.Errorf("Backoff after %d failures is %v whereas %v is expected", i+1, delay, exp)
+		}
+	}
+	if delay := peerBackoff(100); delay != peerMaxBackoff {
+		t.Errorf("Backoff %v exceeds maximum %v", delay, peerMaxBackoff)
+	}
+}
@@ -4,18 +4,23 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blk-io/chimera-api/chimera"
+	"github.com/blk-io/crux/storage"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,39 +34,193 @@ type EncryptedPayload struct {
 	RecipientNonce nacl.Nonce
 }
 
-// PartyInfo is a struct that stores details of all enclave nodes (or parties) on the network.
+// PartyInfo is a concurrency-safe store of the details of all enclave nodes (or parties) on the
+// network.
+//
+// Reads are served from an immutable snapshot of the party details, whereas updates are applied
+// in turn by a dedicated goroutine, which replaces the snapshot once each update is complete.
 type PartyInfo struct {
-	url        string                        // URL identifying this node
-	recipients map[[nacl.KeySize]byte]string // public key -> URL
-	parties    map[string]bool               // Node (or party) URLs
-	client     utils.HttpClient
-	grpc       bool
+	url     string // URL identifying this node
+	client  utils.HttpClient
+	grpc    bool
+	strict  bool              // Only accept recipient bindings signed by the recipient's key
+	db      storage.DataStore // Store the party details are persisted to, if any
+	state   atomic.Value      // *PartySnapshot
+	filter  atomic.Value      // *peerFilter
+	updates chan partyUpdate
+	quit    chan struct{}
+
+	pollMu   sync.Mutex // Prevents concurrent rounds of requests to other nodes
+	pollWg   sync.WaitGroup
+	stopPoll chan struct{}
+	stopOnce sync.Once
+
+	healthMu  sync.Mutex
+	health    map[string]*peerHealth // URL -> liveness of other nodes
+	evicted   map[string]time.Time   // URL -> time of eviction
+	bootNodes map[string]bool        // Nodes provided on startup, which are never evicted
+	stale     map[string]bool        // Nodes persisted by a previous run, yet to be reached
+}
+
+// PartySnapshot is a point in time view of the enclave nodes (or parties) on the network.
+// The maps of a snapshot obtained from a PartyInfo store must not be modified.
+type PartySnapshot struct {
+	Url        string                              // URL identifying the node
+	Recipients map[[nacl.KeySize]byte]string       // public key -> URL
+	Parties    map[string]bool                     // Node (or party) URLs
+	Signatures map[[nacl.KeySize]byte]KeySignature // public key -> signature of its URL binding
+}
+
+// KeySignature is the signature of the binding of a public key to the URL of the node hosting it,
+// created with the corresponding private key.
+type KeySignature struct {
+	Issued    int64 // Unix time at which the binding was signed
+	Signature []byte
+}
+
+type partyUpdate struct {
+	apply func(ps *PartySnapshot)
+	done  chan struct{}
+}
+
+func (ps *PartySnapshot) clone() *PartySnapshot {
+	recipients := make(map[[nacl.KeySize]byte]string, len(ps.Recipients))
+	for key, url := range ps.Recipients {
+		recipients[key] = url
+	}
+	parties := make(map[string]bool, len(ps.Parties))
+	for url, v := range ps.Parties {
+		parties[url] = v
+	}
+	signatures := make(map[[nacl.KeySize]byte]KeySignature, len(ps.Signatures))
+	for key, sig := range ps.Signatures {
+		signatures[key] = sig
+	}
+	return &PartySnapshot{
+		Url:        ps.Url,
+		Recipients: recipients,
+		Parties:    parties,
+		Signatures: signatures,
+	}
+}
+
+// newPartyInfo creates a PartyInfo store with the provided initial details, starting the
+// goroutine responsible for applying updates to it.
+func newPartyInfo(
+	rawUrl string,
+	recipients map[[nacl.KeySize]byte]string,
+	parties map[string]bool,
+	client utils.HttpClient,
+	grpc, strict bool) *PartyInfo {
+
+	pi := &PartyInfo{
+		url:      rawUrl,
+		client:   client,
+		grpc:     grpc,
+		strict:   strict,
+		updates:  make(chan partyUpdate),
+		quit:     make(chan struct{}),
+		stopPoll: make(chan struct{}),
+
+		health:    make(map[string]*peerHealth),
+		evicted:   make(map[string]time.Time),
+		bootNodes: make(map[string]bool),
+		stale:     make(map[string]bool),
+	}
+	for url := range parties {
+		pi.bootNodes[url] = true
+	}
+	pi.state.Store(&PartySnapshot{
+		Url:        rawUrl,
+		Recipients: recipients,
+		Parties:    parties,
+		Signatures: make(map[[nacl.KeySize]byte]KeySignature),
+	})
+	pi.filter.Store(&peerFilter{})
+
+	go pi.processUpdates()
+	return pi
+}
+
+func (s *PartyInfo) processUpdates() {
+	for {
+		select {
+		case u := <-s.updates:
+			next := s.snapshot().clone()
+			u.apply(next)
+			s.state.Store(next)
+			close(u.done)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// update applies the provided function to a copy of the current party details, which then
+// replaces them. It returns once the update has been applied.
+func (s *PartyInfo) update(apply func(ps *PartySnapshot)) {
+	u := partyUpdate{apply: apply, done: make(chan struct{})}
+	select {
+	case s.updates <- u:
+		<-u.done
+	case <-s.quit:
+	}
+}
+
+func (s *PartyInfo) snapshot() *PartySnapshot {
+	return s.state.Load().(*PartySnapshot)
+}
+
+// Snapshot provides the current party details. The snapshot is not affected by subsequent
+// updates.
+func (s *PartyInfo) Snapshot() PartySnapshot {
+	return *s.snapshot()
+}
+
+// Close stops polling other nodes, and the processing of updates to the PartyInfo store, which
+// is persisted first if it has a DataStore.
+func (s *PartyInfo) Close() {
+	s.StopPolling()
+	s.persistPartyInfo()
+	close(s.quit)
 }
 
 // GetRecipient retrieves the URL associated with the provided recipient.
 func (s *PartyInfo) GetRecipient(key nacl.Key) (string, bool) {
-	value, ok := s.recipients[*key]
+	value, ok := s.snapshot().Recipients[*key]
 	return value, ok
 }
 
+// GetAllValues provides a copy of the current party details.
 func (s *PartyInfo) GetAllValues() (string, map[[nacl.KeySize]byte]string, map[string]bool) {
-	return s.url, s.recipients, s.parties
+	ps := s.snapshot().clone()
+	return s.url, ps.Recipients, ps.Parties
 }
 
-// InitPartyInfo initializes a new PartyInfo store.
-func InitPartyInfo(rawUrl string, otherNodes []string, client utils.HttpClient, grpc bool) PartyInfo {
+// InitPartyInfo initializes a new PartyInfo store. If strict is set, bindings of public keys to
+// URLs received from other nodes are only accepted if they have been signed with the
+// corresponding private key.
+//
+// If a DataStore is provided, the party details are persisted to it after each round of requests
+// to other nodes, and the details persisted by a previous run are restored.
+func InitPartyInfo(
+	rawUrl string,
+	otherNodes []string,
+	client utils.HttpClient,
+	grpc, strict bool,
+	db storage.DataStore) *PartyInfo {
+
 	parties := make(map[string]bool)
 	for _, node := range otherNodes {
 		parties[node] = true
 	}
 
-	return PartyInfo{
-		url:        rawUrl,
-		recipients: make(map[[nacl.KeySize]byte]string),
-		parties:    parties,
-		client:     client,
-		grpc:       grpc,
+	pi := newPartyInfo(rawUrl, make(map[[nacl.KeySize]byte]string), parties, client, grpc, strict)
+	if db != nil {
+		pi.db = db
+		pi.loadPartyInfo()
 	}
+	return pi
 }
 
 // CreatePartyInfo creates a new PartyInfo struct.
@@ -69,7 +228,7 @@ func CreatePartyInfo(
 	url string,
 	otherNodes []string,
 	otherKeys []nacl.Key,
-	client utils.HttpClient) PartyInfo {
+	client utils.HttpClient) *PartyInfo {
 
 	recipients := make(map[[nacl.KeySize]byte]string)
 	parties := make(map[string]bool)
@@ -78,33 +237,92 @@ func CreatePartyInfo(
 		recipients[*otherKeys[i]] = node
 	}
 
-	return PartyInfo{
-		url:        url,
-		recipients: recipients,
-		parties:    parties,
-		client:     client,
-	}
+	return newPartyInfo(url, recipients, parties, client, false, false)
 }
 
-// RegisterPublicKeys associates the provided public keys with this node.
-func (s *PartyInfo) RegisterPublicKeys(pubKeys []nacl.Key) {
-	for _, pubKey := range pubKeys {
-		s.recipients[*pubKey] = s.url
+// RegisterPublicKeys associates the provided public keys with this node. Each binding of a public
+// key to this node's URL is signed with the corresponding private key, allowing other nodes to
+// verify it.
+func (s *PartyInfo) RegisterPublicKeys(pubKeys, privKeys []nacl.Key) {
+	issued := time.Now().Unix()
+	signatures := make(map[[nacl.KeySize]byte]KeySignature)
+	for i, pubKey := range pubKeys {
+		sig, err := SignBinding(pubKey, privKeys[i], s.url, issued)
+		if err != nil {
+			log.WithField("url", s.url).Errorf("Unable to sign public key binding, %v", err)
+			continue
+		}
+		signatures[*pubKey] = sig
 	}
+
+	s.update(func(ps *PartySnapshot) {
+		for _, pubKey := range pubKeys {
+			ps.Recipients[*pubKey] = s.url
+			if sig, ok := signatures[*pubKey]; ok {
+				ps.Signatures[*pubKey] = sig
+			} else {
+				delete(ps.Signatures, *pubKey)
+			}
+		}
+	})
+}
+
+// UnregisterPublicKeys removes the bindings of the provided public keys to this node. Bindings of
+// the keys to other nodes are left in place.
+func (s *PartyInfo) UnregisterPublicKeys(pubKeys []nacl.Key) {
+	s.update(func(ps *PartySnapshot) {
+		for _, pubKey := range pubKeys {
+			if url, ok := ps.Recipients[*pubKey]; ok && url == s.url {
+				delete(ps.Recipients, *pubKey)
+				delete(ps.Signatures, *pubKey)
+			}
+		}
+	})
+}
+
+// SyncPublicKeys replaces the bindings of public keys to this node with those of the provided
+// keys, along with their signatures. Keys whose binding could not be signed have no signature.
+func (s *PartyInfo) SyncPublicKeys(signatures map[[nacl.KeySize]byte]KeySignature) {
+	s.update(func(ps *PartySnapshot) {
+		for key, url := range ps.Recipients {
+			if _, ok := signatures[key]; !ok && url == s.url {
+				delete(ps.Recipients, key)
+				delete(ps.Signatures, key)
+			}
+		}
+		for key, sig := range signatures {
+			ps.Recipients[key] = s.url
+			if len(sig.Signature) > 0 {
+				ps.Signatures[key] = sig
+			} else {
+				delete(ps.Signatures, key)
+			}
+		}
+	})
 }
 
 func (s *PartyInfo) GetPartyInfoGrpc() {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	s.getPartyInfoGrpc(false)
+	s.persistPartyInfo()
+}
+
+// PartyInfoMetadata is the gRPC metadata key carrying the binary encoded party details of the
+// node calling UpdatePartyInfo, as the chimera PartyInfo message has no field for signatures.
+const PartyInfoMetadata = "c11n-party-info-bin"
+
+func (s *PartyInfo) getPartyInfoGrpc(force bool) {
+	ps := s.snapshot()
+	// Older nodes ignore the metadata, so the unsigned details are sent too
+	md := metadata.Pairs(PartyInfoMetadata, string(EncodePartyInfo(*ps)))
 	recipients := make(map[string][]byte)
-	for key, url := range s.recipients {
+	for key, url := range ps.Recipients {
 		recipients[url] = key[:]
 	}
-	urls := make(map[string]bool)
-	for k, v := range s.parties {
-		urls[k] = v
-	}
 
-	for rawUrl := range urls {
-		if rawUrl == s.url {
+	for rawUrl := range ps.Parties {
+		if rawUrl == s.url || !s.permitsUrl(rawUrl) || (!force && !s.shouldPoll(rawUrl, time.Now())) {
 			continue
 		}
 		var completeUrl url.URL
@@ -120,11 +338,13 @@ func (s *PartyInfo) GetPartyInfoGrpc() {
 			log.Errorf("Client is not intialised")
 			continue
 		}
-		party := chimera.PartyInfo{Url: rawUrl, Recipients: recipients, Parties: s.parties}
+		party := chimera.PartyInfo{Url: rawUrl, Recipients: recipients, Parties: ps.Parties}
 
-		partyInfoResp, err := cli.UpdatePartyInfo(context.Background(), &party)
+		start := time.Now()
+		partyInfoResp, err := cli.UpdatePartyInfo(metadata.NewOutgoingContext(context.Background(), md), &party)
 		if err != nil {
 			log.Errorf("Error in updating party info %s", err)
+			s.recordFailure(rawUrl, err, time.Now())
 			continue
 		} else {
 			log.Printf("Connected to the other node %s", rawUrl)
@@ -132,28 +352,44 @@ func (s *PartyInfo) GetPartyInfoGrpc() {
 		err = s.updatePartyInfoGrpc(*partyInfoResp, s.url)
 		if err != nil {
 			log.Errorf("Error: %s", err)
+			s.recordFailure(rawUrl, err, time.Now())
 			break
 		}
+		s.recordSuccess(rawUrl, time.Since(start), time.Now())
 	}
 }
 
 // GetPartyInfo requests PartyInfo data from all remote nodes this node is aware of. The data
-// provided in each response is applied to this node.
+// provided in each response is applied to this node. Nodes which are backing off following a
+// failure are skipped.
 func (s *PartyInfo) GetPartyInfo() {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	s.getPartyInfo(false)
+	s.persistPartyInfo()
+}
+
+// RefreshPartyInfo immediately requests PartyInfo data from all remote nodes this node is aware
+// of, including those which are backing off following a failure.
+func (s *PartyInfo) RefreshPartyInfo() {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	s.getPartyInfo(true)
+	s.persistPartyInfo()
+}
+
+func (s *PartyInfo) getPartyInfo(force bool) {
 	if s.grpc {
-		s.GetPartyInfoGrpc()
+		s.getPartyInfoGrpc(force)
 		return
 	}
-	encodedPartyInfo := EncodePartyInfo(*s)
 
-	// First copy our endpoints as we update this map in place
-	urls := make(map[string]bool)
-	for k, v := range s.parties {
-		urls[k] = v
-	}
+	// Updates from each response do not affect the snapshot we are working through
+	ps := s.snapshot()
+	encodedPartyInfo := EncodePartyInfo(*ps)
 
-	for rawUrl := range urls {
-		if rawUrl == s.url {
+	for rawUrl := range ps.Parties {
+		if rawUrl == s.url || !s.permitsUrl(rawUrl) || (!force && !s.shouldPoll(rawUrl, time.Now())) {
 			continue
 		}
 
@@ -165,7 +401,7 @@ func (s *PartyInfo) GetPartyInfo() {
 		}
 
 		var req *http.Request
-		encoded := s.getEncoded(encodedPartyInfo)
+		encoded := s.getEncoded(ps, encodedPartyInfo)
 		req, err = http.NewRequest("POST", endPoint, bytes.NewBuffer(encoded))
 
 		if err != nil {
@@ -176,24 +412,31 @@ func (s *PartyInfo) GetPartyInfo() {
 		req.Header.Set("Content-Type", "application/octet-stream")
 
 		logRequest(req)
+		start := time.Now()
 		resp, err := s.client.Do(req)
 		if err != nil {
 			log.WithField("url", rawUrl).Errorf(
 				"Error sending /partyinfo request, %v", err)
+			s.recordFailure(rawUrl, err, time.Now())
 			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
 			log.WithField("url", rawUrl).Errorf(
 				"Error sending /partyinfo request, non-200 status code: %v", resp)
+			resp.Body.Close()
+			s.recordFailure(
+				rawUrl, fmt.Errorf("non-200 status code: %d", resp.StatusCode), time.Now())
 			continue
 		}
 
 		err = s.updatePartyInfo(resp, rawUrl)
 
 		if err != nil {
+			s.recordFailure(rawUrl, err, time.Now())
 			break
 		}
+		s.recordSuccess(rawUrl, time.Since(start), time.Now())
 	}
 }
 
@@ -204,7 +447,7 @@ func (s *PartyInfo) updatePartyInfoGrpc(partyInfoReq chimera.PartyInfoResponse,
 			"Unable to decode partyInfo response from host, %v", err)
 		return err
 	}
-	s.UpdatePartyInfoGrpc(pi.url, pi.recipients, pi.parties)
+	s.mergePartyInfo(pi)
 	return nil
 }
 
@@ -221,13 +464,13 @@ func (s *PartyInfo) updatePartyInfo(resp *http.Response, rawUrl string) error {
 	return nil
 }
 
-func (s *PartyInfo) getEncoded(encodedPartyInfo []byte) []byte {
+func (s *PartyInfo) getEncoded(ps *PartySnapshot, encodedPartyInfo []byte) []byte {
 	if s.grpc {
 		recipients := make(map[string][]byte)
-		for key, url := range s.recipients {
+		for key, url := range ps.Recipients {
 			recipients[url] = key[:]
 		}
-		e, err := json.Marshal(UpdatePartyInfo{s.url, recipients, s.parties})
+		e, err := json.Marshal(UpdatePartyInfo{s.url, recipients, ps.Parties})
 		if err != nil {
 			log.Errorf("Marshalling failed %v", err)
 			return nil
@@ -237,29 +480,47 @@ func (s *PartyInfo) getEncoded(encodedPartyInfo []byte) []byte {
 	return encodedPartyInfo[:]
 }
 
-func (s *PartyInfo) PollPartyInfo() {
-	time.Sleep(time.Duration(rand.Intn(16)) * time.Second)
-	s.GetPartyInfo()
-
-	ticker := time.NewTicker(2 * time.Minute)
-	quit := make(chan struct{})
+// PollPartyInfo starts requesting PartyInfo data from all remote nodes this node is aware of in
+// the background, until StopPolling is called. Each round of requests is made after the provided
+// interval, plus a random delay of up to jitter, which also delays the first round.
+func (s *PartyInfo) PollPartyInfo(interval, jitter time.Duration) {
+	s.pollWg.Add(1)
 	go func() {
+		defer s.pollWg.Done()
+
+		timer := time.NewTimer(randomDelay(jitter))
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				s.GetPartyInfo()
-			case <-quit:
-				ticker.Stop()
+				timer.Reset(interval + randomDelay(jitter))
+			case <-s.stopPoll:
 				return
 			}
 		}
 	}()
 }
 
+// StopPolling stops requesting PartyInfo data from remote nodes in the background, waiting for
+// any round of requests in progress to complete.
+func (s *PartyInfo) StopPolling() {
+	s.stopOnce.Do(func() {
+		close(s.stopPoll)
+	})
+	s.pollWg.Wait()
+}
+
+func randomDelay(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
 // UpdatePartyInfo updates the PartyInfo datastore with the provided encoded data.
 // This can happen from the /partyinfo server endpoint being hit, or by a response from us hitting
 // another nodes /partyinfo endpoint.
-// TODO: Control access via a channel for updates.
 func (s *PartyInfo) UpdatePartyInfo(encoded []byte) {
 	log.Debugf("Updating party info payload: %s", hex.EncodeToString(encoded))
 	pi, err := DecodePartyInfo(encoded)
@@ -267,52 +528,132 @@ func (s *PartyInfo) UpdatePartyInfo(encoded []byte) {
 	if err != nil {
 		log.WithField("encoded", encoded).Errorf(
 			"Unable to decode party info, error: %v", err)
+		return
+	}
+
+	s.mergePartyInfo(pi)
+}
+
+// UpdatePartyInfoGrpc updates the PartyInfo datastore with the unsigned details provided via gRPC
+// by nodes which do not send their signed party details as metadata. These are ignored in strict
+// mode.
+func (s *PartyInfo) UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool) {
+	s.mergePartyInfo(PartySnapshot{Url: url, Recipients: recipients, Parties: parties})
+}
+
+func (s *PartyInfo) mergePartyInfo(remote PartySnapshot) {
+	s.update(func(ps *PartySnapshot) {
+		if !s.permitsUrl(remote.Url) {
+			log.WithField("url", remote.Url).Warn("Ignoring party info from node not permitted")
+			return
+		}
+		now := time.Now()
+		s.recordSeen(remote.Url, now)
+
+		for publicKey, url := range remote.Recipients {
+			if !s.permits(publicKey, url) || (url != remote.Url && s.isEvicted(url, now)) {
+				continue
+			}
+			sig, signed := remote.Signatures[publicKey]
+			if s.acceptBinding(ps, publicKey, url, sig, signed) {
+				ps.Recipients[publicKey] = url
+				if signed {
+					ps.Signatures[publicKey] = sig
+				} else {
+					delete(ps.Signatures, publicKey)
+				}
+			}
+		}
+
+		for url := range remote.Parties {
+			// we don't want to broadcast party info to ourselves
+			if s.permitsUrl(url) && (url == remote.Url || !s.isEvicted(url, now)) {
+				ps.Parties[url] = true
+			}
+		}
+	})
+}
+
+// acceptBinding determines whether the binding of the public key to the URL received from another
+// node should replace any existing binding. Signatures of received bindings have already been
+// verified when decoding them.
+func (s *PartyInfo) acceptBinding(
+	ps *PartySnapshot,
+	publicKey [nacl.KeySize]byte,
+	url string,
+	sig KeySignature,
+	signed bool) bool {
+
+	existingUrl, exists := ps.Recipients[publicKey]
+	existingSig, existingSigned := ps.Signatures[publicKey]
+
+	// we should ignore messages about ourselves, and other nodes claiming our keys
+	if url == s.url || (exists && existingUrl == s.url) {
+		return false
 	}
 
-	for publicKey, url := range pi.recipients {
-		// we should ignore messages about ourselves
-		// in order to stop people masquerading as you, there
-		// should be a digital signature associated with each
-		// url -> node broadcast
-		if url != s.url {
-			s.recipients[publicKey] = url
+	logger := log.WithFields(log.Fields{
+		"publicKey": hex.EncodeToString(publicKey[:]),
+		"url":       url,
+	})
+
+	if !signed {
+		if s.strict {
+			logger.Warn("Rejecting unsigned recipient binding")
+			return false
+		}
+		if existingSigned && existingUrl != url {
+			logger.Warnf("Rejecting unsigned recipient binding conflicting with %s", existingUrl)
+			return false
 		}
+		return !existingSigned
 	}
 
-	for url := range pi.parties {
-		// we don't want to broadcast party info to ourselves
-		s.parties[url] = true
+	if existingSigned && existingUrl != url && sig.Issued <= existingSig.Issued {
+		logger.Warnf("Rejecting recipient binding conflicting with more recent binding to %s",
+			existingUrl)
+		return false
 	}
+	return !existingSigned || sig.Issued > existingSig.Issued
 }
 
-func (s *PartyInfo) UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool) {
-	for publicKey, url := range recipients {
-		// we should ignore messages about ourselves
-		// in order to stop people masquerading as you, there
-		// should be a digital signature associated with each
-		// url -> node broadcast
-		if url != s.url {
-			s.recipients[publicKey] = url
-		}
+// PushPayload pushes the payload to the node hosting recipient, if the peer filter permits it.
+// Payloads are pushed via gRPC if this node uses it, and otherwise with client.
+func (s *PartyInfo) PushPayload(epl EncryptedPayload, recipient nacl.Key, client utils.HttpClient) error {
+	url, ok := s.GetRecipient(recipient)
+	if !ok {
+		log.WithField("recipientKey", hex.EncodeToString((*recipient)[:])).Error("Unable to resolve host")
+		return fmt.Errorf("unable to resolve host for recipient: %s", hex.EncodeToString((*recipient)[:]))
 	}
 
-	for url := range parties {
-		// we don't want to broadcast party info to ourselves
-		s.parties[url] = true
+	if !s.Permits(recipient, url) {
+		log.WithField("recipientKey", hex.EncodeToString((*recipient)[:])).Error("Recipient not permitted")
+		return fmt.Errorf("recipient not permitted: %s", hex.EncodeToString((*recipient)[:]))
 	}
+
+	encoded := EncodePayloadWithRecipients(epl, [][]byte{})
+	if s.grpc {
+		return PushGrpc(encoded, url, epl)
+	}
+	_, err := Push(encoded, url, client)
+	return err
 }
 
+// PushGrpc is responsible for propagating the encoded payload to the given remote node via gRPC.
 func PushGrpc(encoded []byte, path string, epl EncryptedPayload) error {
 	var completeUrl url.URL
 	url, err := completeUrl.Parse(path)
+	if err != nil {
+		return err
+	}
 	conn, err := grpc.Dial(url.Host, grpc.WithInsecure())
 	if err != nil {
-		log.Fatalf("Connection to gRPC server failed with error %s", err)
+		return fmt.Errorf("connection to gRPC server failed with error %s", err)
 	}
 	defer conn.Close()
 	cli := chimera.NewClientClient(conn)
 	if cli == nil {
-		log.Fatalf("Client is not intialised")
+		return errors.New("client is not intialised")
 	}
 
 	var sender [32]byte
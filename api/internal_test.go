@@ -1,9 +1,16 @@
 package api
 
 import (
+	"crypto/rand"
+	"fmt"
 	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRegisterPublicKeys(t *testing.T) {
@@ -15,14 +22,311 @@ func TestRegisterPublicKeys(t *testing.T) {
 		key,
 		http.DefaultClient)
 
-	expKey := []nacl.Key{nacl.NewKey()}
+	pubKey, privKey := generateKey(t)
 	expUrl := "http://localhost:9000"
 
-	pi.RegisterPublicKeys(expKey)
+	pi.RegisterPublicKeys([]nacl.Key{pubKey}, []nacl.Key{privKey})
 
-	url, ok := pi.GetRecipient(expKey[0])
+	url, ok := pi.GetRecipient(pubKey)
 	if !ok || url != expUrl {
 		t.Errorf("Url is %s whereas %s is expected", url, expUrl)
 	}
 
+	sig, ok := pi.Snapshot().Signatures[*pubKey]
+	if !ok || !VerifyBinding(pubKey, expUrl, sig) {
+		t.Errorf("Binding of public key to %s is not signed", expUrl)
+	}
+}
+
+func TestUnregisterPublicKeys(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	pubKey, privKey := generateKey(t)
+	pi.RegisterPublicKeys([]nacl.Key{pubKey}, []nacl.Key{privKey})
+	remoteKey := nacl.NewKey()
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9001",
+		map[[nacl.KeySize]byte]string{*remoteKey: "http://localhost:9001"},
+		map[string]bool{"http://localhost:9001": true})
+
+	pi.UnregisterPublicKeys([]nacl.Key{pubKey, remoteKey})
+
+	if url, ok := pi.GetRecipient(pubKey); ok {
+		t.Errorf("Unregistered public key is still bound to %s", url)
+	}
+	if _, ok := pi.Snapshot().Signatures[*pubKey]; ok {
+		t.Error("Signature of unregistered public key binding remains")
+	}
+	if url, ok := pi.GetRecipient(remoteKey); !ok || url != "http://localhost:9001" {
+		t.Errorf("Binding of public key to another node should remain, url is %s", url)
+	}
+}
+
+func TestStrictPartyInfo(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, true, nil)
+	defer pi.Close()
+
+	remote := InitPartyInfo("http://localhost:9001", []string{}, http.DefaultClient, false, false, nil)
+	defer remote.Close()
+	pubKey, privKey := generateKey(t)
+	remote.RegisterPublicKeys([]nacl.Key{pubKey}, []nacl.Key{privKey})
+
+	unsignedKey := nacl.NewKey()
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9002",
+		map[[nacl.KeySize]byte]string{*unsignedKey: "http://localhost:9002"},
+		map[string]bool{"http://localhost:9002": true})
+
+	if url, ok := pi.GetRecipient(unsignedKey); ok {
+		t.Errorf("Unsigned binding to %s should be rejected in strict mode", url)
+	}
+
+	pi.UpdatePartyInfo(EncodePartyInfo(remote.Snapshot()))
+
+	if url, ok := pi.GetRecipient(pubKey); !ok || url != "http://localhost:9001" {
+		t.Errorf("Url is %s whereas %s is expected", url, "http://localhost:9001")
+	}
+	if !pi.Snapshot().Parties["http://localhost:9002"] {
+		t.Error("Parties should be updated in strict mode")
+	}
+}
+
+func TestConflictingBindings(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	ownKey, ownPrivKey := generateKey(t)
+	pi.RegisterPublicKeys([]nacl.Key{ownKey}, []nacl.Key{ownPrivKey})
+
+	pubKey, privKey := generateKey(t)
+	issued := time.Now().Unix()
+	pi.UpdatePartyInfo(signedBinding(t, pubKey, privKey, "http://localhost:9001", issued))
+
+	// Unsigned claims must not override signed bindings
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9002",
+		map[[nacl.KeySize]byte]string{
+			*pubKey: "http://localhost:9002",
+			*ownKey: "http://localhost:9002",
+		},
+		map[string]bool{})
+	verifyRecipient(t, pi, pubKey, "http://localhost:9001")
+	verifyRecipient(t, pi, ownKey, "http://localhost:9000")
+
+	// Nor can older signed bindings be replayed
+	pi.UpdatePartyInfo(signedBinding(t, pubKey, privKey, "http://localhost:9002", issued-1))
+	verifyRecipient(t, pi, pubKey, "http://localhost:9001")
+
+	// Another node cannot claim our keys, even with a valid signature
+	pi.UpdatePartyInfo(signedBinding(t, ownKey, ownPrivKey, "http://localhost:9002", issued+1))
+	verifyRecipient(t, pi, ownKey, "http://localhost:9000")
+
+	// Recipients may move to another node
+	pi.UpdatePartyInfo(signedBinding(t, pubKey, privKey, "http://localhost:9002", issued+1))
+	verifyRecipient(t, pi, pubKey, "http://localhost:9002")
+}
+
+func generateKey(t *testing.T) (nacl.Key, nacl.Key) {
+	pubKey, privKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubKey, privKey
+}
+
+func signedBinding(t *testing.T, pubKey, privKey nacl.Key, url string, issued int64) []byte {
+	sig, err := SignBinding(pubKey, privKey, url, issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return EncodePartyInfo(PartySnapshot{
+		Url:        url,
+		Recipients: map[[nacl.KeySize]byte]string{*pubKey: url},
+		Parties:    map[string]bool{url: true},
+		Signatures: map[[nacl.KeySize]byte]KeySignature{*pubKey: sig},
+	})
+}
+
+func verifyRecipient(t *testing.T, pi *PartyInfo, key nacl.Key, expUrl string) {
+	if url, ok := pi.GetRecipient(key); !ok || url != expUrl {
+		t.Errorf("Url is %s whereas %s is expected", url, expUrl)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	const updaters = 20
+	keys := make([]nacl.Key, updaters)
+	for i := range keys {
+		keys[i] = nacl.NewKey()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < updaters; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			url := fmt.Sprintf("http://localhost:%d", 9001+i)
+			remote := PartySnapshot{
+				Url:        url,
+				Recipients: map[[nacl.KeySize]byte]string{*keys[i]: url},
+				Parties:    map[string]bool{url: true},
+			}
+			pi.UpdatePartyInfo(EncodePartyInfo(remote))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			pi.GetRecipient(keys[i])
+			EncodePartyInfo(pi.Snapshot())
+			pi.GetAllValues()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, key := range keys {
+		expUrl := fmt.Sprintf("http://localhost:%d", 9001+i)
+		if url, ok := pi.GetRecipient(key); !ok || url != expUrl {
+			t.Errorf("Url is %s whereas %s is expected", url, expUrl)
+		}
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	before := pi.Snapshot()
+	pubKey, privKey := generateKey(t)
+	pi.RegisterPublicKeys([]nacl.Key{pubKey}, []nacl.Key{privKey})
+
+	if len(before.Recipients) != 0 {
+		t.Errorf("Snapshot should not be affected by updates, recipients: %d",
+			len(before.Recipients))
+	}
+	if len(pi.Snapshot().Recipients) != 1 {
+		t.Errorf("Snapshot should contain registered key, recipients: %d",
+			len(pi.Snapshot().Recipients))
+	}
+}
+
+// TestGossip runs many nodes concurrently exchanging signed party info with each other via a
+// single boot node, verifying that every node discovers the keys of all the others.
+func TestGossip(t *testing.T) {
+	const nodes = 16
+	const rounds = 3
+
+	parties := make([]*PartyInfo, nodes)
+	servers := make([]*httptest.Server, nodes)
+	keys := make([]nacl.Key, nodes)
+
+	for i := 0; i < nodes; i++ {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				payload, err := ioutil.ReadAll(req.Body)
+				req.Body.Close()
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				parties[i].UpdatePartyInfo(payload)
+				w.Write(EncodePartyInfo(parties[i].Snapshot()))
+			}))
+		defer servers[i].Close()
+	}
+
+	for i := 0; i < nodes; i++ {
+		parties[i] = InitPartyInfo(
+			servers[i].URL, []string{servers[0].URL}, http.DefaultClient, false, true, nil)
+		defer parties[i].Close()
+
+		var privKey nacl.Key
+		keys[i], privKey = generateKey(t)
+		parties[i].RegisterPublicKeys([]nacl.Key{keys[i]}, []nacl.Key{privKey})
+	}
+
+	for round := 0; round < rounds; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < nodes; i++ {
+			wg.Add(2)
+			go func(pi *PartyInfo) {
+				defer wg.Done()
+				pi.GetPartyInfo()
+			}(parties[i])
+			go func(pi *PartyInfo) {
+				defer wg.Done()
+				for _, key := range keys {
+					pi.GetRecipient(key)
+				}
+			}(parties[i])
+		}
+		wg.Wait()
+	}
+
+	for i, pi := range parties {
+		for j, key := range keys {
+			if url, ok := pi.GetRecipient(key); !ok || url != servers[j].URL {
+				t.Errorf("Node %d resolved key of node %d to %s, expected %s",
+					i, j, url, servers[j].URL)
+			}
+		}
+	}
+}
+
+func TestPollPartyInfo(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			requests += 1
+			mu.Unlock()
+			w.Write(EncodePartyInfo(PartySnapshot{Url: "http://localhost:9001"}))
+		}))
+	defer server.Close()
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	pi := InitPartyInfo("http://localhost:9000", []string{server.URL}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	pi.PollPartyInfo(10*time.Millisecond, 5*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if count() < 3 {
+		t.Fatalf("Party info should be polled repeatedly, requests: %d", count())
+	}
+
+	pi.StopPolling()
+	stopped := count()
+	time.Sleep(50 * time.Millisecond)
+	if count() != stopped {
+		t.Errorf("Party info should not be polled once stopped, requests: %d", count()-stopped)
+	}
+}
+
+func TestRefreshPartyInfo(t *testing.T) {
+	client := &failingClient{}
+	pi := InitPartyInfo(
+		"http://localhost:9000", []string{"http://localhost:9001"}, client, false, false, nil)
+	defer pi.Close()
+
+	pi.GetPartyInfo()
+	pi.GetPartyInfo()
+	pi.RefreshPartyInfo()
+
+	if client.requests != 2 {
+		t.Errorf("Refresh should request party info from nodes backing off, requests: %d",
+			client.requests)
+	}
 }
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// PeerFilter restricts the other nodes (or parties) on the network this node interacts with.
+//
+// If any allowed URLs or public keys are provided, only those peers are permitted, otherwise all
+// peers are permitted other than those which have been denied.
+type PeerFilter struct {
+	AllowedUrls []string `json:"allowedUrls,omitempty"`
+	AllowedKeys []string `json:"allowedKeys,omitempty"` // base64 encoded public keys
+	DeniedUrls  []string `json:"deniedUrls,omitempty"`
+	DeniedKeys  []string `json:"deniedKeys,omitempty"` // base64 encoded public keys
+}
+
+// peerFilter is the parsed form of a PeerFilter.
+type peerFilter struct {
+	source      PeerFilter
+	allowedUrls map[string]bool
+	allowedKeys map[[nacl.KeySize]byte]bool
+	deniedUrls  map[string]bool
+	deniedKeys  map[[nacl.KeySize]byte]bool
+}
+
+func newPeerFilter(f PeerFilter) (*peerFilter, error) {
+	pf := &peerFilter{
+		source:      f,
+		allowedUrls: make(map[string]bool),
+		allowedKeys: make(map[[nacl.KeySize]byte]bool),
+		deniedUrls:  make(map[string]bool),
+		deniedKeys:  make(map[[nacl.KeySize]byte]bool),
+	}
+
+	for _, url := range f.AllowedUrls {
+		pf.allowedUrls[normaliseUrl(url)] = true
+	}
+	for _, url := range f.DeniedUrls {
+		pf.deniedUrls[normaliseUrl(url)] = true
+	}
+
+	err := loadFilterKeys(f.AllowedKeys, pf.allowedKeys)
+	if err == nil {
+		err = loadFilterKeys(f.DeniedKeys, pf.deniedKeys)
+	}
+	return pf, err
+}
+
+func loadFilterKeys(keys []string, dest map[[nacl.KeySize]byte]bool) error {
+	for _, encoded := range keys {
+		key, err := utils.LoadBase64Key(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid public key %s, %v", encoded, err)
+		}
+		dest[*key] = true
+	}
+	return nil
+}
+
+// normaliseUrl allows URLs which differ only by a trailing slash to be treated as the same peer.
+func normaliseUrl(url string) string {
+	return strings.TrimRight(url, "/")
+}
+
+func (f *peerFilter) allowsUrl(url string) bool {
+	url = normaliseUrl(url)
+	if f.deniedUrls[url] {
+		return false
+	}
+	return len(f.allowedUrls) == 0 || f.allowedUrls[url]
+}
+
+func (f *peerFilter) allowsKey(key [nacl.KeySize]byte) bool {
+	if f.deniedKeys[key] {
+		return false
+	}
+	return len(f.allowedKeys) == 0 || f.allowedKeys[key]
+}
+
+func (s *PartyInfo) peerFilter() *peerFilter {
+	return s.filter.Load().(*peerFilter)
+}
+
+// PeerFilter provides the filter currently applied to the other nodes on the network.
+func (s *PartyInfo) PeerFilter() PeerFilter {
+	return s.peerFilter().source
+}
+
+// SetPeerFilter replaces the filter applied to the other nodes on the network, removing any
+// details of nodes and public keys which are no longer permitted.
+func (s *PartyInfo) SetPeerFilter(f PeerFilter) error {
+	pf, err := newPeerFilter(f)
+	if err != nil {
+		return err
+	}
+
+	s.update(func(ps *PartySnapshot) {
+		s.filter.Store(pf)
+
+		for key, url := range ps.Recipients {
+			if !s.permits(key, url) {
+				log.WithField("url", url).Infof("Removing public key no longer permitted")
+				delete(ps.Recipients, key)
+				delete(ps.Signatures, key)
+			}
+		}
+		for url := range ps.Parties {
+			if !s.permitsUrl(url) {
+				log.WithField("url", url).Infof("Removing node no longer permitted")
+				delete(ps.Parties, url)
+			}
+		}
+	})
+	return nil
+}
+
+// Permits reports whether payloads may be exchanged with the recipient with the provided public
+// key, hosted by the node with the provided URL.
+func (s *PartyInfo) Permits(key nacl.Key, url string) bool {
+	return s.permits(*key, url)
+}
+
+// PermitsSender reports whether payloads sent by the provided public key may be accepted. The node
+// hosting the key must be permitted too, so if any URLs are allowed or denied, payloads from keys
+// not bound to a known node are rejected.
+func (s *PartyInfo) PermitsSender(key nacl.Key) bool {
+	if url, ok := s.GetRecipient(key); ok {
+		return s.permits(*key, url)
+	}
+	pf := s.peerFilter()
+	return pf.allowsKey(*key) && len(pf.allowedUrls) == 0 && len(pf.deniedUrls) == 0
+}
+
+// CheckSender rejects payloads pushed by other nodes from senders not permitted by the peer
+// filter.
+func (s *PartyInfo) CheckSender(sender nacl.Key) error {
+	if !s.PermitsSender(sender) {
+		log.WithField("senderKey", hex.EncodeToString((*sender)[:])).Warn(
+			"Rejecting payload from sender not permitted")
+		return fmt.Errorf("sender not permitted: %s", hex.EncodeToString((*sender)[:]))
+	}
+	return nil
+}
+
+func (s *PartyInfo) permits(key [nacl.KeySize]byte, url string) bool {
+	// Public keys hosted by this node are always permitted
+	return url == s.url || (s.peerFilter().allowsKey(key) && s.peerFilter().allowsUrl(url))
+}
+
+func (s *PartyInfo) permitsUrl(url string) bool {
+	return url == s.url || s.peerFilter().allowsUrl(url)
+}
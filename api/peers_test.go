@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/base64"
+	"github.com/kevinburke/nacl"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSetPeerFilter(t *testing.T) {
+	allowedKey := nacl.NewKey()
+	deniedKey := nacl.NewKey()
+
+	pi := CreatePartyInfo(
+		"http://localhost:9000",
+		[]string{"http://localhost:9001/", "http://localhost:9002", "http://localhost:9003"},
+		[]nacl.Key{allowedKey, deniedKey, nacl.NewKey()},
+		http.DefaultClient)
+	defer pi.Close()
+
+	ownKey, ownPrivKey := generateKey(t)
+	pi.RegisterPublicKeys([]nacl.Key{ownKey}, []nacl.Key{ownPrivKey})
+
+	filter := PeerFilter{
+		AllowedUrls: []string{"http://localhost:9001", "http://localhost:9002"},
+		DeniedKeys:  []string{base64.StdEncoding.EncodeToString(deniedKey[:])},
+	}
+	if err := pi.SetPeerFilter(filter); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyRecipient(t, pi, allowedKey, "http://localhost:9001/")
+	verifyRecipient(t, pi, ownKey, "http://localhost:9000")
+	if _, ok := pi.GetRecipient(deniedKey); ok {
+		t.Error("Denied key should be removed")
+	}
+
+	ps := pi.Snapshot()
+	if len(ps.Recipients) != 2 || len(ps.Parties) != 2 || ps.Parties["http://localhost:9003"] {
+		t.Errorf("Nodes not permitted should be removed, remaining: %v", ps.Parties)
+	}
+
+	if !pi.Permits(allowedKey, "http://localhost:9002/") {
+		t.Error("Recipient on allowed node should be permitted")
+	}
+	if pi.Permits(allowedKey, "http://localhost:9003") || pi.Permits(deniedKey, "http://localhost:9001") {
+		t.Error("Recipient should not be permitted")
+	}
+
+	if !reflect.DeepEqual(pi.PeerFilter(), filter) {
+		t.Errorf("Peer filter is %v whereas %v is expected", pi.PeerFilter(), filter)
+	}
+}
+
+func TestSetInvalidPeerFilter(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	if err := pi.SetPeerFilter(PeerFilter{AllowedKeys: []string{"invalid"}}); err == nil {
+		t.Error("Peer filter with invalid key should be rejected")
+	}
+}
+
+func TestUpdatePartyInfoWithPeerFilter(t *testing.T) {
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	deniedKey := nacl.NewKey()
+	err := pi.SetPeerFilter(PeerFilter{
+		DeniedUrls: []string{"http://localhost:9002"},
+		DeniedKeys: []string{base64.StdEncoding.EncodeToString(deniedKey[:])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates from denied nodes are ignored entirely
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9002",
+		map[[nacl.KeySize]byte]string{*nacl.NewKey(): "http://localhost:9003"},
+		map[string]bool{"http://localhost:9003": true})
+	if ps := pi.Snapshot(); len(ps.Recipients) != 0 || len(ps.Parties) != 0 {
+		t.Errorf("Party info from denied node should be ignored: %v", ps)
+	}
+
+	allowedKey := nacl.NewKey()
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9001",
+		map[[nacl.KeySize]byte]string{
+			*allowedKey:    "http://localhost:9001",
+			*deniedKey:     "http://localhost:9001",
+			*nacl.NewKey(): "http://localhost:9002/",
+		},
+		map[string]bool{"http://localhost:9001": true, "http://localhost:9002": true})
+
+	verifyRecipient(t, pi, allowedKey, "http://localhost:9001")
+	ps := pi.Snapshot()
+	if len(ps.Recipients) != 1 || len(ps.Parties) != 1 {
+		t.Errorf("Denied nodes and keys should be ignored: %v", ps)
+	}
+}
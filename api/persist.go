@@ -0,0 +1,60 @@
+package api
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// PartyInfoKey is the key under which the details of the other nodes on the network are
+// persisted within the DataStore, allowing a node to route payloads following a restart before
+// any of the nodes it was started with respond.
+var PartyInfoKey = []byte("partyinfo")
+
+// loadPartyInfo restores the details of the other nodes on the network which were persisted when
+// the node last ran. These are marked as stale until each node is reached again.
+func (s *PartyInfo) loadPartyInfo() {
+	encoded, err := s.db.Read(&PartyInfoKey)
+	if err != nil {
+		// Nothing has been persisted yet
+		return
+	}
+
+	ps, err := DecodePartyInfo(*encoded)
+	if err != nil {
+		log.Errorf("Unable to decode persisted party info, error: %v", err)
+		return
+	}
+
+	s.healthMu.Lock()
+	for url := range ps.Parties {
+		s.stale[url] = true
+	}
+	for _, url := range ps.Recipients {
+		s.stale[url] = true
+	}
+	delete(s.stale, s.url)
+	s.healthMu.Unlock()
+
+	// Our own public keys are registered afresh on startup
+	for key, url := range ps.Recipients {
+		if url == s.url {
+			delete(ps.Recipients, key)
+			delete(ps.Signatures, key)
+		}
+	}
+	ps.Url = s.url
+	s.mergePartyInfo(ps)
+	log.Infof("Loaded %d parties and %d recipients from previous run",
+		len(ps.Parties), len(ps.Recipients))
+}
+
+// persistPartyInfo saves the current details of the other nodes on the network.
+func (s *PartyInfo) persistPartyInfo() {
+	if s.db == nil {
+		return
+	}
+
+	encoded := EncodePartyInfo(*s.snapshot())
+	if err := s.db.Write(&PartyInfoKey, &encoded); err != nil {
+		log.Errorf("Unable to persist party info, error: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPersistPartyInfo(t *testing.T) {
+	db := storage.InitMemoryDb()
+
+	pi := InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, db)
+	ownKey, ownPrivKey := generateKey(t)
+	pi.RegisterPublicKeys([]nacl.Key{ownKey}, []nacl.Key{ownPrivKey})
+	remoteKey := nacl.NewKey()
+	pi.UpdatePartyInfoGrpc(
+		"http://localhost:9001",
+		map[[nacl.KeySize]byte]string{*remoteKey: "http://localhost:9001"},
+		map[string]bool{"http://localhost:9001": true, "http://localhost:9002": true})
+	pi.Close()
+
+	pi = InitPartyInfo("http://localhost:9000", []string{}, http.DefaultClient, false, false, db)
+	defer pi.Close()
+
+	verifyRecipient(t, pi, remoteKey, "http://localhost:9001")
+	if _, ok := pi.GetRecipient(ownKey); ok {
+		t.Error("Public keys of this node should not be restored")
+	}
+
+	peers := pi.Peers()
+	if len(peers) != 2 || !peers[0].Stale || !peers[1].Stale {
+		t.Fatalf("Restored peers should be stale: %v", peers)
+	}
+
+	pi.recordSuccess("http://localhost:9001", time.Millisecond, time.Now())
+	peers = pi.Peers()
+	if peers[0].Stale || !peers[1].Stale {
+		t.Errorf("Peer should no longer be stale once it has been reached: %v", peers)
+	}
+}
+
+func TestPersistPartyInfoWithoutDataStore(t *testing.T) {
+	pi := InitPartyInfo(
+		"http://localhost:9000", []string{"http://localhost:9001"}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	pi.persistPartyInfo()
+	for _, peer := range pi.Peers() {
+		if peer.Stale {
+			t.Errorf("Boot node should not be stale: %v", peer)
+		}
+	}
+}
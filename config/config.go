@@ -7,6 +7,8 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -19,10 +21,46 @@ const (
 	OtherNodes         = "othernodes"
 	PublicKeys         = "publickeys"
 	PrivateKeys        = "privatekeys"
+	Passwords          = "passwords"
+	RetiredKeys        = "retiredkeys"
+	VaultAddr          = "vaultaddr"
+	VaultMount         = "vaultmount"
+	VaultSecrets       = "vaultsecrets"
 	Port               = "port"
 	Socket             = "socket"
+	DeliveryPolicy     = "deliverypolicy"
+	StrictPartyInfo    = "strictpartyinfo"
+	AllowedPeers       = "allowedpeers"
+	AllowedKeys        = "allowedkeys"
+	DeniedPeers        = "deniedpeers"
+	DeniedKeys         = "deniedkeys"
+	PollInterval       = "pollinterval"
+	PollJitter         = "polljitter"
+
+	RetentionPeriod   = "retentionperiod"
+	RetentionRules    = "retentionrules"
+	RetentionMaxSize  = "retentionmaxsize"
+	RetentionInterval = "retentioninterval"
+	RetentionDryRun   = "retentiondryrun"
 
 	GenerateKeys = "generate-keys"
+	LockKeys     = "lockkeys"
+
+	Migrate     = "migrate" // Command to migrate payloads between data stores
+	MigrateFrom = "from"
+	MigrateTo   = "to"
+	Reencode    = "reencode"
+
+	Rekey               = "rekey" // Command to rewrite storage with the current storage key
+	StorageKey          = "storagekey"
+	PreviousStorageKeys = "previousstoragekeys"
+
+	Backup  = "backup"  // Command to write a backup archive of storage
+	Restore = "restore" // Command to restore storage from a backup archive
+	Archive = "archive"
+
+	Enclave       = "enclave" // Command to run the enclave alone, serving it over its socket
+	EnclaveSocket = "enclavesocket"
 
 	BerkeleyDb       = "berkeleydb"
 	UseGRPC          = "grpc"
@@ -45,20 +83,64 @@ const (
 // InitFlags initializes all supported command line flags.
 func InitFlags() {
 	flag.String(GenerateKeys, "", "Generate a new keypair")
+	flag.Bool(LockKeys, false,
+		"Lock the private key generated by --generate-keys with the first password of --passwords")
+	flag.String(MigrateFrom, "",
+		"Storage to migrate payloads from with the migrate command, e.g. berkeleydb:<path>")
+	flag.String(MigrateTo, "",
+		"Storage to migrate payloads to with the migrate command, e.g. leveldb:<path>")
+	flag.Bool(Reencode, false, "Re-encode payloads in the current format when migrating them")
+	flag.String(Archive, "", "Backup archive written by the backup command, or read by the restore command")
 	flag.String(Url, "", "The URL to advertise to other nodes (reachable by them)")
 	flag.Int(Port, -1, "The local port to listen on")
 	flag.String(WorkDir, ".", "The folder to put stuff in ")
 	flag.String(Socket, "crux.ipc", "IPC socket to create for access to the Private API")
+	flag.String(EnclaveSocket, "",
+		"Socket of an enclave running in a separate process with the enclave command, if set")
 	flag.String(OtherNodes, "", "\"Boot nodes\" to connect to to discover the network")
 	flag.String(PublicKeys, "", "Public keys hosted by this node")
 	flag.String(PrivateKeys, "", "Private keys hosted by this node")
-	flag.String(Storage, "crux.db", "Database storage file name")
+	flag.String(Passwords, "",
+		"File containing the passwords of locked private keys, one per line (empty for unlocked keys)")
+	flag.String(RetiredKeys, "",
+		"Public keys of key pairs hosted by this node which are retired, but still decrypt earlier payloads")
+	flag.String(VaultAddr, "",
+		"Address of a HashiCorp Vault server to read key pairs from instead of key files, if set")
+	flag.String(VaultMount, "secret", "Path the Vault KV version 2 secrets engine is mounted at")
+	flag.String(VaultSecrets, "", "Paths of the Vault secrets holding key pairs, relative to --vaultmount")
+	flag.String(Storage, "crux.db",
+		"Database storage file name, or URI such as sqlite:crux.sqlite (leveldb, berkeleydb, sqlite or memory)")
+	flag.String(StorageKey, "",
+		"File containing a base64 encoded 32 byte key to encrypt storage with, if set")
+	flag.String(PreviousStorageKeys, "",
+		"Files containing storage keys which storage was previously encrypted with")
 	flag.Bool(BerkeleyDb, false,
 		"Use Berkeley DB for working with an existing Constellation data store [experimental]")
 
 	flag.Int(Verbosity, 1, "Verbosity level of logs (0=fatal, 1=warn, 2=info, 3=debug)")
 	flag.Int(VerbosityShorthand, 1, "Verbosity level of logs (shorthand)")
-	flag.String(AlwaysSendTo, "", "List of public keys for nodes to send all transactions too")
+	flag.String(AlwaysSendTo, "",
+		"Public keys of recipients to send all transactions to, in addition to their own")
+	flag.String(DeliveryPolicy, "best-effort",
+		"Recipients that must acknowledge a transaction for it to be sent (all, quorum or best-effort)")
+	flag.Bool(StrictPartyInfo, false,
+		"Only accept public keys from other nodes which have been signed by their private keys")
+	flag.String(AllowedPeers, "",
+		"URLs of the only other nodes to interact with (all nodes are allowed if unset)")
+	flag.String(AllowedKeys, "",
+		"Public keys of the only recipients to interact with (all keys are allowed if unset)")
+	flag.String(DeniedPeers, "", "URLs of other nodes not to interact with")
+	flag.String(DeniedKeys, "", "Public keys of recipients not to interact with")
+	flag.Duration(PollInterval, 2*time.Minute, "Interval between requests for party info from other nodes")
+	flag.Duration(PollJitter, 16*time.Second,
+		"Maximum random delay added to the interval between requests for party info")
+	flag.Duration(RetentionPeriod, 0, "Period after which payloads are removed (payloads are kept if 0)")
+	flag.String(RetentionRules, "",
+		"Retention periods for payloads sent by or to public keys, e.g. sender:<key>:720h,recipient:<key>:24h")
+	flag.Int(RetentionMaxSize, 0,
+		"Maximum total size of payloads in bytes, beyond which the oldest are removed (unlimited if 0)")
+	flag.Duration(RetentionInterval, time.Hour, "Interval between applications of the retention policy")
+	flag.Bool(RetentionDryRun, false, "Only log the payloads which the retention policy would remove")
 	flag.Bool(UseGRPC, true, "Use gRPC server")
 	flag.Bool(Tls, false, "Use TLS to secure HTTP communications")
 	flag.String(TlsServerCert, "", "The server certificate to be used")
@@ -66,8 +148,6 @@ func InitFlags() {
 	flag.Int(GrpcJsonPort, -1, "The local port to listen on for JSON extensions of gRPC")
 	flag.String(NetworkInterface, "localhost", "The network interface to bind the server to")
 
-	// storage not currently supported as we use LevelDB
-
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	viper.BindPFlags(pflag.CommandLine) // Binding the flags to test the initial configuration
 }
@@ -76,9 +156,29 @@ func InitFlags() {
 func Usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "      %-25s%s\n", "crux.config", "Optional config file")
+	fmt.Fprintf(os.Stderr, "      %-25s%s\n", Migrate,
+		"Migrate payloads between data stores, then exit (requires --from and --to)")
+	fmt.Fprintf(os.Stderr, "      %-25s%s\n", Rekey,
+		"Rewrite storage encrypted with --previousstoragekeys using --storagekey, then exit")
+	fmt.Fprintf(os.Stderr, "      %-25s%s\n", Backup,
+		"Write a backup archive of storage to --archive, then exit")
+	fmt.Fprintf(os.Stderr, "      %-25s%s\n", Restore,
+		"Verify the backup archive --archive and restore it to empty storage, then exit")
+	fmt.Fprintf(os.Stderr, "      %-25s%s\n", Enclave,
+		"Run the enclave alone, serving it to a separate process over --enclavesocket")
 	pflag.PrintDefaults()
 }
 
+// Command provides the command provided on the command line, if any.
+func Command() string {
+	for _, arg := range pflag.Args() {
+		if !strings.Contains(arg, ".conf") {
+			return arg
+		}
+	}
+	return ""
+}
+
 // ParseCommandLine parses all provided command line arguments.
 func ParseCommandLine() {
 	pflag.Parse()
@@ -111,3 +211,7 @@ func GetString(key string) string {
 func GetStringSlice(key string) []string {
 	return viper.GetStringSlice(key)
 }
+
+func GetDuration(key string) time.Duration {
+	return viper.GetDuration(key)
+}
@@ -11,18 +11,44 @@ func TestInitFlags(t *testing.T) {
 	InitFlags()
 	conf := AllSettings()
 	expected := map[string]interface{}{
-		Port:         -1,
-		Verbosity:    1,
-		BerkeleyDb:   false,
-		GenerateKeys: "",
-		AlwaysSendTo: "",
-		Storage:      "crux.db",
-		WorkDir:      ".",
-		Url:          "",
-		PublicKeys:   "",
-		OtherNodes:   "",
-		PrivateKeys:  "",
-		Socket:       "crux.ipc",
+		Port:                -1,
+		Verbosity:           1,
+		BerkeleyDb:          false,
+		GenerateKeys:        "",
+		LockKeys:            false,
+		MigrateFrom:         "",
+		MigrateTo:           "",
+		Reencode:            false,
+		Archive:             "",
+		AlwaysSendTo:        "",
+		Storage:             "crux.db",
+		StorageKey:          "",
+		WorkDir:             ".",
+		Url:                 "",
+		PublicKeys:          "",
+		OtherNodes:          "",
+		PrivateKeys:         "",
+		Passwords:           "",
+		RetiredKeys:         "",
+		VaultAddr:           "",
+		VaultMount:          "secret",
+		VaultSecrets:        "",
+		Socket:              "crux.ipc",
+		EnclaveSocket:       "",
+		DeliveryPolicy:      "best-effort",
+		StrictPartyInfo:     false,
+		AllowedPeers:        "",
+		AllowedKeys:         "",
+		DeniedPeers:         "",
+		DeniedKeys:          "",
+		PollInterval:        "2m0s",
+		PollJitter:          "16s",
+		PreviousStorageKeys: "",
+		RetentionPeriod:     "0s",
+		RetentionRules:      "",
+		RetentionMaxSize:    0,
+		RetentionInterval:   "1h0m0s",
+		RetentionDryRun:     false,
 	}
 
 	verifyConfig(t, conf, expected)
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/config"
 	"github.com/blk-io/crux/enclave"
 	"github.com/blk-io/crux/server"
 	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -23,12 +31,14 @@ func main() {
 		exit()
 	}
 
+	var configFile string
 	for _, arg := range args[1:] {
 		if strings.Contains(arg, ".conf") {
 			err := config.LoadConfig(arg)
 			if err != nil {
 				log.Fatalln(err)
 			}
+			configFile = arg
 			break
 		}
 	}
@@ -57,7 +67,19 @@ func main() {
 
 	keyFile := config.GetString(config.GenerateKeys)
 	if keyFile != "" {
-		err := enclave.DoKeyGeneration(keyFile)
+		var password string
+		if config.GetBool(config.LockKeys) {
+			passwords, err := loadPasswords(config.GetString(config.WorkDir))
+			if err != nil {
+				log.Fatalf("Unable to load passwords, error: %v", err)
+			}
+			if len(passwords) == 0 || passwords[0] == "" {
+				log.Fatalf("A password must be provided via --%s or %s to lock keys",
+					config.Passwords, passwordsEnv)
+			}
+			password = passwords[0]
+		}
+		err := enclave.DoKeyGeneration(keyFile, password)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -65,52 +87,241 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch config.Command() {
+	case config.Migrate:
+		doMigration()
+		os.Exit(0)
+	case config.Rekey:
+		doRekey()
+		os.Exit(0)
+	case config.Backup:
+		doBackup()
+		os.Exit(0)
+	case config.Restore:
+		doRestore()
+		os.Exit(0)
+	}
+
 	workDir := config.GetString(config.WorkDir)
-	dbStorage := config.GetString(config.Storage)
 	ipcFile := config.GetString(config.Socket)
-	storagePath := path.Join(workDir, dbStorage)
 	ipcPath := path.Join(workDir, ipcFile)
-	var db storage.DataStore
-	var err error
-	if config.GetBool(config.BerkeleyDb) {
-		db, err = storage.InitBerkeleyDb(storagePath)
-	} else {
-		db, err = storage.InitLevelDb(storagePath)
+	grpc := config.GetBool(config.UseGRPC)
+
+	enclaveSocket := config.GetString(config.EnclaveSocket)
+	standalone := config.Command() == config.Enclave
+	if standalone && enclaveSocket == "" {
+		log.Fatalf("The enclave socket must be provided via --%s", config.EnclaveSocket)
+	}
+	if enclaveSocket != "" && !standalone {
+		// The enclave runs in a separate process, which requests are forwarded to. This process
+		// holds the party details, and pushes the payloads sealed by the enclave to other nodes.
+		pi := initPartyInfo(grpc, nil)
+		defer pi.Close()
+		enc := server.NewEnclaveClient(path.Join(workDir, enclaveSocket), pi, http.DefaultClient)
+		startServer(enc, workDir, ipcPath, grpc)
+		pollPartyInfo(pi)
+		enc.Run(config.GetDuration(config.PollInterval))
+		select {}
 	}
 
+	db, err := openNodeStorage(workDir)
 	if err != nil {
 		log.Fatalf("Unable to initialise storage, error: %v", err)
 	}
 	defer db.Close()
 
-	allOtherNodes := config.GetString(config.OtherNodes)
-	otherNodes := strings.Split(allOtherNodes, ",")
+	keys, err := keyProvider(workDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var enc *enclave.SecureEnclave
+	var pi *api.PartyInfo
+	var pushes *server.PushQueue
+	if standalone {
+		// The transaction manager holds the party details, and pushes the payloads sealed here
+		pushes = server.NewPushQueue()
+		enc = enclave.InitStandalone(db, keys, pushes)
+	} else {
+		pi = initPartyInfo(grpc, db)
+		defer pi.Close()
+		enc = enclave.Init(db, keys, pi, http.DefaultClient)
+	}
+
+	retired, err := retiredKeys()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = enc.RetireKeys(retired); err != nil {
+		log.Fatalf("Unable to retire key pairs, error: %v", err)
+	}
+
+	if pi != nil {
+		pi.RegisterPublicKeys(enc.PubKeys, enc.PrivKeys)
+	}
+
+	err = enc.SetAlwaysSendTo(listSetting(config.AlwaysSendTo))
+	if err != nil {
+		log.Fatalf("Invalid recipients for all transactions, error: %v", err)
+	}
+
+	policy, err := retentionPolicy()
+	if err != nil {
+		log.Fatalf("Invalid retention policy, error: %v", err)
+	}
+	if policy.MaxAge > 0 || policy.MaxSize > 0 ||
+		len(policy.SenderMaxAge) > 0 || len(policy.RecipientMaxAge) > 0 {
+
+		retentionInterval := config.GetDuration(config.RetentionInterval)
+		if retentionInterval <= 0 {
+			log.Fatalln("Retention interval must be positive")
+		}
+		enc.EnforceRetention(policy, retentionInterval, config.GetBool(config.RetentionDryRun))
+	}
+
+	if standalone {
+		err = server.ServeEnclave(enc, pushes, path.Join(workDir, enclaveSocket))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		startServer(enc, workDir, ipcPath, grpc)
+		pollPartyInfo(pi)
+	}
+
+	reloadKeysOnHangup(enc, configFile, workDir)
+}
+
+// initPartyInfo creates the store of the details of the other nodes on the network, which are
+// persisted to db if it is provided.
+func initPartyInfo(grpc bool, db storage.DataStore) *api.PartyInfo {
+	otherNodes := strings.Split(config.GetString(config.OtherNodes), ",")
 	url := config.GetString(config.Url)
 	if url == "" {
 		log.Fatalln("URL must be specified")
 	}
+	httpClient := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	strict := config.GetBool(config.StrictPartyInfo)
+
+	pi := api.InitPartyInfo(url, otherNodes, httpClient, grpc, strict, db)
+
+	peerFilter := api.PeerFilter{
+		AllowedUrls: splitList(config.GetString(config.AllowedPeers)),
+		AllowedKeys: splitList(config.GetString(config.AllowedKeys)),
+		DeniedUrls:  splitList(config.GetString(config.DeniedPeers)),
+		DeniedKeys:  splitList(config.GetString(config.DeniedKeys)),
+	}
+	if err := pi.SetPeerFilter(peerFilter); err != nil {
+		log.Fatalf("Invalid peer filter, error: %v", err)
+	}
+	return pi
+}
+
+// pollPartyInfo starts requesting party details from the other nodes at the configured interval.
+func pollPartyInfo(pi *api.PartyInfo) {
+	pollInterval := config.GetDuration(config.PollInterval)
+	if pollInterval <= 0 {
+		log.Fatalln("Party info poll interval must be positive")
+	}
+	pi.PollPartyInfo(pollInterval, config.GetDuration(config.PollJitter))
+}
+
+// startServer starts the transaction manager's servers, which handle requests using the enclave.
+func startServer(enc server.Enclave, workDir, ipcPath string, grpc bool) {
 	port := config.GetInt(config.Port)
 	if port < 0 {
 		log.Fatalln("Port must be specified")
 	}
-	httpClient := &http.Client{
-		Timeout: time.Second * 10,
+
+	tls := config.GetBool(config.Tls)
+	var tlsCertFile, tlsKeyFile string
+	if tls {
+		servCert := config.GetString(config.TlsServerCert)
+		servKey := config.GetString(config.TlsServerKey)
+
+		if (len(servCert) != len(servKey)) || (len(servCert) <= 0) {
+			log.Fatalf("Please provide server certificate and key for TLS %s %s %d ", servKey, servCert, len(servCert))
+		}
+
+		tlsCertFile = path.Join(workDir, servCert)
+		tlsKeyFile = path.Join(workDir, servKey)
 	}
-	grpc := config.GetBool(config.UseGRPC)
+	grpcJsonport := config.GetInt(config.GrpcJsonPort)
+	networkInterface := config.GetString(config.NetworkInterface)
+	deliveryPolicy := config.GetString(config.DeliveryPolicy)
+	_, err := server.Init(enc, networkInterface, port, ipcPath, grpc, grpcJsonport, tls, tlsCertFile, tlsKeyFile, deliveryPolicy)
+	if err != nil {
+		log.Fatalf("Error starting server: %v\n", err)
+	}
+}
 
-	pi := api.InitPartyInfo(url, otherNodes, httpClient, grpc)
+// retiredKeys provides the public keys of the configured key pairs which the operator has retired.
+// These key pairs are still provided, so that payloads exchanged with them can be decrypted.
+func retiredKeys() ([]nacl.Key, error) {
+	var pubKeys []nacl.Key
+	for _, encoded := range listSetting(config.RetiredKeys) {
+		pubKey, err := utils.LoadBase64Key(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retired public key %s, %v", encoded, err)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	return pubKeys, nil
+}
+
+// vaultTokenEnv is the environment variable which provides the token used to authenticate with
+// Vault.
+const vaultTokenEnv = "VAULT_TOKEN"
 
+// keyProvider provides the configured key pairs, which are read from Vault if a Vault server is
+// configured, or otherwise from key files.
+func keyProvider(workDir string) (enclave.KeyProvider, error) {
+	if vaultAddr := config.GetString(config.VaultAddr); vaultAddr != "" {
+		secrets := splitList(config.GetString(config.VaultSecrets))
+		if len(secrets) == 0 {
+			return nil, fmt.Errorf("the secrets holding key pairs must be provided with Vault")
+		}
+		return &enclave.VaultKeyProvider{
+			Addr:    vaultAddr,
+			Token:   os.Getenv(vaultTokenEnv),
+			Mount:   config.GetString(config.VaultMount),
+			Secrets: secrets,
+			Client:  http.DefaultClient,
+		}, nil
+	}
+
+	pubKeyFiles, privKeyFiles, err := keyFiles(workDir)
+	if err != nil {
+		return nil, err
+	}
+	passwords, err := loadPasswords(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load passwords, error: %v", err)
+	}
+	return &enclave.FileKeyProvider{
+		PubKeyFiles:  pubKeyFiles,
+		PrivKeyFiles: privKeyFiles,
+		Passwords:    passwords,
+	}, nil
+}
+
+// keyFiles provides the paths of the configured public and private key files, which are relative
+// to workDir.
+func keyFiles(workDir string) ([]string, []string, error) {
 	privKeys := config.GetString(config.PrivateKeys)
 	pubKeys := config.GetString(config.PublicKeys)
 	pubKeyFiles := strings.Split(pubKeys, ",")
 	privKeyFiles := strings.Split(privKeys, ",")
 
 	if len(privKeyFiles) != len(pubKeyFiles) {
-		log.Fatalln("Private keys provided must have corresponding public keys")
+		return nil, nil, fmt.Errorf("private keys provided must have corresponding public keys")
 	}
 
 	if len(privKeyFiles) == 0 {
-		log.Fatalln("Node key files must be provided")
+		return nil, nil, fmt.Errorf("node key files must be provided")
 	}
 
 	for i, keyFile := range privKeyFiles {
@@ -120,34 +331,357 @@ func main() {
 	for i, keyFile := range pubKeyFiles {
 		pubKeyFiles[i] = path.Join(workDir, keyFile)
 	}
+	return pubKeyFiles, privKeyFiles, nil
+}
 
-	enc := enclave.Init(db, pubKeyFiles, privKeyFiles, pi, http.DefaultClient, grpc)
+// reloadKeysOnHangup reloads the key pairs hosted by the node from the key files or Vault each
+// time a SIGHUP is received, re-reading the configuration file first if one was provided. Key pairs
+// no longer configured, or configured as retired, are retired. It never returns.
+func reloadKeysOnHangup(enc *enclave.SecureEnclave, configFile, workDir string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 
-	pi.RegisterPublicKeys(enc.PubKeys)
+	for range hangup {
+		log.Info("Reloading key pairs")
+		if configFile != "" {
+			if err := config.LoadConfig(configFile); err != nil {
+				log.Errorf("Unable to reload configuration file, error: %v", err)
+				continue
+			}
+		}
+		keys, err := keyProvider(workDir)
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+		retired, err := retiredKeys()
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+		if err = enc.ReloadKeys(keys, retired); err != nil {
+			log.Errorf("Unable to reload key pairs, error: %v", err)
+		}
+	}
+}
 
-	tls := config.GetBool(config.Tls)
-	var tlsCertFile, tlsKeyFile string
-	if tls {
-		servCert := config.GetString(config.TlsServerCert)
-		servKey := config.GetString(config.TlsServerKey)
+// openStorage opens the configured storage, which is either a URI of the form <scheme>:<path>, or
+// the name of a LevelDB database, or a Berkeley DB database if the berkeleydb flag is set. The path
+// is relative to workDir, and is empty for memory:.
+func openStorage(workDir string) (storage.DataStore, error) {
+	dbStorage := config.GetString(config.Storage)
+	scheme, dbPath, ok := storage.ParseURI(dbStorage)
+	if !ok {
+		scheme, dbPath = storage.LevelDbScheme, dbStorage
+		if config.GetBool(config.BerkeleyDb) {
+			scheme = storage.BerkeleyDbScheme
+		}
+	}
+	if dbPath != "" {
+		dbPath = path.Join(workDir, dbPath)
+	}
+	return storage.Open(scheme + ":" + dbPath)
+}
 
-		if (len(servCert) != len(servKey)) || (len(servCert) <= 0) {
-			log.Fatalf("Please provide server certificate and key for TLS %s %s %d ", servKey, servCert, len(servCert))
+// passwordsEnv is the environment variable which provides the passwords of locked private keys if
+// no passwords file is configured.
+const passwordsEnv = "CRUX_PASSWORDS"
+
+// loadPasswords provides the passwords of the private keys, in the same order, which are read one
+// per line from the passwords file, or otherwise the CRUX_PASSWORDS environment variable.
+func loadPasswords(workDir string) ([]string, error) {
+	passwords := os.Getenv(passwordsEnv)
+	if passwordsFile := config.GetString(config.Passwords); passwordsFile != "" {
+		src, err := ioutil.ReadFile(path.Join(workDir, passwordsFile))
+		if err != nil {
+			return nil, err
 		}
+		passwords = string(src)
+	}
+	if passwords == "" {
+		return nil, nil
+	}
 
-		tlsCertFile = path.Join(workDir, servCert)
-		tlsKeyFile = path.Join(workDir, servKey)
+	lines := strings.Split(strings.TrimRight(passwords, "\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
 	}
-	grpcJsonport := config.GetInt(config.GrpcJsonPort)
-	networkInterface := config.GetString(config.NetworkInterface)
-	_, err = server.Init(enc, networkInterface, port, ipcPath, grpc, grpcJsonport, tls, tlsCertFile, tlsKeyFile)
+	return lines, nil
+}
+
+// openNodeStorage opens the configured storage, which is encrypted if a storage key is provided.
+// Storage which is not encrypted with the storage keys provided, if any, is rejected.
+func openNodeStorage(workDir string) (storage.DataStore, error) {
+	storageKey, previousKeys, err := loadStorageKeys(workDir)
 	if err != nil {
-		log.Fatalf("Error starting server: %v\n", err)
+		return nil, fmt.Errorf("unable to load storage keys, %v", err)
+	}
+	db, err := openStorage(workDir)
+	if err != nil {
+		return nil, err
+	}
+	if storageKey == nil {
+		encrypted, err := storage.IsEncrypted(db)
+		if err == nil && encrypted {
+			err = fmt.Errorf("storage is encrypted, but no storage key is configured")
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return db, nil
+	}
+
+	encryptedDb, err := storage.OpenEncryptedDb(db, storageKey, previousKeys...)
+	if err == storage.ErrStorageKeyMismatch {
+		err = fmt.Errorf("storage is not encrypted with the configured storage keys, " +
+			"unencrypted storage can be encrypted using the migrate command")
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return encryptedDb, nil
+}
+
+// loadStorageKeys loads the keys which storage is encrypted with, which are relative to workDir.
+// No key is provided if storage is not encrypted.
+func loadStorageKeys(workDir string) (nacl.Key, []nacl.Key, error) {
+	keyFile := config.GetString(config.StorageKey)
+	previousFiles := splitList(config.GetString(config.PreviousStorageKeys))
+	if keyFile == "" {
+		if len(previousFiles) > 0 {
+			return nil, nil, fmt.Errorf("previous storage keys require a storage key")
+		}
+		return nil, nil, nil
 	}
 
-	pi.PollPartyInfo()
+	key, err := storage.LoadStorageKey(path.Join(workDir, keyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var previous []nacl.Key
+	for _, previousFile := range previousFiles {
+		previousKey, err := storage.LoadStorageKey(path.Join(workDir, previousFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		previous = append(previous, previousKey)
+	}
+	return key, previous, nil
+}
+
+// doRekey rewrites the records in storage encrypted with a previous storage key using the current
+// storage key.
+func doRekey() {
+	workDir := config.GetString(config.WorkDir)
+	storageKey, previousKeys, err := loadStorageKeys(workDir)
+	if err != nil {
+		log.Fatalf("Unable to load storage keys, error: %v", err)
+	}
+	if storageKey == nil || len(previousKeys) == 0 {
+		log.Fatalln("Storage key and previous storage keys must be specified")
+	}
+
+	db, err := openStorage(workDir)
+	if err != nil {
+		log.Fatalf("Unable to initialise storage, error: %v", err)
+	}
+	defer db.Close()
+
+	encryptedDb, err := storage.OpenEncryptedDb(db, storageKey, previousKeys...)
+	if err != nil {
+		log.Fatalf("Unable to open encrypted storage, error: %v", err)
+	}
+	count, err := encryptedDb.Rekey()
+	fmt.Printf("Rewrote %d records with the current storage key\n", count)
+	if err != nil {
+		log.Fatalf("Rekey incomplete, it can be run again to resume, error: %v", err)
+	}
+}
+
+// doBackup writes a backup archive of the node's storage, requesting it from the node if it is
+// running.
+func doBackup() {
+	archivePath := config.GetString(config.Archive)
+	if archivePath == "" {
+		log.Fatalln("Archive to write the backup to must be specified")
+	}
+
+	archive, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("Unable to create archive, error: %v", err)
+	}
+
+	// Storage is locked by a running node, so the archive is requested from it instead
+	workDir := config.GetString(config.WorkDir)
+	ipcPath := path.Join(workDir, config.GetString(config.Socket))
+	if conn, err := net.Dial("unix", ipcPath); err == nil {
+		conn.Close()
+		err = server.DownloadBackup(ipcPath, config.GetBool(config.UseGRPC), archive)
+		closeArchive(archive, archivePath, err)
+		fmt.Printf("Wrote backup of the running node to %s\n", archivePath)
+		return
+	}
+
+	db, err := openNodeStorage(workDir)
+	if err != nil {
+		archive.Close()
+		os.Remove(archivePath)
+		log.Fatalf("Unable to initialise storage, error: %v", err)
+	}
+	defer db.Close()
+
+	manifest, err := enclave.Backup(db, archive)
+	closeArchive(archive, archivePath, err)
+	fmt.Printf("Wrote %d payloads and %d other records to %s\n",
+		manifest.Payloads, manifest.Records, archivePath)
+}
 
-	select {}
+// closeArchive closes the archive written by a backup, removing it if the backup failed.
+func closeArchive(archive *os.File, archivePath string, err error) {
+	if err == nil {
+		err = archive.Close()
+	} else {
+		archive.Close()
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		log.Fatalf("Unable to write backup, error: %v", err)
+	}
+}
+
+// doRestore verifies a backup archive, and then restores it to the node's storage, which must be
+// empty.
+func doRestore() {
+	archivePath := config.GetString(config.Archive)
+	if archivePath == "" {
+		log.Fatalln("Archive to restore from must be specified")
+	}
+
+	db, err := openNodeStorage(config.GetString(config.WorkDir))
+	if err != nil {
+		log.Fatalf("Unable to initialise storage, error: %v", err)
+	}
+	defer db.Close()
+
+	// The archive is verified in full before any records are written
+	manifest, err := readArchive(archivePath, func(r io.Reader) (api.BackupManifest, error) {
+		r, err := enclave.OpenBackup(r, db)
+		if err != nil {
+			return api.BackupManifest{}, err
+		}
+		return enclave.VerifyBackup(r)
+	})
+	if err != nil {
+		log.Fatalf("Unable to verify archive, error: %v", err)
+	}
+
+	_, err = readArchive(archivePath, func(r io.Reader) (api.BackupManifest, error) {
+		return enclave.Restore(r, db)
+	})
+	if err != nil {
+		log.Fatalf("Unable to restore archive, error: %v", err)
+	}
+	fmt.Printf("Restored %d payloads and %d other records from backup created %s\n",
+		manifest.Payloads, manifest.Records, manifest.Created)
+}
+
+// readArchive invokes read with the contents of the archive at archivePath.
+func readArchive(
+	archivePath string, read func(r io.Reader) (api.BackupManifest, error)) (api.BackupManifest, error) {
+
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return api.BackupManifest{}, err
+	}
+	defer archive.Close()
+	return read(archive)
+}
+
+// doMigration copies the payloads between the data stores provided.
+func doMigration() {
+	from := config.GetString(config.MigrateFrom)
+	to := config.GetString(config.MigrateTo)
+	if from == "" || to == "" {
+		log.Fatalln("Storage to migrate from and to must be specified")
+	}
+
+	src, err := storage.Open(from)
+	if err != nil {
+		log.Fatalf("Unable to open storage to migrate from, error: %v", err)
+	}
+	defer src.Close()
+
+	dest, err := storage.Open(to)
+	if err != nil {
+		log.Fatalf("Unable to open storage to migrate to, error: %v", err)
+	}
+	defer dest.Close()
+
+	// The source is read with the storage keys if it is encrypted, and the destination is
+	// encrypted if a storage key is provided
+	storageKey, previousKeys, err := loadStorageKeys(config.GetString(config.WorkDir))
+	if err != nil {
+		log.Fatalf("Unable to load storage keys, error: %v", err)
+	}
+	encrypted, err := storage.IsEncrypted(src)
+	if err != nil {
+		log.Fatalf("Unable to read storage to migrate from, error: %v", err)
+	}
+	if encrypted {
+		if storageKey == nil {
+			log.Fatalln("Storage to migrate from is encrypted, but no storage key is configured")
+		}
+		if src, err = storage.OpenEncryptedDb(src, storageKey, previousKeys...); err != nil {
+			log.Fatalf("Unable to open storage to migrate from, error: %v", err)
+		}
+	}
+	if storageKey != nil {
+		if dest, err = storage.OpenEncryptedDb(dest, storageKey, previousKeys...); err != nil {
+			log.Fatalf("Unable to open storage to migrate to, error: %v", err)
+		}
+	}
+
+	stats, err := enclave.Migrate(src, dest, config.GetBool(config.Reencode))
+	fmt.Printf("Migrated %s to %s: %s\n", from, to, stats)
+	if err != nil {
+		log.Fatalf("Migration incomplete, it can be run again to resume, error: %v", err)
+	}
+}
+
+// retentionPolicy provides the configured policy determining which payloads are removed.
+func retentionPolicy() (enclave.RetentionPolicy, error) {
+	policy := enclave.RetentionPolicy{
+		MaxAge:  config.GetDuration(config.RetentionPeriod),
+		MaxSize: int64(config.GetInt(config.RetentionMaxSize)),
+	}
+	if policy.MaxAge < 0 || policy.MaxSize < 0 {
+		return policy, fmt.Errorf("retention period and maximum size must not be negative")
+	}
+	err := policy.ParseRules(splitList(config.GetString(config.RetentionRules)))
+	return policy, err
+}
+
+// splitList splits a comma separated list of values, ignoring empty values.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// listSetting provides the values of a setting given either as a list in the configuration file, or
+// as a comma separated list.
+func listSetting(key string) []string {
+	var values []string
+	for _, value := range config.GetStringSlice(key) {
+		values = append(values, splitList(value)...)
+	}
+	return values
 }
 
 func exit() {
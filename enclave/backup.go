@@ -0,0 +1,314 @@
+package enclave
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"golang.org/x/crypto/sha3"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// backupVersion is the version of the archive format written by Backup.
+const backupVersion = 1
+
+// Names of the entries of a backup archive. Payloads and other records are named by their hex
+// encoded keys, following their prefix, and the manifest is the final entry.
+const (
+	backupPayloadPrefix = "payloads/"
+	backupRecordPrefix  = "records/"
+	backupPartyInfo     = "partyinfo"
+	backupManifest      = "manifest.json"
+)
+
+// restoreBatchSize is the number of records written to storage at a time when restoring.
+const restoreBatchSize = 1000
+
+// Backup writes a gzip compressed tar archive of every record in db to w, followed by a manifest
+// describing them. If db supports snapshots, the archive is a snapshot of db at the time Backup
+// is called, so records can continue to be written while it is created. If db is encrypted, the
+// archive is sealed with its storage key.
+func Backup(db storage.DataStore, w io.Writer) (api.BackupManifest, error) {
+	snapshot, consistent, err := storage.NewSnapshot(db)
+	if err != nil {
+		return api.BackupManifest{}, err
+	}
+	defer snapshot.Release()
+
+	var sealed io.WriteCloser
+	if sealer, ok := db.(storage.StreamSealer); ok {
+		sealed = sealer.SealStream(w)
+		w = sealed
+	}
+
+	manifest := api.BackupManifest{
+		Version:    backupVersion,
+		Created:    time.Now().UTC(),
+		Consistent: consistent,
+		Digests:    []string{},
+	}
+	gz := gzip.NewWriter(w)
+	archive := &backupWriter{tw: tar.NewWriter(gz), checksum: sha3.New512(), created: manifest.Created}
+
+	iter := snapshot.NewIterator(nil)
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		switch {
+		case bytes.Equal(key, api.PartyInfoKey):
+			manifest.PartyInfo = true
+			err = archive.writeEntry(backupPartyInfo, value)
+		case isValidPayload(key, value):
+			manifest.Payloads += 1
+			manifest.Digests = append(manifest.Digests, base64.StdEncoding.EncodeToString(key))
+			err = archive.writeEntry(backupPayloadPrefix+hex.EncodeToString(key), value)
+		default:
+			manifest.Records += 1
+			err = archive.writeEntry(backupRecordPrefix+hex.EncodeToString(key), value)
+		}
+		if err != nil {
+			break
+		}
+	}
+	iter.Release()
+	if err == nil {
+		err = iter.Error()
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	manifest.Checksum = hex.EncodeToString(archive.checksum.Sum(nil))
+	encoded, err := json.Marshal(manifest)
+	if err == nil {
+		err = archive.writeEntry(backupManifest, encoded)
+	}
+	if err == nil {
+		err = archive.tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil && sealed != nil {
+		err = sealed.Close()
+	}
+	return manifest, err
+}
+
+// OpenBackup provides a reader of the archive written by Backup from r, opening it with the
+// storage keys of db if it is sealed.
+func OpenBackup(r io.Reader, db storage.DataStore) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(len(storage.SealedStreamHeader))
+	if !bytes.Equal(header, storage.SealedStreamHeader) {
+		return br, nil
+	}
+	sealer, ok := db.(storage.StreamSealer)
+	if !ok {
+		return nil, fmt.Errorf("archive is sealed with a storage key, which must be provided")
+	}
+	return sealer.OpenStream(br)
+}
+
+// isValidPayload reports whether the record is a payload keyed by its digest. Invalid payloads
+// are archived as other records, so that they are restored without being verified.
+func isValidPayload(key, value []byte) bool {
+	if !isPayloadKey(key) {
+		return false
+	}
+	_, _, err := migratePayload(key, value, false)
+	return err == nil
+}
+
+type backupWriter struct {
+	tw       *tar.Writer
+	checksum hash.Hash
+	created  time.Time
+}
+
+func (w *backupWriter) writeEntry(name string, content []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: w.created,
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if name != backupManifest {
+		writeChecksum(w.checksum, name, content)
+	}
+	_, err := w.tw.Write(content)
+	return err
+}
+
+// writeChecksum adds the entry to the checksum, prefixing both its name and content with their
+// lengths so that entries cannot be confused with one another.
+func writeChecksum(checksum hash.Hash, name string, content []byte) {
+	fmt.Fprintf(checksum, "%d:%s%d:", len(name), name, len(content))
+	checksum.Write(content)
+}
+
+// VerifyBackup reads the archive written by Backup from r, verifying its contents against its
+// manifest, and that each payload is keyed by its digest.
+func VerifyBackup(r io.Reader) (api.BackupManifest, error) {
+	return readBackup(r, func(key, value []byte) error {
+		return nil
+	})
+}
+
+// Restore writes the records of the archive written by Backup from r to db, which must be empty.
+// The archive is verified as it is read, and records are written before the manifest is reached,
+// so it should first be verified with VerifyBackup. Sealed archives are opened with the storage
+// keys of db.
+func Restore(r io.Reader, db storage.DataStore) (api.BackupManifest, error) {
+	r, err := OpenBackup(r, db)
+	if err != nil {
+		return api.BackupManifest{}, err
+	}
+
+	empty := true
+	err = storage.ReadRange(db, nil, func(key, value []byte) bool {
+		empty = false
+		return false
+	})
+	if err != nil {
+		return api.BackupManifest{}, err
+	}
+	if !empty {
+		return api.BackupManifest{}, fmt.Errorf("storage to restore to must be empty")
+	}
+
+	if store, ok := db.(storage.MetadataStore); ok {
+		store.SetDescriber(describePayload)
+	}
+	batch := new(storage.Batch)
+	manifest, err := readBackup(r, func(key, value []byte) error {
+		batch.Write(&key, &value)
+		if batch.Len() < restoreBatchSize {
+			return nil
+		}
+		err := db.WriteBatch(batch)
+		batch.Reset()
+		return err
+	})
+	if err == nil && batch.Len() > 0 {
+		err = db.WriteBatch(batch)
+	}
+	return manifest, err
+}
+
+// readBackup invokes f with each record of the archive, verifying the archive against its
+// manifest once it is reached.
+func readBackup(r io.Reader, f func(key, value []byte) error) (api.BackupManifest, error) {
+	var manifest api.BackupManifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	checksum := sha3.New512()
+	var payloads, records int
+	var partyInfo bool
+	var digests []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return manifest, fmt.Errorf("archive is incomplete, as it has no manifest")
+		} else if err != nil {
+			return manifest, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return manifest, err
+		}
+
+		var key []byte
+		name := header.Name
+		switch {
+		case name == backupManifest:
+			if err = json.Unmarshal(content, &manifest); err != nil {
+				return manifest, fmt.Errorf("invalid manifest, %v", err)
+			}
+			if _, err = tr.Next(); err != io.EOF {
+				return manifest, fmt.Errorf("archive has entries following its manifest")
+			}
+			return manifest, verifyManifest(manifest, api.BackupManifest{
+				Version:   backupVersion,
+				Payloads:  payloads,
+				Records:   records,
+				PartyInfo: partyInfo,
+				Digests:   digests,
+				Checksum:  hex.EncodeToString(checksum.Sum(nil)),
+			})
+		case name == backupPartyInfo:
+			partyInfo = true
+			key = api.PartyInfoKey
+		case strings.HasPrefix(name, backupPayloadPrefix):
+			if key, err = hex.DecodeString(name[len(backupPayloadPrefix):]); err != nil {
+				return manifest, fmt.Errorf("invalid entry %s in archive", name)
+			}
+			if _, _, err = migratePayload(key, content, false); err != nil {
+				return manifest, fmt.Errorf("invalid payload %s in archive, %v", name, err)
+			}
+			payloads += 1
+			digests = append(digests, base64.StdEncoding.EncodeToString(key))
+		case strings.HasPrefix(name, backupRecordPrefix):
+			if key, err = hex.DecodeString(name[len(backupRecordPrefix):]); err != nil {
+				return manifest, fmt.Errorf("invalid entry %s in archive", name)
+			}
+			records += 1
+		default:
+			return manifest, fmt.Errorf("unknown entry %s in archive", name)
+		}
+
+		writeChecksum(checksum, name, content)
+		if err = f(append([]byte{}, key...), content); err != nil {
+			return manifest, err
+		}
+	}
+}
+
+// verifyManifest verifies that the manifest of an archive describes the contents read from it.
+func verifyManifest(manifest, read api.BackupManifest) error {
+	if manifest.Version != read.Version {
+		return fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if manifest.Payloads != read.Payloads || manifest.Records != read.Records ||
+		manifest.PartyInfo != read.PartyInfo {
+		return fmt.Errorf("archive contains %d payloads, %d records and party info: %t, "+
+			"whereas its manifest lists %d payloads, %d records and party info: %t",
+			read.Payloads, read.Records, read.PartyInfo,
+			manifest.Payloads, manifest.Records, manifest.PartyInfo)
+	}
+	if len(manifest.Digests) != len(read.Digests) {
+		return fmt.Errorf("archive contains %d payload digests whereas its manifest lists %d",
+			len(read.Digests), len(manifest.Digests))
+	}
+	for i, digest := range read.Digests {
+		if manifest.Digests[i] != digest {
+			return fmt.Errorf("payload %s in archive is not listed in its manifest", digest)
+		}
+	}
+	if manifest.Checksum != read.Checksum {
+		return fmt.Errorf("archive checksum %s does not match its manifest", read.Checksum)
+	}
+	return nil
+}
+
+// Backup writes an archive of the SecureEnclave's store to w, as described by Backup.
+func (s *SecureEnclave) Backup(w io.Writer) (api.BackupManifest, error) {
+	return Backup(s.Db, w)
+}
@@ -0,0 +1,172 @@
+package enclave
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/crypto/sha3"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	mockClient := &MockClient{}
+	mockClient.setUnavailable(true)
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partyInfo := []byte("party info")
+	if err = enc.Db.Write(&api.PartyInfoKey, &partyInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := enc.Backup(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Consistent || manifest.Payloads != 1 || !manifest.PartyInfo {
+		t.Errorf("Unexpected backup manifest %v", manifest)
+	}
+
+	// Payloads stored once the backup has started are not included
+	if _, err = enc.Store(&message, []byte{}, [][]byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := VerifyBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Checksum != manifest.Checksum || verified.Digests[0] != manifest.Digests[0] {
+		t.Errorf("Verified manifest %v does not match %v", verified, manifest)
+	}
+
+	dest := storage.InitMemoryDb()
+	if _, err = Restore(bytes.NewReader(archive.Bytes()), dest); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored store holds every record of the original, other than those written later
+	var restored int
+	err = storage.ReadRange(dest, nil, func(key, value []byte) bool {
+		restored += 1
+		original, err := enc.Db.Read(&key)
+		if err != nil || !bytes.Equal(*original, value) {
+			t.Errorf("Restored record %q does not match the original", key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != manifest.Payloads+manifest.Records+1 {
+		t.Errorf("%d records restored whereas the manifest lists %d payloads and %d records",
+			restored, manifest.Payloads, manifest.Records)
+	}
+
+	restoredEnc, _ := initOutboxEnclave(t, dest, mockClient)
+	if _, err = restoredEnc.RetrieveDefault(&digest); err != nil {
+		t.Errorf("Unable to retrieve restored payload, error: %v", err)
+	}
+
+	if _, err = Restore(bytes.NewReader(archive.Bytes()), dest); err == nil {
+		t.Error("Archive restored to storage which is not empty")
+	}
+}
+
+func TestBackupEncrypted(t *testing.T) {
+	mockClient := &MockClient{}
+	mockClient.setUnavailable(true)
+	key := nacl.NewKey()
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitEncryptedDb(storage.InitMemoryDb(), key), mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if _, err = enc.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(archive.Bytes(), storage.SealedStreamHeader) {
+		t.Error("Backup of encrypted storage should be sealed")
+	}
+
+	if _, err = Restore(bytes.NewReader(archive.Bytes()), storage.InitMemoryDb()); err == nil {
+		t.Error("Sealed archive restored without the storage key")
+	}
+	wrongKey := storage.InitEncryptedDb(storage.InitMemoryDb(), nacl.NewKey())
+	if _, err = Restore(bytes.NewReader(archive.Bytes()), wrongKey); err == nil {
+		t.Error("Sealed archive restored with the wrong storage key")
+	}
+
+	dest := storage.InitEncryptedDb(storage.InitMemoryDb(), key)
+	r, err := OpenBackup(bytes.NewReader(archive.Bytes()), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = VerifyBackup(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Restore(bytes.NewReader(archive.Bytes()), dest); err != nil {
+		t.Fatal(err)
+	}
+	restoredEnc, _ := initOutboxEnclave(t, dest, mockClient)
+	if _, err = restoredEnc.RetrieveDefault(&digest); err != nil {
+		t.Errorf("Unable to retrieve restored payload, error: %v", err)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	enc := initDefaultEnclave(storage.InitMemoryDb())
+	if _, err := enc.Store(&message, []byte{}, [][]byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := enc.Backup(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := archive.Bytes()[:archive.Len()/2]
+	if _, err = VerifyBackup(bytes.NewReader(truncated)); err == nil {
+		t.Error("Truncated archive verified")
+	}
+
+	tampered := manifest
+	tampered.Payloads += 1
+	if _, err = VerifyBackup(bytes.NewReader(writeTestArchive(t, tampered))); err == nil {
+		t.Error("Archive whose manifest lists a missing payload verified")
+	}
+}
+
+// writeTestArchive writes an archive containing only the manifest provided.
+func writeTestArchive(t *testing.T, manifest api.BackupManifest) []byte {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	w := &backupWriter{tw: tar.NewWriter(gz), checksum: sha3.New512()}
+
+	encoded, err := json.Marshal(manifest)
+	if err == nil {
+		err = w.writeEntry(backupManifest, encoded)
+	}
+	if err == nil {
+		err = w.tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
@@ -17,50 +17,98 @@ import (
 	"github.com/kevinburke/nacl/secretbox"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // SecureEnclave is the secure transaction enclave.
 type SecureEnclave struct {
-	Db         storage.DataStore                  // The underlying key-value datastore for encrypted transactions
-	PubKeys    []nacl.Key                         // Public keys associated with this enclave
-	PrivKeys   []nacl.Key                         // Private keys associated with this enclave
-	selfPubKey nacl.Key                           // An ephemeral key used for transactions only intended for this enclave
-	PartyInfo  api.PartyInfo                      // Details of all other nodes (or parties) on the network
-	keyCache   map[nacl.Key]map[nacl.Key]nacl.Key // Maps sender -> recipient -> shared key
-	client     utils.HttpClient                   // The underlying HTTP client used to propagate requests
-	grpc       bool
+	Db          storage.DataStore                                      // The underlying key-value datastore for encrypted transactions
+	PubKeys     []nacl.Key                                             // Public keys associated with this enclave
+	PrivKeys    []nacl.Key                                             // Private keys associated with this enclave
+	PartyInfo   *api.PartyInfo                                         // Details of all other nodes (or parties) on the network, if held by the enclave
+	index       *storage.RecipientIndex                                // Maps recipients to the payloads addressed to them
+	keyCache    map[[nacl.KeySize]byte]map[[nacl.KeySize]byte]nacl.Key // Maps sender -> recipient -> shared key
+	publisher   Publisher                                              // Pushes payloads to the nodes of their recipients
+	outboxMu    sync.Mutex
+	pending     map[string]bool // Outbox keys of deliveries awaiting acknowledgement
+	resendMu    sync.Mutex
+	resendJobs  map[string]*resendJob           // Resend jobs by ID
+	keysMu      sync.RWMutex                    // Guards PubKeys, PrivKeys, retired, keyCache and alwaysSend
+	keyOpsMu    sync.Mutex                      // Serialises adding and retiring key pairs
+	retired     map[[nacl.KeySize]byte]nacl.Key // Private keys of retired key pairs, or nil if not provided
+	alwaysSend  [][]byte                        // Recipients added to every payload stored
+	retentionMu sync.Mutex
+	retention   RetentionPolicy // Policy applied by the retention sweeper
+	quit        chan struct{}
 }
 
-// Init creates a new instance of the SecureEnclave.
+// selfKeyContext separates the derivation of self addressed keys from any other use of the
+// private key material.
+const selfKeyContext = "crux-self-recipient"
+
+// Publisher pushes payloads to the nodes hosting their recipients.
+type Publisher interface {
+	Publish(epl api.EncryptedPayload, recipient nacl.Key) error
+}
+
+// partyPublisher pushes payloads to the nodes listed in the party details held by the enclave.
+type partyPublisher struct {
+	pi     *api.PartyInfo
+	client utils.HttpClient // The underlying HTTP client used to propagate requests
+}
+
+func (p partyPublisher) Publish(epl api.EncryptedPayload, recipient nacl.Key) error {
+	return p.pi.PushPayload(epl, recipient, p.client)
+}
+
+// Init creates a new instance of the SecureEnclave, hosting the key pairs provided by keys, which
+// pushes payloads to the nodes listed in the party details pi using client.
 func Init(
 	db storage.DataStore,
-	pubKeyFiles, privKeyFiles []string,
-	pi api.PartyInfo,
-	client utils.HttpClient, grpc bool) *SecureEnclave {
+	keys KeyProvider,
+	pi *api.PartyInfo,
+	client utils.HttpClient) *SecureEnclave {
 
-	// Key format:
-	// BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo=
-	pubKeys, err := loadPubKeys(pubKeyFiles)
-	if err != nil {
-		log.Fatalf("Unable to load public key files: %s, error: %v", pubKeyFiles, err)
-	}
+	return newEnclave(db, keys, pi, partyPublisher{pi: pi, client: client})
+}
 
-	// Key format:
-	// {"data":{"bytes":"Wl+xSyXVuuqzpvznOS7dOobhcn4C5auxkFRi7yLtgtA="},"type":"unlocked"}
-	privKeys, err := loadPrivKeys(privKeyFiles)
+// InitStandalone creates a new instance of the SecureEnclave, hosting the key pairs provided by
+// keys, for a transaction manager running in another process. The enclave holds no party details,
+// so it only seals and opens payloads, leaving publisher to push them via the transaction manager,
+// which also checks the senders of payloads pushed to this node.
+func InitStandalone(db storage.DataStore, keys KeyProvider, publisher Publisher) *SecureEnclave {
+	return newEnclave(db, keys, nil, publisher)
+}
+
+func newEnclave(
+	db storage.DataStore,
+	keys KeyProvider,
+	pi *api.PartyInfo,
+	publisher Publisher) *SecureEnclave {
+
+	pubKeys, privKeys, err := keys.Keys()
 	if err != nil {
-		log.Fatalf("Unable to load private key files: %s, error: %v", privKeyFiles, err)
+		log.Fatalf("Unable to load key pairs, error: %v", err)
+	}
+	if len(pubKeys) == 0 {
+		log.Fatalln("At least one key pair must be provided")
 	}
 
 	enc := SecureEnclave{
-		Db:        db,
-		PubKeys:   pubKeys,
-		PrivKeys:  privKeys,
-		PartyInfo: pi,
-		client:    client,
-		grpc:      grpc,
+		Db:         db,
+		PubKeys:    pubKeys,
+		PrivKeys:   privKeys,
+		PartyInfo:  pi,
+		index:      storage.NewRecipientIndex(db),
+		publisher:  publisher,
+		pending:    make(map[string]bool),
+		resendJobs: make(map[string]*resendJob),
+		retired:    make(map[[nacl.KeySize]byte]nacl.Key),
+		quit:       make(chan struct{}),
 	}
 
 	// We use shared keys for encrypting data. The keys between a specific sender and recipient are
@@ -70,6 +118,7 @@ func Init(
 	// The sender value must always be a public key that we have the corresponding private key for
 	// privateFor: [] => 	encrypt with sharedKey [self-private, selfPub-public]
 	// 		store in cache as (self-public, selfPub-public)
+	//      where selfPub is derived from self-private, see deriveSelfKey
 	// privateFor: [recipient1, ...] => encrypt with sharedKey1 [self-private, recipient1-public], ...
 	//     store in cache as (self-public, recipient1-public)
 	// Decrypt scenarios:
@@ -83,21 +132,37 @@ func Init(
 	// Note that sharedKey(privA, pubB) produces the same key as sharedKey(pubA, privB), which is
 	// why when sending to ones self we encrypt with sharedKey [self-private, selfPub-public], then
 	// retrieve with sharedKey [self-private, selfPub-public]
-	enc.keyCache = make(map[nacl.Key]map[nacl.Key]nacl.Key)
+	enc.keyCache = make(map[[nacl.KeySize]byte]map[[nacl.KeySize]byte]nacl.Key)
 
-	enc.selfPubKey = nacl.NewKey()
-
-	for _, pubKey := range enc.PubKeys {
-		enc.keyCache[pubKey] = make(map[nacl.Key]nacl.Key)
+	// Key pairs retired when the node last ran are not used for new payloads
+	if err = enc.loadRetiredKeys(); err != nil {
+		log.Fatalf("Unable to load retired key pairs, error: %v", err)
+	}
 
-		// We have a once off generated key which we use for storing payloads which are addressed
-		// only to ourselves. We have to do this, as we cannot use box.Seal with a public and
-		// private key-pair.
+	for i, pubKey := range enc.PubKeys {
+		// We have a key derived from each private key which we use for storing payloads which
+		// are addressed only to ourselves. We have to do this, as we cannot use box.Seal with a
+		// public and private key-pair.
 		//
 		// We pre-compute these keys on startup.
-		enc.resolveSharedKey(enc.PrivKeys[0], pubKey, enc.selfPubKey)
+		enc.resolveSharedKey(enc.PrivKeys[i], pubKey, deriveSelfKey(enc.PrivKeys[i]))
+	}
+
+	if store, ok := db.(storage.MetadataStore); ok {
+		store.SetDescriber(describePayload)
 	}
 
+	err = enc.buildIndex()
+	if err != nil {
+		log.Errorf("Unable to build recipient index, error: %v", err)
+	}
+
+	err = enc.loadOutbox()
+	if err != nil {
+		log.Errorf("Unable to load outbox, error: %v", err)
+	}
+	go enc.processOutbox()
+
 	return &enc
 }
 
@@ -113,8 +178,7 @@ func (s *SecureEnclave) Store(
 
 	if len(sender) == 0 {
 		// from address is either default or specified on communication
-		senderPubKey = s.PubKeys[0]
-		senderPrivKey = s.PrivKeys[0]
+		senderPubKey, senderPrivKey = s.defaultKeyPair()
 	} else {
 		senderPubKey, err = utils.ToKey(sender)
 		if err != nil {
@@ -123,7 +187,8 @@ func (s *SecureEnclave) Store(
 			return nil, err
 		}
 
-		senderPrivKey, err = s.resolvePrivateKey(senderPubKey)
+		// Retired keys cannot be used to send new payloads
+		senderPrivKey, err = s.resolvePrivateKey(senderPubKey, false)
 		if err != nil {
 			log.WithField("senderPubKey", sender).Errorf(
 				"Unable to locate private key for sender public key, %v", err)
@@ -131,7 +196,67 @@ func (s *SecureEnclave) Store(
 		}
 	}
 
-	return s.store(message, senderPubKey, senderPrivKey, recipients)
+	return s.store(message, senderPubKey, senderPrivKey, s.withAlwaysSendTo(senderPubKey, recipients))
+}
+
+// SetAlwaysSendTo sets the public keys which every payload stored is also encrypted for and pushed
+// to, in addition to its explicit recipients. Each key is either the path of a public key file, as
+// Constellation expects, or a base64 encoded public key.
+func (s *SecureEnclave) SetAlwaysSendTo(pubKeys []string) error {
+	var recipients [][]byte
+	for _, pubKey := range pubKeys {
+		key, err := loadAlwaysSendToKey(pubKey)
+		if err != nil {
+			return fmt.Errorf("invalid public key %s, %v", pubKey, err)
+		}
+		recipients = appendRecipient(recipients, (*key)[:])
+	}
+
+	s.keysMu.Lock()
+	s.alwaysSend = recipients
+	s.keysMu.Unlock()
+	return nil
+}
+
+// loadAlwaysSendToKey loads the public key from the file at pubKey if one exists, otherwise it is
+// decoded as a base64 encoded key.
+func loadAlwaysSendToKey(pubKey string) (nacl.Key, error) {
+	if info, err := os.Stat(pubKey); err == nil && info.Mode().IsRegular() {
+		keys, err := loadPubKeys([]string{pubKey})
+		if err != nil {
+			return nil, err
+		}
+		return keys[0], nil
+	}
+	return utils.LoadBase64Key(pubKey)
+}
+
+// withAlwaysSendTo adds the recipients of every payload to those of a payload from sender,
+// omitting any which are already recipients or are the sender itself.
+func (s *SecureEnclave) withAlwaysSendTo(sender nacl.Key, recipients [][]byte) [][]byte {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	if len(s.alwaysSend) == 0 {
+		return recipients
+	}
+	combined := append([][]byte{}, recipients...)
+	for _, recipient := range s.alwaysSend {
+		if !bytes.Equal(recipient, (*sender)[:]) {
+			combined = appendRecipient(combined, recipient)
+		}
+	}
+	return combined
+}
+
+// appendRecipient appends recipient to recipients unless it is already present.
+func appendRecipient(recipients [][]byte, recipient []byte) [][]byte {
+	for _, existing := range recipients {
+		if bytes.Equal(existing, recipient) {
+			return recipients
+		}
+	}
+	return append(recipients, recipient)
 }
 
 func (s *SecureEnclave) store(
@@ -139,10 +264,15 @@ func (s *SecureEnclave) store(
 	senderPubKey, senderPrivKey nacl.Key,
 	recipients [][]byte) ([]byte, error) {
 
+	recipients, err := filterRecipients(senderPubKey, recipients)
+	if err != nil {
+		return nil, err
+	}
+
 	var toSelf bool
 	if len(recipients) == 0 {
 		toSelf = true
-		recipients = [][]byte{(*s.selfPubKey)[:]}
+		recipients = [][]byte{(*deriveSelfKey(senderPrivKey))[:]}
 	} else {
 		toSelf = false
 	}
@@ -150,21 +280,7 @@ func (s *SecureEnclave) store(
 	epl, masterKey := createEncryptedPayload(message, senderPubKey, recipients)
 
 	for i, recipient := range recipients {
-
-		recipientKey, err := utils.ToKey(recipient)
-		if err != nil {
-			log.WithField("recipientKey", recipientKey).Errorf(
-				"Unable to load recipient, %v", err)
-			continue
-		}
-
-		// TODO: We may choose to loosen this check
-		if bytes.Equal((*recipientKey)[:], (*senderPubKey)[:]) {
-			log.WithField("recipientKey", recipientKey).Errorf(
-				"Sender cannot be recipient, %v", err)
-			continue
-		}
-
+		recipientKey, _ := utils.ToKey(recipient)
 		sharedKey := s.resolveSharedKey(senderPrivKey, senderPubKey, recipientKey)
 		sealedBox := sealPayload(epl.RecipientNonce, masterKey, sharedKey)
 
@@ -172,27 +288,76 @@ func (s *SecureEnclave) store(
 	}
 
 	encodedEpl := api.EncodePayloadWithRecipients(epl, recipients)
-	digest, err := s.storePayload(epl, encodedEpl)
+	digest, batch := s.payloadBatch(epl, recipients, encodedEpl)
 
+	// The outbox records are written with the payload, so no delivery can be lost
+	var deliveries []*delivery
 	if !toSelf {
-		for i, recipient := range recipients {
-			recipientEpl := api.EncryptedPayload{
-				Sender:         senderPubKey,
-				CipherText:     epl.CipherText,
-				Nonce:          epl.Nonce,
-				RecipientBoxes: [][]byte{epl.RecipientBoxes[i]},
-				RecipientNonce: epl.RecipientNonce,
+		for _, recipient := range recipients {
+			d, err := enqueueDelivery(batch, digest, recipient)
+			if err != nil {
+				return nil, err
 			}
+			deliveries = append(deliveries, d)
+		}
+	}
+	if err := s.Db.WriteBatch(batch); err != nil {
+		return nil, err
+	}
+
+	for i, d := range deliveries {
+		recipientEpl := api.EncryptedPayload{
+			Sender:         senderPubKey,
+			CipherText:     epl.CipherText,
+			Nonce:          epl.Nonce,
+			RecipientBoxes: [][]byte{epl.RecipientBoxes[i]},
+			RecipientNonce: epl.RecipientNonce,
+		}
+
+		log.WithFields(log.Fields{
+			"recipient": hex.EncodeToString(d.Recipient), "digest": hex.EncodeToString(digest),
+		}).Debug("Publishing payload")
 
-			log.WithFields(log.Fields{
-				"recipient": hex.EncodeToString(recipient), "digest": hex.EncodeToString(digest),
-			}).Debug("Publishing payload")
+		s.deliver(d, recipientEpl)
+	}
+
+	return digest, nil
+}
+
+// filterRecipients removes the sender from the recipients of a payload, so that a box is sealed
+// and a delivery enqueued for every recipient which remains. An error is returned if any recipient
+// is not a valid public key.
+func filterRecipients(sender nacl.Key, recipients [][]byte) ([][]byte, error) {
+	filtered := make([][]byte, 0, len(recipients))
+	for _, recipient := range recipients {
+		recipientKey, err := utils.ToKey(recipient)
+		if err != nil {
+			log.WithField("recipientKey", recipient).Errorf(
+				"Unable to load recipient, %v", err)
+			return nil, fmt.Errorf("invalid recipient public key, %v", err)
+		}
 
-			s.publishPayload(recipientEpl, recipient)
+		// TODO: We may choose to loosen this check
+		if bytes.Equal((*recipientKey)[:], (*sender)[:]) {
+			log.WithField("recipientKey", recipientKey).Warn(
+				"Sender cannot be recipient, ignoring")
+			continue
 		}
+		filtered = append(filtered, recipient)
 	}
+	return filtered, nil
+}
 
-	return digest, err
+// deriveSelfKey provides the recipient key used for payloads which are only addressed to the
+// holder of privKey.
+//
+// The key is written alongside each payload in its recipient list, so earlier payloads that were
+// addressed to a randomly generated key can still be opened by Retrieve. Deriving it rather than
+// generating it on startup means the same key is used across restarts of the node.
+func deriveSelfKey(privKey nacl.Key) nacl.Key {
+	hash := utils.Sha3Hash(append([]byte(selfKeyContext), (*privKey)[:]...))
+	key, _ := utils.ToKey(hash[:nacl.KeySize])
+	return key
 }
 
 func createEncryptedPayload(
@@ -213,50 +378,52 @@ func createEncryptedPayload(
 	}, masterKey
 }
 
-func (s *SecureEnclave) publishPayload(epl api.EncryptedPayload, recipient []byte) {
+func (s *SecureEnclave) publishPayload(epl api.EncryptedPayload, recipient []byte) error {
 
 	key, err := utils.ToKey(recipient)
 	if err != nil {
 		log.WithField("recipient", recipient).Errorf(
 			"Unable to decode key for recipient, error: %v", err)
+		return err
 	}
-
-	if url, ok := s.PartyInfo.GetRecipient(key); ok {
-		encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
-		if s.grpc {
-			api.PushGrpc(encoded, url, epl)
-		} else {
-			api.Push(encoded, url, s.client)
-		}
-	} else {
-		log.WithField("recipientKey", hex.EncodeToString(recipient)).Error("Unable to resolve host")
-	}
+	return s.publisher.Publish(epl, key)
 }
 
 func (s *SecureEnclave) resolveSharedKey(
 	senderPrivKey, senderPubKey, recipientPubKey nacl.Key) nacl.Key {
 
-	keyCache, ok := s.keyCache[senderPubKey]
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	keyCache, ok := s.keyCache[*senderPubKey]
 	if !ok {
-		keyCache = make(map[nacl.Key]nacl.Key)
-		s.keyCache[senderPubKey] = keyCache
+		keyCache = make(map[[nacl.KeySize]byte]nacl.Key)
+		s.keyCache[*senderPubKey] = keyCache
 	}
 
-	sharedKey, ok := keyCache[recipientPubKey]
+	sharedKey, ok := keyCache[*recipientPubKey]
 	if !ok {
 		sharedKey = box.Precompute(recipientPubKey, senderPrivKey)
-		keyCache[recipientPubKey] = sharedKey
+		keyCache[*recipientPubKey] = sharedKey
 	}
 
 	return sharedKey
 }
 
-func (s *SecureEnclave) resolvePrivateKey(publicKey nacl.Key) (nacl.Key, error) {
+// resolvePrivateKey provides the private key of one of the key pairs hosted by the enclave, or if
+// retired is set, of a retired key pair.
+func (s *SecureEnclave) resolvePrivateKey(publicKey nacl.Key, retired bool) (nacl.Key, error) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
 	for i, key := range s.PubKeys {
 		if bytes.Equal((*publicKey)[:], (*key)[:]) {
 			return s.PrivKeys[i], nil
 		}
 	}
+	if privKey := s.retired[*publicKey]; privKey != nil && retired {
+		return privKey, nil
+	}
 	return nil, fmt.Errorf("unable to find private key for public key: %s",
 		hex.EncodeToString((*publicKey)[:]))
 }
@@ -266,20 +433,87 @@ func (s *SecureEnclave) resolvePrivateKey(publicKey nacl.Key) (nacl.Key, error)
 // transaction. I.e. it is not the original recipient of the transaction, but one of the recipients
 // it is intended for.
 func (s *SecureEnclave) StorePayload(encoded []byte) ([]byte, error) {
-	epl, _ := api.DecodePayloadWithRecipients(encoded)
-	return s.storePayload(epl, encoded)
+	epl, recipients := api.DecodePayloadWithRecipients(encoded)
+	if err := s.checkSender(epl.Sender); err != nil {
+		return nil, err
+	}
+	return s.storePayload(epl, recipients, encoded)
 }
 
 func (s *SecureEnclave) StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
-	return s.storePayload(epl, encoded)
+	_, recipients := api.DecodePayloadWithRecipients(encoded)
+	if err := s.checkSender(epl.Sender); err != nil {
+		return nil, err
+	}
+	return s.storePayload(epl, recipients, encoded)
 }
 
-func (s *SecureEnclave) storePayload(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
-	digestHash := utils.Sha3Hash(epl.CipherText)
-	err := s.Db.Write(&digestHash, &encoded)
+// checkSender rejects payloads pushed by other nodes from senders not permitted by the peer
+// filter. Enclaves without party details leave this to their transaction manager.
+func (s *SecureEnclave) checkSender(sender nacl.Key) error {
+	if s.PartyInfo == nil {
+		return nil
+	}
+	return s.PartyInfo.CheckSender(sender)
+}
+
+// storePayload writes the payload along with its recipient index entries and the time it was
+// stored.
+func (s *SecureEnclave) storePayload(
+	epl api.EncryptedPayload, recipients [][]byte, encoded []byte) ([]byte, error) {
+
+	digestHash, batch := s.payloadBatch(epl, recipients, encoded)
+	err := s.Db.WriteBatch(batch)
 	return digestHash, err
 }
 
+// payloadBatch provides a batch writing the payload along with its recipient index entries and
+// the time it was stored.
+func (s *SecureEnclave) payloadBatch(
+	epl api.EncryptedPayload, recipients [][]byte, encoded []byte) ([]byte, *storage.Batch) {
+
+	digestHash := utils.Sha3Hash(epl.CipherText)
+	batch := new(storage.Batch)
+	batch.Write(&digestHash, &encoded)
+	writeStored(batch, digestHash, time.Now())
+	s.index.Add(batch, digestHash, recipients)
+	return digestHash, batch
+}
+
+// buildIndex adds the payloads stored before the recipient index was introduced to it.
+func (s *SecureEnclave) buildIndex() error {
+	if s.index.Built() {
+		return nil
+	}
+	log.Info("Building recipient index")
+	count, err := s.index.Build(isPayloadKey, func(value []byte) [][]byte {
+		_, recipients := api.DecodePayloadWithRecipients(value)
+		return recipients
+	})
+	if err == nil {
+		log.Infof("Indexed %d payloads by recipient", count)
+	}
+	return err
+}
+
+// describePayload provides the sender and recipients of a payload, for DataStores which record
+// them alongside it.
+func describePayload(key, value []byte) (meta storage.Metadata, ok bool) {
+	if !isPayloadKey(key) {
+		return meta, false
+	}
+
+	// Decoding assumes well formed input
+	defer func() {
+		if r := recover(); r != nil {
+			meta, ok = storage.Metadata{}, false
+		}
+	}()
+
+	epl, recipients := api.DecodePayloadWithRecipients(value)
+	return storage.Metadata{Sender: (*epl.Sender)[:], Recipients: recipients}, true
+}
+
 func sealPayload(
 	recipientNonce nacl.Nonce,
 	masterKey nacl.Key,
@@ -297,7 +531,8 @@ func sealPayload(
 // If the payload cannot be found, or decrypted successfully an error is returned.
 func (s *SecureEnclave) RetrieveDefault(digestHash *[]byte) ([]byte, error) {
 	// to address is either default or specified on communication
-	key := (*s.PubKeys[0])[:]
+	pubKey, _ := s.defaultKeyPair()
+	key := (*pubKey)[:]
 	return s.Retrieve(digestHash, &key)
 }
 
@@ -332,7 +567,8 @@ func (s *SecureEnclave) Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error)
 		}
 	}
 
-	senderPrivKey, err = s.resolvePrivateKey(senderPubKey)
+	// Payloads exchanged with keys which have since been retired can still be retrieved
+	senderPrivKey, err = s.resolvePrivateKey(senderPubKey, true)
 	if err != nil {
 		return nil, err
 	}
@@ -358,56 +594,63 @@ func (s *SecureEnclave) Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error)
 // RetrieveFor retrieves a payload with the given digestHash for a specific recipient who was one
 // of the original recipients specified on the payload.
 func (s *SecureEnclave) RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*[]byte, error) {
-	encoded, err := s.Db.Read(digestHash)
+	recipientEpl, err := s.recipientPayload(digestHash, reqRecipient)
 	if err != nil {
 		return nil, err
 	}
+	encoded := api.EncodePayload(recipientEpl)
+	return &encoded, nil
+}
+
+// recipientPayload provides the payload with the given digestHash as it is propagated to
+// reqRecipient, containing only the recipient box for that recipient.
+func (s *SecureEnclave) recipientPayload(
+	digestHash *[]byte, reqRecipient *[]byte) (api.EncryptedPayload, error) {
+
+	encoded, err := s.Db.Read(digestHash)
+	if err != nil {
+		return api.EncryptedPayload{}, err
+	}
 
 	epl, recipients := api.DecodePayloadWithRecipients(*encoded)
 
 	for i, recipient := range recipients {
 		if bytes.Equal(*reqRecipient, recipient) {
-			recipientEpl := api.EncryptedPayload{
+			return api.EncryptedPayload{
 				Sender:         epl.Sender,
 				CipherText:     epl.CipherText,
 				Nonce:          epl.Nonce,
 				RecipientBoxes: [][]byte{epl.RecipientBoxes[i]},
 				RecipientNonce: epl.RecipientNonce,
-			}
-			encoded := api.EncodePayload(recipientEpl)
-			return &encoded, nil
+			}, nil
 		}
 	}
-	return nil, fmt.Errorf("invalid recipient %x requested for payload", reqRecipient)
-}
-
-// RetrieveAllFor retrieves all payloads that the specified recipient was an original recipient
-// for.
-// Each payload found is published to the specified recipient.
-func (s *SecureEnclave) RetrieveAllFor(reqRecipient *[]byte) error {
-	return s.Db.ReadAll(func(key, value *[]byte) {
-		epl, recipients := api.DecodePayloadWithRecipients(*value)
-
-		for i, recipient := range recipients {
-			if bytes.Equal(*reqRecipient, recipient) {
-				recipientEpl := api.EncryptedPayload{
-					Sender:         epl.Sender,
-					CipherText:     epl.CipherText,
-					Nonce:          epl.Nonce,
-					RecipientBoxes: [][]byte{epl.RecipientBoxes[i]},
-					RecipientNonce: epl.RecipientNonce,
-				}
-				func() {
-					go s.publishPayload(recipientEpl, *reqRecipient)
-				}()
-			}
-		}
-	})
+	return api.EncryptedPayload{}, fmt.Errorf("invalid recipient %x requested for payload", *reqRecipient)
 }
 
 // Delete deletes the payload associated with the given digestHash from the SecureEnclave's store.
 func (s *SecureEnclave) Delete(digestHash *[]byte) error {
-	return s.Db.Delete(digestHash)
+	stored := storedKey(*digestHash)
+	batch := new(storage.Batch)
+	batch.Delete(digestHash)
+	batch.Delete(&stored)
+
+	encoded, err := s.Db.Read(digestHash)
+	if err != nil {
+		return s.Db.WriteBatch(batch)
+	}
+
+	// The payload is deleted along with its deliveries, recipient index entries and storage time
+	_, recipients := api.DecodePayloadWithRecipients(*encoded)
+	s.index.Remove(batch, *digestHash, recipients)
+	s.deleteDeliveries(batch, digestHash, recipients)
+	if err = s.Db.WriteBatch(batch); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		s.removePending(string(outboxKey(*digestHash, recipient)))
+	}
+	return nil
 }
 
 // UpdatePartyInfo applies the provided binary encoded party details to the SecureEnclave's
@@ -422,11 +665,11 @@ func (s *SecureEnclave) UpdatePartyInfoGrpc(url string, recipients map[[nacl.Key
 
 // GetEncodedPartyInfo provides this SecureEnclaves PartyInfo details in a binary encoded format.
 func (s *SecureEnclave) GetEncodedPartyInfo() []byte {
-	return api.EncodePartyInfo(s.PartyInfo)
+	return api.EncodePartyInfo(s.PartyInfo.Snapshot())
 }
 
 func (s *SecureEnclave) GetEncodedPartyInfoGrpc() []byte {
-	encoded, err := json.Marshal(api.PartyInfoResponse{Payload: api.EncodePartyInfo(s.PartyInfo)})
+	encoded, err := json.Marshal(api.PartyInfoResponse{Payload: api.EncodePartyInfo(s.PartyInfo.Snapshot())})
 	if err != nil {
 		log.Errorf("Marshalling failed %v", err)
 	}
@@ -437,10 +680,30 @@ func (s *SecureEnclave) GetPartyInfo() (string, map[[nacl.KeySize]byte]string, m
 	return s.PartyInfo.GetAllValues()
 }
 
+// GetPeerFilter provides the filter applied to the other nodes on the network.
+func (s *SecureEnclave) GetPeerFilter() api.PeerFilter {
+	return s.PartyInfo.PeerFilter()
+}
+
+// GetPeers provides the liveness state of the other nodes on the network.
+func (s *SecureEnclave) GetPeers() []api.PeerStatus {
+	return s.PartyInfo.Peers()
+}
+
+// RefreshPartyInfo immediately requests party details from all other nodes on the network.
+func (s *SecureEnclave) RefreshPartyInfo() {
+	s.PartyInfo.RefreshPartyInfo()
+}
+
+// SetPeerFilter replaces the filter applied to the other nodes on the network.
+func (s *SecureEnclave) SetPeerFilter(filter api.PeerFilter) error {
+	return s.PartyInfo.SetPeerFilter(filter)
+}
+
 func loadPubKeys(pubKeyFiles []string) ([]nacl.Key, error) {
 	return loadKeys(
 		pubKeyFiles,
-		func(s string) (string, error) {
+		func(i int, s string) (string, error) {
 			src, err := ioutil.ReadFile(s)
 			if err != nil {
 				return "", err
@@ -449,10 +712,10 @@ func loadPubKeys(pubKeyFiles []string) ([]nacl.Key, error) {
 		})
 }
 
-func loadPrivKeys(privKeyFiles []string) ([]nacl.Key, error) {
+func loadPrivKeys(privKeyFiles, passwords []string) ([]nacl.Key, error) {
 	return loadKeys(
 		privKeyFiles,
-		func(s string) (string, error) {
+		func(i int, s string) (string, error) {
 			var privateKey api.PrivateKey
 			src, err := ioutil.ReadFile(s)
 			if err != nil {
@@ -463,16 +726,24 @@ func loadPrivKeys(privKeyFiles []string) ([]nacl.Key, error) {
 				return "", err
 			}
 
-			return privateKey.Data.Bytes, nil
+			var password string
+			if i < len(passwords) {
+				password = passwords[i]
+			}
+			data, err := unlockPrivateKey(privateKey, password)
+			if err != nil {
+				return "", fmt.Errorf("%s: %v", s, err)
+			}
+			return data, nil
 		})
 }
 
 func loadKeys(
-	keyFiles []string, f func(string) (string, error)) ([]nacl.Key, error) {
+	keyFiles []string, f func(int, string) (string, error)) ([]nacl.Key, error) {
 	keys := make([]nacl.Key, len(keyFiles))
 
 	for i, keyFile := range keyFiles {
-		data, err := f(keyFile)
+		data, err := f(i, keyFile)
 		if err != nil {
 			return nil, err
 		}
@@ -490,8 +761,9 @@ func loadKeys(
 
 // DoKeyGeneration is used to generate new public and private key-pairs, writing them to the
 // provided file locations.
-// Public keys have the "pub" suffix, whereas private keys have the "key" suffix.
-func DoKeyGeneration(keyFile string) error {
+// Public keys have the "pub" suffix, whereas private keys have the "key" suffix. If a password is
+// provided, the private key is locked with it.
+func DoKeyGeneration(keyFile, password string) error {
 	pubKey, privKey, err := box.GenerateKey(rand.Reader)
 	if err != nil {
 		return fmt.Errorf("error creating keys: %v", err)
@@ -511,11 +783,17 @@ func DoKeyGeneration(keyFile string) error {
 	}
 
 	jsonKey := api.PrivateKey{
-		Type: "unlocked",
+		Type: unlockedKeyType,
 		Data: api.PrivateKeyBytes{
 			Bytes: b64PrivKey,
 		},
 	}
+	if password != "" {
+		jsonKey, err = lockPrivateKey(privKey, password, lockOptions)
+		if err != nil {
+			return fmt.Errorf("unable to lock private key, error: %v", err)
+		}
+	}
 
 	var encoded []byte
 	encoded, err = json.Marshal(jsonKey)
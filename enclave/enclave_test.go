@@ -2,14 +2,20 @@ package enclave
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/storage"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -18,8 +24,9 @@ import (
 var message = []byte("Test message")
 
 type MockClient struct {
-	serviceMu sync.Mutex
-	requests  [][]byte
+	serviceMu   sync.Mutex
+	requests    [][]byte
+	unavailable bool
 }
 
 func (c *MockClient) Do(req *http.Request) (*http.Response, error) {
@@ -29,11 +36,21 @@ func (c *MockClient) Do(req *http.Request) (*http.Response, error) {
 	}
 
 	c.serviceMu.Lock()
+	defer c.serviceMu.Unlock()
 	c.requests = append(c.requests, body)
-	c.serviceMu.Unlock()
+
+	if c.unavailable {
+		return nil, errors.New("connection refused")
+	}
 
 	respBody := ioutil.NopCloser(bytes.NewReader([]byte("")))
-	return &http.Response{Body: respBody}, nil
+	return &http.Response{StatusCode: http.StatusOK, Body: respBody}, nil
+}
+
+func (c *MockClient) setUnavailable(unavailable bool) {
+	c.serviceMu.Lock()
+	defer c.serviceMu.Unlock()
+	c.unavailable = unavailable
 }
 
 func (c *MockClient) reqCount() int {
@@ -43,45 +60,32 @@ func (c *MockClient) reqCount() int {
 }
 
 func initEnclave(
-	t *testing.T,
-	dbPath string,
-	pi api.PartyInfo,
+	db storage.DataStore,
+	pi *api.PartyInfo,
 	client utils.HttpClient) *SecureEnclave {
 
-	db, err := storage.InitLevelDb(dbPath)
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	return Init(
 		db,
-		[]string{"testdata/key.pub"},
-		[]string{"testdata/key"},
+		&FileKeyProvider{
+			PubKeyFiles:  []string{"testdata/key.pub"},
+			PrivKeyFiles: []string{"testdata/key"},
+		},
 		pi,
-		client, false)
+		client)
 }
 
-func initDefaultEnclave(t *testing.T,
-	dbPath string) *SecureEnclave {
+func initDefaultEnclave(db storage.DataStore) *SecureEnclave {
 
 	var client utils.HttpClient
 	client = &MockClient{}
 	pi := api.InitPartyInfo(
 		"http://localhost:8000",
-		[]string{"http://localhost:8001"}, client, false)
+		[]string{"http://localhost:8001"}, client, false, false, nil)
 
-	return initEnclave(t, dbPath, pi, client)
+	return initEnclave(db, pi, client)
 }
 
 func TestStoreAndRetrieve(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestStoreAndRetrieve")
-
-	if err != nil {
-		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
-	}
-
 	mockClient := &MockClient{requests: [][]byte{}}
 	var client utils.HttpClient
 	client = mockClient
@@ -98,7 +102,7 @@ func TestStoreAndRetrieve(t *testing.T) {
 		[]nacl.Key{rcpt1},
 		client)
 
-	enc := initEnclave(t, dbPath, pi, client)
+	enc := initEnclave(storage.InitMemoryDb(), pi, client)
 
 	var digest []byte
 	digest, err = enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
@@ -136,17 +140,14 @@ func TestStoreAndRetrieve(t *testing.T) {
 	}
 
 	// Then we simulate the propagation and retrieval by the client
-	db, err := storage.InitLevelDb(dbPath + "2")
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	enc2 := Init(
-		db,
-		[]string{"testdata/rcpt1.pub"},
-		[]string{"testdata/rcpt1"},
+		storage.InitMemoryDb(),
+		&FileKeyProvider{
+			PubKeyFiles:  []string{"testdata/rcpt1.pub"},
+			PrivKeyFiles: []string{"testdata/rcpt1"},
+		},
 		pi,
-		client, false)
+		client)
 
 	var digest2 []byte
 	digest2, err = enc2.StorePayload(propagatedPl)
@@ -169,23 +170,41 @@ func TestStoreAndRetrieve(t *testing.T) {
 }
 
 func TestStoreAndRetrieveSelf(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestStoreAndRetrieveSelf")
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
+	digest, err := enc.Store(&message, []byte{}, [][]byte{})
 	if err != nil {
 		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
 	}
 
-	enc := initDefaultEnclave(t, dbPath)
+	var returned []byte
+	returned, err = enc.Retrieve(&digest, nil)
+
+	if !bytes.Equal(message, returned) {
+		t.Errorf(
+			"Retrieved message is not the same as original:\n"+
+				"Original: %v\nRetrieved: %v",
+			message, returned)
+	}
+}
+
+func TestStoreAndRetrieveSelfAfterRestart(t *testing.T) {
+	db := storage.InitMemoryDb()
+	enc := initDefaultEnclave(db)
 
 	digest, err := enc.Store(&message, []byte{}, [][]byte{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	// A new enclave instance over the same store simulates a restart of the node
+	enc = initDefaultEnclave(db)
+
 	var returned []byte
 	returned, err = enc.Retrieve(&digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !bytes.Equal(message, returned) {
 		t.Errorf(
@@ -195,16 +214,52 @@ func TestStoreAndRetrieveSelf(t *testing.T) {
 	}
 }
 
-func TestStoreNotAuthorised(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestStoreNotAuthorised")
+func TestRetrieveSelfWithLegacyKey(t *testing.T) {
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
+	// Payloads written by earlier versions were addressed to a key generated on each startup
+	legacySelfKey := nacl.NewKey()
+	epl, masterKey := createEncryptedPayload(&message, enc.PubKeys[0], [][]byte{(*legacySelfKey)[:]})
+	sharedKey := box.Precompute(legacySelfKey, enc.PrivKeys[0])
+	epl.RecipientBoxes[0] = sealPayload(epl.RecipientNonce, masterKey, sharedKey)
+
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{(*legacySelfKey)[:]})
+	digest, err := enc.storePayload(epl, [][]byte{(*legacySelfKey)[:]}, encoded)
 	if err != nil {
 		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
 	}
 
-	enc := initDefaultEnclave(t, dbPath)
+	var returned []byte
+	returned, err = enc.Retrieve(&digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(message, returned) {
+		t.Errorf(
+			"Retrieved message is not the same as original:\n"+
+				"Original: %v\nRetrieved: %v",
+			message, returned)
+	}
+}
+
+func TestDeriveSelfKey(t *testing.T) {
+	privKeys, err := loadPrivKeys([]string{"testdata/key", "testdata/rcpt1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal((*deriveSelfKey(privKeys[0]))[:], (*deriveSelfKey(privKeys[0]))[:]) {
+		t.Error("Self key should be the same each time it is derived")
+	}
+
+	if bytes.Equal((*deriveSelfKey(privKeys[0]))[:], (*deriveSelfKey(privKeys[1]))[:]) {
+		t.Error("Self keys derived from different private keys should differ")
+	}
+}
+
+func TestStoreNotAuthorised(t *testing.T) {
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
 	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
 	if err != nil {
@@ -219,18 +274,10 @@ func TestStoreNotAuthorised(t *testing.T) {
 }
 
 func TestRetrieveInvalid(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestRetrieveInvalid")
-
-	if err != nil {
-		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
-	}
-
-	enc := initDefaultEnclave(t, dbPath)
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
 	digest := []byte("invalid")
-	_, err = enc.Retrieve(&digest, nil)
+	_, err := enc.Retrieve(&digest, nil)
 	if err == nil {
 		t.Error("Invalid digest requested")
 	}
@@ -240,15 +287,7 @@ func TestRetrieveNotAuthorised(t *testing.T) {
 	// If you know the source enclave of the message, you can retrieve passing in any value you
 	// want in the to field. This may not be appropriate.
 	// TODO: Confirm if we want to do this
-	dbPath, err := ioutil.TempDir("", "TestRetrieveNotAuthorised")
-
-	if err != nil {
-		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
-	}
-
-	enc := initDefaultEnclave(t, dbPath)
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
 	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub", "testdata/rcpt2.pub"})
 	if err != nil {
@@ -277,15 +316,7 @@ func TestRetrieveNotAuthorised(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestDelete")
-
-	if err != nil {
-		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
-	}
-
-	enc := initDefaultEnclave(t, dbPath)
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
 	digest, err := enc.Store(&message, []byte{}, [][]byte{})
 	if err != nil {
@@ -314,15 +345,7 @@ func TestDelete(t *testing.T) {
 }
 
 func TestRetrieveFor(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestRetrieveFor")
-
-	if err != nil {
-		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
-	}
-
-	enc := initDefaultEnclave(t, dbPath)
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
 	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
 	if err != nil {
@@ -347,18 +370,9 @@ func TestRetrieveFor(t *testing.T) {
 }
 
 func TestRetrieveForInvalid(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestRetrieveFor")
-
-	if err != nil {
-		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
-	}
+	enc := initDefaultEnclave(storage.InitMemoryDb())
 
-	enc := initDefaultEnclave(t, dbPath)
-
-	var pubKeys []nacl.Key
-	pubKeys, err = loadPubKeys([]string{"testdata/rcpt1.pub"})
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -372,15 +386,7 @@ func TestRetrieveForInvalid(t *testing.T) {
 	}
 }
 
-func TestRetrieveAllFor(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestRetrieveAllFor")
-
-	if err != nil {
-		t.Fatal(err)
-	} else {
-		defer os.RemoveAll(dbPath)
-	}
-
+func TestResendAll(t *testing.T) {
 	mockClient := &MockClient{requests: [][]byte{}}
 	var client utils.HttpClient
 	client = mockClient
@@ -397,7 +403,7 @@ func TestRetrieveAllFor(t *testing.T) {
 		[]nacl.Key{rcpt1},
 		client)
 
-	enc := initEnclave(t, dbPath, pi, client)
+	enc := initEnclave(storage.InitMemoryDb(), pi, client)
 
 	_, err = enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
 	if err != nil {
@@ -410,20 +416,285 @@ func TestRetrieveAllFor(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rcpt1Key := (*rcpt1)[:]
-	err = enc.RetrieveAllFor(&rcpt1Key)
-	if err != nil {
-		t.Fatal(err)
+	status := waitForResend(t, enc, (*rcpt1)[:], nil)
+	if status.Sent != 2 || status.Failed != 0 || status.Error != "" {
+		t.Errorf("Unexpected resend job status: %v", status)
 	}
 
-	// we need to wait for the replay go-routines to complete
-	time.Sleep(1 * time.Millisecond)
 	if mockClient.reqCount() != 4 {
 		t.Errorf("Four requests should have been captured, actual: %d\n",
 			len(mockClient.requests))
 	}
 }
 
+func TestStartResend(t *testing.T) {
+	mockClient := &MockClient{requests: [][]byte{}}
+	rcpt1 := nacl.NewKey()
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		[]nacl.Key{rcpt1},
+		mockClient)
+
+	enc := initEnclave(storage.InitMemoryDb(), pi, mockClient)
+
+	var digests [][]byte
+	for i := 0; i < resendPageSize+1; i++ {
+		msg := []byte(fmt.Sprintf("Message %d", i))
+		digest, err := enc.Store(&msg, []byte{}, [][]byte{(*rcpt1)[:]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return bytes.Compare(digests[i], digests[j]) < 0
+	})
+
+	status := waitForResend(t, enc, (*rcpt1)[:], nil)
+	if status.Sent != len(digests) || status.Failed != 0 || status.Error != "" {
+		t.Errorf("Unexpected resend job status: %v", status)
+	}
+	if status.Cursor != base64.StdEncoding.EncodeToString(digests[len(digests)-1]) {
+		t.Errorf("Cursor %s should refer to the last payload", status.Cursor)
+	}
+
+	// Resume following the first page of payloads
+	status = waitForResend(t, enc, (*rcpt1)[:], digests[resendPageSize-1])
+	if status.Sent != 1 {
+		t.Errorf("Resumed resend job should send a single payload: %v", status)
+	}
+
+	mockClient.setUnavailable(true)
+	status = waitForResend(t, enc, (*rcpt1)[:], nil)
+	if status.Sent != 0 || status.Failed != len(digests) {
+		t.Errorf("Failed payloads should be reported: %v", status)
+	}
+
+	_, err := enc.ResendStatus("unknown")
+	if err == nil {
+		t.Error("No error returned requesting unknown resend job")
+	}
+}
+
+func TestStartResendLimit(t *testing.T) {
+	enc := initDefaultEnclave(storage.InitMemoryDb())
+
+	running := func(recipient nacl.Key) *resendJob {
+		return &resendJob{status: api.ResendStatus{
+			Id:        base64.StdEncoding.EncodeToString((*recipient)[:]),
+			PublicKey: base64.StdEncoding.EncodeToString((*recipient)[:]),
+		}}
+	}
+
+	rcpt1 := nacl.NewKey()
+	enc.resendMu.Lock()
+	enc.resendJobs["rcpt1"] = running(rcpt1)
+	enc.resendMu.Unlock()
+
+	if _, err := enc.StartResend((*rcpt1)[:], nil); err != api.ErrResendLimit {
+		t.Errorf("Second resend job started for recipient, error: %v", err)
+	}
+
+	enc.resendMu.Lock()
+	for i := 1; i < resendJobLimit; i++ {
+		enc.resendJobs[fmt.Sprintf("job%d", i)] = running(nacl.NewKey())
+	}
+	enc.resendMu.Unlock()
+
+	if _, err := enc.StartResend((*nacl.NewKey())[:], nil); err != api.ErrResendLimit {
+		t.Errorf("Resend job started beyond the limit, error: %v", err)
+	}
+
+	enc.resendMu.Lock()
+	delete(enc.resendJobs, "rcpt1")
+	enc.resendMu.Unlock()
+
+	status := waitForResend(t, enc, (*rcpt1)[:], nil)
+	if status.Error != "" {
+		t.Errorf("Resend job failed once another finished: %v", status)
+	}
+
+	// Only the most recently finished jobs are kept
+	now := time.Now()
+	enc.resendMu.Lock()
+	for i := 0; i < resendJobsKept+10; i++ {
+		id := fmt.Sprintf("finished%d", i)
+		enc.resendJobs[id] = &resendJob{status: api.ResendStatus{
+			Id: id, Done: true, Finished: now.Add(time.Duration(i) * time.Second),
+		}}
+	}
+	enc.pruneResendJobs(now)
+	_, oldest := enc.resendJobs["finished0"]
+	_, newest := enc.resendJobs[fmt.Sprintf("finished%d", resendJobsKept+9)]
+	enc.resendMu.Unlock()
+
+	if oldest || !newest {
+		t.Error("Oldest finished resend jobs should be forgotten")
+	}
+}
+
+func waitForResend(t *testing.T, enc *SecureEnclave, recipient, cursor []byte) api.ResendStatus {
+	status, err := enc.StartResend(recipient, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !status.Done && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status, err = enc.ResendStatus(status.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !status.Done {
+		t.Fatalf("Resend job did not complete: %v", status)
+	}
+	return status
+}
+
+func TestResendDeleted(t *testing.T) {
+	mockClient := &MockClient{requests: [][]byte{}}
+	rcpt1 := nacl.NewKey()
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		[]nacl.Key{rcpt1},
+		mockClient)
+
+	enc := initEnclave(storage.InitMemoryDb(), pi, mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enc.Delete(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := waitForResend(t, enc, (*rcpt1)[:], nil)
+	if status.Sent != 0 || status.Error != "" {
+		t.Errorf("Unexpected resend job status: %v", status)
+	}
+
+	if mockClient.reqCount() != 1 {
+		t.Errorf("Deleted payload should not be resent, requests: %d", mockClient.reqCount())
+	}
+}
+
+func TestStoreInvalidRecipients(t *testing.T) {
+	mockClient := &MockClient{requests: [][]byte{}}
+	rcpt1 := nacl.NewKey()
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		[]nacl.Key{rcpt1},
+		mockClient)
+
+	enc := initEnclave(storage.InitMemoryDb(), pi, mockClient)
+
+	if _, err := enc.Store(&message, []byte{}, [][]byte{[]byte("invalid")}); err == nil {
+		t.Error("Payload stored for an invalid recipient")
+	}
+	if mockClient.reqCount() != 0 {
+		t.Errorf("Payload for an invalid recipient should not be pushed, requests: %d",
+			mockClient.reqCount())
+	}
+
+	// The sender is removed from the recipients, rather than being enqueued for delivery
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*enc.PubKeys[0])[:], (*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := enc.DeliveryStatus(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 ||
+		statuses[0].Recipient != base64.StdEncoding.EncodeToString((*rcpt1)[:]) {
+		t.Errorf("Payload should only be delivered to the recipient, status: %v", statuses)
+	}
+
+	returned, err := enc.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Sender unable to retrieve payload, error: %v", err)
+	}
+}
+
+// failingBatchStore is a DataStore which is unable to apply batches.
+type failingBatchStore struct {
+	storage.DataStore
+}
+
+func (s *failingBatchStore) WriteBatch(batch *storage.Batch) error {
+	return errors.New("disk full")
+}
+
+func TestStorePayloadAtomic(t *testing.T) {
+	enc := initDefaultEnclave(storage.InitMemoryDb())
+	db := enc.Db
+	enc.Db = &failingBatchStore{db}
+
+	recipients := [][]byte{(*nacl.NewKey())[:]}
+	epl, _ := createEncryptedPayload(&message, enc.PubKeys[0], recipients)
+	encoded := api.EncodePayloadWithRecipients(epl, recipients)
+	digest, err := enc.storePayload(epl, recipients, encoded)
+	if err == nil {
+		t.Fatal("No error returned when the payload could not be written")
+	}
+
+	if _, err = db.Read(&digest); err == nil {
+		t.Error("Payload should not be written")
+	}
+	err = enc.index.Digests(recipients[0], nil, func(d []byte) bool {
+		t.Errorf("Recipient index entry for %x should not be written", d)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildIndex(t *testing.T) {
+	db := storage.InitMemoryDb()
+
+	// Payloads written by earlier versions were not indexed
+	rcpt1 := nacl.NewKey()
+	pubKeys, err := loadPubKeys([]string{"testdata/key.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := [][]byte{(*rcpt1)[:]}
+	epl, _ := createEncryptedPayload(&message, pubKeys[0], recipients)
+	encoded := api.EncodePayloadWithRecipients(epl, recipients)
+	digest := utils.Sha3Hash(epl.CipherText)
+	err = db.Write(&digest, &encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000", []string{"http://localhost:8001"}, []nacl.Key{rcpt1}, &MockClient{})
+	enc := initEnclave(db, pi, &MockClient{})
+
+	var digests [][]byte
+	err = enc.index.Digests(recipients[0], nil, func(d []byte) bool {
+		digests = append(digests, d)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 1 || !bytes.Equal(digests[0], digest) {
+		t.Errorf("Index contains %v whereas %v is expected", digests, [][]byte{digest})
+	}
+	if !enc.index.Built() {
+		t.Error("Index should be recorded as built")
+	}
+}
+
 func TestDoKeyGeneration(t *testing.T) {
 	dbPath, err := ioutil.TempDir("", "TestDoKeyGeneration")
 
@@ -434,7 +705,7 @@ func TestDoKeyGeneration(t *testing.T) {
 	}
 
 	keyFiles := path.Join(dbPath, "testKey")
-	err = DoKeyGeneration(keyFiles)
+	err = DoKeyGeneration(keyFiles, "")
 
 	if err != nil {
 		t.Fatal(err)
@@ -445,8 +716,172 @@ func TestDoKeyGeneration(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = loadPrivKeys([]string{keyFiles + ".key"})
+	_, err = loadPrivKeys([]string{keyFiles + ".key"}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestStoreNotPermitted(t *testing.T) {
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), &MockClient{})
+
+	err := enc.SetPeerFilter(api.PeerFilter{DeniedUrls: []string{"http://localhost:8001"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := enc.DeliveryStatus(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Delivered {
+		t.Errorf("Payload should not be delivered to denied node: %v", statuses)
+	}
+}
+
+func TestStorePayloadNotPermitted(t *testing.T) {
+	sender := initDefaultEnclave(storage.InitMemoryDb()).PubKeys[0]
+	unknown := nacl.NewKey()
+
+	client := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001",
+		[]string{"http://localhost:8000"},
+		[]nacl.Key{sender},
+		client)
+	enc := Init(
+		storage.InitMemoryDb(),
+		&FileKeyProvider{
+			PubKeyFiles:  []string{"testdata/rcpt1.pub"},
+			PrivKeyFiles: []string{"testdata/rcpt1"},
+		},
+		pi,
+		client)
+
+	filters := []api.PeerFilter{
+		{},
+		{AllowedUrls: []string{"http://localhost:8000"}},
+		{DeniedUrls: []string{"http://localhost:8000"}},
+		{DeniedKeys: []string{base64.StdEncoding.EncodeToString((*sender)[:])}},
+	}
+	// whether payloads from the sender and unknown keys are accepted with each filter
+	expected := [][2]bool{{true, true}, {true, false}, {false, false}, {false, true}}
+
+	for i, filter := range filters {
+		if err := enc.SetPeerFilter(filter); err != nil {
+			t.Fatal(err)
+		}
+		for j, key := range []nacl.Key{sender, unknown} {
+			epl, _ := createEncryptedPayload(&message, key, [][]byte{})
+			_, err := enc.StorePayload(api.EncodePayloadWithRecipients(epl, [][]byte{}))
+			if accepted := err == nil; accepted != expected[i][j] {
+				t.Errorf("Payload from key %d accepted: %t with filter %v, expected %t",
+					j, accepted, filter, expected[i][j])
+			}
+		}
+	}
+}
+
+func TestStoreAlwaysSendTo(t *testing.T) {
+	mockClient := &MockClient{requests: [][]byte{}}
+	var client utils.HttpClient
+	client = mockClient
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub", "testdata/rcpt2.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1, rcpt2 := pubKeys[0], pubKeys[1]
+
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001", "http://localhost:8002"},
+		[]nacl.Key{rcpt1, rcpt2},
+		client)
+
+	enc := initEnclave(storage.InitMemoryDb(), pi, client)
+
+	if err = enc.SetAlwaysSendTo([]string{"invalid"}); err == nil {
+		t.Error("Invalid public key accepted")
+	}
+
+	if err = enc.SetAlwaysSendTo([]string{"testdata/missing.pub"}); err == nil {
+		t.Error("Missing public key file accepted")
+	}
+
+	// Keys may be given as files, as Constellation expects, and duplicates and the sender's own key
+	// are ignored
+	err = enc.SetAlwaysSendTo([]string{
+		"testdata/rcpt1.pub",
+		base64.StdEncoding.EncodeToString((*rcpt1)[:]),
+		base64.StdEncoding.EncodeToString((*enc.PubKeys[0])[:]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipientLists := [][][]byte{{}, {(*rcpt2)[:]}, {(*rcpt1)[:], (*rcpt2)[:]}}
+	expected := [][]string{
+		{base64.StdEncoding.EncodeToString((*rcpt1)[:])},
+		{base64.StdEncoding.EncodeToString((*rcpt2)[:]), base64.StdEncoding.EncodeToString((*rcpt1)[:])},
+		{base64.StdEncoding.EncodeToString((*rcpt1)[:]), base64.StdEncoding.EncodeToString((*rcpt2)[:])},
+	}
+	for i, recipients := range recipientLists {
+		requests := mockClient.reqCount()
+
+		digest, err := enc.Store(&message, []byte{}, recipients)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statuses, err := enc.DeliveryStatus(&digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delivered []string
+		for _, status := range statuses {
+			if status.Delivered {
+				delivered = append(delivered, status.Recipient)
+			}
+		}
+		sort.Strings(delivered)
+		sort.Strings(expected[i])
+		if !reflect.DeepEqual(delivered, expected[i]) {
+			t.Errorf("Payload for %d recipients delivered to %v, expected %v",
+				len(recipients), delivered, expected[i])
+		}
+		if sent := mockClient.reqCount() - requests; sent != len(expected[i]) {
+			t.Errorf("Payload pushed %d times, expected %d", sent, len(expected[i]))
+		}
+
+		returned, err := enc.RetrieveDefault(&digest)
+		if err != nil || !bytes.Equal(returned, message) {
+			t.Errorf("Sender unable to retrieve payload, error: %v", err)
+		}
+	}
+
+	// The payload pushed to a recipient of every payload can be opened by it
+	enc2 := Init(
+		storage.InitMemoryDb(),
+		&FileKeyProvider{
+			PubKeyFiles:  []string{"testdata/rcpt1.pub"},
+			PrivKeyFiles: []string{"testdata/rcpt1"},
+		},
+		pi,
+		client)
+
+	digest, err := enc2.StorePayload(mockClient.requests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := (*rcpt1)[:]
+	returned, err := enc2.Retrieve(&digest, &to)
+	if err != nil || !bytes.Equal(returned, message) {
+		t.Errorf("Recipient unable to retrieve payload, error: %v", err)
+	}
+}
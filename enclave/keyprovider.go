@@ -0,0 +1,158 @@
+package enclave
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// KeyProvider provides the key pairs hosted by an enclave.
+type KeyProvider interface {
+	// Keys provides the public keys of the key pairs, along with the private key at the same
+	// position of each.
+	Keys() (pubKeys, privKeys []nacl.Key, err error)
+}
+
+// FileKeyProvider provides key pairs read from public and private key files. Locked private keys
+// are unlocked with the password at the same position as their key file in Passwords.
+type FileKeyProvider struct {
+	PubKeyFiles  []string
+	PrivKeyFiles []string
+	Passwords    []string
+}
+
+func (p *FileKeyProvider) Keys() ([]nacl.Key, []nacl.Key, error) {
+	if len(p.PubKeyFiles) != len(p.PrivKeyFiles) {
+		return nil, nil, fmt.Errorf("the same number of public and private key files must be provided")
+	}
+
+	// Key format:
+	// BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo=
+	pubKeys, err := loadPubKeys(p.PubKeyFiles)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load public key files: %s, error: %v",
+			p.PubKeyFiles, err)
+	}
+
+	// Key format:
+	// {"data":{"bytes":"Wl+xSyXVuuqzpvznOS7dOobhcn4C5auxkFRi7yLtgtA="},"type":"unlocked"}
+	// or a key locked with a password of type "argon2sbox"
+	privKeys, err := loadPrivKeys(p.PrivKeyFiles, p.Passwords)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load private key files: %s, error: %v",
+			p.PrivKeyFiles, err)
+	}
+	return pubKeys, privKeys, nil
+}
+
+// Fields of the Vault secrets holding key pairs.
+const (
+	vaultPublicKey  = "publicKey"
+	vaultPrivateKey = "privateKey"
+)
+
+// maxVaultResponse limits the size of responses read from Vault.
+const maxVaultResponse = 1 << 20
+
+// VaultKeyProvider provides key pairs stored in the KV version 2 secrets engine of a HashiCorp
+// Vault server, so that private keys are never written to the node's filesystem. Each secret holds
+// a key pair, whose base64 encoded keys are its publicKey and privateKey fields.
+type VaultKeyProvider struct {
+	Addr    string           // Address of the Vault server, such as https://127.0.0.1:8200
+	Token   string           // Token used to authenticate with Vault
+	Mount   string           // Path the KV secrets engine is mounted at
+	Secrets []string         // Paths of the secrets holding key pairs, relative to the mount
+	Client  utils.HttpClient // The underlying HTTP client used to request secrets
+}
+
+func (p *VaultKeyProvider) Keys() ([]nacl.Key, []nacl.Key, error) {
+	pubKeys := make([]nacl.Key, len(p.Secrets))
+	privKeys := make([]nacl.Key, len(p.Secrets))
+
+	for i, secret := range p.Secrets {
+		data, err := p.readSecret(secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		pubKeys[i], err = loadSecretKey(data, secret, vaultPublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		privKeys[i], err = loadSecretKey(data, secret, vaultPrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pubKeys, privKeys, nil
+}
+
+// readSecret reads the current version of the secret, providing its fields.
+func (p *VaultKeyProvider) readSecret(secret string) (map[string]interface{}, error) {
+	if secret == "" || strings.Contains(secret, "..") {
+		return nil, fmt.Errorf("invalid Vault secret path: %q", secret)
+	}
+	url := strings.TrimSuffix(p.Addr, "/") + "/v1/" + path.Join(p.Mount, "data", secret)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret %s from Vault, error: %v", secret, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxVaultResponse))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret %s from Vault, error: %v", secret, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(body, &vaultErr)
+		return nil, fmt.Errorf("unable to read secret %s from Vault, status: %s, errors: [%s]",
+			secret, resp.Status, strings.Join(vaultErr.Errors, ", "))
+	}
+
+	var kv struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &kv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response reading secret %s from Vault, error: %v",
+			secret, err)
+	}
+	// The data of deleted or destroyed versions of secrets is null
+	if kv.Data.Data == nil {
+		return nil, fmt.Errorf("secret %s in Vault has been deleted", secret)
+	}
+	return kv.Data.Data, nil
+}
+
+// loadSecretKey decodes the base64 encoded key held in the field of a secret.
+func loadSecretKey(data map[string]interface{}, secret, field string) (nacl.Key, error) {
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret %s in Vault has no %s field", secret, field)
+	}
+	key, err := utils.LoadBase64Key(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s in secret %s, error: %v", field, secret, err)
+	}
+	return key, nil
+}
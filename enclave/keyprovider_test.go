@@ -0,0 +1,137 @@
+package enclave
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl/box"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testVaultToken = "s.testtoken"
+
+// vaultStandIn serves the provided secrets, keyed by their path under the "secret" mount, as the KV
+// version 2 secrets engine of a Vault server would.
+func vaultStandIn(t *testing.T, secrets map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method != http.MethodGet {
+			t.Errorf("Unexpected %s request to Vault", req.Method)
+		}
+		if req.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		data, ok := secrets[strings.TrimPrefix(req.URL.Path, "/v1/secret/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     data,
+				"metadata": map[string]interface{}{"version": 1},
+			},
+		})
+	}))
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	pubKey, privKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := vaultStandIn(t, map[string]interface{}{
+		"crux/node1": map[string]string{
+			"publicKey":  base64.StdEncoding.EncodeToString((*pubKey)[:]),
+			"privateKey": base64.StdEncoding.EncodeToString((*privKey)[:]),
+		},
+		"crux/invalid": map[string]string{
+			"publicKey":  base64.StdEncoding.EncodeToString((*pubKey)[:]),
+			"privateKey": "invalid",
+		},
+		"crux/deleted": nil,
+		"crux/other":   map[string]string{"password": "password"},
+	})
+	defer vault.Close()
+
+	provider := &VaultKeyProvider{
+		Addr:    vault.URL,
+		Token:   testVaultToken,
+		Mount:   "secret",
+		Secrets: []string{"crux/node1"},
+		Client:  vault.Client(),
+	}
+	pubKeys, privKeys, err := provider.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pubKeys) != 1 || *pubKeys[0] != *pubKey || *privKeys[0] != *privKey {
+		t.Error("Key pair provided does not match the key pair stored in Vault")
+	}
+
+	invalid := []string{"crux/missing", "crux/invalid", "crux/deleted", "crux/other", "../sys"}
+	for _, secret := range invalid {
+		provider.Secrets = []string{"crux/node1", secret}
+		if _, _, err = provider.Keys(); err == nil {
+			t.Errorf("Keys provided from invalid secret %s", secret)
+		}
+	}
+
+	provider.Secrets = []string{"crux/node1"}
+	provider.Token = "invalid"
+	if _, _, err = provider.Keys(); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Keys provided with an invalid token, error: %v", err)
+	}
+}
+
+func TestInitWithVaultKeyProvider(t *testing.T) {
+	keys := &FileKeyProvider{
+		PubKeyFiles:  []string{"testdata/key.pub"},
+		PrivKeyFiles: []string{"testdata/key"},
+	}
+	pubKeys, privKeys, err := keys.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := vaultStandIn(t, map[string]interface{}{
+		"crux/node1": map[string]string{
+			"publicKey":  base64.StdEncoding.EncodeToString((*pubKeys[0])[:]),
+			"privateKey": base64.StdEncoding.EncodeToString((*privKeys[0])[:]),
+		},
+	})
+	defer vault.Close()
+
+	pi := api.InitPartyInfo("http://localhost:8000", []string{}, &MockClient{}, false, false, nil)
+	defer pi.Close()
+
+	// The default HTTP client is used if none is provided
+	enc := Init(
+		storage.InitMemoryDb(),
+		&VaultKeyProvider{
+			Addr: vault.URL, Token: testVaultToken, Mount: "secret", Secrets: []string{"crux/node1"},
+		},
+		pi, &MockClient{})
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload can be retrieved by an enclave hosting the same key pair from key files
+	fileEnc := initEnclave(enc.Db, pi, &MockClient{})
+	retrieved, err := fileEnc.RetrieveDefault(&digest)
+	if err != nil || string(retrieved) != string(message) {
+		t.Errorf("Unable to retrieve payload, error: %v", err)
+	}
+}
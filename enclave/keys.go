@@ -0,0 +1,387 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/curve25519"
+	"time"
+)
+
+// retiredKeyPrefix namespaces the records of retired key pairs within the DataStore, each keyed
+// by the public key of the key pair, so that they remain retired once the node restarts.
+var retiredKeyPrefix = []byte("retiredkey/")
+
+func retiredKeyRecord(pubKey nacl.Key) []byte {
+	return append(append([]byte{}, retiredKeyPrefix...), (*pubKey)[:]...)
+}
+
+// loadRetiredKeys retires the key pairs which were retired when the node last ran. Those which
+// are still provided are kept for decrypting earlier payloads, but are not used for new ones.
+func (s *SecureEnclave) loadRetiredKeys() error {
+	var pubKeys []nacl.Key
+	err := storage.ReadRange(s.Db, storage.PrefixRange(retiredKeyPrefix), func(key, value []byte) bool {
+		if pubKey, err := utils.ToKey(key[len(retiredKeyPrefix):]); err == nil {
+			pubKeys = append(pubKeys, pubKey)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	for _, pubKey := range pubKeys {
+		index := s.keyIndex(pubKey)
+		if index == -1 {
+			// The private key is no longer provided
+			s.retired[*pubKey] = nil
+			continue
+		}
+		if len(s.PubKeys) == 1 {
+			return fmt.Errorf("every key pair provided has been retired")
+		}
+		s.retired[*pubKey] = s.PrivKeys[index]
+		s.removeKeyPair(index)
+	}
+	return nil
+}
+
+// keyIndex provides the index of the hosted key pair with the public key, or -1 if it is not
+// hosted. The caller must hold keysMu.
+func (s *SecureEnclave) keyIndex(pubKey nacl.Key) int {
+	for i, key := range s.PubKeys {
+		if bytes.Equal((*key)[:], (*pubKey)[:]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeKeyPair stops hosting the key pair at index. The caller must hold keysMu.
+func (s *SecureEnclave) removeKeyPair(index int) {
+	// Copies are made, as the previous slices may be in use by callers
+	s.PubKeys = append(append([]nacl.Key{}, s.PubKeys[:index]...), s.PubKeys[index+1:]...)
+	s.PrivKeys = append(append([]nacl.Key{}, s.PrivKeys[:index]...), s.PrivKeys[index+1:]...)
+}
+
+// defaultKeyPair provides the key pair used when no sender or recipient is specified, which is
+// the first of those hosted by the enclave.
+func (s *SecureEnclave) defaultKeyPair() (nacl.Key, nacl.Key) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.PubKeys[0], s.PrivKeys[0]
+}
+
+// KeyPairs provides the public keys of the key pairs hosted by the enclave, along with those
+// which have been retired.
+func (s *SecureEnclave) KeyPairs() api.KeysResponse {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	resp := api.KeysResponse{Active: []string{}, Retired: []string{}}
+	for _, pubKey := range s.PubKeys {
+		resp.Active = append(resp.Active, base64.StdEncoding.EncodeToString((*pubKey)[:]))
+	}
+	for pubKey := range s.retired {
+		resp.Retired = append(resp.Retired, base64.StdEncoding.EncodeToString(pubKey[:]))
+	}
+	return resp
+}
+
+// SignBindings signs the binding of the public key of each key pair hosted by the enclave to the
+// URL of this node, for a transaction manager holding the party details in another process. Keys
+// whose binding cannot be signed are provided without a signature.
+func (s *SecureEnclave) SignBindings(url string) map[[nacl.KeySize]byte]api.KeySignature {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	issued := time.Now().Unix()
+	signatures := make(map[[nacl.KeySize]byte]api.KeySignature)
+	for i, pubKey := range s.PubKeys {
+		sig, err := api.SignBinding(pubKey, s.PrivKeys[i], url, issued)
+		if err != nil {
+			log.WithField("url", url).Errorf("Unable to sign public key binding, %v", err)
+		}
+		signatures[*pubKey] = sig
+	}
+	return signatures
+}
+
+// announceKeys requests party details from the other nodes, which also provides them with the key
+// pairs now hosted. Enclaves without party details leave this to their transaction manager.
+func (s *SecureEnclave) announceKeys() {
+	if s.PartyInfo != nil {
+		go s.PartyInfo.RefreshPartyInfo()
+	}
+}
+
+// AddKeyPair hosts the key pair provided via the admin API. Locked private keys are unlocked with
+// the password of the request.
+func (s *SecureEnclave) AddKeyPair(req api.KeyPairRequest) error {
+	pubKey, err := utils.LoadBase64Key(req.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key, %v", err)
+	}
+	data, err := unlockPrivateKey(req.PrivateKey, req.Password)
+	if err != nil {
+		return err
+	}
+	privKey, err := utils.LoadBase64Key(data)
+	if err != nil {
+		return fmt.Errorf("invalid private key, %v", err)
+	}
+
+	s.keyOpsMu.Lock()
+	_, err = s.addKeyPair(pubKey, privKey)
+	s.keyOpsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.announceKeys()
+	return nil
+}
+
+// RetireKeyPair stops the key pair with the provided public key being used for new payloads, and
+// withdraws its binding to this node from the party info. Its private key is retained, so payloads
+// exchanged with it can still be retrieved.
+func (s *SecureEnclave) RetireKeyPair(pubKey []byte) error {
+	key, err := utils.ToKey(pubKey)
+	if err != nil {
+		return err
+	}
+	s.keyOpsMu.Lock()
+	_, err = s.retireKeyPair(key)
+	s.keyOpsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.announceKeys()
+	return nil
+}
+
+// RetireKeys retires each of the hosted key pairs with the provided public keys, such as those the
+// operator has configured as retired while still providing them. Key pairs which have already been
+// retired are ignored.
+func (s *SecureEnclave) RetireKeys(pubKeys []nacl.Key) error {
+	s.keyOpsMu.Lock()
+	defer s.keyOpsMu.Unlock()
+
+	var changed bool
+	for _, pubKey := range pubKeys {
+		retired, err := s.retireKeyPair(pubKey)
+		if err != nil {
+			return err
+		}
+		changed = changed || retired
+	}
+
+	if changed {
+		s.announceKeys()
+	}
+	return nil
+}
+
+// ReloadKeys reloads the key pairs hosted by the enclave from the provider. Key pairs which are not
+// already hosted are added, and those which are no longer provided are retired, as are those with
+// the public keys in retire. Key pairs which have been retired remain so, unless they are added via
+// AddKeyPair, and the private keys of those which are still provided are kept for decrypting
+// earlier payloads.
+func (s *SecureEnclave) ReloadKeys(keys KeyProvider, retire []nacl.Key) error {
+	pubKeys, privKeys, err := keys.Keys()
+	if err != nil {
+		return err
+	}
+	if len(pubKeys) == 0 {
+		return fmt.Errorf("at least one key pair must be provided")
+	}
+	for i := range pubKeys {
+		if err = checkKeyPair(pubKeys[i], privKeys[i]); err != nil {
+			return err
+		}
+	}
+
+	retiring := make(map[[nacl.KeySize]byte]bool)
+	for _, pubKey := range retire {
+		retiring[*pubKey] = true
+	}
+
+	s.keyOpsMu.Lock()
+	defer s.keyOpsMu.Unlock()
+
+	var changed bool
+	for i := range pubKeys {
+		retired, err := s.provideRetiredKey(pubKeys[i], privKeys[i], retiring[*pubKeys[i]])
+		if err != nil {
+			return err
+		}
+		if retired {
+			continue
+		}
+		added, err := s.addKeyPair(pubKeys[i], privKeys[i])
+		if err != nil {
+			return err
+		}
+		changed = changed || added
+	}
+
+	listed := make(map[[nacl.KeySize]byte]bool)
+	for _, pubKey := range pubKeys {
+		listed[*pubKey] = true
+	}
+	s.keysMu.RLock()
+	var unlisted []nacl.Key
+	for _, pubKey := range s.PubKeys {
+		if !listed[*pubKey] || retiring[*pubKey] {
+			unlisted = append(unlisted, pubKey)
+		}
+	}
+	s.keysMu.RUnlock()
+
+	for _, pubKey := range unlisted {
+		retired, err := s.retireKeyPair(pubKey)
+		if err != nil {
+			return err
+		}
+		changed = changed || retired
+	}
+
+	if changed {
+		s.announceKeys()
+	}
+	return nil
+}
+
+// provideRetiredKey records the private key of a key pair which is not hosted, if it has been
+// retired or is to be retired, so that it can decrypt earlier payloads. It reports whether the key
+// pair is retired. The caller must hold keyOpsMu.
+func (s *SecureEnclave) provideRetiredKey(pubKey, privKey nacl.Key, retire bool) (bool, error) {
+	s.keysMu.RLock()
+	_, retired := s.retired[*pubKey]
+	hosted := s.keyIndex(pubKey) != -1
+	s.keysMu.RUnlock()
+
+	if hosted || !(retired || retire) {
+		return false, nil
+	}
+	if !retired {
+		if err := s.writeRetiredKey(pubKey); err != nil {
+			return false, err
+		}
+		log.WithField("publicKey", base64.StdEncoding.EncodeToString((*pubKey)[:])).
+			Info("Retired key pair")
+	}
+
+	s.keysMu.Lock()
+	s.retired[*pubKey] = privKey
+	s.keysMu.Unlock()
+	return true, nil
+}
+
+// addKeyPair hosts the key pair, registering it with the party info. Retired key pairs are
+// reinstated. It reports whether the key pair was not already hosted. The caller must hold
+// keyOpsMu.
+func (s *SecureEnclave) addKeyPair(pubKey, privKey nacl.Key) (bool, error) {
+	if err := checkKeyPair(pubKey, privKey); err != nil {
+		return false, err
+	}
+
+	s.keysMu.RLock()
+	hosted := s.keyIndex(pubKey) != -1
+	_, retired := s.retired[*pubKey]
+	s.keysMu.RUnlock()
+
+	if hosted {
+		return false, nil
+	}
+	if retired {
+		record := retiredKeyRecord(pubKey)
+		if err := s.Db.Delete(&record); err != nil {
+			return false, fmt.Errorf("unable to reinstate retired key pair, %v", err)
+		}
+	}
+
+	s.keysMu.Lock()
+	s.PubKeys = append(s.PubKeys, pubKey)
+	s.PrivKeys = append(s.PrivKeys, privKey)
+	delete(s.retired, *pubKey)
+	s.keysMu.Unlock()
+
+	s.resolveSharedKey(privKey, pubKey, deriveSelfKey(privKey))
+	if s.PartyInfo != nil {
+		s.PartyInfo.RegisterPublicKeys([]nacl.Key{pubKey}, []nacl.Key{privKey})
+	}
+
+	log.WithField("publicKey", base64.StdEncoding.EncodeToString((*pubKey)[:])).
+		Info("Added key pair")
+	return true, nil
+}
+
+// retireKeyPair retires the hosted key pair, unregistering it from the party info, and records its
+// retirement in the DataStore. It reports whether the key pair was hosted. The caller must hold
+// keyOpsMu.
+func (s *SecureEnclave) retireKeyPair(pubKey nacl.Key) (bool, error) {
+	s.keysMu.RLock()
+	hosted := s.keyIndex(pubKey) != -1
+	_, retired := s.retired[*pubKey]
+	last := len(s.PubKeys) == 1
+	s.keysMu.RUnlock()
+
+	if !hosted {
+		if retired {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to find key pair for public key: %s",
+			base64.StdEncoding.EncodeToString((*pubKey)[:]))
+	}
+	if last {
+		return false, fmt.Errorf("the last key pair hosted cannot be retired")
+	}
+
+	if err := s.writeRetiredKey(pubKey); err != nil {
+		return false, err
+	}
+
+	// The key pair is still hosted, as changes to the key pairs are serialised by keyOpsMu
+	s.keysMu.Lock()
+	index := s.keyIndex(pubKey)
+	s.retired[*pubKey] = s.PrivKeys[index]
+	s.removeKeyPair(index)
+	// Shared keys of retired key pairs are rarely needed, so are recomputed when they are
+	delete(s.keyCache, *pubKey)
+	s.keysMu.Unlock()
+
+	if s.PartyInfo != nil {
+		s.PartyInfo.UnregisterPublicKeys([]nacl.Key{pubKey})
+	}
+
+	log.WithField("publicKey", base64.StdEncoding.EncodeToString((*pubKey)[:])).
+		Info("Retired key pair")
+	return true, nil
+}
+
+// writeRetiredKey records the retirement of the key pair in the DataStore.
+func (s *SecureEnclave) writeRetiredKey(pubKey nacl.Key) error {
+	record, empty := retiredKeyRecord(pubKey), []byte{}
+	if err := s.Db.Write(&record, &empty); err != nil {
+		return fmt.Errorf("unable to record retired key pair, %v", err)
+	}
+	return nil
+}
+
+// checkKeyPair verifies that the public key corresponds to the private key.
+func checkKeyPair(pubKey, privKey nacl.Key) error {
+	var derived [nacl.KeySize]byte
+	curve25519.ScalarBaseMult(&derived, privKey)
+	if derived != *pubKey {
+		return fmt.Errorf("private key does not correspond to public key %s",
+			base64.StdEncoding.EncodeToString((*pubKey)[:]))
+	}
+	return nil
+}
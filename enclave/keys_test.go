@@ -0,0 +1,331 @@
+package enclave
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// initKeysEnclave initializes an enclave whose requests to other nodes fail, so that the party
+// info refreshes following changes to its key pairs complete immediately.
+func initKeysEnclave() *SecureEnclave {
+	client := &MockClient{}
+	client.setUnavailable(true)
+	pi := api.InitPartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"}, client, false, false, nil)
+
+	return initEnclave(storage.InitMemoryDb(), pi, client)
+}
+
+func TestAddAndRetireKeyPair(t *testing.T) {
+	enc := initKeysEnclave()
+	defaultKey, _ := enc.defaultKeyPair()
+
+	pubKey, privKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString((*pubKey)[:])
+
+	otherKey, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enc.AddKeyPair(api.KeyPairRequest{
+		PublicKey: base64.StdEncoding.EncodeToString((*otherKey)[:]),
+		PrivateKey: api.PrivateKey{
+			Type: "unlocked",
+			Data: api.PrivateKeyBytes{Bytes: base64.StdEncoding.EncodeToString((*privKey)[:])},
+		},
+	})
+	if err == nil {
+		t.Error("Key pair added with a private key which does not correspond to its public key")
+	}
+
+	err = enc.AddKeyPair(api.KeyPairRequest{
+		PublicKey: encodedKey,
+		PrivateKey: api.PrivateKey{
+			Type: "unlocked",
+			Data: api.PrivateKeyBytes{Bytes: base64.StdEncoding.EncodeToString((*privKey)[:])},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 2 || keys.Active[1] != encodedKey {
+		t.Errorf("Added key pair %s is not active, keys are %v", encodedKey, keys)
+	}
+	if url, ok := enc.PartyInfo.GetRecipient(pubKey); !ok || url != "http://localhost:8000" {
+		t.Errorf("Added public key is bound to %s", url)
+	}
+
+	digest, err := enc.Store(&message, (*pubKey)[:], [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = enc.RetireKeyPair((*pubKey)[:]); err != nil {
+		t.Fatal(err)
+	}
+	keys := enc.KeyPairs()
+	if len(keys.Active) != 1 || len(keys.Retired) != 1 || keys.Retired[0] != encodedKey {
+		t.Errorf("Key pair %s is not retired, keys are %v", encodedKey, keys)
+	}
+	if url, ok := enc.PartyInfo.GetRecipient(pubKey); ok {
+		t.Errorf("Retired public key is still bound to %s", url)
+	}
+
+	if _, err = enc.Store(&message, (*pubKey)[:], [][]byte{}); err == nil {
+		t.Error("Payload stored with a retired sender key")
+	}
+	to := (*pubKey)[:]
+	retrieved, err := enc.Retrieve(&digest, &to)
+	if err != nil || string(retrieved) != string(message) {
+		t.Errorf("Unable to retrieve payload stored with retired key, error: %v", err)
+	}
+
+	if err = enc.RetireKeyPair((*defaultKey)[:]); err == nil {
+		t.Error("Last key pair hosted retired")
+	}
+}
+
+func TestReloadKeys(t *testing.T) {
+	keyPath, err := ioutil.TempDir("", "TestReloadKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyPath)
+
+	newKey := path.Join(keyPath, "new")
+	if err = DoKeyGeneration(newKey, ""); err != nil {
+		t.Fatal(err)
+	}
+	newPubKeys, err := loadPubKeys([]string{newKey + ".pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := initKeysEnclave()
+	defaultKey, _ := enc.defaultKeyPair()
+	digest, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.ReloadKeys(&FileKeyProvider{
+		PubKeyFiles:  []string{"testdata/key.pub", newKey + ".pub"},
+		PrivKeyFiles: []string{"testdata/key", newKey + ".key"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 2 || len(keys.Retired) != 0 {
+		t.Errorf("Unexpected keys %v once new key pair added", keys)
+	}
+
+	// The original key pair is retired once it is no longer configured
+	err = enc.ReloadKeys(
+		&FileKeyProvider{PubKeyFiles: []string{newKey + ".pub"}, PrivKeyFiles: []string{newKey + ".key"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 1 {
+		t.Errorf("Unexpected keys %v once original key pair removed", keys)
+	}
+	if pubKey, _ := enc.defaultKeyPair(); *pubKey != *newPubKeys[0] {
+		t.Error("Default key pair should be the remaining key pair")
+	}
+
+	to := (*defaultKey)[:]
+	if _, err = enc.Retrieve(&digest, &to); err != nil {
+		t.Errorf("Unable to retrieve payload stored with retired key, error: %v", err)
+	}
+
+	err = enc.ReloadKeys(
+		&FileKeyProvider{PubKeyFiles: []string{newKey + ".pub"}, PrivKeyFiles: []string{"testdata/key"}}, nil)
+	if err == nil {
+		t.Error("Key pairs reloaded with mismatched key files")
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 1 {
+		t.Errorf("Keys %v changed by failed reload", keys)
+	}
+}
+
+func TestRetiredKeysPersisted(t *testing.T) {
+	keyPath, err := ioutil.TempDir("", "TestRetiredKeysPersisted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyPath)
+
+	newKey := path.Join(keyPath, "new")
+	if err = DoKeyGeneration(newKey, ""); err != nil {
+		t.Fatal(err)
+	}
+	newPubKeys, err := loadPubKeys([]string{newKey + ".pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPubKey := (*newPubKeys[0])[:]
+
+	keys := &FileKeyProvider{
+		PubKeyFiles:  []string{"testdata/key.pub", newKey + ".pub"},
+		PrivKeyFiles: []string{"testdata/key", newKey + ".key"},
+	}
+	db := storage.InitMemoryDb()
+	restart := func() *SecureEnclave {
+		client := &MockClient{}
+		client.setUnavailable(true)
+		pi := api.InitPartyInfo(
+			"http://localhost:8000",
+			[]string{"http://localhost:8001"}, client, false, false, nil)
+		return Init(db, keys, pi, client)
+	}
+
+	enc := restart()
+	digest, err := enc.Store(&message, newPubKey, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.RetireKeyPair(newPubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key pair is still provided, but remains retired
+	enc = restart()
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 1 {
+		t.Errorf("Unexpected keys %v once restarted", keys)
+	}
+	if _, err = enc.Store(&message, newPubKey, [][]byte{}); err == nil {
+		t.Error("Payload stored with a key retired before restarting")
+	}
+	if _, err = enc.Retrieve(&digest, &newPubKey); err != nil {
+		t.Errorf("Unable to retrieve payload stored with retired key, error: %v", err)
+	}
+
+	if err = enc.ReloadKeys(keys, nil); err != nil {
+		t.Fatal(err)
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 1 {
+		t.Errorf("Retired key pair reinstated by reloading keys, keys are %v", keys)
+	}
+
+	// Key pairs added via the API are reinstated
+	newPrivKey := enc.retired[*newPubKeys[0]]
+	err = enc.AddKeyPair(api.KeyPairRequest{
+		PublicKey: base64.StdEncoding.EncodeToString(newPubKey),
+		PrivateKey: api.PrivateKey{
+			Type: "unlocked",
+			Data: api.PrivateKeyBytes{Bytes: base64.StdEncoding.EncodeToString((*newPrivKey)[:])},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc = restart()
+	if keys := enc.KeyPairs(); len(keys.Active) != 2 || len(keys.Retired) != 0 {
+		t.Errorf("Unexpected keys %v once reinstated key pair restarted", keys)
+	}
+
+	// Key pairs retired and no longer provided are still listed, but cannot decrypt payloads
+	if err = enc.RetireKeyPair(newPubKey); err != nil {
+		t.Fatal(err)
+	}
+	keys.PubKeyFiles, keys.PrivKeyFiles = keys.PubKeyFiles[:1], keys.PrivKeyFiles[:1]
+	enc = restart()
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 1 {
+		t.Errorf("Unexpected keys %v once retired key pair removed", keys)
+	}
+	if _, err = enc.Retrieve(&digest, &newPubKey); err == nil {
+		t.Error("Payload retrieved without the private key of the retired key pair")
+	}
+}
+
+func TestRetireConfiguredKeys(t *testing.T) {
+	keyPath, err := ioutil.TempDir("", "TestRetireConfiguredKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyPath)
+
+	var pubKeys []nacl.Key
+	for _, name := range []string{"new", "other"} {
+		if err = DoKeyGeneration(path.Join(keyPath, name), ""); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadPubKeys([]string{path.Join(keyPath, name) + ".pub"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys = append(pubKeys, loaded[0])
+	}
+	newPubKey, otherPubKey := (*pubKeys[0])[:], (*pubKeys[1])[:]
+
+	keys := &FileKeyProvider{
+		PubKeyFiles:  []string{"testdata/key.pub", path.Join(keyPath, "new.pub")},
+		PrivKeyFiles: []string{"testdata/key", path.Join(keyPath, "new.key")},
+	}
+	db := storage.InitMemoryDb()
+	restart := func() *SecureEnclave {
+		client := &MockClient{}
+		client.setUnavailable(true)
+		pi := api.InitPartyInfo(
+			"http://localhost:8000",
+			[]string{"http://localhost:8001"}, client, false, false, nil)
+		return Init(db, keys, pi, client)
+	}
+
+	enc := restart()
+	digest, err := enc.Store(&message, newPubKey, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key pair is retired while it is still configured, keeping its private key
+	if err = enc.ReloadKeys(keys, []nacl.Key{pubKeys[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 1 {
+		t.Errorf("Unexpected keys %v once key pair configured as retired", keys)
+	}
+
+	enc = restart()
+	if err = enc.RetireKeys([]nacl.Key{pubKeys[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 1 {
+		t.Errorf("Unexpected keys %v once restarted", keys)
+	}
+	if _, err = enc.Retrieve(&digest, &newPubKey); err != nil {
+		t.Errorf("Unable to retrieve payload stored with retired key, error: %v", err)
+	}
+
+	// Key pairs configured as retired when they are first provided are never hosted
+	keys.PubKeyFiles = append(keys.PubKeyFiles, path.Join(keyPath, "other.pub"))
+	keys.PrivKeyFiles = append(keys.PrivKeyFiles, path.Join(keyPath, "other.key"))
+	if err = enc.ReloadKeys(keys, []nacl.Key{pubKeys[0], pubKeys[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := enc.KeyPairs(); len(keys.Active) != 1 || len(keys.Retired) != 2 {
+		t.Errorf("Unexpected keys %v once new key pair configured as retired", keys)
+	}
+	if _, err = enc.resolvePrivateKey(pubKeys[1], true); err != nil {
+		t.Errorf("Private key of retired key pair should be kept, error: %v", err)
+	}
+	enc = restart()
+	if _, err = enc.Store(&message, otherPubKey, [][]byte{}); err == nil {
+		t.Error("Payload stored with a key configured as retired")
+	}
+
+	if err = enc.RetireKeys([]nacl.Key{nacl.NewKey()}); err == nil {
+		t.Error("Unknown key pair retired")
+	}
+}
@@ -0,0 +1,120 @@
+package enclave
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"golang.org/x/crypto/argon2"
+)
+
+// Types of private key files. Locked keys are sealed with a key derived from a password, in the
+// format used by Constellation and Tessera.
+const (
+	unlockedKeyType = "unlocked"
+	lockedKeyType   = "argon2sbox"
+)
+
+// argonSaltSize is the size of the salts generated for locked keys.
+const argonSaltSize = 16
+
+// lockOptions are the Argon2 options used when locking private keys, which are the defaults of
+// Constellation and Tessera.
+var lockOptions = api.ArgonOptions{Variant: "id", Memory: 1 << 20, Iterations: 10, Parallelism: 4}
+
+// unlockPrivateKey provides the base64 encoded private key, decrypting it with the password if it
+// is locked.
+func unlockPrivateKey(privateKey api.PrivateKey, password string) (string, error) {
+	switch privateKey.Type {
+	case "", unlockedKeyType:
+		return privateKey.Data.Bytes, nil
+	case lockedKeyType:
+	default:
+		return "", fmt.Errorf("unsupported private key type: %s", privateKey.Type)
+	}
+
+	if password == "" {
+		return "", fmt.Errorf("a password is required for locked private keys")
+	}
+	data := privateKey.Data
+	if data.ArgonOptions == nil {
+		return "", fmt.Errorf("locked private key has no Argon2 options")
+	}
+	salt, err := base64.StdEncoding.DecodeString(data.Salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid salt for locked private key, %v", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(data.Nonce)
+	if err != nil || len(nonce) != nacl.NonceSize {
+		return "", fmt.Errorf("invalid nonce for locked private key")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data.SealedKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid sealed private key, %v", err)
+	}
+
+	key, err := deriveLockKey(password, salt, *data.ArgonOptions)
+	if err != nil {
+		return "", err
+	}
+	n := new([nacl.NonceSize]byte)
+	copy(n[:], nonce)
+	privKey, ok := secretbox.Open(nil, sealed, n, key)
+	if !ok {
+		return "", fmt.Errorf("unable to unlock private key, the password may be incorrect")
+	}
+	return base64.StdEncoding.EncodeToString(privKey), nil
+}
+
+// lockPrivateKey seals the private key with a key derived from the password.
+func lockPrivateKey(privKey nacl.Key, password string, opts api.ArgonOptions) (api.PrivateKey, error) {
+	salt := make([]byte, argonSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return api.PrivateKey{}, err
+	}
+	key, err := deriveLockKey(password, salt, opts)
+	if err != nil {
+		return api.PrivateKey{}, err
+	}
+	nonce := nacl.NewNonce()
+	sealed := secretbox.Seal(nil, (*privKey)[:], nonce, key)
+
+	return api.PrivateKey{
+		Type: lockedKeyType,
+		Data: api.PrivateKeyBytes{
+			ArgonOptions: &opts,
+			Salt:         base64.StdEncoding.EncodeToString(salt),
+			Nonce:        base64.StdEncoding.EncodeToString((*nonce)[:]),
+			SealedKey:    base64.StdEncoding.EncodeToString(sealed),
+		},
+	}, nil
+}
+
+// deriveLockKey derives the key which locks a private key from its password. Only version 1.3 of
+// the Argon2i and Argon2id variants is supported.
+func deriveLockKey(password string, salt []byte, opts api.ArgonOptions) (nacl.Key, error) {
+	if opts.Version != 0 && opts.Version != 1.3 {
+		return nil, fmt.Errorf("unsupported Argon2 version: %v", opts.Version)
+	}
+	if opts.Iterations == 0 || opts.Parallelism == 0 {
+		return nil, fmt.Errorf("invalid Argon2 options: %+v", opts)
+	}
+
+	var key []byte
+	switch opts.Variant {
+	case "i":
+		key = argon2.Key(
+			[]byte(password), salt, opts.Iterations, opts.Memory, opts.Parallelism, nacl.KeySize)
+	case "id":
+		key = argon2.IDKey(
+			[]byte(password), salt, opts.Iterations, opts.Memory, opts.Parallelism, nacl.KeySize)
+	default:
+		return nil, fmt.Errorf("unsupported Argon2 variant: %s", opts.Variant)
+	}
+
+	lockKey := new([nacl.KeySize]byte)
+	copy(lockKey[:], key)
+	return lockKey, nil
+}
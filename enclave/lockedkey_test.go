@@ -0,0 +1,152 @@
+package enclave
+
+import (
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testLockOptions are Argon2 options which are cheap enough for tests.
+var testLockOptions = api.ArgonOptions{Variant: "id", Memory: 64, Iterations: 1, Parallelism: 1}
+
+func TestLockPrivateKey(t *testing.T) {
+	privKey := nacl.NewKey()
+
+	for _, variant := range []string{"i", "id"} {
+		opts := testLockOptions
+		opts.Variant = variant
+		locked, err := lockPrivateKey(privKey, "password", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The fields are named as in Constellation and Tessera key files
+		encoded, err := json.Marshal(locked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := []string{`"type":"argon2sbox"`, `"aopts":`, `"asalt":`, `"snonce":`, `"sbox":`}
+		for _, field := range fields {
+			if !strings.Contains(string(encoded), field) {
+				t.Errorf("Locked key %s does not contain %s", encoded, field)
+			}
+		}
+		if strings.Contains(string(encoded), `"bytes"`) {
+			t.Errorf("Locked key %s contains the private key", encoded)
+		}
+
+		unlocked, err := unlockPrivateKey(locked, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, err := utils.LoadBase64Key(unlocked); err != nil || *key != *privKey {
+			t.Errorf("Unlocked key does not match the original, error: %v", err)
+		}
+
+		if _, err = unlockPrivateKey(locked, "wrong password"); err == nil {
+			t.Error("Private key unlocked with the wrong password")
+		}
+		if _, err = unlockPrivateKey(locked, ""); err == nil {
+			t.Error("Private key unlocked without a password")
+		}
+	}
+
+	opts := testLockOptions
+	opts.Variant = "d"
+	if _, err := lockPrivateKey(privKey, "password", opts); err == nil {
+		t.Error("Private key locked with unsupported Argon2 variant")
+	}
+	if _, err := unlockPrivateKey(api.PrivateKey{Type: "unknown"}, "password"); err == nil {
+		t.Error("Private key of unknown type unlocked")
+	}
+}
+
+func TestLoadLockedPrivKeys(t *testing.T) {
+	keyPath, err := ioutil.TempDir("", "TestLoadLockedPrivKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyPath)
+
+	defaultOptions := lockOptions
+	lockOptions = testLockOptions
+	defer func() {
+		lockOptions = defaultOptions
+	}()
+
+	locked := path.Join(keyPath, "locked")
+	if err = DoKeyGeneration(locked, "password"); err != nil {
+		t.Fatal(err)
+	}
+	unlocked := path.Join(keyPath, "unlocked")
+	if err = DoKeyGeneration(unlocked, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unlocked keys have an empty password
+	keyFiles := []string{unlocked + ".key", locked + ".key"}
+	privKeys, err := loadPrivKeys(keyFiles, []string{"", "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeys, err := loadPubKeys([]string{unlocked + ".pub", locked + ".pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range privKeys {
+		var pubKey [nacl.KeySize]byte
+		curve25519.ScalarBaseMult(&pubKey, privKeys[i])
+		if pubKey != *pubKeys[i] {
+			t.Errorf("Private key %s does not match its public key", keyFiles[i])
+		}
+	}
+
+	if _, err = loadPrivKeys(keyFiles, []string{""}); err == nil {
+		t.Error("Locked private key loaded without a password")
+	}
+}
+
+// lockedKeyFixtures holds locked key pairs in the layouts written by Constellation
+// (constellation-node --generatekeys), which uses Argon2i, and Tessera (tessera -keygen), which
+// uses Argon2id, each as <name>.key and <name>.pub, with the password it was locked with in
+// <name>.password. They were sealed with the Argon2 and secretbox implementations of x/crypto
+// rather than lockPrivateKey, and with reduced Argon2 memory to keep the test fast, as the
+// defaults require 1GiB.
+const lockedKeyFixtures = "testdata/locked"
+
+func TestUnlockFixtureKeys(t *testing.T) {
+	for _, fixture := range []string{"constellation", "tessera"} {
+		name := path.Join(lockedKeyFixtures, fixture)
+		keyFile := name + ".key"
+		password, err := ioutil.ReadFile(name + ".password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		privKeys, err := loadPrivKeys(
+			[]string{keyFile}, []string{strings.TrimRight(string(password), "\r\n")})
+		if err != nil {
+			t.Errorf("Unable to unlock %s, error: %v", keyFile, err)
+			continue
+		}
+		pubKeys, err := loadPubKeys([]string{name + ".pub"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var pubKey [nacl.KeySize]byte
+		curve25519.ScalarBaseMult(&pubKey, privKeys[0])
+		if pubKey != *pubKeys[0] {
+			t.Errorf("Unlocked private key %s does not match its public key", keyFile)
+		}
+		if _, err = loadPrivKeys([]string{keyFile}, []string{"wrong password"}); err == nil {
+			t.Errorf("%s unlocked with the wrong password", keyFile)
+		}
+	}
+}
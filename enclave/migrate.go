@@ -0,0 +1,103 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrateBatchSize is the number of records written to the destination at a time.
+const migrateBatchSize = 1000
+
+// MigrationStats reports the outcome of migrating the contents of one DataStore to another.
+type MigrationStats struct {
+	Copied  int // Payloads written to the destination
+	Skipped int // Payloads already present in the destination
+	Invalid int // Payloads which could not be decoded, or whose key is not their digest
+	Records int // Other records copied, such as outbox records, storage times and party details
+}
+
+func (m MigrationStats) String() string {
+	return fmt.Sprintf("%d payloads copied, %d already present, %d invalid, %d other records copied",
+		m.Copied, m.Skipped, m.Invalid, m.Records)
+}
+
+// Migrate copies all payloads from src to dest, verifying that each is keyed by its digest. If
+// reencode is set, payloads are written in the current format of EncodePayloadWithRecipients.
+//
+// Payloads already present in dest are skipped, so an interrupted migration can be run again.
+// The recipient index of dest is updated along with each payload, whereas the index of src is
+// not copied.
+func Migrate(src, dest storage.DataStore, reencode bool) (MigrationStats, error) {
+	var stats MigrationStats
+	if store, ok := dest.(storage.MetadataStore); ok {
+		store.SetDescriber(describePayload)
+	}
+	index := storage.NewRecipientIndex(dest)
+	batch := new(storage.Batch)
+
+	var writeErr error
+	err := storage.ReadRange(src, nil, func(key, value []byte) bool {
+		if storage.IsRecipientIndexKey(key) {
+			return true
+		}
+
+		key = append([]byte{}, key...)
+		value = append([]byte{}, value...)
+
+		if !isPayloadKey(key) {
+			stats.Records += 1
+			batch.Write(&key, &value)
+		} else if recipients, encoded, err := migratePayload(key, value, reencode); err != nil {
+			log.WithField("key", hex.EncodeToString(key)).Errorf("Invalid payload, %v", err)
+			stats.Invalid += 1
+		} else if existing, err := dest.Read(&key); err == nil && bytes.Equal(*existing, encoded) {
+			stats.Skipped += 1
+		} else {
+			stats.Copied += 1
+			batch.Write(&key, &encoded)
+			index.Add(batch, key, recipients)
+		}
+
+		if batch.Len() >= migrateBatchSize {
+			writeErr = dest.WriteBatch(batch)
+			batch.Reset()
+		}
+		return writeErr == nil
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil && batch.Len() > 0 {
+		err = dest.WriteBatch(batch)
+	}
+	return stats, err
+}
+
+// migratePayload verifies that the payload is keyed by its digest, providing its recipients and
+// the encoding to write to the destination.
+func migratePayload(key, value []byte, reencode bool) (
+	recipients [][]byte, encoded []byte, err error) {
+
+	// Decoding assumes well formed input
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to decode payload: %v", r)
+		}
+	}()
+
+	epl, recipients := api.DecodePayloadWithRecipients(value)
+	if !bytes.Equal(key, utils.Sha3Hash(epl.CipherText)) {
+		return nil, nil, fmt.Errorf("key is not the digest of the payload")
+	}
+
+	encoded = value
+	if reencode {
+		encoded = api.EncodePayloadWithRecipients(epl, recipients)
+	}
+	return recipients, encoded, nil
+}
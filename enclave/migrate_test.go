@@ -0,0 +1,79 @@
+package enclave
+
+import (
+	"bytes"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	mockClient := &MockClient{}
+	mockClient.setUnavailable(true)
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), mockClient)
+	src := enc.Db
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalidKey := []byte("not a digest")
+	invalidValue := []byte("not a payload")
+	err = src.Write(&invalidKey, &invalidValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := storage.InitMemoryDb()
+
+	stats, err := Migrate(src, dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MigrationStats{Copied: 1, Invalid: 1, Records: 2}
+	if stats != expected {
+		t.Errorf("Migration reported %v whereas %v is expected", stats, expected)
+	}
+
+	// The outbox record is migrated along with the payload
+	key := outboxKey(digest, (*rcpt1)[:])
+	if _, err = dest.Read(&key); err != nil {
+		t.Error("Outbox record should be migrated")
+	}
+
+	var digests [][]byte
+	err = storage.NewRecipientIndex(dest).Digests((*rcpt1)[:], nil, func(d []byte) bool {
+		digests = append(digests, d)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 1 || !bytes.Equal(digests[0], digest) {
+		t.Errorf("Recipient index of destination contains %v whereas %v is expected",
+			digests, [][]byte{digest})
+	}
+
+	// Migrating again skips the payloads already present
+	stats, err = Migrate(src, dest, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = MigrationStats{Skipped: 1, Invalid: 1, Records: 2}
+	if stats != expected {
+		t.Errorf("Repeated migration reported %v whereas %v is expected", stats, expected)
+	}
+
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000", []string{"http://localhost:8001"}, []nacl.Key{rcpt1}, mockClient)
+	migrated := initEnclave(dest, pi, mockClient)
+	returned, err := migrated.Retrieve(&digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(returned, message) {
+		t.Errorf("Migrated message %q does not match original %q", returned, message)
+	}
+}
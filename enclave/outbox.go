@@ -0,0 +1,298 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// outboxPrefix namespaces the records tracking the propagation of payloads to their recipients
+// within the DataStore. Each record is keyed by the payload digest followed by the recipient's
+// public key.
+var outboxPrefix = []byte("outbox/")
+
+const (
+	outboxInterval   = time.Second      // How often pending deliveries are checked
+	outboxMinBackoff = time.Second      // Delay before the first retry of a failed delivery
+	outboxMaxBackoff = 10 * time.Minute // Upper bound on the delay between retries
+)
+
+// delivery is the persisted propagation state of a payload to a single recipient. The record is
+// removed once the recipient's node acknowledges the payload.
+type delivery struct {
+	Digest      []byte    `json:"digest"`
+	Recipient   []byte    `json:"recipient"`
+	Delivered   bool      `json:"delivered"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+func outboxKey(digest, recipient []byte) []byte {
+	key := make([]byte, 0, len(outboxPrefix)+len(digest)+len(recipient))
+	key = append(key, outboxPrefix...)
+	key = append(key, digest...)
+	return append(key, recipient...)
+}
+
+// isPayloadKey reports whether the key refers to a payload, rather than one of the other records
+// the enclave keeps in its DataStore.
+func isPayloadKey(key []byte) bool {
+	return !bytes.HasPrefix(key, outboxPrefix) && !bytes.HasPrefix(key, storedPrefix) &&
+		!bytes.HasPrefix(key, retiredKeyPrefix) && !bytes.Equal(key, api.PartyInfoKey) &&
+		!storage.IsRecipientIndexKey(key)
+}
+
+// loadOutbox restores the deliveries which had not been acknowledged when the node last ran,
+// removing the records of acknowledged deliveries kept by earlier versions.
+func (s *SecureEnclave) loadOutbox() error {
+	var delivered [][]byte
+	err := storage.ReadRange(s.Db, storage.PrefixRange(outboxPrefix), func(key, value []byte) bool {
+		var d delivery
+		if err := json.Unmarshal(value, &d); err != nil {
+			log.WithField("key", hex.EncodeToString(key)).Errorf(
+				"Unable to decode outbox record, %v", err)
+			return true
+		}
+		if d.Delivered {
+			delivered = append(delivered, append([]byte{}, key...))
+		} else {
+			s.pending[string(key)] = true
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range delivered {
+		if err = s.Db.Delete(&key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processOutbox periodically retries deliveries which have not yet been acknowledged by the
+// recipient's node.
+func (s *SecureEnclave) processOutbox() {
+	ticker := time.NewTicker(outboxInterval)
+	for {
+		select {
+		case <-ticker.C:
+			s.retryDeliveries(time.Now())
+		case <-s.quit:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (s *SecureEnclave) retryDeliveries(now time.Time) {
+	s.outboxMu.Lock()
+	keys := make([]string, 0, len(s.pending))
+	for key := range s.pending {
+		keys = append(keys, key)
+	}
+	s.outboxMu.Unlock()
+
+	for _, key := range keys {
+		k := []byte(key)
+		value, err := s.Db.Read(&k)
+		if err != nil {
+			s.removePending(key)
+			continue
+		}
+
+		var d delivery
+		if err = json.Unmarshal(*value, &d); err != nil {
+			s.removePending(key)
+			continue
+		}
+		if d.Delivered {
+			s.Db.Delete(&k)
+			s.removePending(key)
+			continue
+		}
+
+		if now.Before(d.NextAttempt) {
+			continue
+		}
+
+		epl, err := s.recipientPayload(&d.Digest, &d.Recipient)
+		if err != nil {
+			// The payload has been deleted since the delivery was recorded
+			s.Db.Delete(&k)
+			s.removePending(key)
+			continue
+		}
+
+		s.deliver(&d, epl)
+	}
+}
+
+// enqueueDelivery adds a record that the payload must be propagated to recipient to the batch
+// storing the payload, so the delivery can be retried if the node stops before it succeeds.
+func enqueueDelivery(batch *storage.Batch, digest, recipient []byte) (*delivery, error) {
+	d := &delivery{
+		Digest:    digest,
+		Recipient: recipient,
+	}
+	key := outboxKey(d.Digest, d.Recipient)
+	value, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	batch.Write(&key, &value)
+	return d, nil
+}
+
+// deliver attempts to propagate the payload, recording the outcome of the attempt. The outbox
+// record is removed once the payload has been delivered.
+func (s *SecureEnclave) deliver(d *delivery, epl api.EncryptedPayload) error {
+	err := s.publishPayload(epl, d.Recipient)
+
+	d.Attempts++
+	if err == nil {
+		d.Delivered = true
+		d.LastError = ""
+		d.NextAttempt = time.Time{}
+	} else {
+		log.WithFields(log.Fields{
+			"recipient": hex.EncodeToString(d.Recipient),
+			"digest":    hex.EncodeToString(d.Digest),
+			"attempts":  d.Attempts,
+		}).Warnf("Unable to publish payload, %v", err)
+		d.LastError = err.Error()
+		d.NextAttempt = time.Now().Add(backoff(d.Attempts))
+	}
+
+	key := outboxKey(d.Digest, d.Recipient)
+	var writeErr error
+	if d.Delivered {
+		writeErr = s.Db.Delete(&key)
+	} else {
+		writeErr = s.writeDelivery(d)
+	}
+	if writeErr != nil {
+		log.WithField("digest", hex.EncodeToString(d.Digest)).Errorf(
+			"Unable to update outbox record, %v", writeErr)
+	}
+
+	if d.Delivered {
+		s.removePending(string(key))
+	} else {
+		s.outboxMu.Lock()
+		s.pending[string(key)] = true
+		s.outboxMu.Unlock()
+	}
+	return err
+}
+
+func (s *SecureEnclave) writeDelivery(d *delivery) error {
+	key := outboxKey(d.Digest, d.Recipient)
+	value, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return s.Db.Write(&key, &value)
+}
+
+func (s *SecureEnclave) removePending(key string) {
+	s.outboxMu.Lock()
+	delete(s.pending, key)
+	s.outboxMu.Unlock()
+}
+
+// backoff provides the delay before the next attempt of a delivery which has failed the given
+// number of times.
+func backoff(attempts int) time.Duration {
+	delay := outboxMinBackoff
+	for i := 1; i < attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+	return delay
+}
+
+// DeliveryStatus provides the propagation state of the payload associated with the given
+// digestHash for each of its recipients. Recipients without an outbox record have acknowledged
+// the payload.
+func (s *SecureEnclave) DeliveryStatus(digestHash *[]byte) ([]api.DeliveryStatus, error) {
+	encoded, err := s.Db.Read(digestHash)
+	if err != nil {
+		return nil, err
+	}
+
+	epl, recipients := api.DecodePayloadWithRecipients(*encoded)
+
+	statuses := make([]api.DeliveryStatus, 0, len(recipients))
+
+	// Payloads received from other nodes are not propagated by this one
+	senderPrivKey, err := s.resolvePrivateKey(epl.Sender, true)
+	if err != nil {
+		return statuses, nil
+	}
+	selfKey := deriveSelfKey(senderPrivKey)
+
+	for _, recipient := range recipients {
+		// Payloads only addressed to ourselves are never propagated
+		if bytes.Equal(recipient, (*selfKey)[:]) {
+			continue
+		}
+
+		d, found, err := s.readDelivery(outboxKey(*digestHash, recipient))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			d = delivery{Delivered: true}
+		}
+
+		statuses = append(statuses, api.DeliveryStatus{
+			Recipient: base64.StdEncoding.EncodeToString(recipient),
+			Delivered: d.Delivered,
+			Attempts:  d.Attempts,
+			LastError: d.LastError,
+		})
+	}
+
+	return statuses, nil
+}
+
+// readDelivery reads the outbox record with the given key, reporting whether it exists.
+func (s *SecureEnclave) readDelivery(key []byte) (delivery, bool, error) {
+	var d delivery
+	var found bool
+	var decodeErr error
+	err := storage.ReadRange(s.Db, storage.PrefixRange(key), func(k, value []byte) bool {
+		if !bytes.Equal(k, key) {
+			return true
+		}
+		found = true
+		decodeErr = json.Unmarshal(value, &d)
+		return false
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	return d, found, err
+}
+
+// deleteDeliveries adds the removal of the outbox records associated with the given payload to
+// the batch.
+func (s *SecureEnclave) deleteDeliveries(
+	batch *storage.Batch, digestHash *[]byte, recipients [][]byte) {
+
+	for _, recipient := range recipients {
+		key := outboxKey(*digestHash, recipient)
+		batch.Delete(&key)
+	}
+}
@@ -0,0 +1,200 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"testing"
+	"time"
+)
+
+func initOutboxEnclave(
+	t *testing.T, db storage.DataStore, client *MockClient) (*SecureEnclave, nacl.Key) {
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := pubKeys[0]
+
+	var httpClient utils.HttpClient
+	httpClient = client
+
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		[]nacl.Key{rcpt1},
+		httpClient)
+
+	return initEnclave(db, pi, httpClient), rcpt1
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), &MockClient{})
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := enc.DeliveryStatus(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := api.DeliveryStatus{
+		Recipient: base64.StdEncoding.EncodeToString((*rcpt1)[:]),
+		Delivered: true,
+	}
+	if len(statuses) != 1 || statuses[0] != expected {
+		t.Errorf("Delivery status %v does not match expected %v", statuses, expected)
+	}
+
+	// Acknowledged deliveries are removed from the outbox
+	key := outboxKey(digest, (*rcpt1)[:])
+	if _, err = enc.Db.Read(&key); err == nil {
+		t.Error("Outbox record should have been removed once delivered")
+	}
+
+	if enc.pendingCount() != 0 {
+		t.Errorf("No deliveries should be pending, actual: %d", enc.pendingCount())
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	mockClient := &MockClient{}
+	mockClient.setUnavailable(true)
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := enc.DeliveryStatus(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Delivered || statuses[0].LastError == "" {
+		t.Errorf("Delivery should have failed, status: %v", statuses)
+	}
+
+	// Retries are not attempted until the backoff period has elapsed
+	enc.retryDeliveries(time.Now())
+	if mockClient.reqCount() != 1 {
+		t.Errorf("Delivery should not have been retried, requests: %d", mockClient.reqCount())
+	}
+
+	mockClient.setUnavailable(false)
+	enc.retryDeliveries(time.Now().Add(outboxMinBackoff))
+
+	statuses, err = enc.DeliveryStatus(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || !statuses[0].Delivered || statuses[0].LastError != "" {
+		t.Errorf("Delivery should have succeeded on retry, status: %v", statuses)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	mockClient := &MockClient{}
+	mockClient.setUnavailable(true)
+	db := storage.InitMemoryDb()
+	enc, rcpt1 := initOutboxEnclave(t, db, mockClient)
+
+	_, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(enc.quit)
+
+	// A new enclave instance over the same store simulates a restart of the node
+	enc, _ = initOutboxEnclave(t, db, mockClient)
+
+	if enc.pendingCount() != 1 {
+		t.Errorf("One delivery should be pending after restart, actual: %d", enc.pendingCount())
+	}
+}
+
+func TestDeliveredRecordsPruned(t *testing.T) {
+	db := storage.InitMemoryDb()
+	enc, rcpt1 := initOutboxEnclave(t, db, &MockClient{})
+	close(enc.quit)
+
+	// Earlier versions kept the records of acknowledged deliveries
+	d := delivery{Digest: []byte("digest"), Recipient: (*rcpt1)[:], Delivered: true, Attempts: 1}
+	if err := enc.writeDelivery(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, _ = initOutboxEnclave(t, db, &MockClient{})
+
+	key := outboxKey(d.Digest, d.Recipient)
+	if _, err := enc.Db.Read(&key); err == nil {
+		t.Error("Delivered outbox record should have been removed on restart")
+	}
+}
+
+func TestStoreOutboxFailure(t *testing.T) {
+	mockClient := &MockClient{}
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), mockClient)
+	enc.Db = &failingBatchStore{enc.Db}
+
+	if _, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]}); err == nil {
+		t.Error("No error returned when the outbox could not be written")
+	}
+	if mockClient.reqCount() != 0 {
+		t.Errorf("Payload should not be published without an outbox record, requests: %d",
+			mockClient.reqCount())
+	}
+}
+
+func TestDeleteRemovesDeliveries(t *testing.T) {
+	mockClient := &MockClient{}
+	mockClient.setUnavailable(true)
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), mockClient)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Delete(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := outboxKey(digest, (*rcpt1)[:])
+	if _, err = enc.Db.Read(&key); err == nil {
+		t.Error("Outbox record should have been deleted with the payload")
+	}
+
+	if enc.pendingCount() != 0 {
+		t.Errorf("No deliveries should be pending, actual: %d", enc.pendingCount())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	values := map[int]time.Duration{
+		1:  outboxMinBackoff,
+		2:  2 * outboxMinBackoff,
+		3:  4 * outboxMinBackoff,
+		50: outboxMaxBackoff,
+	}
+
+	for attempts, expected := range values {
+		if backoff(attempts) != expected {
+			t.Errorf("Backoff for %d attempts is %v, expected %v",
+				attempts, backoff(attempts), expected)
+		}
+	}
+}
+
+func (s *SecureEnclave) pendingCount() int {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	return len(s.pending)
+}
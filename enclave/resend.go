@@ -0,0 +1,212 @@
+package enclave
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	resendWorkers   = 8         // Payloads published concurrently by each resend job
+	resendPageSize  = 100       // Payloads published before the cursor of a resend job advances
+	resendRetention = time.Hour // How long finished resend jobs can be polled for
+	resendJobLimit  = 4         // Resend jobs which can run at once
+	resendKeyLimit  = 1         // Resend jobs which can run at once for each recipient
+	resendJobsKept  = 256       // Finished resend jobs kept for polling, the oldest are forgotten
+)
+
+// resendJob tracks the progress of resending all payloads addressed to a recipient.
+type resendJob struct {
+	mu     sync.Mutex
+	status api.ResendStatus
+}
+
+func (j *resendJob) snapshot() api.ResendStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+func (j *resendJob) update(f func(status *api.ResendStatus)) {
+	j.mu.Lock()
+	f(&j.status)
+	j.mu.Unlock()
+}
+
+// StartResend begins resending all payloads addressed to the recipient, following the payload
+// identified by cursor if one is provided. The job runs in the background, its progress is
+// available via ResendStatus. ErrResendLimit is returned if too many jobs are already running for
+// the recipient or in total.
+func (s *SecureEnclave) StartResend(recipient, cursor []byte) (api.ResendStatus, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return api.ResendStatus{}, err
+	}
+
+	job := &resendJob{status: api.ResendStatus{
+		Id:        hex.EncodeToString(id),
+		PublicKey: base64.StdEncoding.EncodeToString(recipient),
+		Cursor:    base64.StdEncoding.EncodeToString(cursor),
+		Started:   time.Now(),
+	}}
+
+	s.resendMu.Lock()
+	s.pruneResendJobs(job.status.Started)
+	running, forRecipient := s.runningResendJobs(job.status.PublicKey)
+	if running >= resendJobLimit || forRecipient >= resendKeyLimit {
+		s.resendMu.Unlock()
+		log.WithField("recipient", hex.EncodeToString(recipient)).Warn(
+			"Rejecting resend request, too many resend jobs are running")
+		return api.ResendStatus{}, api.ErrResendLimit
+	}
+	s.resendJobs[job.status.Id] = job
+	s.resendMu.Unlock()
+
+	log.WithFields(log.Fields{
+		"id": job.status.Id, "recipient": hex.EncodeToString(recipient),
+	}).Info("Starting resend job")
+	go s.resendAll(job, recipient, cursor)
+	return job.snapshot(), nil
+}
+
+// ResendStatus provides the progress of the resend job with the given ID.
+func (s *SecureEnclave) ResendStatus(id string) (api.ResendStatus, error) {
+	s.resendMu.Lock()
+	job, ok := s.resendJobs[id]
+	s.resendMu.Unlock()
+
+	if !ok {
+		return api.ResendStatus{}, fmt.Errorf("unknown resend job: %s", id)
+	}
+	return job.snapshot(), nil
+}
+
+// pruneResendJobs forgets jobs which finished long enough ago, along with the oldest finished
+// jobs beyond the number kept.
+func (s *SecureEnclave) pruneResendJobs(now time.Time) {
+	var finished []api.ResendStatus
+	for id, job := range s.resendJobs {
+		status := job.snapshot()
+		if !status.Done {
+			continue
+		}
+		if now.Sub(status.Finished) >= resendRetention {
+			delete(s.resendJobs, id)
+		} else {
+			finished = append(finished, status)
+		}
+	}
+
+	if len(finished) > resendJobsKept {
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].Finished.Before(finished[j].Finished)
+		})
+		for _, status := range finished[:len(finished)-resendJobsKept] {
+			delete(s.resendJobs, status.Id)
+		}
+	}
+}
+
+// runningResendJobs counts the resend jobs which have not finished, in total and for the recipient
+// with the given base64 encoded public key.
+func (s *SecureEnclave) runningResendJobs(recipient string) (running, forRecipient int) {
+	for _, job := range s.resendJobs {
+		status := job.snapshot()
+		if status.Done {
+			continue
+		}
+		running++
+		if status.PublicKey == recipient {
+			forRecipient++
+		}
+	}
+	return running, forRecipient
+}
+
+// resendAll publishes the payloads addressed to the recipient a page at a time. The cursor of the
+// job only advances once every payload in a page has been processed, as the payloads within a
+// page are published concurrently.
+//
+// Payloads are visited in the order of their digests, so the cursor is only meaningful for
+// DataStores which maintain their keys in order.
+func (s *SecureEnclave) resendAll(job *resendJob, recipient, cursor []byte) {
+	page := make([][]byte, 0, resendPageSize)
+	flush := func() {
+		s.resendPage(job, recipient, page)
+		last := page[len(page)-1]
+		job.update(func(status *api.ResendStatus) {
+			status.Cursor = base64.StdEncoding.EncodeToString(last)
+		})
+		page = make([][]byte, 0, resendPageSize)
+	}
+
+	err := s.index.Digests(recipient, cursor, func(digest []byte) bool {
+		page = append(page, digest)
+		if len(page) == resendPageSize {
+			flush()
+		}
+		return true
+	})
+	if err == nil && len(page) > 0 {
+		flush()
+	}
+
+	job.update(func(status *api.ResendStatus) {
+		status.Done = true
+		status.Finished = time.Now()
+		if err != nil {
+			status.Error = err.Error()
+		}
+	})
+
+	status := job.snapshot()
+	log.WithFields(log.Fields{
+		"id": status.Id, "sent": status.Sent, "failed": status.Failed,
+	}).Info("Resend job finished")
+}
+
+// resendPage publishes each of the payloads to the recipient using a bounded number of workers.
+func (s *SecureEnclave) resendPage(job *resendJob, recipient []byte, digests [][]byte) {
+	work := make(chan []byte)
+	var wg sync.WaitGroup
+	for i := 0; i < resendWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for digest := range work {
+				s.resend(job, recipient, digest)
+			}
+		}()
+	}
+
+	for _, digest := range digests {
+		work <- digest
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (s *SecureEnclave) resend(job *resendJob, recipient, digest []byte) {
+	epl, err := s.recipientPayload(&digest, &recipient)
+	if err != nil {
+		// The payload has been deleted since it was indexed
+		log.WithField("digest", hex.EncodeToString(digest)).Warnf(
+			"Ignoring recipient index entry, %v", err)
+		return
+	}
+
+	err = s.publishPayload(epl, recipient)
+	job.update(func(status *api.ResendStatus) {
+		if err == nil {
+			status.Sent += 1
+		} else {
+			status.Failed += 1
+		}
+	})
+}
@@ -0,0 +1,280 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storedPrefix namespaces the records holding the time each payload was stored within the
+// DataStore. Each record is keyed by the payload digest.
+var storedPrefix = []byte("stored/")
+
+// Reasons reported for the removal of a payload by a RetentionPolicy.
+const (
+	expiredAge  = "age"
+	expiredSize = "size"
+)
+
+// storedRecord is the persisted storage time of a payload.
+type storedRecord struct {
+	Stored time.Time `json:"stored"`
+}
+
+func storedKey(digest []byte) []byte {
+	return append(append([]byte{}, storedPrefix...), digest...)
+}
+
+// RetentionPolicy determines which payloads are removed from a node. Payloads are removed once
+// they exceed the shortest maximum age which applies to them, after which the oldest payloads are
+// removed while the total size of those remaining exceeds MaxSize.
+type RetentionPolicy struct {
+	MaxAge time.Duration // Maximum age of all payloads, unless zero
+	// Maximum age of payloads sent by or to a public key, by the base64 encoded key. Recipients are
+	// only recorded for payloads sent by this node.
+	SenderMaxAge    map[string]time.Duration
+	RecipientMaxAge map[string]time.Duration
+	MaxSize         int64 // Maximum total size of all payloads in bytes, unless zero
+}
+
+// ParseRules adds the maximum ages provided by rules of the form sender:<public key>:<duration>
+// or recipient:<public key>:<duration> to the policy.
+func (p *RetentionPolicy) ParseRules(rules []string) error {
+	for _, rule := range rules {
+		parts := strings.Split(rule, ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid retention rule: %s", rule)
+		}
+		if _, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return fmt.Errorf("invalid public key in retention rule: %s", rule)
+		}
+		maxAge, err := time.ParseDuration(parts[2])
+		if err != nil || maxAge <= 0 {
+			return fmt.Errorf("invalid duration in retention rule: %s", rule)
+		}
+
+		switch parts[0] {
+		case "sender":
+			if p.SenderMaxAge == nil {
+				p.SenderMaxAge = make(map[string]time.Duration)
+			}
+			p.SenderMaxAge[parts[1]] = maxAge
+		case "recipient":
+			if p.RecipientMaxAge == nil {
+				p.RecipientMaxAge = make(map[string]time.Duration)
+			}
+			p.RecipientMaxAge[parts[1]] = maxAge
+		default:
+			return fmt.Errorf("invalid retention rule: %s, expected sender or recipient", rule)
+		}
+	}
+	return nil
+}
+
+// maxAge provides the shortest maximum age which applies to a payload, or zero if there is none.
+func (p RetentionPolicy) maxAge(meta storage.Metadata) time.Duration {
+	maxAge := p.MaxAge
+	shorten := func(age time.Duration, ok bool) {
+		if ok && (maxAge == 0 || age < maxAge) {
+			maxAge = age
+		}
+	}
+
+	age, ok := p.SenderMaxAge[base64.StdEncoding.EncodeToString(meta.Sender)]
+	shorten(age, ok)
+	for _, recipient := range meta.Recipients {
+		age, ok = p.RecipientMaxAge[base64.StdEncoding.EncodeToString(recipient)]
+		shorten(age, ok)
+	}
+	return maxAge
+}
+
+// EnforceRetention removes the payloads which have expired under the policy every interval. If
+// dryRun is set, the payloads which would be removed are only logged.
+func (s *SecureEnclave) EnforceRetention(policy RetentionPolicy, interval time.Duration, dryRun bool) {
+	s.retentionMu.Lock()
+	s.retention = policy
+	s.retentionMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ticker.C:
+				report, err := s.applyRetention(policy, time.Now(), dryRun)
+				if err != nil {
+					log.Errorf("Unable to apply retention policy, error: %v", err)
+				}
+				logRetention(report)
+			case <-s.quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func logRetention(report api.RetentionReport) {
+	if report.DryRun {
+		for _, payload := range report.Payloads {
+			log.WithFields(log.Fields{
+				"key": payload.Key, "stored": payload.Stored, "reason": payload.Reason,
+			}).Info("Payload would be removed by retention policy")
+		}
+	}
+	log.WithFields(log.Fields{
+		"dryRun": report.DryRun, "removed": report.Removed, "retained": report.Retained,
+	}).Info("Applied retention policy")
+}
+
+// RetentionReport provides the payloads which would currently be removed by the retention
+// policy, without removing them.
+func (s *SecureEnclave) RetentionReport() (api.RetentionReport, error) {
+	s.retentionMu.Lock()
+	policy := s.retention
+	s.retentionMu.Unlock()
+	return s.applyRetention(policy, time.Now(), true)
+}
+
+// retainedPayload is a payload to which a retention policy is applied.
+type retainedPayload struct {
+	digest []byte
+	stored time.Time
+	size   int
+	meta   storage.Metadata
+}
+
+// applyRetention removes the payloads which have expired under the policy at the given time, or
+// only reports them if dryRun is set. Payloads which cannot be removed are retained, and the first error
+// removing them is reported once the others have been removed.
+func (s *SecureEnclave) applyRetention(
+	policy RetentionPolicy, now time.Time, dryRun bool) (api.RetentionReport, error) {
+
+	report := api.RetentionReport{DryRun: dryRun, Payloads: []api.ExpiredPayload{}}
+	payloads, err := s.storedPayloads(now)
+	if err != nil {
+		return report, err
+	}
+
+	var retained []retainedPayload
+	var expired []api.ExpiredPayload
+	var retainedBytes int64
+	for _, p := range payloads {
+		if maxAge := policy.maxAge(p.meta); maxAge > 0 && now.Sub(p.stored) > maxAge {
+			expired = append(expired, expiredPayload(p, expiredAge))
+		} else {
+			retained = append(retained, p)
+			retainedBytes += int64(p.size)
+		}
+	}
+
+	// The oldest payloads are removed first
+	sort.Slice(retained, func(i, j int) bool {
+		if retained[i].stored.Equal(retained[j].stored) {
+			return bytes.Compare(retained[i].digest, retained[j].digest) < 0
+		}
+		return retained[i].stored.Before(retained[j].stored)
+	})
+	for policy.MaxSize > 0 && retainedBytes > policy.MaxSize && len(retained) > 0 {
+		expired = append(expired, expiredPayload(retained[0], expiredSize))
+		retainedBytes -= int64(retained[0].size)
+		retained = retained[1:]
+	}
+
+	report.Retained = len(retained)
+	report.RetainedBytes = retainedBytes
+	var failed int
+	var firstErr error
+	for _, payload := range expired {
+		if !dryRun {
+			digest, _ := base64.StdEncoding.DecodeString(payload.Key)
+			if err = s.Delete(&digest); err != nil {
+				log.WithField("digest", hex.EncodeToString(digest)).Errorf(
+					"Unable to remove expired payload, %v", err)
+				report.Retained += 1
+				report.RetainedBytes += int64(payload.Size)
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed += 1
+				continue
+			}
+		}
+		report.Removed += 1
+		report.RemovedBytes += int64(payload.Size)
+		report.Payloads = append(report.Payloads, payload)
+	}
+	if firstErr != nil {
+		return report, fmt.Errorf("unable to remove %d expired payloads, first error: %v",
+			failed, firstErr)
+	}
+	return report, nil
+}
+
+func expiredPayload(p retainedPayload, reason string) api.ExpiredPayload {
+	return api.ExpiredPayload{
+		Key:    base64.StdEncoding.EncodeToString(p.digest),
+		Stored: p.stored,
+		Size:   p.size,
+		Reason: reason,
+	}
+}
+
+// storedPayloads provides every payload along with the time it was stored. Payloads stored before
+// storage times were recorded are recorded as being stored now.
+func (s *SecureEnclave) storedPayloads(now time.Time) ([]retainedPayload, error) {
+	stored := make(map[string]time.Time)
+	err := storage.ReadRange(s.Db, storage.PrefixRange(storedPrefix), func(key, value []byte) bool {
+		var record storedRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			log.WithField("key", hex.EncodeToString(key)).Errorf(
+				"Unable to decode storage time, %v", err)
+			return true
+		}
+		stored[string(key[len(storedPrefix):])] = record.Stored
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads []retainedPayload
+	batch := new(storage.Batch)
+	err = storage.ReadRange(s.Db, nil, func(key, value []byte) bool {
+		meta, ok := describePayload(key, value)
+		if !ok {
+			return true
+		}
+
+		p := retainedPayload{digest: append([]byte{}, key...), size: len(value), meta: meta}
+		if p.stored, ok = stored[string(key)]; !ok {
+			p.stored = now
+			writeStored(batch, p.digest, now)
+		}
+		payloads = append(payloads, p)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if batch.Len() > 0 {
+		log.Infof("Recording storage time of %d payloads", batch.Len())
+		err = s.Db.WriteBatch(batch)
+	}
+	return payloads, err
+}
+
+// writeStored adds the recording of the time the payload was stored to the batch.
+func writeStored(batch *storage.Batch, digest []byte, stored time.Time) {
+	key := storedKey(digest)
+	value, _ := json.Marshal(storedRecord{Stored: stored})
+	batch.Write(&key, &value)
+}
@@ -0,0 +1,172 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	enc, rcpt1 := initOutboxEnclave(t, storage.InitMemoryDb(), &MockClient{})
+	now := time.Now()
+
+	old, err := enc.Store(&message, []byte{}, [][]byte{(*rcpt1)[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := new(storage.Batch)
+	writeStored(batch, old, now.Add(-48*time.Hour))
+	writeStored(batch, recent, now.Add(-2*time.Hour))
+	if err = enc.Db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey := base64.StdEncoding.EncodeToString(old)
+	recentKey := base64.StdEncoding.EncodeToString(recent)
+	sender := base64.StdEncoding.EncodeToString((*enc.PubKeys[0])[:])
+	recipient := base64.StdEncoding.EncodeToString((*rcpt1)[:])
+
+	policies := []struct {
+		policy  RetentionPolicy
+		removed map[string]string // Reasons for removal by payload key
+	}{
+		{RetentionPolicy{}, map[string]string{}},
+		{RetentionPolicy{MaxAge: 24 * time.Hour}, map[string]string{oldKey: expiredAge}},
+		{RetentionPolicy{MaxAge: 72 * time.Hour, RecipientMaxAge: map[string]time.Duration{
+			recipient: 24 * time.Hour}}, map[string]string{oldKey: expiredAge}},
+		{RetentionPolicy{SenderMaxAge: map[string]time.Duration{sender: time.Hour}},
+			map[string]string{oldKey: expiredAge, recentKey: expiredAge}},
+		{RetentionPolicy{MaxSize: 1}, map[string]string{oldKey: expiredSize, recentKey: expiredSize}},
+	}
+
+	for _, p := range policies {
+		report, err := enc.applyRetention(p.policy, now, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Removed != len(p.removed) || report.Retained != 2-len(p.removed) {
+			t.Errorf("Policy %v removes %d and retains %d payloads whereas %d are removed",
+				p.policy, report.Removed, report.Retained, len(p.removed))
+		}
+		for _, payload := range report.Payloads {
+			if reason, ok := p.removed[payload.Key]; !ok || reason != payload.Reason {
+				t.Errorf("Policy %v removes %s due to %s", p.policy, payload.Key, payload.Reason)
+			}
+		}
+	}
+
+	// Nothing is removed by a dry run
+	if _, err = enc.RetrieveDefault(&old); err != nil {
+		t.Errorf("Payload removed by dry run, error: %v", err)
+	}
+
+	report, err := enc.applyRetention(RetentionPolicy{MaxAge: 24 * time.Hour}, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := api.ExpiredPayload{
+		Key: oldKey, Stored: report.Payloads[0].Stored, Size: report.Payloads[0].Size, Reason: expiredAge}
+	if report.Removed != 1 || report.Payloads[0] != expected ||
+		!expected.Stored.Equal(now.Add(-48*time.Hour)) {
+		t.Errorf("Retention report %v does not match expected removal of %v", report, expected)
+	}
+
+	if _, err = enc.RetrieveDefault(&old); err == nil {
+		t.Error("Expired payload should have been removed")
+	}
+	key := storedKey(old)
+	if _, err = enc.Db.Read(&key); err == nil {
+		t.Error("Storage time should have been removed with the payload")
+	}
+	if _, err = enc.RetrieveDefault(&recent); err != nil {
+		t.Errorf("Payload within retention period removed, error: %v", err)
+	}
+}
+
+// flakyBatchStore fails the first batch written to it.
+type flakyBatchStore struct {
+	storage.DataStore
+	failed bool
+}
+
+func (s *flakyBatchStore) WriteBatch(batch *storage.Batch) error {
+	if !s.failed {
+		s.failed = true
+		return errors.New("disk full")
+	}
+	return s.DataStore.WriteBatch(batch)
+}
+
+func TestRetentionRemovalFailure(t *testing.T) {
+	enc := initDefaultEnclave(storage.InitMemoryDb())
+	for i := 0; i < 2; i++ {
+		if _, err := enc.Store(&message, []byte{}, [][]byte{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enc.Db = &flakyBatchStore{DataStore: enc.Db}
+
+	// The first removal fails, whereas the last succeeds
+	report, err := enc.applyRetention(RetentionPolicy{MaxSize: 1}, time.Now(), false)
+	if err == nil {
+		t.Error("No error returned when an expired payload could not be removed")
+	}
+	if report.Removed != 1 || report.Retained != 1 {
+		t.Errorf("Report %v should record one payload removed and one retained", report)
+	}
+}
+
+func TestRetentionRecordsStorageTime(t *testing.T) {
+	enc := initDefaultEnclave(storage.InitMemoryDb())
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Payloads stored before storage times were recorded are retained from when they are found
+	key := storedKey(digest)
+	if err = enc.Db.Delete(&key); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(time.Hour)
+	report, err := enc.applyRetention(RetentionPolicy{MaxAge: time.Minute}, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Removed != 0 || report.Retained != 1 {
+		t.Errorf("Payload without storage time should be retained, report: %v", report)
+	}
+	if _, err = enc.Db.Read(&key); err != nil {
+		t.Errorf("Storage time should have been recorded, error: %v", err)
+	}
+}
+
+func TestParseRetentionRules(t *testing.T) {
+	key := "BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="
+
+	var policy RetentionPolicy
+	err := policy.ParseRules([]string{"sender:" + key + ":720h", "recipient:" + key + ":24h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.SenderMaxAge[key] != 720*time.Hour || policy.RecipientMaxAge[key] != 24*time.Hour {
+		t.Errorf("Unexpected retention policy %v", policy)
+	}
+
+	for _, rule := range []string{
+		"sender:" + key, "owner:" + key + ":24h", "sender:not a key:24h", "sender:" + key + ":-1h",
+	} {
+		if err = new(RetentionPolicy).ParseRules([]string{rule}); err == nil {
+			t.Errorf("Invalid retention rule %s accepted", rule)
+		}
+	}
+}
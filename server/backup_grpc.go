@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// BackupMethod is the full name of the gRPC method streaming a backup archive of the node's
+// storage as a sequence of api.BackupChunk messages. As with the PeersMethod, it must be called
+// using the "json" content subtype, and it is only served over IPC.
+const BackupMethod = "/crux.Backup/Backup"
+
+// backupChunkSize is the size of the chunks a backup archive is streamed in via gRPC.
+const backupChunkSize = 64 * 1024
+
+// BackupServer is the gRPC service streaming backup archives of the node's storage.
+type BackupServer interface {
+	Backup(*api.BackupRequest, grpc.ServerStream) error
+}
+
+// RegisterBackupServer registers the BackupServer with the gRPC server.
+func RegisterBackupServer(s *grpc.Server, srv BackupServer) {
+	s.RegisterService(&backupServiceDesc, srv)
+}
+
+func backupHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := new(api.BackupRequest)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(BackupServer).Backup(in, stream)
+}
+
+var backupServiceDesc = grpc.ServiceDesc{
+	ServiceName: "crux.Backup",
+	HandlerType: (*BackupServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Backup",
+			Handler:       backupHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "backup",
+}
+
+// Backup streams a backup archive of the node's storage, as served by the /backup endpoint.
+func (s *Server) Backup(in *api.BackupRequest, stream grpc.ServerStream) error {
+	w := bufio.NewWriterSize(&backupStreamWriter{stream: stream}, backupChunkSize)
+	manifest, err := s.Enclave.Backup(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Errorf("Unable to complete backup, error: %v", err)
+		return status.Errorf(codes.Internal, "unable to create backup: %v", err)
+	}
+	log.WithFields(log.Fields{
+		"payloads": manifest.Payloads, "records": manifest.Records,
+	}).Info("Created backup")
+	return nil
+}
+
+// backupStreamWriter sends the data written to it as BackupChunk messages.
+type backupStreamWriter struct {
+	stream grpc.ServerStream
+}
+
+func (w *backupStreamWriter) Write(p []byte) (int, error) {
+	if err := w.stream.SendMsg(&api.BackupChunk{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// DownloadBackup writes the backup archive of the storage of the node serving its private API at
+// ipcPath to w, using gRPC if set, and otherwise the /backup endpoint.
+func DownloadBackup(ipcPath string, useGrpc bool, w io.Writer) error {
+	if useGrpc {
+		return downloadBackupGrpc(ipcPath, w)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", ipcPath)
+		},
+	}}
+	resp, err := client.Get("http://localhost" + backup)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup request failed with status %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func downloadBackupGrpc(ipcPath string, w io.Writer) error {
+	dialer := func(_ string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", ipcPath, timeout)
+	}
+	conn, err := grpc.Dial("passthrough:///"+ipcPath, grpc.WithInsecure(), grpc.WithDialer(dialer))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(context.Background(), &backupServiceDesc.Streams[0], BackupMethod,
+		grpc.CallContentSubtype(JsonCodecName))
+	if err != nil {
+		return err
+	}
+	if err = stream.SendMsg(&api.BackupRequest{}); err != nil {
+		return err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		var chunk api.BackupChunk
+		err = stream.RecvMsg(&chunk)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err = w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
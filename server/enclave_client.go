@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrKeyUpload is returned when a key pair is added via an EnclaveClient, as private keys are
+// provided to the enclave process directly rather than passing through the transaction manager.
+var ErrKeyUpload = errors.New(
+	"key pairs cannot be added via the transaction manager, provide them to the enclave instead")
+
+// EnclaveClient is an Enclave whose operations are performed by an enclave in another process,
+// which serves them over a Unix socket using ServeEnclave. Private keys are then held only by the
+// enclave process, rather than the process handling public HTTP and gRPC traffic.
+//
+// The transaction manager holds the party details, and pushes the payloads sealed by the enclave
+// to other nodes once Run is called, so the enclave only seals and opens payloads.
+type EnclaveClient struct {
+	client     *http.Client
+	pi         *api.PartyInfo
+	pushClient utils.HttpClient // The underlying HTTP client used to push payloads
+	quit       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewEnclaveClient creates a client of the enclave serving its operations at socketPath, which
+// pushes payloads to the nodes listed in the party details pi using pushClient.
+func NewEnclaveClient(
+	socketPath string, pi *api.PartyInfo, pushClient utils.HttpClient) *EnclaveClient {
+
+	transport := &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}
+	return &EnclaveClient{
+		client:     &http.Client{Transport: transport},
+		pi:         pi,
+		pushClient: pushClient,
+		quit:       make(chan struct{}),
+	}
+}
+
+// call performs the operation at path, encoding request as its body, and decoding its result into
+// response if provided.
+func (c *EnclaveClient) call(path string, request, response interface{}) error {
+	resp, err := c.post(path, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if response == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return fmt.Errorf("invalid response from enclave, error: %v", err)
+	}
+	return nil
+}
+
+// post sends the request to the enclave, returning its response if the operation succeeded.
+func (c *EnclaveClient) post(path string, request interface{}) (*http.Response, error) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	// The host is ignored, as requests are sent over the enclave's socket
+	resp, err := c.client.Post("http://enclave"+path, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach enclave, error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = resp.Status
+		}
+		return nil, errors.New(message)
+	}
+	return resp, nil
+}
+
+// logError logs the failure of an operation whose signature does not allow it to be reported.
+func logError(path string, err error) {
+	if err != nil {
+		log.WithField("operation", path).Errorf("Enclave request failed, error: %v", err)
+	}
+}
+
+func (c *EnclaveClient) Store(message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
+	var resp enclaveData
+	err := c.call(enclaveStore,
+		enclaveStoreRequest{Message: *message, Sender: sender, Recipients: recipients}, &resp)
+	return resp.Data, err
+}
+
+// StorePayloadGrpc stores a payload pushed by another node, if the peer filter permits its sender.
+func (c *EnclaveClient) StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
+	if err := c.pi.CheckSender(epl.Sender); err != nil {
+		return nil, err
+	}
+	var resp enclaveData
+	err := c.call(enclaveStorePayloadGrpc,
+		enclavePayloadRequest{Payload: epl, Encoded: encoded}, &resp)
+	return resp.Data, err
+}
+
+// StorePayload stores a payload pushed by another node, if the peer filter permits its sender.
+func (c *EnclaveClient) StorePayload(encoded []byte) ([]byte, error) {
+	epl, _ := api.DecodePayloadWithRecipients(encoded)
+	if err := c.pi.CheckSender(epl.Sender); err != nil {
+		return nil, err
+	}
+	var resp enclaveData
+	err := c.call(enclaveStorePayload, enclavePayloadRequest{Encoded: encoded}, &resp)
+	return resp.Data, err
+}
+
+func (c *EnclaveClient) Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error) {
+	req := enclaveKeyRequest{Key: *digestHash}
+	if to != nil {
+		req.To = *to
+	}
+	var resp enclaveData
+	err := c.call(enclaveRetrieve, req, &resp)
+	return resp.Data, err
+}
+
+func (c *EnclaveClient) RetrieveDefault(digestHash *[]byte) ([]byte, error) {
+	var resp enclaveData
+	err := c.call(enclaveRetrieveDefault, enclaveKeyRequest{Key: *digestHash}, &resp)
+	return resp.Data, err
+}
+
+func (c *EnclaveClient) RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*[]byte, error) {
+	var resp enclaveData
+	err := c.call(enclaveRetrieveFor, enclaveKeyRequest{Key: *digestHash, To: *reqRecipient}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+func (c *EnclaveClient) StartResend(recipient, cursor []byte) (api.ResendStatus, error) {
+	var status api.ResendStatus
+	err := c.call(enclaveStartResend,
+		enclaveResendRequest{Recipient: recipient, Cursor: cursor}, &status)
+	if err != nil && err.Error() == api.ErrResendLimit.Error() {
+		// Callers distinguish requests rejected by the limit on resend jobs
+		err = api.ErrResendLimit
+	}
+	return status, err
+}
+
+func (c *EnclaveClient) ResendStatus(id string) (api.ResendStatus, error) {
+	var status api.ResendStatus
+	err := c.call(enclaveResendStatus, enclaveResendRequest{Id: id}, &status)
+	return status, err
+}
+
+func (c *EnclaveClient) Delete(digestHash *[]byte) error {
+	return c.call(enclaveDelete, enclaveKeyRequest{Key: *digestHash}, nil)
+}
+
+func (c *EnclaveClient) DeliveryStatus(digestHash *[]byte) ([]api.DeliveryStatus, error) {
+	var statuses []api.DeliveryStatus
+	err := c.call(enclaveDeliveryStatus, enclaveKeyRequest{Key: *digestHash}, &statuses)
+	return statuses, err
+}
+
+// UpdatePartyInfo applies the provided binary encoded party details to the transaction
+// manager's party details store.
+func (c *EnclaveClient) UpdatePartyInfo(encoded []byte) {
+	c.pi.UpdatePartyInfo(encoded)
+}
+
+func (c *EnclaveClient) UpdatePartyInfoGrpc(
+	url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool) {
+
+	c.pi.UpdatePartyInfoGrpc(url, recipients, parties)
+}
+
+func (c *EnclaveClient) GetEncodedPartyInfo() []byte {
+	return api.EncodePartyInfo(c.pi.Snapshot())
+}
+
+func (c *EnclaveClient) GetEncodedPartyInfoGrpc() []byte {
+	encoded, err := json.Marshal(api.PartyInfoResponse{Payload: api.EncodePartyInfo(c.pi.Snapshot())})
+	if err != nil {
+		log.Errorf("Marshalling failed %v", err)
+	}
+	return encoded
+}
+
+func (c *EnclaveClient) GetPartyInfo() (string, map[[nacl.KeySize]byte]string, map[string]bool) {
+	return c.pi.GetAllValues()
+}
+
+func (c *EnclaveClient) GetPeerFilter() api.PeerFilter {
+	return c.pi.PeerFilter()
+}
+
+func (c *EnclaveClient) SetPeerFilter(filter api.PeerFilter) error {
+	return c.pi.SetPeerFilter(filter)
+}
+
+func (c *EnclaveClient) GetPeers() []api.PeerStatus {
+	return c.pi.Peers()
+}
+
+func (c *EnclaveClient) RefreshPartyInfo() {
+	c.pi.RefreshPartyInfo()
+}
+
+func (c *EnclaveClient) RetentionReport() (api.RetentionReport, error) {
+	var report api.RetentionReport
+	err := c.call(enclaveRetentionReport, struct{}{}, &report)
+	return report, err
+}
+
+// Backup writes the backup archive streamed by the enclave to w. The manifest returned does not
+// list the digests of the payloads archived, which are listed in the manifest within the archive.
+func (c *EnclaveClient) Backup(w io.Writer) (api.BackupManifest, error) {
+	resp, err := c.post(enclaveBackup, struct{}{})
+	if err != nil {
+		return api.BackupManifest{}, err
+	}
+	defer resp.Body.Close()
+
+	// Trailers are only available once the body has been read
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return api.BackupManifest{}, err
+	}
+	if message := resp.Trailer.Get(hBackupError); message != "" {
+		return api.BackupManifest{}, errors.New(message)
+	}
+	var manifest api.BackupManifest
+	err = json.Unmarshal([]byte(resp.Trailer.Get(hBackupManifest)), &manifest)
+	if err != nil {
+		return api.BackupManifest{}, fmt.Errorf("backup manifest not received from enclave, %v", err)
+	}
+	return manifest, nil
+}
+
+func (c *EnclaveClient) KeyPairs() api.KeysResponse {
+	var keys api.KeysResponse
+	logError(enclaveKeyPairs, c.call(enclaveKeyPairs, struct{}{}, &keys))
+	return keys
+}
+
+// AddKeyPair refuses to add the key pair, so that private keys are never uploaded to the
+// transaction manager.
+func (c *EnclaveClient) AddKeyPair(req api.KeyPairRequest) error {
+	return ErrKeyUpload
+}
+
+// RetireKeyPair retires the key pair in the enclave, then removes its binding to this node from
+// the party details.
+func (c *EnclaveClient) RetireKeyPair(pubKey []byte) error {
+	err := c.call(enclaveRetireKeyPair, enclaveData{Data: pubKey}, nil)
+	if err != nil {
+		return err
+	}
+	if err = c.SyncKeys(); err != nil {
+		return err
+	}
+	go c.pi.RefreshPartyInfo()
+	return nil
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/enclave"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serveTestEnclave serves the enclave over a socket in a new temporary directory, providing a
+// client of it holding the party details pi.
+func serveTestEnclave(
+	t *testing.T, enc StandaloneEnclave, pushes *PushQueue, pi *api.PartyInfo) (*EnclaveClient, func()) {
+
+	dir, err := ioutil.TempDir("", "TestEnclaveSocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := path.Join(dir, "enclave.ipc")
+	if err = ServeEnclave(enc, pushes, socketPath); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	client := NewEnclaveClient(socketPath, pi, http.DefaultClient)
+	return client, func() {
+		client.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func initStandaloneEnclave() (*enclave.SecureEnclave, *PushQueue) {
+	pushes := NewPushQueue()
+	enc := enclave.InitStandalone(
+		storage.InitMemoryDb(),
+		&enclave.FileKeyProvider{
+			PubKeyFiles:  []string{"../enclave/testdata/key.pub"},
+			PrivKeyFiles: []string{"../enclave/testdata/key"},
+		},
+		pushes)
+	return enc, pushes
+}
+
+func TestEnclaveClient(t *testing.T) {
+	pi := api.InitPartyInfo(
+		"http://localhost:9000",
+		[]string{"http://localhost:9001"}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+	enc, pushes := initStandaloneEnclave()
+
+	client, cleanup := serveTestEnclave(t, enc, pushes, pi)
+	defer cleanup()
+
+	digest, err := client.Store(&payload, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retrieved, err := client.RetrieveDefault(&digest)
+	if err != nil || !bytes.Equal(retrieved, payload) {
+		t.Errorf("Retrieved %q whereas %q is expected, error: %v", retrieved, payload, err)
+	}
+	to := (*enc.PubKeys[0])[:]
+	retrieved, err = client.Retrieve(&digest, &to)
+	if err != nil || !bytes.Equal(retrieved, payload) {
+		t.Errorf("Retrieved %q whereas %q is expected, error: %v", retrieved, payload, err)
+	}
+
+	// Errors of the enclave are reported by the client
+	unknown := []byte("unknown")
+	if _, err = client.RetrieveDefault(&unknown); err == nil {
+		t.Error("Payload retrieved for unknown digest")
+	}
+
+	// The party details are held by the client, with the enclave signing its key bindings
+	if err = client.SyncKeys(); err != nil {
+		t.Fatal(err)
+	}
+	url, recipients, _ := client.GetPartyInfo()
+	if url != "http://localhost:9000" || recipients[*enc.PubKeys[0]] != url {
+		t.Errorf("Unexpected party info %s, %v", url, recipients)
+	}
+	sig, ok := pi.Snapshot().Signatures[*enc.PubKeys[0]]
+	if !ok || !api.VerifyBinding(enc.PubKeys[0], url, sig) {
+		t.Error("Key binding not signed by the enclave")
+	}
+	if encoded := client.GetEncodedPartyInfo(); !bytes.Equal(encoded, api.EncodePartyInfo(pi.Snapshot())) {
+		t.Error("Encoded party info does not match the client's")
+	}
+
+	remoteKey := nacl.NewKey()
+	client.UpdatePartyInfoGrpc(
+		"http://localhost:9002",
+		map[[nacl.KeySize]byte]string{*remoteKey: "http://localhost:9002"},
+		map[string]bool{"http://localhost:9002": true})
+	if url, ok := pi.GetRecipient(remoteKey); !ok || url != "http://localhost:9002" {
+		t.Errorf("Party info not updated via client, url is %s", url)
+	}
+
+	if keys := client.KeyPairs(); !reflect.DeepEqual(keys, enc.KeyPairs()) {
+		t.Errorf("Key pairs %v do not match the enclave's %v", keys, enc.KeyPairs())
+	}
+	if err = client.RetireKeyPair((*enc.PubKeys[0])[:]); err == nil {
+		t.Error("Last key pair retired via client")
+	}
+	err = client.AddKeyPair(api.KeyPairRequest{PublicKey: base64.StdEncoding.EncodeToString(to)})
+	if err != ErrKeyUpload {
+		t.Errorf("Key pair upload not refused via client, error: %v", err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := client.Backup(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := enclave.VerifyBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Payloads != 1 || manifest.Checksum != verified.Checksum {
+		t.Errorf("Backup manifest %v does not match archive manifest %v", manifest, verified)
+	}
+
+	if err = client.Delete(&digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.RetrieveDefault(&digest); err == nil {
+		t.Error("Payload retrieved once deleted")
+	}
+}
+
+func TestEnclaveClientPush(t *testing.T) {
+	pushed := make(chan []byte, 1)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		pushed <- body
+	}))
+	defer node.Close()
+
+	pi := api.InitPartyInfo("http://localhost:9000", nil, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+	enc, pushes := initStandaloneEnclave()
+
+	client, cleanup := serveTestEnclave(t, enc, pushes, pi)
+	defer cleanup()
+	client.Run(time.Hour)
+
+	remoteKey, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.UpdatePartyInfoGrpc(
+		node.URL,
+		map[[nacl.KeySize]byte]string{*remoteKey: node.URL},
+		map[string]bool{node.URL: true})
+
+	// Payloads sealed by the enclave are pushed by the client
+	if _, err = client.Store(&payload, []byte{}, [][]byte{(*remoteKey)[:]}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-pushed:
+		epl, _ := api.DecodePayloadWithRecipients(body)
+		if !bytes.Equal((*epl.Sender)[:], (*enc.PubKeys[0])[:]) {
+			t.Errorf("Pushed payload sent by %x whereas %x is expected", *epl.Sender, *enc.PubKeys[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Payload not pushed via client")
+	}
+
+	// Payloads pushed by senders the client's peer filter denies are rejected before the enclave
+	err = client.SetPeerFilter(api.PeerFilter{
+		DeniedKeys: []string{base64.StdEncoding.EncodeToString((*remoteKey)[:])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	epl := api.EncryptedPayload{
+		Sender:         remoteKey,
+		CipherText:     payload,
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{payload},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	if _, err = client.StorePayload(api.EncodePayloadWithRecipients(epl, [][]byte{})); err == nil {
+		t.Error("Payload from denied sender stored via client")
+	}
+}
+
+func TestTransactionManagerWithEnclaveClient(t *testing.T) {
+	pi := api.InitPartyInfo("http://localhost:9000", nil, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+	client, cleanup := serveTestEnclave(t, &MockEnclave{}, NewPushQueue(), pi)
+	defer cleanup()
+
+	tm := TransactionManager{Enclave: client}
+
+	expected := api.ResendStatus{Id: mockResendJob, PublicKey: sender, Sent: 2, Done: true}
+	response := api.ResendStatus{}
+	runJsonHandlerTest(t, &api.ResendStatusRequest{Id: mockResendJob}, &response, &expected,
+		resendStatus, tm.resendStatus)
+
+	busyKey, _ := base64.StdEncoding.DecodeString(receiver)
+	if _, err := client.StartResend(busyKey, nil); err != api.ErrResendLimit {
+		t.Errorf("Resend limit not reported via client, error: %v", err)
+	}
+
+	report := api.RetentionReport{}
+	expectedReport, _ := (&MockEnclave{}).RetentionReport()
+	runSimpleJsonGetRequest(t, retention, &report, &expectedReport, tm.retention)
+
+	runSimpleGetRequest(t, backup, string(payload), tm.backup)
+
+	// Errors of the enclave are reported to callers of the transaction manager
+	unknown, err := json.Marshal(api.ResendStatusRequest{Id: "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runFailingRawHandlerTest(t, http.Header{}, unknown, nil, resendStatus, tm.resendStatus)
+
+	retireReq, err := json.Marshal(api.RetireKeyRequest{PublicKey: receiver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runFailingRawHandlerTest(t, http.Header{}, retireReq, nil, retireKey, tm.retireKey)
+}
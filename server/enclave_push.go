@@ -0,0 +1,201 @@
+package server
+
+import (
+	"errors"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pushWait is how long a transaction manager's request for the next payload to push waits for
+// the enclave to provide one.
+const pushWait = 30 * time.Second
+
+// pushTimeout is how long an enclave waits for its transaction manager to take a payload to push,
+// and then again for the result of the push, before the push fails.
+const pushTimeout = time.Minute
+
+// pushWorkers is the number of payloads a transaction manager pushes concurrently for its enclave.
+const pushWorkers = 4
+
+// enclavePush is a payload for the transaction manager to push to the node hosting recipient,
+// encoded without its recipients.
+type enclavePush struct {
+	Id        string `json:"id"`
+	Payload   []byte `json:"payload"`
+	Recipient []byte `json:"recipient"`
+}
+
+// enclavePushOutcome reports the result of a push to the enclave.
+type enclavePushOutcome struct {
+	Id    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// PushQueue is the Publisher of an enclave served by ServeEnclave. Rather than pushing payloads
+// itself, the enclave hands them to its transaction manager, which holds the party details, and
+// waits for the result of each push.
+type PushQueue struct {
+	next    uint64 // ID of the last push queued, first for 64-bit alignment
+	pushes  chan enclavePush
+	results sync.Map // Push ID -> channel of the result awaited
+}
+
+// NewPushQueue creates a PushQueue for an enclave, which must then be served by ServeEnclave.
+func NewPushQueue() *PushQueue {
+	return &PushQueue{pushes: make(chan enclavePush)}
+}
+
+// Publish pushes the payload to the node hosting recipient via the transaction manager.
+func (q *PushQueue) Publish(epl api.EncryptedPayload, recipient nacl.Key) error {
+	push := enclavePush{
+		Id:        strconv.FormatUint(atomic.AddUint64(&q.next, 1), 10),
+		Payload:   api.EncodePayloadWithRecipients(epl, [][]byte{}),
+		Recipient: (*recipient)[:],
+	}
+	result := make(chan error, 1)
+	q.results.Store(push.Id, result)
+	defer q.results.Delete(push.Id)
+
+	timeout := time.NewTimer(pushTimeout)
+	defer timeout.Stop()
+	select {
+	case q.pushes <- push:
+	case <-timeout.C:
+		return errors.New("payload not taken by the transaction manager to push")
+	}
+
+	timeout.Reset(pushTimeout)
+	select {
+	case err := <-result:
+		return err
+	case <-timeout.C:
+		return errors.New("push not completed by the transaction manager")
+	}
+}
+
+// take provides the next payload to push, or false if there is none within wait, or done is
+// closed first.
+func (q *PushQueue) take(wait time.Duration, done <-chan struct{}) (enclavePush, bool) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case push := <-q.pushes:
+		return push, true
+	case <-timer.C:
+	case <-done:
+	}
+	return enclavePush{}, false
+}
+
+// complete provides the result of a push to its publisher, unless it has stopped waiting.
+func (q *PushQueue) complete(r enclavePushOutcome) {
+	result, ok := q.results.Load(r.Id)
+	if !ok {
+		return
+	}
+
+	var err error
+	if r.Error != "" {
+		err = errors.New(r.Error)
+	}
+	select {
+	case result.(chan error) <- err:
+	default:
+		// The result has already been provided
+	}
+}
+
+// Run starts pushing the payloads of the enclave to other nodes, and registering the public keys
+// of its key pairs with the party details every interval, until Close is called.
+func (c *EnclaveClient) Run(interval time.Duration) {
+	for i := 0; i < pushWorkers; i++ {
+		go c.pushPayloads()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			logError(enclaveSignBindings, c.SyncKeys())
+			select {
+			case <-ticker.C:
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops pushing payloads and registering public keys for the enclave.
+func (c *EnclaveClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.quit)
+	})
+}
+
+// pushPayloads pushes each payload provided by the enclave, reporting the result to it.
+func (c *EnclaveClient) pushPayloads() {
+	for {
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+
+		var push enclavePush
+		if err := c.call(enclaveNextPush, struct{}{}, &push); err != nil {
+			logError(enclaveNextPush, err)
+			select {
+			case <-time.After(time.Second):
+			case <-c.quit:
+				return
+			}
+			continue
+		}
+		if push.Id == "" {
+			continue
+		}
+
+		result := enclavePushOutcome{Id: push.Id}
+		if err := c.push(push); err != nil {
+			result.Error = err.Error()
+		}
+		logError(enclavePushResult, c.call(enclavePushResult, result, nil))
+	}
+}
+
+func (c *EnclaveClient) push(p enclavePush) error {
+	recipient, err := utils.ToKey(p.Recipient)
+	if err != nil {
+		return err
+	}
+	epl, _ := api.DecodePayloadWithRecipients(p.Payload)
+	return c.pi.PushPayload(epl, recipient, c.pushClient)
+}
+
+// SyncKeys registers the public keys of the key pairs hosted by the enclave with the party
+// details, along with the signatures of their bindings to this node created by the enclave. Keys
+// which are no longer hosted are removed.
+func (c *EnclaveClient) SyncKeys() error {
+	var bindings []enclaveBinding
+	err := c.call(enclaveSignBindings, enclaveSignRequest{Url: c.pi.Snapshot().Url}, &bindings)
+	if err != nil {
+		return err
+	}
+
+	signatures := make(map[[nacl.KeySize]byte]api.KeySignature)
+	for _, binding := range bindings {
+		key, err := utils.ToKey(binding.Key)
+		if err != nil {
+			return err
+		}
+		signatures[*key] = api.KeySignature{Issued: binding.Issued, Signature: binding.Signature}
+	}
+	c.pi.SyncPublicKeys(signatures)
+	return nil
+}
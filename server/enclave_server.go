@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Paths of the operations of an enclave served over a Unix socket. Each is a POST request with a
+// JSON body, which is answered with a JSON body, or the error of the operation as text with an
+// internal server error status.
+const (
+	enclaveStore            = "/store"
+	enclaveStorePayload     = "/storepayload"
+	enclaveStorePayloadGrpc = "/storepayloadgrpc"
+	enclaveRetrieve         = "/retrieve"
+	enclaveRetrieveDefault  = "/retrievedefault"
+	enclaveRetrieveFor      = "/retrievefor"
+	enclaveStartResend      = "/startresend"
+	enclaveResendStatus     = "/resendstatus"
+	enclaveDelete           = "/delete"
+	enclaveDeliveryStatus   = "/deliverystatus"
+	enclaveRetentionReport  = "/retentionreport"
+	enclaveBackup           = "/backup"
+	enclaveKeyPairs         = "/keypairs"
+	enclaveRetireKeyPair    = "/retirekeypair"
+	enclaveSignBindings     = "/signbindings"
+	enclaveNextPush         = "/nextpush"
+	enclavePushResult       = "/pushresult"
+)
+
+// Trailers of the response to a backup request, which follow the archive.
+const hBackupManifest = "c11n-backup-manifest"
+const hBackupError = "c11n-backup-error"
+
+type enclaveStoreRequest struct {
+	Message    []byte   `json:"message"`
+	Sender     []byte   `json:"sender"`
+	Recipients [][]byte `json:"recipients"`
+}
+
+type enclavePayloadRequest struct {
+	Payload api.EncryptedPayload `json:"payload"`
+	Encoded []byte               `json:"encoded"`
+}
+
+// enclaveKeyRequest identifies a payload by its digest, along with the recipient to retrieve it for
+// if required.
+type enclaveKeyRequest struct {
+	Key []byte `json:"key"`
+	To  []byte `json:"to,omitempty"`
+}
+
+type enclaveResendRequest struct {
+	Recipient []byte `json:"recipient"`
+	Cursor    []byte `json:"cursor"`
+	Id        string `json:"id"`
+}
+
+// enclaveData is a request or response consisting of a single value.
+type enclaveData struct {
+	Data []byte `json:"data"`
+}
+
+// enclaveSignRequest requests the signatures of the bindings of the enclave's public keys to the
+// URL of this node.
+type enclaveSignRequest struct {
+	Url string `json:"url"`
+}
+
+// enclaveBinding is the binding of a public key hosted by the enclave to the URL of this node,
+// without a signature if it could not be signed.
+type enclaveBinding struct {
+	Key       []byte `json:"key"`
+	Issued    int64  `json:"issued"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// StandaloneEnclave is an Enclave which can be served to a transaction manager in another
+// process. As the transaction manager holds the party details, the enclave signs the bindings of
+// its public keys to this node for it.
+type StandaloneEnclave interface {
+	Enclave
+	SignBindings(url string) map[[nacl.KeySize]byte]api.KeySignature
+}
+
+// enclaveServer serves the operations of an enclave running in this process to a transaction
+// manager in another.
+type enclaveServer struct {
+	enc    StandaloneEnclave
+	pushes *PushQueue
+}
+
+// ServeEnclave serves the operations of the enclave over the Unix socket at socketPath, so that
+// the transaction manager handling public HTTP and gRPC traffic can run in a separate process,
+// using an EnclaveClient. The enclave only seals and opens payloads, with those it publishes to
+// pushes being pushed to other nodes by the transaction manager.
+func ServeEnclave(enc StandaloneEnclave, pushes *PushQueue, socketPath string) error {
+	s := enclaveServer{enc: enc, pushes: pushes}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(enclaveStore, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveStoreRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			key, err := s.enc.Store(&r.Message, r.Sender, r.Recipients)
+			return enclaveData{Data: key}, err
+		})
+	})
+	mux.HandleFunc(enclaveStorePayload, func(w http.ResponseWriter, req *http.Request) {
+		var r enclavePayloadRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			key, err := s.enc.StorePayload(r.Encoded)
+			return enclaveData{Data: key}, err
+		})
+	})
+	mux.HandleFunc(enclaveStorePayloadGrpc, func(w http.ResponseWriter, req *http.Request) {
+		var r enclavePayloadRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			key, err := s.enc.StorePayloadGrpc(r.Payload, r.Encoded)
+			return enclaveData{Data: key}, err
+		})
+	})
+	mux.HandleFunc(enclaveRetrieve, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveKeyRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			payload, err := s.enc.Retrieve(&r.Key, &r.To)
+			return enclaveData{Data: payload}, err
+		})
+	})
+	mux.HandleFunc(enclaveRetrieveDefault, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveKeyRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			payload, err := s.enc.RetrieveDefault(&r.Key)
+			return enclaveData{Data: payload}, err
+		})
+	})
+	mux.HandleFunc(enclaveRetrieveFor, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveKeyRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			encoded, err := s.enc.RetrieveFor(&r.Key, &r.To)
+			if err != nil || encoded == nil {
+				return enclaveData{}, err
+			}
+			return enclaveData{Data: *encoded}, nil
+		})
+	})
+	mux.HandleFunc(enclaveStartResend, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveResendRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			return s.enc.StartResend(r.Recipient, r.Cursor)
+		})
+	})
+	mux.HandleFunc(enclaveResendStatus, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveResendRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			return s.enc.ResendStatus(r.Id)
+		})
+	})
+	mux.HandleFunc(enclaveDelete, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveKeyRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			return struct{}{}, s.enc.Delete(&r.Key)
+		})
+	})
+	mux.HandleFunc(enclaveDeliveryStatus, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveKeyRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			return s.enc.DeliveryStatus(&r.Key)
+		})
+	})
+	mux.HandleFunc(enclaveRetentionReport, func(w http.ResponseWriter, req *http.Request) {
+		s.handle(w, req, nil, func() (interface{}, error) {
+			return s.enc.RetentionReport()
+		})
+	})
+	mux.HandleFunc(enclaveBackup, s.backup)
+	mux.HandleFunc(enclaveKeyPairs, func(w http.ResponseWriter, req *http.Request) {
+		s.handle(w, req, nil, func() (interface{}, error) {
+			return s.enc.KeyPairs(), nil
+		})
+	})
+	mux.HandleFunc(enclaveRetireKeyPair, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveData
+		s.handle(w, req, &r, func() (interface{}, error) {
+			return struct{}{}, s.enc.RetireKeyPair(r.Data)
+		})
+	})
+	mux.HandleFunc(enclaveSignBindings, func(w http.ResponseWriter, req *http.Request) {
+		var r enclaveSignRequest
+		s.handle(w, req, &r, func() (interface{}, error) {
+			bindings := []enclaveBinding{}
+			for key, sig := range s.enc.SignBindings(r.Url) {
+				k := key
+				bindings = append(bindings,
+					enclaveBinding{Key: k[:], Issued: sig.Issued, Signature: sig.Signature})
+			}
+			return bindings, nil
+		})
+	})
+	mux.HandleFunc(enclaveNextPush, func(w http.ResponseWriter, req *http.Request) {
+		s.handle(w, req, nil, func() (interface{}, error) {
+			// No payload is provided if there is none to push within the wait
+			push, _ := s.pushes.take(pushWait, req.Context().Done())
+			return push, nil
+		})
+	})
+	mux.HandleFunc(enclavePushResult, func(w http.ResponseWriter, req *http.Request) {
+		var r enclavePushOutcome
+		s.handle(w, req, &r, func() (interface{}, error) {
+			s.pushes.complete(r)
+			return struct{}{}, nil
+		})
+	})
+
+	listener, err := utils.CreateIpcSocket(socketPath)
+	if err != nil {
+		return fmt.Errorf("unable to create enclave socket at %s, error: %v", socketPath, err)
+	}
+	go func() {
+		log.Fatal(http.Serve(listener, requestLogger(mux)))
+	}()
+	log.Infof("Enclave server is running at: %s", socketPath)
+	return nil
+}
+
+// handle decodes the request into request, if provided, then responds with the result of the
+// operation.
+func (s *enclaveServer) handle(
+	w http.ResponseWriter,
+	req *http.Request,
+	request interface{},
+	operation func() (interface{}, error)) {
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if request != nil {
+		err := json.NewDecoder(req.Body).Decode(request)
+		req.Body.Close()
+		if err != nil {
+			invalidBody(w, req, err)
+			return
+		}
+	}
+
+	result, err := operation()
+	if err != nil {
+		// The error is reported to the transaction manager, which logs it
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// backup streams a backup archive of the enclave's storage, followed by trailers holding the
+// manifest of the archive, without its digests, or the reason it could not be completed.
+func (s *enclaveServer) backup(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Trailer", hBackupManifest+", "+hBackupError)
+	w.Header().Set("Content-Type", "application/gzip")
+
+	manifest, err := s.enc.Backup(w)
+	if err != nil {
+		w.Header().Set(hBackupError, err.Error())
+		return
+	}
+	// The digests are listed in the manifest within the archive, and may be too many for a trailer
+	manifest.Digests = nil
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		w.Header().Set(hBackupError, err.Error())
+		return
+	}
+	w.Header().Set(hBackupManifest, string(encoded))
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// The Chimera API cannot be extended, so additional gRPC services are defined by hand, with
+// messages encoded as JSON. Clients must call them using the "json" content subtype, e.g.
+// grpc.CallContentSubtype(JsonCodecName).
+
+// JsonCodecName is the gRPC content subtype of services which are not part of the Chimera API.
+const JsonCodecName = "json"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return JsonCodecName
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// PeersMethod is the full name of the gRPC method providing the liveness state of the other
+// nodes on the network.
+const PeersMethod = "/crux.Peers/Peers"
+
+// RefreshMethod is the full name of the gRPC method which immediately requests party details
+// from the other nodes on the network.
+const RefreshMethod = "/crux.Peers/Refresh"
+
+// PeersServer is the gRPC service providing the liveness state of the other nodes on the
+// network.
+type PeersServer interface {
+	Peers(context.Context, *api.PeersRequest) (*api.PeersResponse, error)
+	Refresh(context.Context, *api.PeersRequest) (*api.PeersResponse, error)
+}
+
+// RegisterPeersServer registers the PeersServer with the gRPC server.
+func RegisterPeersServer(s *grpc.Server, srv PeersServer) {
+	s.RegisterService(&peersServiceDesc, srv)
+}
+
+func peersHandler(
+	srv interface{},
+	ctx context.Context,
+	dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	return handlePeersRequest(srv.(PeersServer).Peers, PeersMethod, srv, ctx, dec, interceptor)
+}
+
+func refreshHandler(
+	srv interface{},
+	ctx context.Context,
+	dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	return handlePeersRequest(srv.(PeersServer).Refresh, RefreshMethod, srv, ctx, dec, interceptor)
+}
+
+func handlePeersRequest(
+	method func(context.Context, *api.PeersRequest) (*api.PeersResponse, error),
+	fullMethod string,
+	srv interface{},
+	ctx context.Context,
+	dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	in := new(api.PeersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return method(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: fullMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return method(ctx, req.(*api.PeersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var peersServiceDesc = grpc.ServiceDesc{
+	ServiceName: "crux.Peers",
+	HandlerType: (*PeersServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Peers",
+			Handler:    peersHandler,
+		},
+		{
+			MethodName: "Refresh",
+			Handler:    refreshHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "peers",
+}
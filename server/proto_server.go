@@ -18,9 +18,12 @@ func (tm *TransactionManager) startRpcServer(networkInterface string, port int,
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	s := Server{Enclave: tm.Enclave}
+	s := Server{Enclave: tm.Enclave, DeliveryPolicy: tm.DeliveryPolicy}
 	grpcServer := grpc.NewServer()
 	chimera.RegisterClientServer(grpcServer, &s)
+	RegisterPeersServer(grpcServer, &s)
+	RegisterResendServer(grpcServer, &s)
+	RegisterBackupServer(grpcServer, &s)
 	go func() {
 		log.Fatal(grpcServer.Serve(lis))
 	}()
@@ -73,9 +76,12 @@ func (tm *TransactionManager) startRestServer(networkInterface string, port int)
 	if err != nil {
 		panic(err)
 	}
-	s := Server{Enclave: tm.Enclave}
+	s := Server{Enclave: tm.Enclave, DeliveryPolicy: tm.DeliveryPolicy}
 	grpcServer := grpc.NewServer()
 	chimera.RegisterClientServer(grpcServer, &s)
+	RegisterPeersServer(grpcServer, &s)
+	RegisterResendServer(grpcServer, &s)
+	RegisterBackupServer(grpcServer, &s)
 	go func() {
 		log.Fatal(grpcServer.Serve(lis))
 	}()
@@ -105,7 +111,7 @@ func (tm *TransactionManager) startRestServerTLS(networkInterface string, port i
 	if err != nil {
 		log.Fatalf("failed to start gRPC REST server: %s", err)
 	}
-	s := Server{Enclave: tm.Enclave}
+	s := Server{Enclave: tm.Enclave, DeliveryPolicy: tm.DeliveryPolicy}
 	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
 	opts := []grpc.ServerOption{grpc.Creds(creds)}
 	if err != nil {
@@ -113,6 +119,9 @@ func (tm *TransactionManager) startRestServerTLS(networkInterface string, port i
 	}
 	grpcServer := grpc.NewServer(opts...)
 	chimera.RegisterClientServer(grpcServer, &s)
+	RegisterPeersServer(grpcServer, &s)
+	RegisterResendServer(grpcServer, &s)
+	RegisterBackupServer(grpcServer, &s)
 	go func() {
 		log.Fatal(grpcServer.Serve(lis))
 	}()
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/blk-io/crux/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// ResendStatusMethod is the full name of the gRPC method providing the progress of a job started
+// by a resend request of type "all". As with the PeersMethod, it must be called using the "json"
+// content subtype.
+const ResendStatusMethod = "/crux.Resend/Status"
+
+// ResendServer is the gRPC service providing the progress of resend jobs.
+type ResendServer interface {
+	ResendStatus(context.Context, *api.ResendStatusRequest) (*api.ResendStatus, error)
+}
+
+// RegisterResendServer registers the ResendServer with the gRPC server.
+func RegisterResendServer(s *grpc.Server, srv ResendServer) {
+	s.RegisterService(&resendServiceDesc, srv)
+}
+
+func resendStatusHandler(
+	srv interface{},
+	ctx context.Context,
+	dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	in := new(api.ResendStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ResendServer).ResendStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ResendStatusMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ResendServer).ResendStatus(ctx, req.(*api.ResendStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var resendServiceDesc = grpc.ServiceDesc{
+	ServiceName: "crux.Resend",
+	HandlerType: (*ResendServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Status",
+			Handler:    resendStatusHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "resend",
+}
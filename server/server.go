@@ -10,12 +10,15 @@ import (
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/textproto"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Enclave is the interface used by the transaction enclaves.
@@ -26,18 +29,30 @@ type Enclave interface {
 	Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error)
 	RetrieveDefault(digestHash *[]byte) ([]byte, error)
 	RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*[]byte, error)
-	RetrieveAllFor(reqRecipient *[]byte) error
+	StartResend(recipient, cursor []byte) (api.ResendStatus, error)
+	ResendStatus(id string) (api.ResendStatus, error)
 	Delete(digestHash *[]byte) error
+	DeliveryStatus(digestHash *[]byte) ([]api.DeliveryStatus, error)
 	UpdatePartyInfo(encoded []byte)
 	UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool)
 	GetEncodedPartyInfo() []byte
 	GetEncodedPartyInfoGrpc() []byte
 	GetPartyInfo() (url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool)
+	GetPeerFilter() api.PeerFilter
+	SetPeerFilter(filter api.PeerFilter) error
+	GetPeers() []api.PeerStatus
+	RefreshPartyInfo()
+	RetentionReport() (api.RetentionReport, error)
+	Backup(w io.Writer) (api.BackupManifest, error)
+	KeyPairs() api.KeysResponse
+	AddKeyPair(req api.KeyPairRequest) error
+	RetireKeyPair(pubKey []byte) error
 }
 
 // TransactionManager is responsible for handling all transaction requests.
 type TransactionManager struct {
-	Enclave Enclave
+	Enclave        Enclave
+	DeliveryPolicy string // The default delivery policy applied to send requests
 }
 
 const upCheckResponse = "I'm up!"
@@ -47,16 +62,30 @@ const version = "/version"
 const upCheck = "/upcheck"
 const push = "/push"
 const resend = "/resend"
+const resendStatus = "/resendstatus"
 const partyInfo = "/partyinfo"
 const send = "/send"
 const sendRaw = "/sendraw"
 const receive = "/receive"
 const receiveRaw = "/receiveraw"
 const delete = "/delete"
+const deliveryStatus = "/deliverystatus"
+const peerFilter = "/peerfilter"
+const peers = "/peers"
+const refreshPartyInfo = "/partyinfo/refresh"
+const retention = "/retention"
+const backup = "/backup"
+const keys = "/keys"
+const retireKey = "/keys/retire"
 
 const hFrom = "c11n-from"
 const hTo = "c11n-to"
 const hKey = "c11n-key"
+const hDeliveryPolicy = "c11n-delivery-policy"
+const hDelivered = "c11n-delivered"
+const hFailed = "c11n-failed"
+const hResendCursor = "c11n-resend-cursor"
+const hResendJob = "c11n-resend-job"
 
 func requestLogger(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -75,9 +104,13 @@ func requestLogger(handler http.Handler) http.Handler {
 }
 
 // Init initializes a new TransactionManager instance.
-func Init(enc Enclave, networkInterface string, port int, ipcPath string, grpc bool, grpcJsonPort int, tls bool, certFile, keyFile string) (TransactionManager, error) {
-	tm := TransactionManager{Enclave: enc}
-	var err error
+func Init(enc Enclave, networkInterface string, port int, ipcPath string, grpc bool, grpcJsonPort int, tls bool, certFile, keyFile string, deliveryPolicy string) (TransactionManager, error) {
+	err := api.ValidateDeliveryPolicy(deliveryPolicy)
+	if err != nil {
+		return TransactionManager{}, err
+	}
+
+	tm := TransactionManager{Enclave: enc, DeliveryPolicy: deliveryPolicy}
 	if grpc == true {
 		err = tm.startRpcServer(networkInterface, port, grpcJsonPort, ipcPath, tls, certFile, keyFile)
 
@@ -94,6 +127,7 @@ func (tm *TransactionManager) startHttpserver(networkInterface string, port int,
 	httpServer.HandleFunc(version, tm.version)
 	httpServer.HandleFunc(push, tm.push)
 	httpServer.HandleFunc(resend, tm.resend)
+	httpServer.HandleFunc(resendStatus, tm.resendStatus)
 	httpServer.HandleFunc(partyInfo, tm.partyInfo)
 
 	serverUrl := networkInterface + ":" + strconv.Itoa(port)
@@ -122,6 +156,14 @@ func (tm *TransactionManager) startHttpserver(networkInterface string, port int,
 	ipcServer.HandleFunc(receive, tm.receive)
 	ipcServer.HandleFunc(receiveRaw, tm.receiveRaw)
 	ipcServer.HandleFunc(delete, tm.delete)
+	ipcServer.HandleFunc(deliveryStatus, tm.deliveryStatus)
+	ipcServer.HandleFunc(peerFilter, tm.peerFilter)
+	ipcServer.HandleFunc(peers, tm.peers)
+	ipcServer.HandleFunc(refreshPartyInfo, tm.refreshPartyInfo)
+	ipcServer.HandleFunc(retention, tm.retention)
+	ipcServer.HandleFunc(backup, tm.backup)
+	ipcServer.HandleFunc(keys, tm.keys)
+	ipcServer.HandleFunc(retireKey, tm.retireKey)
 
 	ipc, err := utils.CreateIpcSocket(ipcPath)
 	if err != nil {
@@ -167,6 +209,12 @@ func (s *TransactionManager) send(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	policy, err := s.deliveryPolicy(sendReq.DeliveryPolicy)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
 	var key []byte
 	key, err = s.processSend(w, req, sendReq.From, sendReq.To, &payload)
 
@@ -177,9 +225,15 @@ func (s *TransactionManager) send(w http.ResponseWriter, req *http.Request) {
 				key, payload, err))
 	} else {
 		encodedKey := base64.StdEncoding.EncodeToString(key)
-		sendResp := api.SendResponse{Key: encodedKey}
-		json.NewEncoder(w).Encode(sendResp)
+		delivered, failed, err := s.checkDelivery(key, policy)
+		sendResp := api.SendResponse{Key: encodedKey, Delivered: delivered, Failed: failed}
+
 		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			log.WithField("key", encodedKey).Error(err)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(sendResp)
 	}
 }
 
@@ -202,6 +256,12 @@ func (s *TransactionManager) sendRaw(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	policy, err := s.deliveryPolicy(req.Header.Get(hDeliveryPolicy))
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
 	var key []byte
 	key, err = s.processSend(w, req, from, to, &payload)
 	if err != nil {
@@ -209,6 +269,21 @@ func (s *TransactionManager) sendRaw(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	delivered, failed, err := s.checkDelivery(key, policy)
+	if len(delivered) > 0 {
+		w.Header().Set(hDelivered, strings.Join(delivered, ","))
+	}
+	if len(failed) > 0 {
+		w.Header().Set(hFailed, strings.Join(failed, ","))
+	}
+	if err != nil {
+		// Clients treat the body of a response as the key of the transaction, so none is returned
+		// for transactions which have not been delivered
+		log.WithField("key", base64.StdEncoding.EncodeToString(key)).Error(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
 	// Uncomment the below for Quorum v2.0.1 or below
 	// see https://github.com/jpmorganchase/quorum/commit/ee498061b5a74bf1f3290139a53840345fa038cb#diff-63fbbd6b2c0487b8cd4445e881822cdd
 	//w.Write(key)
@@ -249,6 +324,41 @@ func (s *TransactionManager) processSend(
 	return s.Enclave.Store(payload, sender, recipients)
 }
 
+// deliveryPolicy resolves the delivery policy for a send request, falling back to the default
+// policy if none was specified.
+func (s *TransactionManager) deliveryPolicy(requested string) (string, error) {
+	return resolveDeliveryPolicy(requested, s.DeliveryPolicy)
+}
+
+// checkDelivery reports which recipients have acknowledged the transaction with the given key,
+// returning an error if the delivery policy has not been satisfied.
+//
+// The policy is checked once the transaction has been pushed to each recipient a single time,
+// without waiting for retries. Recipients which did not acknowledge that push are reported as
+// failed, although propagation to them continues to be retried in the background.
+func (s *TransactionManager) checkDelivery(key []byte, policy string) ([]string, []string, error) {
+	return checkDelivery(s.Enclave, key, policy)
+}
+
+func resolveDeliveryPolicy(requested, defaultPolicy string) (string, error) {
+	policy := requested
+	if policy == "" {
+		policy = defaultPolicy
+	}
+	if policy == "" {
+		policy = api.DeliverBestEffort
+	}
+	return policy, api.ValidateDeliveryPolicy(policy)
+}
+
+func checkDelivery(enc Enclave, key []byte, policy string) ([]string, []string, error) {
+	statuses, err := enc.DeliveryStatus(&key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return api.CheckDelivery(policy, statuses)
+}
+
 func (s *TransactionManager) receive(w http.ResponseWriter, req *http.Request) {
 	var receiveReq api.ReceiveRequest
 	err := json.NewDecoder(req.Body).Decode(&receiveReq)
@@ -332,6 +442,166 @@ func (s *TransactionManager) delete(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (s *TransactionManager) deliveryStatus(w http.ResponseWriter, req *http.Request) {
+	var statusReq api.DeliveryStatusRequest
+	err := json.NewDecoder(req.Body).Decode(&statusReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(statusReq.Key)
+	if err != nil {
+		decodeError(w, req, "key", statusReq.Key, err)
+		return
+	}
+
+	statuses, err := s.Enclave.DeliveryStatus(&key)
+	if err != nil {
+		badRequest(w,
+			fmt.Sprintf("Unable to retrieve delivery status for key: %s, error: %s\n",
+				statusReq.Key, err))
+		return
+	}
+
+	statusResp := api.DeliveryStatusResponse{Key: statusReq.Key, Recipients: statuses}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statusResp)
+}
+
+// peerFilter provides the filter applied to the other nodes on the network, replacing it first
+// if a new filter is provided via a POST or PUT request.
+func (s *TransactionManager) peerFilter(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		var filter api.PeerFilter
+		err := json.NewDecoder(req.Body).Decode(&filter)
+		req.Body.Close()
+		if err != nil {
+			invalidBody(w, req, err)
+			return
+		}
+
+		err = s.Enclave.SetPeerFilter(filter)
+		if err != nil {
+			badRequest(w, fmt.Sprintf("Unable to apply peer filter, error: %s\n", err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Enclave.GetPeerFilter())
+}
+
+// peers provides the liveness state of the other nodes on the network.
+func (s *TransactionManager) peers(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.PeersResponse{Peers: s.Enclave.GetPeers()})
+}
+
+// refreshPartyInfo immediately requests party details from all other nodes on the network,
+// providing their liveness state once complete.
+func (s *TransactionManager) refreshPartyInfo(w http.ResponseWriter, req *http.Request) {
+	s.Enclave.RefreshPartyInfo()
+	s.peers(w, req)
+}
+
+// retention provides the payloads which would currently be removed by the retention policy,
+// without removing them.
+func (s *TransactionManager) retention(w http.ResponseWriter, req *http.Request) {
+	report, err := s.Enclave.RetentionReport()
+	if err != nil {
+		internalServerError(w, fmt.Sprintf("Unable to apply retention policy, error: %s\n", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// backup streams a backup archive of the node's storage, which is a snapshot of it at the time of
+// the request if the storage supports them.
+func (s *TransactionManager) backup(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"crux-%s.tar.gz\"",
+		time.Now().UTC().Format("20060102T150405Z")))
+
+	archive := &countingWriter{w: w}
+	manifest, err := s.Enclave.Backup(archive)
+	if err != nil && archive.written == 0 {
+		internalServerError(w, fmt.Sprintf("Unable to create backup, error: %s\n", err))
+		return
+	} else if err != nil {
+		// The archive is incomplete, which is detected on restore as it lacks a manifest
+		log.Errorf("Unable to complete backup, error: %v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"payloads": manifest.Payloads, "records": manifest.Records, "bytes": archive.written,
+	}).Info("Created backup")
+}
+
+// keys provides the public keys of the key pairs hosted by the node, and of those retired, adding
+// a key pair first if one is provided via a POST or PUT request.
+func (s *TransactionManager) keys(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		var keyPairReq api.KeyPairRequest
+		err := json.NewDecoder(req.Body).Decode(&keyPairReq)
+		req.Body.Close()
+		if err != nil {
+			invalidBody(w, req, err)
+			return
+		}
+
+		err = s.Enclave.AddKeyPair(keyPairReq)
+		if err != nil {
+			badRequest(w, fmt.Sprintf("Unable to add key pair, error: %s\n", err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Enclave.KeyPairs())
+}
+
+// retireKey stops the node using the key pair with the public key provided for new payloads.
+// Payloads exchanged with it can still be retrieved.
+func (s *TransactionManager) retireKey(w http.ResponseWriter, req *http.Request) {
+	var retireReq api.RetireKeyRequest
+	err := json.NewDecoder(req.Body).Decode(&retireReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(retireReq.PublicKey)
+	if err != nil {
+		decodeError(w, req, "publicKey", retireReq.PublicKey, err)
+		return
+	}
+
+	err = s.Enclave.RetireKeyPair(publicKey)
+	if err != nil {
+		badRequest(w, fmt.Sprintf("Unable to retire key pair, error: %s\n", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Enclave.KeyPairs())
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
 func (s *TransactionManager) push(w http.ResponseWriter, req *http.Request) {
 	payload, err := ioutil.ReadAll(req.Body)
 	req.Body.Close()
@@ -366,10 +636,25 @@ func (s *TransactionManager) resend(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if resendReq.Type == "all" {
-		err = s.Enclave.RetrieveAllFor(&publicKey)
+		var cursor []byte
+		cursor, err = base64.StdEncoding.DecodeString(resendReq.Cursor)
 		if err != nil {
-			invalidBody(w, req, err)
+			decodeError(w, req, "cursor", resendReq.Cursor, err)
+			return
+		}
+
+		var status api.ResendStatus
+		status, err = s.Enclave.StartResend(publicKey, cursor)
+		if err == api.ErrResendLimit {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, "Unable to start resend, error: %s\n", err)
+			return
+		} else if err != nil {
+			internalServerError(w, fmt.Sprintf("Unable to start resend, error: %s\n", err))
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
 	} else if resendReq.Type == "individual" {
 		var key []byte
 		key, err = base64.StdEncoding.DecodeString(resendReq.Key)
@@ -388,6 +673,25 @@ func (s *TransactionManager) resend(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// resendStatus provides the progress of a job started by a resend request of type "all".
+func (s *TransactionManager) resendStatus(w http.ResponseWriter, req *http.Request) {
+	var statusReq api.ResendStatusRequest
+	err := json.NewDecoder(req.Body).Decode(&statusReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	status, err := s.Enclave.ResendStatus(statusReq.Id)
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
 func (s *TransactionManager) partyInfo(w http.ResponseWriter, req *http.Request) {
 	payload, err := ioutil.ReadAll(req.Body)
 	req.Body.Close()
@@ -10,10 +10,15 @@ import (
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
-	Enclave Enclave
+	Enclave        Enclave
+	DeliveryPolicy string // The default delivery policy applied to send requests
 }
 
 func (s *Server) Version(ctx context.Context, in *chimera.ApiVersion) (*chimera.ApiVersion, error) {
@@ -23,15 +28,37 @@ func (s *Server) Version(ctx context.Context, in *chimera.ApiVersion) (*chimera.
 func (s *Server) Upcheck(ctx context.Context, in *chimera.UpCheckResponse) (*chimera.UpCheckResponse, error) {
 	return &chimera.UpCheckResponse{Message: upCheckResponse}, nil
 }
+
+// Send stores and propagates a transaction. The delivery policy may be provided via the
+// c11n-delivery-policy request metadata, and the recipients which did and did not acknowledge the
+// transaction are returned in the c11n-delivered and c11n-failed trailers.
 func (s *Server) Send(ctx context.Context, in *chimera.SendRequest) (*chimera.SendResponse, error) {
+	var requested string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(hDeliveryPolicy); len(values) > 0 {
+			requested = values[0]
+		}
+	}
+	policy, err := resolveDeliveryPolicy(requested, s.DeliveryPolicy)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	key, err := s.processSend(in.GetFrom(), in.GetTo(), &in.Payload)
 	var sendResp chimera.SendResponse
 	if err != nil {
 		log.Error(err)
-	} else {
-		sendResp = chimera.SendResponse{Key: key}
+		return &sendResp, err
 	}
-	return &sendResp, err
+	sendResp = chimera.SendResponse{Key: key}
+
+	delivered, failed, err := checkDelivery(s.Enclave, key, policy)
+	grpc.SetTrailer(ctx, metadata.MD{hDelivered: delivered, hFailed: failed})
+	if err != nil {
+		log.WithField("key", base64.StdEncoding.EncodeToString(key)).Error(err)
+		return &sendResp, status.Error(codes.Unavailable, err.Error())
+	}
+	return &sendResp, nil
 }
 
 func (s *Server) processSend(b64from string, b64recipients []string, payload *[]byte) ([]byte, error) {
@@ -86,13 +113,19 @@ func (s *Server) processReceive(b64Key []byte, b64To string) ([]byte, error) {
 }
 
 func (s *Server) UpdatePartyInfo(ctx context.Context, in *chimera.PartyInfo) (*chimera.PartyInfoResponse, error) {
-	recipients := make(map[[nacl.KeySize]byte]string)
-	for url, key := range in.Recipients {
-		var as [32]byte
-		copy(as[:], key)
-		recipients[as] = url
+	// Signed party details are sent as metadata by nodes that support it
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(api.PartyInfoMetadata); len(values) > 0 {
+		s.Enclave.UpdatePartyInfo([]byte(values[0]))
+	} else {
+		recipients := make(map[[nacl.KeySize]byte]string)
+		for url, key := range in.Recipients {
+			var as [32]byte
+			copy(as[:], key)
+			recipients[as] = url
+		}
+		s.Enclave.UpdatePartyInfoGrpc(in.Url, recipients, in.Parties)
 	}
-	s.Enclave.UpdatePartyInfoGrpc(in.Url, recipients, in.Parties)
 	encoded := s.Enclave.GetEncodedPartyInfoGrpc()
 	var decodedPartyInfo chimera.PartyInfoResponse
 	err := json.Unmarshal(encoded, &decodedPartyInfo)
@@ -102,6 +135,18 @@ func (s *Server) UpdatePartyInfo(ctx context.Context, in *chimera.PartyInfo) (*c
 	return &chimera.PartyInfoResponse{Payload: decodedPartyInfo.Payload}, nil
 }
 
+// Peers provides the liveness state of the other nodes on the network.
+func (s *Server) Peers(ctx context.Context, in *api.PeersRequest) (*api.PeersResponse, error) {
+	return &api.PeersResponse{Peers: s.Enclave.GetPeers()}, nil
+}
+
+// Refresh immediately requests party details from all other nodes on the network, providing
+// their liveness state once complete.
+func (s *Server) Refresh(ctx context.Context, in *api.PeersRequest) (*api.PeersResponse, error) {
+	s.Enclave.RefreshPartyInfo()
+	return s.Peers(ctx, in)
+}
+
 func (s *Server) Push(ctx context.Context, in *chimera.PushPayload) (*chimera.PartyInfoResponse, error) {
 	sender := new([nacl.KeySize]byte)
 	nonce := new([nacl.NonceSize]byte)
@@ -120,7 +165,7 @@ func (s *Server) Push(ctx context.Context, in *chimera.PushPayload) (*chimera.Pa
 
 	digestHash, err := s.Enclave.StorePayloadGrpc(encyptedPayload, in.Encoded)
 	if err != nil {
-		log.Fatalf("Unable to store payload, error: %s\n", err)
+		return nil, status.Errorf(codes.InvalidArgument, "unable to store payload: %v", err)
 	}
 
 	return &chimera.PartyInfoResponse{Payload: digestHash}, nil
@@ -135,26 +180,53 @@ func (s *Server) Delete(ctx context.Context, in *chimera.DeleteRequest) (*chimer
 	return &chimera.DeleteRequest{Key: deleteReq.Key}, nil
 }
 
+// Resend resends previous transactions. For requests of type "all", a job is started in the
+// background, whose ID is returned in the c11n-resend-job trailer and whose progress is available
+// via the ResendStatusMethod. The job resumes from the cursor of an earlier job if one is provided
+// via the c11n-resend-cursor request metadata.
 func (s *Server) Resend(ctx context.Context, in *chimera.ResendRequest) (*chimera.ResendResponse, error) {
-	var resendReq chimera.ResendRequest
 	var err error
 
-	if resendReq.Type == "all" {
-		err = s.Enclave.RetrieveAllFor(&resendReq.PublicKey)
-		if err != nil {
-			log.Fatalf("Invalid body, exited with %s", err)
+	if in.Type == "all" {
+		var cursor []byte
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(hResendCursor); len(values) > 0 {
+				cursor, err = base64.StdEncoding.DecodeString(values[0])
+				if err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+			}
 		}
-		return nil, err
-	} else if resendReq.Type == "individual" {
+
+		var resendStatus api.ResendStatus
+		resendStatus, err = s.Enclave.StartResend(in.PublicKey, cursor)
+		if err == api.ErrResendLimit {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		grpc.SetTrailer(ctx, metadata.Pairs(hResendJob, resendStatus.Id))
+		return &chimera.ResendResponse{}, nil
+	} else if in.Type == "individual" {
 		var encodedPl *[]byte
-		encodedPl, err = s.Enclave.RetrieveFor(&resendReq.Key, &resendReq.PublicKey)
+		encodedPl, err = s.Enclave.RetrieveFor(&in.Key, &in.PublicKey)
 		if err != nil {
-			log.Fatalf("Invalid body, exited with %s", err)
-			return nil, err
+			return nil, status.Error(codes.NotFound, err.Error())
 		}
 		return &chimera.ResendResponse{Encoded: *encodedPl}, nil
 	}
-	return nil, err
+	return nil, status.Errorf(codes.InvalidArgument, "unknown resend type: %s", in.Type)
+}
+
+// ResendStatus provides the progress of a job started by a resend request of type "all".
+func (s *Server) ResendStatus(
+	ctx context.Context, in *api.ResendStatusRequest) (*api.ResendStatus, error) {
+
+	resendStatus, err := s.Enclave.ResendStatus(in.Id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &resendStatus, nil
 }
 
 func decodeErrorGRPC(name string, value string, err error) {
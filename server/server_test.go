@@ -2,23 +2,33 @@ package server
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blk-io/chimera-api/chimera"
 	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/enclave"
 	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const sender = "BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="
@@ -27,6 +37,8 @@ const receiver = "QfeDAys9MPDs2XHExtc84jKGHxZg/aj52DTh0vtA3Xc="
 var payload = []byte("payload")
 var encodedPayload = base64.StdEncoding.EncodeToString(payload)
 
+const mockResendJob = "0123456789abcdef"
+
 type MockEnclave struct{}
 
 func (s *MockEnclave) Store(message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
@@ -49,17 +61,36 @@ func (s *MockEnclave) RetrieveDefault(digestHash *[]byte) ([]byte, error) {
 }
 
 func (s *MockEnclave) RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*[]byte, error) {
+	if !bytes.Equal(*digestHash, payload) {
+		return nil, fmt.Errorf("payload not found: %x", *digestHash)
+	}
 	return digestHash, nil
 }
 
-func (s *MockEnclave) RetrieveAllFor(reqRecipient *[]byte) error {
-	return nil
+func (s *MockEnclave) StartResend(recipient, cursor []byte) (api.ResendStatus, error) {
+	if base64.StdEncoding.EncodeToString(recipient) == receiver {
+		return api.ResendStatus{}, api.ErrResendLimit
+	}
+	return s.ResendStatus(mockResendJob)
+}
+
+func (s *MockEnclave) ResendStatus(id string) (api.ResendStatus, error) {
+	if id != mockResendJob {
+		return api.ResendStatus{}, fmt.Errorf("unknown resend job: %s", id)
+	}
+	return api.ResendStatus{Id: id, PublicKey: sender, Sent: 2, Done: true}, nil
 }
 
 func (s *MockEnclave) Delete(digestHash *[]byte) error {
 	return nil
 }
 
+func (s *MockEnclave) DeliveryStatus(digestHash *[]byte) ([]api.DeliveryStatus, error) {
+	return []api.DeliveryStatus{
+		{Recipient: receiver, Delivered: true, Attempts: 1},
+	}, nil
+}
+
 func (s *MockEnclave) UpdatePartyInfo(encoded []byte) {}
 
 func (s *MockEnclave) UpdatePartyInfoGrpc(string, map[[nacl.KeySize]byte]string, map[string]bool) {}
@@ -76,6 +107,61 @@ func (s *MockEnclave) GetPartyInfo() (string, map[[nacl.KeySize]byte]string, map
 	return "", nil, nil
 }
 
+func (s *MockEnclave) GetPeerFilter() api.PeerFilter {
+	return api.PeerFilter{}
+}
+
+func (s *MockEnclave) SetPeerFilter(filter api.PeerFilter) error {
+	return nil
+}
+
+func (s *MockEnclave) RefreshPartyInfo() {}
+
+func (s *MockEnclave) RetentionReport() (api.RetentionReport, error) {
+	return api.RetentionReport{
+		DryRun:       true,
+		Removed:      1,
+		RemovedBytes: int64(len(payload)),
+		Payloads: []api.ExpiredPayload{
+			{Key: encodedPayload, Stored: time.Unix(0, 0).UTC(), Size: len(payload), Reason: "age"},
+		},
+	}, nil
+}
+
+func (s *MockEnclave) Backup(w io.Writer) (api.BackupManifest, error) {
+	_, err := w.Write(payload)
+	return api.BackupManifest{Payloads: 1}, err
+}
+
+func (s *MockEnclave) KeyPairs() api.KeysResponse {
+	return api.KeysResponse{Active: []string{sender}, Retired: []string{receiver}}
+}
+
+func (s *MockEnclave) AddKeyPair(req api.KeyPairRequest) error {
+	if req.PublicKey != receiver {
+		return errors.New("private key does not correspond to public key")
+	}
+	return nil
+}
+
+func (s *MockEnclave) RetireKeyPair(pubKey []byte) error {
+	if base64.StdEncoding.EncodeToString(pubKey) != sender {
+		return errors.New("unable to find key pair")
+	}
+	return nil
+}
+
+func (s *MockEnclave) SignBindings(url string) map[[nacl.KeySize]byte]api.KeySignature {
+	key, _ := utils.LoadBase64Key(sender)
+	return map[[nacl.KeySize]byte]api.KeySignature{*key: {Issued: 1}}
+}
+
+func (s *MockEnclave) GetPeers() []api.PeerStatus {
+	return []api.PeerStatus{
+		{Url: "http://localhost:8001", ConsecutiveFailures: 2, LastError: "connection refused"},
+	}
+}
+
 func TestUpcheck(t *testing.T) {
 	tm := TransactionManager{}
 	runSimpleGetRequest(t, upCheck, upCheckResponse, tm.upcheck)
@@ -125,7 +211,7 @@ func TestSend(t *testing.T) {
 	}
 
 	response := api.SendResponse{}
-	expected := api.SendResponse{Key: encodedPayload}
+	expected := api.SendResponse{Key: encodedPayload, Delivered: []string{receiver}}
 
 	tm := TransactionManager{Enclave: &MockEnclave{}}
 
@@ -134,6 +220,98 @@ func TestSend(t *testing.T) {
 	}
 }
 
+// UndeliveredEnclave is a MockEnclave whose transactions are never acknowledged by recipients.
+type UndeliveredEnclave struct {
+	MockEnclave
+}
+
+func (s *UndeliveredEnclave) DeliveryStatus(digestHash *[]byte) ([]api.DeliveryStatus, error) {
+	return []api.DeliveryStatus{
+		{Recipient: receiver, Delivered: false, Attempts: 1, LastError: "connection refused"},
+	}, nil
+}
+
+func TestSendDeliveryPolicy(t *testing.T) {
+	policies := map[string]int{
+		api.DeliverAll:        http.StatusBadGateway,
+		api.DeliverQuorum:     http.StatusBadGateway,
+		api.DeliverBestEffort: http.StatusOK,
+		"":                    http.StatusOK,
+		"some":                http.StatusBadRequest,
+	}
+
+	tm := TransactionManager{Enclave: &UndeliveredEnclave{}, DeliveryPolicy: api.DeliverBestEffort}
+
+	for policy, expected := range policies {
+		sendReq := api.SendRequest{
+			Payload:        encodedPayload,
+			From:           sender,
+			To:             []string{receiver},
+			DeliveryPolicy: policy,
+		}
+		encoded, err := json.Marshal(sendReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", send, bytes.NewBuffer(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(tm.send)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code for policy %s: got %v want %v",
+				policy, status, expected)
+		}
+
+		if expected == http.StatusBadRequest {
+			continue
+		}
+
+		var response api.SendResponse
+		err = json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(response.Failed, []string{receiver}) {
+			t.Errorf("Failed recipients %v should contain %s", response.Failed, receiver)
+		}
+	}
+}
+
+func TestSendRawDeliveryPolicy(t *testing.T) {
+	tm := TransactionManager{Enclave: &UndeliveredEnclave{}, DeliveryPolicy: api.DeliverAll}
+
+	req, err := http.NewRequest("POST", sendRaw, bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(hFrom, sender)
+	req.Header.Set(hTo, receiver)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(tm.sendRaw)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadGateway {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadGateway)
+	}
+
+	if failed := rr.Header().Get(hFailed); failed != receiver {
+		t.Errorf("Failed recipients header %s should contain %s", failed, receiver)
+	}
+
+	if strings.Contains(rr.Body.String(), encodedPayload) {
+		t.Errorf("Response %s should not contain the key of the transaction", rr.Body.String())
+	}
+}
+
 func TestGRPCSend(t *testing.T) {
 	sendReqs := []chimera.SendRequest{
 		{
@@ -306,6 +484,210 @@ func TestDelete(t *testing.T) {
 	runJsonHandlerTest(t, &sendReq, &response, &expected, delete, tm.delete)
 }
 
+func TestDeliveryStatus(t *testing.T) {
+	statusReq := api.DeliveryStatusRequest{
+		Key: encodedPayload,
+	}
+
+	response := api.DeliveryStatusResponse{}
+	expected := api.DeliveryStatusResponse{
+		Key: encodedPayload,
+		Recipients: []api.DeliveryStatus{
+			{Recipient: receiver, Delivered: true, Attempts: 1},
+		},
+	}
+
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	runJsonHandlerTest(t, &statusReq, &response, &expected, deliveryStatus, tm.deliveryStatus)
+}
+
+func TestPeers(t *testing.T) {
+	response := api.PeersResponse{}
+	expected := api.PeersResponse{Peers: (&MockEnclave{}).GetPeers()}
+
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	runSimpleJsonGetRequest(t, peers, &response, &expected, tm.peers)
+
+	response = api.PeersResponse{}
+	runJsonHandlerTest(t, &api.PeersRequest{}, &response, &expected, refreshPartyInfo, tm.refreshPartyInfo)
+}
+
+func TestRetention(t *testing.T) {
+	response := api.RetentionReport{}
+	expected, _ := (&MockEnclave{}).RetentionReport()
+
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	runSimpleJsonGetRequest(t, retention, &response, &expected, tm.retention)
+}
+
+func TestBackup(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	runSimpleGetRequest(t, backup, string(payload), tm.backup)
+}
+
+func TestDownloadBackup(t *testing.T) {
+	for _, useGrpc := range []bool{true, false} {
+		freePort, err := GetFreePort("localhost")
+		if err != nil {
+			t.Fatalf("failed to find a free port to start the server: %s", err)
+		}
+		ipcPath := InitgRPCServer(t, useGrpc, freePort)
+
+		var archive bytes.Buffer
+		if err = DownloadBackup(ipcPath, useGrpc, &archive); err != nil {
+			t.Fatalf("Backup via IPC with gRPC: %t failed with %s", useGrpc, err)
+		}
+		if !bytes.Equal(archive.Bytes(), payload) {
+			t.Errorf("Backup via IPC with gRPC: %t returned %q, expected %q",
+				useGrpc, archive.Bytes(), payload)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	expected := (&MockEnclave{}).KeyPairs()
+
+	response := api.KeysResponse{}
+	runSimpleJsonGetRequest(t, keys, &response, &expected, tm.keys)
+
+	addReq := api.KeyPairRequest{PublicKey: receiver, PrivateKey: api.PrivateKey{Type: "unlocked"}}
+	response = api.KeysResponse{}
+	runJsonHandlerTest(t, &addReq, &response, &expected, keys, tm.keys)
+
+	invalid, err := json.Marshal(api.KeyPairRequest{PublicKey: sender})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runFailingRawHandlerTest(t, http.Header{}, invalid, nil, keys, tm.keys)
+	runFailingRawHandlerTest(t, http.Header{}, []byte("{"), nil, keys, tm.keys)
+}
+
+func TestRetireKey(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	expected := (&MockEnclave{}).KeyPairs()
+
+	response := api.KeysResponse{}
+	runJsonHandlerTest(
+		t, &api.RetireKeyRequest{PublicKey: sender}, &response, &expected, retireKey, tm.retireKey)
+
+	for _, publicKey := range []string{receiver, "invalid"} {
+		unknown, err := json.Marshal(api.RetireKeyRequest{PublicKey: publicKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runFailingRawHandlerTest(t, http.Header{}, unknown, nil, retireKey, tm.retireKey)
+	}
+}
+
+func TestGRPCPeers(t *testing.T) {
+	freePort, err := GetFreePort("localhost")
+	if err != nil {
+		log.Fatalf("failed to find a free port to start gRPC REST server: %s", err)
+	}
+	ipcPath := InitgRPCServer(t, true, freePort)
+
+	var conn *grpc.ClientConn
+	conn, err = grpc.Dial(fmt.Sprintf("passthrough:///unix://%s", ipcPath), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Connection to gRPC server failed with error %s", err)
+	}
+	defer conn.Close()
+
+	expected := api.PeersResponse{Peers: (&MockEnclave{}).GetPeers()}
+
+	for _, method := range []string{PeersMethod, RefreshMethod} {
+		response := api.PeersResponse{}
+		err = conn.Invoke(context.Background(), method, &api.PeersRequest{}, &response,
+			grpc.CallContentSubtype(JsonCodecName))
+		if err != nil {
+			t.Fatalf("gRPC %s failed with %s", method, err)
+		}
+		if !reflect.DeepEqual(response, expected) {
+			t.Errorf("handler returned unexpected response: %v, expected: %v\n", response, expected)
+		}
+	}
+}
+
+// PeerFilterEnclave is a MockEnclave which applies peer filters to its party details.
+type PeerFilterEnclave struct {
+	MockEnclave
+	pi *api.PartyInfo
+}
+
+func (s *PeerFilterEnclave) GetPeerFilter() api.PeerFilter {
+	return s.pi.PeerFilter()
+}
+
+func (s *PeerFilterEnclave) SetPeerFilter(filter api.PeerFilter) error {
+	return s.pi.SetPeerFilter(filter)
+}
+
+func TestPeerFilter(t *testing.T) {
+	pi := api.InitPartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001", "http://localhost:8002"},
+		http.DefaultClient, false, false, nil)
+	defer pi.Close()
+
+	filter := api.PeerFilter{
+		AllowedUrls: []string{"http://localhost:8001"},
+		DeniedKeys:  []string{receiver},
+	}
+	response := api.PeerFilter{}
+
+	tm := TransactionManager{Enclave: &PeerFilterEnclave{pi: pi}}
+
+	runJsonHandlerTest(t, &filter, &response, &filter, peerFilter, tm.peerFilter)
+
+	if pi.Snapshot().Parties["http://localhost:8002"] {
+		t.Error("Node should be removed once no longer permitted")
+	}
+
+	response = api.PeerFilter{}
+	runSimpleJsonGetRequest(t, peerFilter, &response, &filter, tm.peerFilter)
+
+	invalid, err := json.Marshal(api.PeerFilter{AllowedKeys: []string{"invalid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runFailingRawHandlerTest(t, http.Header{}, invalid, nil, peerFilter, tm.peerFilter)
+	runFailingRawHandlerTest(t, http.Header{}, []byte("{"), nil, peerFilter, tm.peerFilter)
+}
+
+func runSimpleJsonGetRequest(
+	t *testing.T,
+	url string,
+	response, expected interface{},
+	handlerFunc http.HandlerFunc) {
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handlerFunc.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v\n",
+			status, http.StatusOK)
+	}
+
+	err = json.Unmarshal(rr.Body.Bytes(), response)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(response, expected) {
+		t.Errorf("handler returned unexpected response: %v, expected: %v\n", response, expected)
+	}
+}
+
 func runJsonHandlerTest(
 	t *testing.T,
 	request, response, expected interface{},
@@ -428,9 +810,123 @@ func TestResendAll(t *testing.T) {
 
 	body := runResendTest(t, resendReq)
 
-	if len(body) != 0 {
-		t.Errorf("handler returned unexpected body, it should be empty, instead received: %v\n",
-			body)
+	var status api.ResendStatus
+	err := json.Unmarshal(body, &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := (&MockEnclave{}).ResendStatus(mockResendJob)
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("handler returned unexpected response: %v, expected: %v\n", status, expected)
+	}
+}
+
+func TestResendLimit(t *testing.T) {
+	encoded, err := json.Marshal(api.ResendRequest{Type: "all", PublicKey: receiver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", resend, bytes.NewBuffer(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	http.HandlerFunc(tm.resend).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v\n",
+			status, http.StatusTooManyRequests)
+	}
+}
+
+func TestResendStatus(t *testing.T) {
+	response := api.ResendStatus{}
+	expected, _ := (&MockEnclave{}).ResendStatus(mockResendJob)
+
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	runJsonHandlerTest(t, &api.ResendStatusRequest{Id: mockResendJob}, &response, &expected,
+		resendStatus, tm.resendStatus)
+}
+
+func TestGRPCResendAll(t *testing.T) {
+	freePort, err := GetFreePort("localhost")
+	if err != nil {
+		log.Fatalf("failed to find a free port to start gRPC REST server: %s", err)
+	}
+	ipcPath := InitgRPCServer(t, true, freePort)
+
+	var conn *grpc.ClientConn
+	conn, err = grpc.Dial(fmt.Sprintf("passthrough:///unix://%s", ipcPath), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Connection to gRPC server failed with error %s", err)
+	}
+	defer conn.Close()
+	c := chimera.NewClientClient(conn)
+
+	publicKey, _ := base64.StdEncoding.DecodeString(sender)
+	var trailer metadata.MD
+	_, err = c.Resend(context.Background(),
+		&chimera.ResendRequest{Type: "all", PublicKey: publicKey}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("gRPC resend failed with %s", err)
+	}
+	if jobs := trailer.Get(hResendJob); len(jobs) != 1 || jobs[0] != mockResendJob {
+		t.Fatalf("Resend job %v returned whereas %s is expected", jobs, mockResendJob)
+	}
+
+	response := api.ResendStatus{}
+	expected, _ := (&MockEnclave{}).ResendStatus(mockResendJob)
+	err = conn.Invoke(context.Background(), ResendStatusMethod,
+		&api.ResendStatusRequest{Id: mockResendJob}, &response,
+		grpc.CallContentSubtype(JsonCodecName))
+	if err != nil {
+		t.Fatalf("gRPC %s failed with %s", ResendStatusMethod, err)
+	}
+	if !reflect.DeepEqual(response, expected) {
+		t.Errorf("handler returned unexpected response: %v, expected: %v\n", response, expected)
+	}
+}
+
+func TestGRPCResendInvalid(t *testing.T) {
+	freePort, err := GetFreePort("localhost")
+	if err != nil {
+		log.Fatalf("failed to find a free port to start gRPC REST server: %s", err)
+	}
+	ipcPath := InitgRPCServer(t, true, freePort)
+
+	var conn *grpc.ClientConn
+	conn, err = grpc.Dial(fmt.Sprintf("passthrough:///unix://%s", ipcPath), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Connection to gRPC server failed with error %s", err)
+	}
+	defer conn.Close()
+	c := chimera.NewClientClient(conn)
+
+	publicKey, _ := base64.StdEncoding.DecodeString(sender)
+	resp, err := c.Resend(context.Background(),
+		&chimera.ResendRequest{Type: "individual", PublicKey: publicKey, Key: payload})
+	if err != nil || !bytes.Equal(resp.Encoded, payload) {
+		t.Fatalf("gRPC resend returned %v, error: %v", resp, err)
+	}
+
+	// Requests which cannot be served are reported to the caller rather than stopping the node
+	_, err = c.Resend(context.Background(),
+		&chimera.ResendRequest{Type: "individual", PublicKey: publicKey, Key: []byte("unknown")})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Resend of unknown payload returned %v whereas NotFound is expected", err)
+	}
+	busyKey, _ := base64.StdEncoding.DecodeString(receiver)
+	_, err = c.Resend(context.Background(), &chimera.ResendRequest{Type: "all", PublicKey: busyKey})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Resend beyond the limit returned %v whereas ResourceExhausted is expected", err)
+	}
+	_, err = c.Resend(context.Background(),
+		&chimera.ResendRequest{Type: "unknown", PublicKey: publicKey})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Resend of unknown type returned %v whereas InvalidArgument is expected", err)
 	}
 }
 
@@ -462,7 +958,7 @@ func runResendTest(t *testing.T, resendReq api.ResendRequest) []byte {
 
 func TestPartyInfo(t *testing.T) {
 
-	partyInfos := []api.PartyInfo{
+	partyInfos := []*api.PartyInfo{
 		api.CreatePartyInfo(
 			"http://localhost:8000",
 			[]string{"http://localhost:8001"},
@@ -472,7 +968,7 @@ func TestPartyInfo(t *testing.T) {
 		api.InitPartyInfo(
 			"http://localhost:8000",
 			[]string{"http://localhost:8001"},
-			http.DefaultClient, false),
+			http.DefaultClient, false, false, nil),
 	}
 
 	for _, pi := range partyInfos {
@@ -480,8 +976,8 @@ func TestPartyInfo(t *testing.T) {
 	}
 }
 
-func testRunPartyInfo(t *testing.T, pi api.PartyInfo) {
-	encodedPartyInfo := api.EncodePartyInfo(pi)
+func testRunPartyInfo(t *testing.T, pi *api.PartyInfo) {
+	encodedPartyInfo := api.EncodePartyInfo(pi.Snapshot())
 	encoded, err := json.Marshal(api.PartyInfoResponse{Payload: encodedPartyInfo})
 	if err != nil {
 		t.Errorf("Marshalling failed %v", err)
@@ -510,7 +1006,7 @@ func testRunPartyInfo(t *testing.T, pi api.PartyInfo) {
 
 func InitgRPCServer(t *testing.T, grpc bool, port int) string {
 	ipcPath, err := ioutil.TempDir("", "TestInitIpc")
-	tm, err := Init(&MockEnclave{}, "localhost", port, ipcPath, grpc, -1, false, "", "")
+	tm, err := Init(&MockEnclave{}, "localhost", port, ipcPath, grpc, -1, false, "", "", api.DeliverBestEffort)
 
 	if err != nil {
 		t.Errorf("Error starting server: %v\n", err)
@@ -520,14 +1016,7 @@ func InitgRPCServer(t *testing.T, grpc bool, port int) string {
 }
 
 func TestInit(t *testing.T) {
-	dbPath, err := ioutil.TempDir("", "TestInit")
-	if err != nil {
-		t.Error(err)
-	}
-	db, err := storage.InitLevelDb(dbPath)
-	if err != nil {
-		t.Errorf("Error starting server: %v\n", err)
-	}
+	db := storage.InitMemoryDb()
 	pubKeyFiles := []string{"key.pub"}
 	privKeyFiles := []string{"key"}
 
@@ -547,16 +1036,78 @@ func TestInit(t *testing.T) {
 		key,
 		http.DefaultClient)
 
-	enc := enclave.Init(db, pubKeyFiles, privKeyFiles, pi, http.DefaultClient, false)
+	keys := &enclave.FileKeyProvider{PubKeyFiles: pubKeyFiles, PrivKeyFiles: privKeyFiles}
+	enc := enclave.Init(db, keys, pi, http.DefaultClient)
 
 	ipcPath, err := ioutil.TempDir("", "TestInitIpc")
 	if err != nil {
 		t.Error(err)
 	}
 	certFile, keyFile := "../enclave/testdata/cert/server.crt", "../enclave/testdata/cert/server.key"
-	tm, err := Init(enc, "localhost", 9001, ipcPath, false, -1, true, certFile, keyFile)
+	tm, err := Init(enc, "localhost", 9001, ipcPath, false, -1, true, certFile, keyFile, api.DeliverBestEffort)
 	if err != nil {
 		t.Errorf("Error starting server: %v\n", err)
 	}
 	runSimpleGetRequest(t, upCheck, upCheckResponse, tm.upcheck)
 }
+
+func TestGRPCUpdatePartyInfoStrict(t *testing.T) {
+	freePort, err := GetFreePort("localhost")
+	if err != nil {
+		t.Fatalf("failed to find a free port to start gRPC server: %s", err)
+	}
+	serverUrl := fmt.Sprintf("http://localhost:%d/", freePort)
+
+	serverPi := api.InitPartyInfo(serverUrl, nil, http.DefaultClient, true, true, nil)
+	defer serverPi.Close()
+	keys := &enclave.FileKeyProvider{
+		PubKeyFiles:  []string{"../enclave/testdata/key.pub"},
+		PrivKeyFiles: []string{"../enclave/testdata/key"},
+	}
+	enc := enclave.Init(storage.InitMemoryDb(), keys, serverPi, http.DefaultClient)
+
+	ipcPath, err := ioutil.TempDir("", "TestGRPCUpdatePartyInfoStrict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Init(enc, "localhost", freePort, ipcPath, true, -1, false, "", "", api.DeliverBestEffort)
+	if err != nil {
+		t.Fatalf("Error starting server: %v\n", err)
+	}
+
+	pubKey, privKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientUrl := "http://localhost:9100/"
+	clientPi := api.InitPartyInfo(clientUrl, []string{serverUrl}, http.DefaultClient, true, false, nil)
+	defer clientPi.Close()
+	clientPi.RegisterPublicKeys([]nacl.Key{pubKey}, []nacl.Key{privKey})
+	clientPi.GetPartyInfoGrpc()
+
+	if url, ok := serverPi.GetRecipient(pubKey); !ok || url != clientUrl {
+		t.Errorf("Signed binding sent via gRPC was not accepted, got %s", url)
+	}
+
+	// Nodes which don't send their signed party details are ignored in strict mode
+	unsignedKey, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", freePort), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Connection to gRPC server failed with error %s", err)
+	}
+	defer conn.Close()
+	_, err = chimera.NewClientClient(conn).UpdatePartyInfo(context.Background(), &chimera.PartyInfo{
+		Url:        "http://localhost:9200/",
+		Recipients: map[string][]byte{"http://localhost:9200/": unsignedKey[:]},
+		Parties:    map[string]bool{"http://localhost:9200/": true},
+	})
+	if err != nil {
+		t.Fatalf("gRPC UpdatePartyInfo failed with %s", err)
+	}
+	if _, ok := serverPi.GetRecipient(unsignedKey); ok {
+		t.Error("Unsigned binding sent via gRPC should be rejected in strict mode")
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+// Batch is a set of writes and deletes which a DataStore applies atomically, so that related
+// records, such as a payload and its index entries, are never left partially written.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// Write adds the writing of value under key to the batch.
+func (b *Batch) Write(key *[]byte, value *[]byte) {
+	b.ops = append(b.ops, batchOp{Key: *key, Value: *value})
+}
+
+// Delete adds the deletion of key to the batch.
+func (b *Batch) Delete(key *[]byte) {
+	b.ops = append(b.ops, batchOp{Key: *key, Delete: true})
+}
+
+// Len provides the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset removes all operations from the batch, so that it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Transaction provides reads and writes against a DataStore, which are applied atomically once
+// the function passed to DataStore.Update returns successfully. Reads reflect the writes already
+// made within the transaction.
+type Transaction interface {
+	Read(key *[]byte) (*[]byte, error)
+	Write(key *[]byte, value *[]byte) error
+	Delete(key *[]byte) error
+}
+
+// batchTransaction is a Transaction for DataStores without native transactions, which buffers
+// writes in a Batch to be applied once the transaction is committed. The DataStore must prevent
+// concurrent transactions.
+type batchTransaction struct {
+	read    func(key *[]byte) (*[]byte, error) // Reads records not written by the transaction
+	batch   Batch
+	pending map[string]int // Index of the latest operation on each key within the batch
+}
+
+func newBatchTransaction(read func(key *[]byte) (*[]byte, error)) *batchTransaction {
+	return &batchTransaction{read: read, pending: make(map[string]int)}
+}
+
+func (tx *batchTransaction) Read(key *[]byte) (*[]byte, error) {
+	if i, ok := tx.pending[string(*key)]; ok {
+		op := tx.batch.ops[i]
+		if op.Delete {
+			return nil, ErrNotFound
+		}
+		value := op.Value
+		return &value, nil
+	}
+	return tx.read(key)
+}
+
+func (tx *batchTransaction) Write(key *[]byte, value *[]byte) error {
+	tx.batch.Write(key, value)
+	tx.pending[string(*key)] = len(tx.batch.ops) - 1
+	return nil
+}
+
+func (tx *batchTransaction) Delete(key *[]byte) error {
+	tx.batch.Delete(key)
+	tx.pending[string(*key)] = len(tx.batch.ops) - 1
+	return nil
+}
@@ -2,26 +2,84 @@ package storage
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"github.com/jsimonetti/berkeleydb"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
+// journalKey is the key under which batches are recorded before they are applied, so that an
+// interrupted batch is completed when the database is next opened. As it is not valid base64, it
+// cannot collide with any other key.
+const journalKey = "!journal"
+
+// constellationPayloadDb is the name of the database within a Constellation storage directory
+// which holds its payloads.
+const constellationPayloadDb = "payload.db"
+
+// envSuffix is appended to the path of a database file to name the directory holding its
+// environment. Databases within a storage directory share the directory with their environment,
+// as Constellation's do.
+const envSuffix = "-env"
+
 type berkleyDb struct {
 	dbPath string
+	env    *berkeleydb.Environment
 	conn   *berkeleydb.Db
+	mu     sync.Mutex // Serialises batches and transactions
 }
 
+// InitBerkeleyDb opens the Berkeley DB database at dbPath, creating it if it does not exist. If
+// dbPath is the storage directory of a Constellation node, the payload database within it is
+// opened, allowing the node to be migrated to Crux.
+//
+// The database is opened within a transactional environment, so that each write is durable, and
+// any interrupted when the node stopped are rolled back when it is next opened.
+//
+// Keys and values are stored base64 encoded, as they are by Constellation.
 func InitBerkeleyDb(dbPath string) (*berkleyDb, error) {
-	bdb := &berkleyDb{dbPath: dbPath}
+	envPath := dbPath + envSuffix
+	if info, err := os.Stat(dbPath); err == nil && info.IsDir() {
+		envPath = dbPath
+		dbPath = filepath.Join(dbPath, constellationPayloadDb)
+	}
+	dbPath, err := filepath.Abs(dbPath)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := berkeleydb.NewDB()
+	if err = os.MkdirAll(envPath, 0700); err != nil {
+		return nil, err
+	}
+	env, err := berkeleydb.NewEnvironment()
 	if err != nil {
 		return nil, err
 	}
+	if err = env.Open(envPath, dbEnvFlags, 0600); err != nil {
+		return nil, err
+	}
 
-	err = db.Open(
-		dbPath, berkeleydb.DbHash, berkeleydb.DbCreate)
+	db, err := berkeleydb.NewDBInEnvironment(env)
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+
+	// Existing databases are opened using whichever access method they were created with
+	if _, err = os.Stat(dbPath); err == nil {
+		err = db.OpenWithTxn(dbPath, nil, berkeleydb.DbUnknown, dbAutoCommit)
+	} else {
+		err = db.OpenWithTxn(dbPath, nil, berkeleydb.DbHash, berkeleydb.DbCreate|dbAutoCommit)
+	}
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
 
-	return bdb, err
+	bdb := &berkleyDb{dbPath: dbPath, env: env, conn: db}
+	return bdb, bdb.replayJournal()
 }
 
 func (db *berkleyDb) Write(key *[]byte, value *[]byte) error {
@@ -52,29 +110,70 @@ func (db *berkleyDb) Read(key *[]byte) (*[]byte, error) {
 }
 
 func (db *berkleyDb) ReadAll(f func(key, value *[]byte)) error {
-	iter, err := db.conn.Cursor()
-	if err != nil {
-		return err
-	}
+	return ReadRange(db, nil, func(key, value []byte) bool {
+		f(&key, &value)
+		return true
+	})
+}
+
+// NewIterator provides an Iterator over the records within the Range. As keys are stored base64
+// encoded, the entire database is scanned, and records are not visited in order.
+func (db *berkleyDb) NewIterator(r *Range) Iterator {
+	cursor, err := db.conn.Cursor()
+	return &berkleyIterator{cursor: cursor, r: r, err: err}
+}
+
+type berkleyIterator struct {
+	cursor *berkeleydb.Cursor
+	r      *Range
+	key    []byte
+	value  []byte
+	err    error
+}
 
-	var b64Key, b64Value string
-	for {
-		b64Key, b64Value, err = iter.GetNext()
+func (iter *berkleyIterator) Next() bool {
+	for iter.err == nil {
+		b64Key, b64Value, err := iter.cursor.GetNext()
 		if err != nil {
+			if !isNotFound(err) {
+				iter.err = err
+			}
 			break
 		}
-		key, err := base64.StdEncoding.DecodeString(b64Key)
-		if err != nil {
-			break
+		if b64Key == journalKey {
+			continue
 		}
-		value, err := base64.StdEncoding.DecodeString(b64Value)
-		if err != nil {
-			break
+
+		iter.key, iter.err = base64.StdEncoding.DecodeString(b64Key)
+		if iter.err != nil || !iter.r.Contains(iter.key) {
+			continue
+		}
+		iter.value, iter.err = base64.StdEncoding.DecodeString(b64Value)
+		if iter.err == nil {
+			return true
 		}
-		f(&key, &value)
 	}
+	iter.key, iter.value = nil, nil
+	return false
+}
 
-	return err
+func (iter *berkleyIterator) Key() []byte {
+	return iter.key
+}
+
+func (iter *berkleyIterator) Value() []byte {
+	return iter.value
+}
+
+func (iter *berkleyIterator) Error() error {
+	return iter.err
+}
+
+func (iter *berkleyIterator) Release() {
+	if iter.cursor != nil {
+		iter.cursor.Close()
+		iter.cursor = nil
+	}
 }
 
 func (db *berkleyDb) Delete(key *[]byte) error {
@@ -82,6 +181,90 @@ func (db *berkleyDb) Delete(key *[]byte) error {
 	return db.conn.Delete(b64Key)
 }
 
+// WriteBatch records the batch in a journal with a single write before applying it. Each write is
+// committed on its own, as the Berkeley DB bindings cannot begin a transaction spanning several.
+// Should the node stop while the batch is being applied, it is completed when the database is next
+// opened.
+func (db *berkleyDb) WriteBatch(batch *Batch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.writeBatch(batch)
+}
+
+func (db *berkleyDb) writeBatch(batch *Batch) error {
+	journal, err := json.Marshal(batch.ops)
+	if err != nil {
+		return err
+	}
+	err = db.conn.Put(journalKey, base64.StdEncoding.EncodeToString(journal))
+	if err != nil {
+		return err
+	}
+	if err = db.applyBatch(batch.ops); err != nil {
+		return err
+	}
+	return db.conn.Delete(journalKey)
+}
+
+func (db *berkleyDb) applyBatch(ops []batchOp) error {
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = db.Delete(&op.Key)
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+		} else {
+			err = db.Write(&op.Key, &op.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replayJournal completes any batch which was interrupted when the database was last open.
+func (db *berkleyDb) replayJournal() error {
+	b64Journal, err := db.conn.Get(journalKey)
+	if err != nil {
+		// No batch was interrupted
+		return nil
+	}
+	journal, err := base64.StdEncoding.DecodeString(b64Journal)
+	if err != nil {
+		return err
+	}
+	var ops []batchOp
+	if err = json.Unmarshal(journal, &ops); err != nil {
+		return err
+	}
+	if err = db.applyBatch(ops); err != nil {
+		return err
+	}
+	return db.conn.Delete(journalKey)
+}
+
+// Update runs f within a transaction, whose writes are buffered and then applied as a batch.
+func (db *berkleyDb) Update(f func(tx Transaction) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx := newBatchTransaction(db.Read)
+	if err := f(tx); err != nil {
+		return err
+	}
+	return db.writeBatch(&tx.batch)
+}
+
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "DB_NOTFOUND")
+}
+
 func (db *berkleyDb) Close() error {
-	return db.conn.Close()
+	err := db.conn.Close()
+	if envErr := db.env.Close(); err == nil {
+		err = envErr
+	}
+	return err
 }
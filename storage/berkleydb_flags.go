@@ -0,0 +1,13 @@
+package storage
+
+// #cgo LDFLAGS: -ldb
+// #include <db.h>
+import "C"
+
+// Flags for opening a transactional environment and the databases within it, which the Berkeley
+// DB bindings do not provide.
+const (
+	dbEnvFlags = C.DB_CREATE | C.DB_INIT_LOCK | C.DB_INIT_LOG | C.DB_INIT_MPOOL | C.DB_INIT_TXN |
+		C.DB_RECOVER
+	dbAutoCommit = C.DB_AUTO_COMMIT
+)
@@ -0,0 +1,114 @@
+package storage_test
+
+import (
+	"bytes"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/enclave"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+// The fixture is a db_dump of the B-tree payload database of a Constellation node holding a
+// payload it sent, and a payload it received from another node, using the keys in
+// enclave/testdata. Constellation writes keys and values without a NUL terminator.
+const constellationFixture = "testdata/constellation.dump"
+
+var fixtureMessages = [][]byte{
+	[]byte("Payload sent from this node"),
+	[]byte("Payload received from another node"),
+}
+
+// dbLoadCommands are the names under which the db_load utility of Berkeley DB is installed.
+var dbLoadCommands = []string{"db_load", "db5.3_load", "db4.8_load"}
+
+// initConstellationStore creates a Constellation storage directory from the fixture, loading it
+// with db_load as the B-tree database Constellation creates.
+func initConstellationStore(t *testing.T, storagePath string) {
+	var dbLoad string
+	for _, command := range dbLoadCommands {
+		if p, err := exec.LookPath(command); err == nil {
+			dbLoad = p
+			break
+		}
+	}
+	if dbLoad == "" {
+		t.Skip("db_load is required to create the Constellation fixture")
+	}
+
+	err := os.Mkdir(storagePath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(
+		dbLoad, "-f", constellationFixture, path.Join(storagePath, "payload.db")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Unable to load %s, error: %v, output: %s", constellationFixture, err, out)
+	}
+}
+
+func TestReadConstellationStore(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestReadConstellationStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	storagePath := path.Join(dbPath, "storage")
+	initConstellationStore(t, storagePath)
+
+	db, err := storage.InitBerkeleyDb(storagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var digests [][]byte
+	err = db.ReadAll(func(key, value *[]byte) {
+		epl, _ := api.DecodePayloadWithRecipients(*value)
+		if !bytes.Equal(*key, utils.Sha3Hash(epl.CipherText)) {
+			t.Errorf("Key %x is not the digest of its payload", *key)
+		}
+		digests = append(digests, append([]byte{}, *key...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != len(fixtureMessages) {
+		t.Fatalf("%d payloads read whereas %d are expected", len(digests), len(fixtureMessages))
+	}
+
+	pi := api.InitPartyInfo("http://localhost:9001", []string{}, http.DefaultClient, false, false, nil)
+	defer pi.Close()
+	enc := enclave.Init(
+		db,
+		&enclave.FileKeyProvider{
+			PubKeyFiles:  []string{"../enclave/testdata/key.pub"},
+			PrivKeyFiles: []string{"../enclave/testdata/key"},
+		},
+		pi, http.DefaultClient)
+
+	to := (*enc.PubKeys[0])[:]
+	var retrieved [][]byte
+	for _, digest := range digests {
+		message, err := enc.Retrieve(&digest, &to)
+		if err != nil {
+			t.Fatalf("Unable to retrieve payload %x, error: %v", digest, err)
+		}
+		retrieved = append(retrieved, message)
+	}
+	for _, expected := range fixtureMessages {
+		found := false
+		for _, message := range retrieved {
+			found = found || bytes.Equal(message, expected)
+		}
+		if !found {
+			t.Errorf("Message %q was not retrieved", expected)
+		}
+	}
+}
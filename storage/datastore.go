@@ -1,10 +1,81 @@
 package storage
 
+import (
+	"errors"
+)
+
+// ErrNotFound is returned when reading a key which has been deleted within a Transaction.
+var ErrNotFound = errors.New("storage: not found")
+
+// ErrNoSnapshots is returned by a Snapshotter wrapping a DataStore which does not support them.
+var ErrNoSnapshots = errors.New("storage: snapshots are not supported")
+
 // DataStore is an interface that facilitates operations with an underlying persistent data store.
 type DataStore interface {
 	Write(key *[]byte, value *[]byte) error
 	Read(key *[]byte) (*[]byte, error)
 	ReadAll(f func(key, value *[]byte)) error
+	// NewIterator provides an Iterator over the records within the Range, or all records if it is
+	// nil. Records are visited in order of their keys, unless the DataStore does not maintain
+	// them in order.
+	NewIterator(r *Range) Iterator
 	Delete(key *[]byte) error
+	// WriteBatch applies all of the operations in the batch, or none of them.
+	WriteBatch(batch *Batch) error
+	// Update runs f within a Transaction, which is committed if f returns no error.
+	Update(f func(tx Transaction) error) error
 	Close() error
 }
+
+// Metadata describes a payload held in a DataStore.
+type Metadata struct {
+	Sender     []byte
+	Recipients [][]byte
+}
+
+// Describer provides the Metadata of the record with the given key and value, reporting false if
+// the record is not a payload.
+type Describer func(key, value []byte) (Metadata, bool)
+
+// MetadataStore is implemented by DataStores which record the Metadata of payloads alongside
+// them, so that it can be queried.
+type MetadataStore interface {
+	SetDescriber(d Describer)
+}
+
+// Snapshotter is implemented by DataStores which provide a consistent view of their records at a
+// point in time, while records continue to be written.
+type Snapshotter interface {
+	Snapshot() (Snapshot, error)
+}
+
+// Snapshot is a read-only view of the records of a DataStore at the time it was taken, which must
+// be released once no longer needed.
+type Snapshot interface {
+	// NewIterator provides an Iterator over the records within the Range, or all records if it is
+	// nil, as they were when the Snapshot was taken.
+	NewIterator(r *Range) Iterator
+	Release()
+}
+
+// NewSnapshot provides a Snapshot of db, reporting whether it is consistent. If db does not
+// support snapshots, the Snapshot reads the records of db as they are when they are iterated over.
+func NewSnapshot(db DataStore) (s Snapshot, consistent bool, err error) {
+	if snapshotter, ok := db.(Snapshotter); ok {
+		s, err = snapshotter.Snapshot()
+		if err != ErrNoSnapshots {
+			return s, err == nil, err
+		}
+	}
+	return liveSnapshot{db}, false, nil
+}
+
+type liveSnapshot struct {
+	db DataStore
+}
+
+func (s liveSnapshot) NewIterator(r *Range) Iterator {
+	return s.db.NewIterator(r)
+}
+
+func (s liveSnapshot) Release() {}
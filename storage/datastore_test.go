@@ -0,0 +1,344 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// TestDataStores runs the conformance tests against each DataStore implementation. Any new
+// implementation should be added here.
+func TestDataStores(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestDataStores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	backends := []struct {
+		name    string
+		ordered bool // Whether records are visited in order of their keys
+		open    func() (storage.DataStore, error)
+	}{
+		{"leveldb", true, func() (storage.DataStore, error) {
+			return storage.InitLevelDb(path.Join(dbPath, "leveldb"))
+		}},
+		{"berkeleydb", false, func() (storage.DataStore, error) {
+			return storage.InitBerkeleyDb(path.Join(dbPath, "berkeley.db"))
+		}},
+		{"sqlite", true, func() (storage.DataStore, error) {
+			return storage.InitSqliteDb(path.Join(dbPath, "crux.sqlite"))
+		}},
+		{"memory", true, func() (storage.DataStore, error) {
+			return storage.InitMemoryDb(), nil
+		}},
+		{"encrypted", false, func() (storage.DataStore, error) {
+			return storage.InitEncryptedDb(storage.InitMemoryDb(), nacl.NewKey(), nacl.NewKey()), nil
+		}},
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, db storage.DataStore, ordered bool)
+	}{
+		{"ReadWrite", testReadWrite},
+		{"Iterator", testIterator},
+		{"WriteBatch", testWriteBatch},
+		{"Update", testUpdate},
+		{"ConcurrentWrites", testConcurrentWrites},
+		{"Snapshot", testSnapshot},
+	}
+
+	for _, backend := range backends {
+		db, err := backend.open()
+		if err != nil {
+			t.Fatalf("Unable to open %s, error: %v", backend.name, err)
+		}
+		for _, test := range tests {
+			t.Run(backend.name+"/"+test.name, func(t *testing.T) {
+				clearDataStore(t, db)
+				test.test(t, db, backend.ordered)
+			})
+		}
+		if err = db.Close(); err != nil {
+			t.Errorf("Unable to close %s, error: %v", backend.name, err)
+		}
+	}
+}
+
+func clearDataStore(t *testing.T, db storage.DataStore) {
+	batch := new(storage.Batch)
+	err := storage.ReadRange(db, nil, func(key, value []byte) bool {
+		key = append([]byte{}, key...)
+		batch.Delete(&key)
+		return true
+	})
+	if err == nil {
+		err = db.WriteBatch(batch)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func write(t *testing.T, db storage.DataStore, key, value string) {
+	k, v := []byte(key), []byte(value)
+	if err := db.Write(&k, &v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectValue(t *testing.T, db storage.DataStore, key, expected string) {
+	k := []byte(key)
+	value, err := db.Read(&k)
+	if err != nil {
+		t.Errorf("Unable to read %s, error: %v", key, err)
+	} else if string(*value) != expected {
+		t.Errorf("Value of %s is %q whereas %q is expected", key, *value, expected)
+	}
+}
+
+func expectMissing(t *testing.T, db storage.DataStore, key string) {
+	k := []byte(key)
+	if _, err := db.Read(&k); err == nil {
+		t.Errorf("%s should not be present", key)
+	}
+}
+
+// readKeys provides the keys within the Range, sorting them if the DataStore is not ordered.
+func readKeys(t *testing.T, db storage.DataStore, r *storage.Range, ordered bool) []string {
+	var keys []string
+	err := storage.ReadRange(db, r, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ordered {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+func testReadWrite(t *testing.T, db storage.DataStore, ordered bool) {
+	key, value := []byte("key"), []byte("value")
+	if err := db.Write(&key, &value); err != nil {
+		t.Fatal(err)
+	}
+	// The value written must not be affected by later changes to the slice provided
+	value[0] = 'V'
+	expectValue(t, db, "key", "value")
+
+	write(t, db, "key", "updated")
+	expectValue(t, db, "key", "updated")
+
+	write(t, db, "empty", "")
+	expectValue(t, db, "empty", "")
+
+	expectMissing(t, db, "missing")
+
+	if err := db.Delete(&key); err != nil {
+		t.Fatal(err)
+	}
+	expectMissing(t, db, "key")
+
+	count := 0
+	err := db.ReadAll(func(key, value *[]byte) {
+		count += 1
+	})
+	if err != nil || count != 1 {
+		t.Errorf("%d records read whereas 1 is expected, error: %v", count, err)
+	}
+}
+
+func testIterator(t *testing.T, db storage.DataStore, ordered bool) {
+	// Enough records to span several pages of those backends which read in pages
+	batch := new(storage.Batch)
+	for i := 0; i < 250; i++ {
+		key := []byte(fmt.Sprintf("record/%03d", i))
+		value := []byte(fmt.Sprintf("value %d", i))
+		batch.Write(&key, &value)
+	}
+	if err := db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	write(t, db, "other", "")
+
+	keys := readKeys(t, db, storage.PrefixRange([]byte("record/1")), ordered)
+	if len(keys) != 100 || keys[0] != "record/100" || keys[99] != "record/199" {
+		t.Errorf("Unexpected keys read from prefix: %v", keys)
+	}
+
+	keys = readKeys(t, db, &storage.Range{Start: []byte("record/248")}, ordered)
+	if fmt.Sprint(keys) != "[record/248 record/249]" {
+		t.Errorf("Unexpected keys read from range: %v", keys)
+	}
+
+	if keys = readKeys(t, db, nil, ordered); len(keys) != 251 {
+		t.Errorf("%d records read whereas 251 are expected", len(keys))
+	}
+
+	keys = readKeys(t, db, &storage.Range{Limit: []byte("record/002")}, ordered)
+	if fmt.Sprint(keys) != "[other record/000 record/001]" {
+		t.Errorf("Unexpected keys read from range: %v", keys)
+	}
+
+	// Records may be written during iteration, and iteration may be stopped early
+	count := 0
+	err := storage.ReadRange(db, storage.PrefixRange([]byte("record/")), func(key, value []byte) bool {
+		if value == nil || !bytes.HasPrefix(value, []byte("value ")) {
+			t.Errorf("Unexpected value %q for %s", value, key)
+		}
+		write(t, db, "written/"+string(key), "")
+		count += 1
+		return count < 150
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 150 {
+		t.Errorf("Iteration should stop after 150 records, actual: %d", count)
+	}
+	if keys = readKeys(t, db, storage.PrefixRange([]byte("written/")), ordered); len(keys) != 150 {
+		t.Errorf("%d records written during iteration whereas 150 are expected", len(keys))
+	}
+}
+
+func testWriteBatch(t *testing.T, db storage.DataStore, ordered bool) {
+	write(t, db, "deleted", "value")
+	write(t, db, "updated", "value")
+
+	batch := new(storage.Batch)
+	for _, key := range []string{"added", "updated"} {
+		k, v := []byte(key), []byte("batch")
+		batch.Write(&k, &v)
+	}
+	deleted := []byte("deleted")
+	batch.Delete(&deleted)
+	if err := db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, db, "added", "batch")
+	expectValue(t, db, "updated", "batch")
+	expectMissing(t, db, "deleted")
+}
+
+func testUpdate(t *testing.T, db storage.DataStore, ordered bool) {
+	write(t, db, "deleted", "value")
+
+	rollback := errors.New("rollback")
+	err := db.Update(func(tx storage.Transaction) error {
+		key, value := []byte("added"), []byte("value")
+		if err := tx.Write(&key, &value); err != nil {
+			return err
+		}
+		deleted := []byte("deleted")
+		if err := tx.Delete(&deleted); err != nil {
+			return err
+		}
+
+		// Reads reflect the writes made within the transaction
+		if read, err := tx.Read(&key); err != nil || string(*read) != "value" {
+			t.Errorf("Write not read within transaction, value: %v, error: %v", read, err)
+		}
+		if _, err := tx.Read(&deleted); err == nil {
+			t.Error("Deleted key read within transaction")
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Errorf("Error from transaction not returned, actual: %v", err)
+	}
+	expectMissing(t, db, "added")
+	expectValue(t, db, "deleted", "value")
+
+	err = db.Update(func(tx storage.Transaction) error {
+		key := []byte("deleted")
+		value, err := tx.Read(&key)
+		if err != nil {
+			return err
+		}
+		added := []byte("added")
+		if err = tx.Write(&added, value); err != nil {
+			return err
+		}
+		return tx.Delete(&key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "added", "value")
+	expectMissing(t, db, "deleted")
+}
+
+func testConcurrentWrites(t *testing.T, db storage.DataStore, ordered bool) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				key := []byte(fmt.Sprintf("%d/%d", i, j))
+				value := []byte("value")
+				if err := db.Write(&key, &value); err != nil {
+					t.Error(err)
+				}
+				if _, err := db.Read(&key); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if keys := readKeys(t, db, nil, ordered); len(keys) != 200 {
+		t.Errorf("%d records read whereas 200 are expected", len(keys))
+	}
+}
+
+func testSnapshot(t *testing.T, db storage.DataStore, ordered bool) {
+	write(t, db, "a", "1")
+	write(t, db, "b", "2")
+
+	snapshot, consistent, err := storage.NewSnapshot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	write(t, db, "a", "updated")
+	write(t, db, "c", "3")
+	deleted := []byte("b")
+	if err = db.Delete(&deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string]string)
+	iter := snapshot.NewIterator(nil)
+	for iter.Next() {
+		records[string(iter.Key())] = string(iter.Value())
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"a": "1", "b": "2"}
+	if !consistent {
+		// The snapshot reads the records as they are
+		expected = map[string]string{"a": "updated", "c": "3"}
+	}
+	if fmt.Sprint(records) != fmt.Sprint(expected) {
+		t.Errorf("Snapshot contains %v whereas %v is expected", records, expected)
+	}
+}
@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"io/ioutil"
+	"strings"
+)
+
+// Contexts separating the keys derived from a storage key for each of their uses.
+const (
+	sealKeyContext  = "crux-storage-seal"
+	blindKeyContext = "crux-storage-blind"
+)
+
+// rekeyBatchSize is the number of records rewritten at a time when rotating keys.
+const rekeyBatchSize = 1000
+
+// ErrUndecryptable is returned when a record cannot be decrypted with any of the storage keys.
+var ErrUndecryptable = errors.New("storage: unable to decrypt record")
+
+// ErrStorageKeyMismatch is returned when opening a store which is encrypted with a key other than
+// the storage keys provided, or which is not encrypted as expected.
+var ErrStorageKeyMismatch = errors.New("storage: storage key does not match the store")
+
+// encryptionMarker is the key of the record marking a store as encrypted. It is written in the
+// clear, with a value sealed with the storage key, so the key can be checked when the store is
+// opened.
+var encryptionMarker = []byte("crux/encrypted")
+
+// storageKey holds the keys derived from a storage key.
+type storageKey struct {
+	seal  nacl.Key // Encrypts records
+	blind []byte   // Blinds the keys of records
+}
+
+func deriveStorageKey(key nacl.Key) storageKey {
+	seal, _ := utils.ToKey(
+		utils.Sha3Hash(append([]byte(sealKeyContext), (*key)[:]...))[:nacl.KeySize])
+	blind := utils.Sha3Hash(append([]byte(blindKeyContext), (*key)[:]...))[:nacl.KeySize]
+	return storageKey{seal: seal, blind: blind}
+}
+
+// maxNamespace is the maximum length of the namespace of a key, excluding its separator.
+const maxNamespace = 16
+
+// namespace provides the namespace of the key, which is a prefix of lowercase letters terminated
+// by a slash, such as "rcptidx/", or nil if it has none. Payloads are stored under their digests,
+// so have no namespace, other than by chance.
+func namespace(key []byte) []byte {
+	for i, b := range key {
+		switch {
+		case b == '/' && i > 0:
+			return key[:i+1]
+		case b < 'a' || b > 'z' || i == maxNamespace:
+			return nil
+		}
+	}
+	return nil
+}
+
+// blindKey provides the key under which the record with the given key is stored. The namespace of
+// the key is kept, so that the records within a namespace can be read without reading every record
+// of the store.
+func (k storageKey) blindKey(key []byte) []byte {
+	hash := utils.Sha3Hash(append(append([]byte{}, k.blind...), key...))[:nacl.KeySize]
+	return append(append([]byte{}, namespace(key)...), hash...)
+}
+
+// blindRange provides the Range of the underlying store holding the records within r. Only ranges
+// within a single namespace can be narrowed, otherwise every record of the store is within it.
+func blindRange(r *Range) *Range {
+	if r == nil {
+		return nil
+	}
+	ns := namespace(r.Start)
+	if ns == nil {
+		return nil
+	}
+	nsRange := PrefixRange(ns)
+	if r.Limit == nil || !(bytes.HasPrefix(r.Limit, ns) || bytes.Equal(r.Limit, nsRange.Limit)) {
+		return nil
+	}
+	return nsRange
+}
+
+// sealRecord encrypts the key of the record along with its value, as the key is not recoverable
+// from its blinded form.
+func (k storageKey) sealRecord(key, value []byte) []byte {
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(key)+len(value))
+	record = record[:binary.PutUvarint(record, uint64(len(key)))]
+	record = append(append(record, key...), value...)
+
+	nonce := nacl.NewNonce()
+	return secretbox.Seal((*nonce)[:], record, nonce, k.seal)
+}
+
+func (k storageKey) openRecord(sealed []byte) (key, value []byte, ok bool) {
+	if len(sealed) < nacl.NonceSize+secretbox.Overhead {
+		return nil, nil, false
+	}
+	nonce := new([nacl.NonceSize]byte)
+	copy(nonce[:], sealed)
+	record, ok := secretbox.Open(nil, sealed[nacl.NonceSize:], nonce, k.seal)
+	if !ok {
+		return nil, nil, false
+	}
+
+	keyLen, n := binary.Uvarint(record)
+	if n <= 0 || uint64(len(record)-n) < keyLen {
+		return nil, nil, false
+	}
+	return record[n : n+int(keyLen)], record[n+int(keyLen):], true
+}
+
+type encryptedDb struct {
+	db   DataStore
+	keys []storageKey // The current key, followed by any previous keys
+}
+
+// InitEncryptedDb wraps db so that the values of its records are encrypted with key, and their
+// keys are blinded, so that the contents of the store reveal neither payloads nor who they were
+// exchanged with.
+//
+// Records written with any of the previous keys remain readable, and are rewritten with key by
+// Rekey. Keys are blinded apart from their namespace, such as "rcptidx/", so iterating over a
+// Range within a namespace reads every record in the namespace, and any other Range reads every
+// record in db. Records are not visited in order. db must not be used directly.
+func InitEncryptedDb(db DataStore, key nacl.Key, previous ...nacl.Key) *encryptedDb {
+	keys := []storageKey{deriveStorageKey(key)}
+	for _, k := range previous {
+		keys = append(keys, deriveStorageKey(k))
+	}
+	return &encryptedDb{db: db, keys: keys}
+}
+
+// OpenEncryptedDb wraps db as InitEncryptedDb does, once it has verified that db is encrypted with
+// one of the keys. A store which is not yet encrypted is marked as encrypted with key if it is
+// empty, and rejected otherwise, as its records would no longer be readable.
+func OpenEncryptedDb(db DataStore, key nacl.Key, previous ...nacl.Key) (*encryptedDb, error) {
+	encrypted := InitEncryptedDb(db, key, previous...)
+	marker, err := readMarker(db)
+	if err != nil {
+		return nil, err
+	}
+	if marker != nil {
+		if markerKey, _, _, ok := openRecord(encrypted.keys, marker); ok &&
+			bytes.Equal(markerKey, encryptionMarker) {
+			return encrypted, nil
+		}
+		return nil, ErrStorageKeyMismatch
+	}
+
+	empty := true
+	err = ReadRange(db, nil, func(key, value []byte) bool {
+		empty = false
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, ErrStorageKeyMismatch
+	}
+	sealed := encrypted.keys[0].sealRecord(encryptionMarker, nil)
+	return encrypted, db.Write(&encryptionMarker, &sealed)
+}
+
+// IsEncrypted reports whether db has been marked as encrypted by OpenEncryptedDb, in which case
+// it must only be accessed via the encrypted store.
+func IsEncrypted(db DataStore) (bool, error) {
+	marker, err := readMarker(db)
+	return marker != nil, err
+}
+
+// readMarker provides the value of the encryption marker, or nil if db is not encrypted. Stores
+// report missing keys with differing errors, so the marker is found by iterating over its key.
+func readMarker(db DataStore) ([]byte, error) {
+	var marker []byte
+	r := &Range{Start: encryptionMarker, Limit: append(append([]byte{}, encryptionMarker...), 0)}
+	err := ReadRange(db, r, func(key, value []byte) bool {
+		marker = append([]byte{}, value...)
+		return false
+	})
+	return marker, err
+}
+
+// LoadStorageKey reads a base64 encoded storage key from keyFile.
+func LoadStorageKey(keyFile string) (nacl.Key, error) {
+	src, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return utils.LoadBase64Key(strings.TrimSpace(string(src)))
+}
+
+func (db *encryptedDb) Write(key *[]byte, value *[]byte) error {
+	return db.db.WriteBatch(db.sealBatch([]batchOp{{Key: *key, Value: *value}}))
+}
+
+// sealBatch provides the batch applying the operations to the underlying store. Each operation
+// also removes any copy of the record written with a previous key.
+func (db *encryptedDb) sealBatch(ops []batchOp) *Batch {
+	batch := new(Batch)
+	for _, op := range ops {
+		for _, previous := range db.keys[1:] {
+			blinded := previous.blindKey(op.Key)
+			batch.Delete(&blinded)
+		}
+		blinded := db.keys[0].blindKey(op.Key)
+		if op.Delete {
+			batch.Delete(&blinded)
+		} else {
+			sealed := db.keys[0].sealRecord(op.Key, op.Value)
+			batch.Write(&blinded, &sealed)
+		}
+	}
+	return batch
+}
+
+func (db *encryptedDb) Read(key *[]byte) (*[]byte, error) {
+	return db.read(db.db, key)
+}
+
+// read reads the record using each key in turn, as it may not yet have been rewritten with the
+// current key.
+func (db *encryptedDb) read(tx Transaction, key *[]byte) (*[]byte, error) {
+	for _, k := range db.keys {
+		blinded := k.blindKey(*key)
+		sealed, err := tx.Read(&blinded)
+		if err != nil {
+			continue
+		}
+		recordKey, value, ok := k.openRecord(*sealed)
+		if !ok || !bytes.Equal(recordKey, *key) {
+			return nil, ErrUndecryptable
+		}
+		return &value, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (db *encryptedDb) ReadAll(f func(key, value *[]byte)) error {
+	return ReadRange(db, nil, func(key, value []byte) bool {
+		f(&key, &value)
+		return true
+	})
+}
+
+// NewIterator provides an Iterator over the records within the Range, which scans every record of
+// the underlying store within the namespace of the Range, or the entire store if it has none.
+func (db *encryptedDb) NewIterator(r *Range) Iterator {
+	return &encryptedIterator{iter: db.db.NewIterator(blindRange(r)), keys: db.keys, r: r}
+}
+
+type encryptedIterator struct {
+	iter  Iterator
+	keys  []storageKey
+	r     *Range
+	key   []byte
+	value []byte
+	err   error
+}
+
+func (iter *encryptedIterator) Next() bool {
+	for iter.err == nil && iter.iter.Next() {
+		if bytes.Equal(iter.iter.Key(), encryptionMarker) {
+			continue
+		}
+		key, value, _, ok := openRecord(iter.keys, iter.iter.Value())
+		if !ok {
+			iter.err = ErrUndecryptable
+			break
+		}
+		if iter.r.Contains(key) {
+			iter.key, iter.value = key, value
+			return true
+		}
+	}
+	iter.key, iter.value = nil, nil
+	return false
+}
+
+// openRecord decrypts the record with whichever of the keys it was written with, reporting the
+// index of the key.
+func openRecord(keys []storageKey, sealed []byte) (key, value []byte, index int, ok bool) {
+	for i, k := range keys {
+		if key, value, ok = k.openRecord(sealed); ok {
+			return key, value, i, true
+		}
+	}
+	return nil, nil, -1, false
+}
+
+func (iter *encryptedIterator) Key() []byte {
+	return iter.key
+}
+
+func (iter *encryptedIterator) Value() []byte {
+	return iter.value
+}
+
+func (iter *encryptedIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.iter.Error()
+}
+
+func (iter *encryptedIterator) Release() {
+	iter.iter.Release()
+}
+
+// Snapshot provides a Snapshot of the underlying store, whose records are decrypted as they are
+// read, or ErrNoSnapshots if it does not support them.
+func (db *encryptedDb) Snapshot() (Snapshot, error) {
+	snapshotter, ok := db.db.(Snapshotter)
+	if !ok {
+		return nil, ErrNoSnapshots
+	}
+	snapshot, err := snapshotter.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedSnapshot{snapshot: snapshot, keys: db.keys}, nil
+}
+
+type encryptedSnapshot struct {
+	snapshot Snapshot
+	keys     []storageKey
+}
+
+func (s *encryptedSnapshot) NewIterator(r *Range) Iterator {
+	return &encryptedIterator{iter: s.snapshot.NewIterator(blindRange(r)), keys: s.keys, r: r}
+}
+
+func (s *encryptedSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+func (db *encryptedDb) Delete(key *[]byte) error {
+	return db.db.WriteBatch(db.sealBatch([]batchOp{{Key: *key, Delete: true}}))
+}
+
+func (db *encryptedDb) WriteBatch(batch *Batch) error {
+	return db.db.WriteBatch(db.sealBatch(batch.ops))
+}
+
+func (db *encryptedDb) Update(f func(tx Transaction) error) error {
+	return db.db.Update(func(tx Transaction) error {
+		return f(&encryptedTransaction{db: db, tx: tx})
+	})
+}
+
+type encryptedTransaction struct {
+	db *encryptedDb
+	tx Transaction
+}
+
+func (t *encryptedTransaction) Read(key *[]byte) (*[]byte, error) {
+	return t.db.read(t.tx, key)
+}
+
+func (t *encryptedTransaction) Write(key *[]byte, value *[]byte) error {
+	return t.apply(t.db.sealBatch([]batchOp{{Key: *key, Value: *value}}))
+}
+
+func (t *encryptedTransaction) Delete(key *[]byte) error {
+	return t.apply(t.db.sealBatch([]batchOp{{Key: *key, Delete: true}}))
+}
+
+func (t *encryptedTransaction) apply(batch *Batch) error {
+	for _, op := range batch.ops {
+		var err error
+		if op.Delete {
+			err = t.tx.Delete(&op.Key)
+		} else {
+			err = t.tx.Write(&op.Key, &op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rekey rewrites each record written with a previous key using the current key, providing the
+// number of records rewritten. Once it completes, the previous keys are no longer required. It
+// can be run again should it be interrupted.
+func (db *encryptedDb) Rekey() (int, error) {
+	count := 0
+	batch := new(Batch)
+	var writeErr error
+	err := ReadRange(db.db, nil, func(blinded, sealed []byte) bool {
+		key, value, index, ok := openRecord(db.keys, sealed)
+		if !ok {
+			writeErr = ErrUndecryptable
+			return false
+		}
+		if index == 0 {
+			return true
+		}
+		if bytes.Equal(blinded, encryptionMarker) {
+			resealed := db.keys[0].sealRecord(key, value)
+			batch.Write(&encryptionMarker, &resealed)
+			return true
+		}
+
+		previous := append([]byte{}, blinded...)
+		batch.Delete(&previous)
+		current := db.keys[0].blindKey(key)
+		resealed := db.keys[0].sealRecord(key, value)
+		batch.Write(&current, &resealed)
+		count += 1
+
+		if batch.Len() >= rekeyBatchSize {
+			writeErr = db.db.WriteBatch(batch)
+			batch.Reset()
+		}
+		return writeErr == nil
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil && batch.Len() > 0 {
+		err = db.db.WriteBatch(batch)
+	}
+	return count, err
+}
+
+func (db *encryptedDb) Close() error {
+	return db.db.Close()
+}
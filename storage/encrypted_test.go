@@ -0,0 +1,160 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"testing"
+)
+
+func TestEncryptedDb(t *testing.T) {
+	raw := storage.InitMemoryDb()
+	oldKey, newKey := nacl.NewKey(), nacl.NewKey()
+
+	db := storage.InitEncryptedDb(raw, oldKey)
+	for i := 0; i < 10; i++ {
+		write(t, db, fmt.Sprintf("recipient/%d", i), fmt.Sprintf("payload %d", i))
+	}
+
+	// Only the namespaces of keys are visible in the underlying store
+	err := storage.ReadRange(raw, nil, func(key, value []byte) bool {
+		if !bytes.HasPrefix(key, []byte("recipient/")) || len(key) != len("recipient/")+nacl.KeySize ||
+			bytes.Contains(value, []byte("payload")) {
+			t.Errorf("Record %q is stored in plaintext", key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.ReadRange(storage.InitEncryptedDb(raw, newKey), nil, func(key, value []byte) bool {
+		return true
+	})
+	if err != storage.ErrUndecryptable {
+		t.Errorf("Records read with the wrong key, error: %v", err)
+	}
+
+	// Records written with the previous key remain readable until they are rewritten
+	db = storage.InitEncryptedDb(raw, newKey, oldKey)
+	expectValue(t, db, "recipient/1", "payload 1")
+	write(t, db, "recipient/2", "updated")
+
+	count, err := db.Rekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 9 {
+		t.Errorf("%d records rewritten whereas 9 are expected", count)
+	}
+	if count, err = db.Rekey(); err != nil || count != 0 {
+		t.Errorf("%d records rewritten once rekeyed, error: %v", count, err)
+	}
+
+	db = storage.InitEncryptedDb(raw, newKey)
+	keys := readKeys(t, db, storage.PrefixRange([]byte("recipient/")), false)
+	if len(keys) != 10 {
+		t.Errorf("%d records read after rekeying whereas 10 are expected", len(keys))
+	}
+	expectValue(t, db, "recipient/1", "payload 1")
+	expectValue(t, db, "recipient/2", "updated")
+}
+
+func TestOpenEncryptedDb(t *testing.T) {
+	raw := storage.InitMemoryDb()
+	oldKey, newKey := nacl.NewKey(), nacl.NewKey()
+
+	db, err := storage.OpenEncryptedDb(raw, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, db, "recipient/1", "payload 1")
+	if encrypted, err := storage.IsEncrypted(raw); err != nil || !encrypted {
+		t.Errorf("Store should be marked as encrypted, error: %v", err)
+	}
+	if keys := readKeys(t, db, nil, false); len(keys) != 1 {
+		t.Errorf("%d records read whereas only 1 was written", len(keys))
+	}
+
+	if _, err = storage.OpenEncryptedDb(raw, newKey); err != storage.ErrStorageKeyMismatch {
+		t.Errorf("Store opened with the wrong key, error: %v", err)
+	}
+
+	// The marker is rewritten with the current key along with the other records
+	db, err = storage.OpenEncryptedDb(raw, newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := db.Rekey(); err != nil || count != 1 {
+		t.Errorf("%d records rewritten whereas 1 is expected, error: %v", count, err)
+	}
+	db, err = storage.OpenEncryptedDb(raw, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "recipient/1", "payload 1")
+
+	// Existing records of unencrypted stores would no longer be readable
+	plain := storage.InitMemoryDb()
+	write(t, plain, "recipient/1", "payload 1")
+	if _, err = storage.OpenEncryptedDb(plain, newKey); err != storage.ErrStorageKeyMismatch {
+		t.Errorf("Unencrypted store opened as encrypted, error: %v", err)
+	}
+	if encrypted, err := storage.IsEncrypted(plain); err != nil || encrypted {
+		t.Errorf("Unencrypted store should not be marked as encrypted, error: %v", err)
+	}
+}
+
+func TestEncryptedDbNamespaces(t *testing.T) {
+	raw := storage.InitMemoryDb()
+	db := storage.InitEncryptedDb(raw, nacl.NewKey())
+	index := storage.NewRecipientIndex(db)
+
+	recipient, other := []byte("recipient"), []byte("other")
+	batch := new(storage.Batch)
+	for i := 0; i < 10; i++ {
+		digest := []byte(fmt.Sprintf("digest %d", i))
+		batch.Write(&digest, &digest)
+		if i%2 == 0 {
+			index.Add(batch, digest, [][]byte{recipient})
+		} else {
+			index.Add(batch, digest, [][]byte{other})
+		}
+	}
+	if err := db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records outside of the namespace of the index are not read when reading it
+	undecryptable, value := []byte("undecryptable"), []byte("value")
+	if err := raw.Write(&undecryptable, &value); err != nil {
+		t.Fatal(err)
+	}
+	err := storage.ReadRange(db, nil, func(key, value []byte) bool { return true })
+	if err != storage.ErrUndecryptable {
+		t.Errorf("Undecryptable record should be read when reading every record, error: %v", err)
+	}
+
+	digests := make(map[string]bool)
+	err = index.Digests(recipient, nil, func(digest []byte) bool {
+		digests[string(digest)] = true
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 5 || !digests["digest 0"] || digests["digest 1"] {
+		t.Errorf("Unexpected digests %v for recipient", digests)
+	}
+
+	err = storage.ReadRange(raw, nil, func(key, value []byte) bool {
+		if bytes.Contains(key, recipient) || bytes.Contains(key, other) {
+			t.Errorf("Recipient visible in index key %q", key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+)
+
+// recipientIndexPrefix namespaces the entries of the recipient index within a DataStore. Each
+// entry is keyed by the length of the recipient's public key, the key itself, then the digest of
+// a payload addressed to it, and has no value.
+var recipientIndexPrefix = []byte("rcptidx/")
+
+// recipientIndexVersion is the key recording that the recipient index has been built over all
+// payloads in a DataStore.
+var recipientIndexVersion = []byte("rcptidx")
+
+// buildBatchSize is the number of entries written at a time when building the index.
+const buildBatchSize = 1000
+
+// RecipientIndex maps the public keys of recipients to the digests of the payloads addressed to
+// them, so that the payloads for a recipient can be found without scanning the entire DataStore.
+type RecipientIndex struct {
+	db DataStore
+}
+
+// NewRecipientIndex creates a RecipientIndex whose entries are kept in the provided DataStore.
+func NewRecipientIndex(db DataStore) *RecipientIndex {
+	return &RecipientIndex{db: db}
+}
+
+// IsRecipientIndexKey reports whether the key is used by the recipient index rather than
+// referring to a payload.
+func IsRecipientIndexKey(key []byte) bool {
+	return bytes.HasPrefix(key, recipientIndexPrefix) || bytes.Equal(key, recipientIndexVersion)
+}
+
+func recipientPrefix(recipient []byte) []byte {
+	prefix := make([]byte, 0, len(recipientIndexPrefix)+1+len(recipient))
+	prefix = append(prefix, recipientIndexPrefix...)
+	prefix = append(prefix, byte(len(recipient)))
+	return append(prefix, recipient...)
+}
+
+func recipientIndexKey(recipient, digest []byte) []byte {
+	return append(recipientPrefix(recipient), digest...)
+}
+
+// Add adds entries recording that the payload with the given digest is addressed to each of the
+// recipients to the batch, which should also write the payload.
+func (idx *RecipientIndex) Add(batch *Batch, digest []byte, recipients [][]byte) {
+	empty := []byte{}
+	for _, recipient := range recipients {
+		key := recipientIndexKey(recipient, digest)
+		batch.Write(&key, &empty)
+	}
+}
+
+// Remove adds the deletion of the entries for the payload with the given digest to the batch,
+// which should also delete the payload.
+func (idx *RecipientIndex) Remove(batch *Batch, digest []byte, recipients [][]byte) {
+	for _, recipient := range recipients {
+		key := recipientIndexKey(recipient, digest)
+		batch.Delete(&key)
+	}
+}
+
+// Digests invokes f with the digest of each payload addressed to the recipient, in order, which
+// follows after if it is provided. Iteration stops if f returns false.
+func (idx *RecipientIndex) Digests(recipient, after []byte, f func(digest []byte) bool) error {
+	prefix := recipientPrefix(recipient)
+	r := PrefixRange(prefix)
+	if len(after) > 0 {
+		r.Start = append(recipientIndexKey(recipient, after), 0)
+	}
+	return ReadRange(idx.db, r, func(key, value []byte) bool {
+		digest := make([]byte, len(key)-len(prefix))
+		copy(digest, key[len(prefix):])
+		return f(digest)
+	})
+}
+
+// Built reports whether the index has been built over all payloads already in the DataStore.
+func (idx *RecipientIndex) Built() bool {
+	_, err := idx.db.Read(&recipientIndexVersion)
+	return err == nil
+}
+
+// Build indexes all payloads already in the DataStore, which are identified by isPayload and
+// whose recipients are provided by recipients. It is only required once for DataStores populated
+// before the index was introduced.
+func (idx *RecipientIndex) Build(
+	isPayload func(key []byte) bool, recipients func(value []byte) [][]byte) (int, error) {
+
+	count := 0
+	batch := new(Batch)
+	var writeErr error
+	err := idx.db.ReadAll(func(key, value *[]byte) {
+		if writeErr != nil || IsRecipientIndexKey(*key) || !isPayload(*key) {
+			return
+		}
+		digest := make([]byte, len(*key))
+		copy(digest, *key)
+		idx.Add(batch, digest, recipients(*value))
+		count += 1
+		if batch.Len() >= buildBatchSize {
+			writeErr = idx.db.WriteBatch(batch)
+			batch.Reset()
+		}
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return count, err
+	}
+
+	// The index is only recorded as built along with its final entries
+	version := []byte{1}
+	batch.Write(&recipientIndexVersion, &version)
+	return count, idx.db.WriteBatch(batch)
+}
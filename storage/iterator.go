@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+)
+
+// Range is a range of keys within a DataStore, from Start inclusive to Limit exclusive. A nil
+// Start or Limit leaves the range unbounded in that direction.
+type Range struct {
+	Start []byte
+	Limit []byte
+}
+
+// PrefixRange provides the Range of all keys with the given prefix.
+func PrefixRange(prefix []byte) *Range {
+	var limit []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			limit = make([]byte, i+1)
+			copy(limit, prefix)
+			limit[i] += 1
+			break
+		}
+	}
+	return &Range{Start: prefix, Limit: limit}
+}
+
+// Contains reports whether the key falls within the range.
+func (r *Range) Contains(key []byte) bool {
+	if r == nil {
+		return true
+	}
+	return (r.Start == nil || bytes.Compare(key, r.Start) >= 0) &&
+		(r.Limit == nil || bytes.Compare(key, r.Limit) < 0)
+}
+
+// Iterator iterates over the records within a Range of a DataStore. Iteration may be stopped at
+// any point, after which Release must be called. Key and Value are only valid until the next call
+// to Next.
+type Iterator interface {
+	// Next moves to the next record, reporting whether there is one.
+	Next() bool
+	Key() []byte
+	Value() []byte
+	// Error provides any error which ended the iteration.
+	Error() error
+	Release()
+}
+
+// ReadRange invokes f with each record within the Range, until f returns false.
+func ReadRange(db DataStore, r *Range, f func(key, value []byte) bool) error {
+	iter := db.NewIterator(r)
+	defer iter.Release()
+	for iter.Next() {
+		if !f(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
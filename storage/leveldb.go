@@ -2,6 +2,7 @@ package storage
 
 import (
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type levelDb struct {
@@ -40,10 +41,91 @@ func (db *levelDb) ReadAll(f func(key, value *[]byte)) error {
 	return iter.Error()
 }
 
+func (db *levelDb) NewIterator(r *Range) Iterator {
+	return db.conn.NewIterator(toLevelDbRange(r), nil)
+}
+
+func toLevelDbRange(r *Range) *util.Range {
+	if r == nil {
+		return nil
+	}
+	return &util.Range{Start: r.Start, Limit: r.Limit}
+}
+
+// Snapshot provides a LevelDB snapshot of the database.
+func (db *levelDb) Snapshot() (Snapshot, error) {
+	snapshot, err := db.conn.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &levelDbSnapshot{snapshot}, nil
+}
+
+type levelDbSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+func (s *levelDbSnapshot) NewIterator(r *Range) Iterator {
+	return s.snapshot.NewIterator(toLevelDbRange(r), nil)
+}
+
+func (s *levelDbSnapshot) Release() {
+	s.snapshot.Release()
+}
+
 func (db *levelDb) Delete(key *[]byte) error {
 	return db.conn.Delete(*key, nil)
 }
 
+func (db *levelDb) WriteBatch(batch *Batch) error {
+	return db.conn.Write(toLevelDbBatch(batch), nil)
+}
+
+func toLevelDbBatch(batch *Batch) *leveldb.Batch {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.Delete {
+			b.Delete(op.Key)
+		} else {
+			b.Put(op.Key, op.Value)
+		}
+	}
+	return b
+}
+
+// Update runs f within a LevelDB transaction, which prevents other writes until it completes.
+func (db *levelDb) Update(f func(tx Transaction) error) error {
+	tx, err := db.conn.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	if err = f(&levelDbTransaction{tx}); err != nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+type levelDbTransaction struct {
+	tx *leveldb.Transaction
+}
+
+func (t *levelDbTransaction) Read(key *[]byte) (*[]byte, error) {
+	value, err := t.tx.Get(*key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (t *levelDbTransaction) Write(key *[]byte, value *[]byte) error {
+	return t.tx.Put(*key, *value, nil)
+}
+
+func (t *levelDbTransaction) Delete(key *[]byte) error {
+	return t.tx.Delete(*key, nil)
+}
+
 func (db *levelDb) Close() error {
 	return db.conn.Close()
 }
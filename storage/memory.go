@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+type memoryDb struct {
+	mu      sync.RWMutex
+	records map[string][]byte
+}
+
+// InitMemoryDb creates an empty DataStore which holds its records in memory, for tests and nodes
+// whose payloads need not survive a restart. It is safe for concurrent use.
+//
+// Closing the DataStore does not discard its records, so a node can be restarted over it within
+// the same process.
+func InitMemoryDb() *memoryDb {
+	return &memoryDb{records: make(map[string][]byte)}
+}
+
+func (db *memoryDb) Write(key *[]byte, value *[]byte) error {
+	db.mu.Lock()
+	db.write(*key, *value)
+	db.mu.Unlock()
+	return nil
+}
+
+// write stores a copy of value, as callers may reuse the slice they provide.
+func (db *memoryDb) write(key, value []byte) {
+	db.records[string(key)] = append([]byte{}, value...)
+}
+
+func (db *memoryDb) Read(key *[]byte) (*[]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.read(key)
+}
+
+func (db *memoryDb) read(key *[]byte) (*[]byte, error) {
+	value, ok := db.records[string(*key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	value = append([]byte{}, value...)
+	return &value, nil
+}
+
+func (db *memoryDb) ReadAll(f func(key, value *[]byte)) error {
+	return ReadRange(db, nil, func(key, value []byte) bool {
+		f(&key, &value)
+		return true
+	})
+}
+
+// NewIterator provides an Iterator over a snapshot of the records within the Range, so records can
+// be written during iteration.
+func (db *memoryDb) NewIterator(r *Range) Iterator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return newMemoryIterator(db.records, r)
+}
+
+func newMemoryIterator(records map[string][]byte, r *Range) *memoryIterator {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		if r.Contains([]byte(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = records[key]
+	}
+	return &memoryIterator{keys: keys, values: values, pos: -1}
+}
+
+// Snapshot provides a copy of the records, which shares their values as they are never modified
+// once written.
+func (db *memoryDb) Snapshot() (Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	records := make(map[string][]byte, len(db.records))
+	for key, value := range db.records {
+		records[key] = value
+	}
+	return &memorySnapshot{records: records}, nil
+}
+
+type memorySnapshot struct {
+	records map[string][]byte
+}
+
+func (s *memorySnapshot) NewIterator(r *Range) Iterator {
+	return newMemoryIterator(s.records, r)
+}
+
+func (s *memorySnapshot) Release() {
+	s.records = nil
+}
+
+type memoryIterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+}
+
+func (iter *memoryIterator) Next() bool {
+	if iter.pos < len(iter.keys) {
+		iter.pos += 1
+	}
+	return iter.pos < len(iter.keys)
+}
+
+func (iter *memoryIterator) Key() []byte {
+	if iter.pos < 0 || iter.pos >= len(iter.keys) {
+		return nil
+	}
+	return []byte(iter.keys[iter.pos])
+}
+
+func (iter *memoryIterator) Value() []byte {
+	if iter.pos < 0 || iter.pos >= len(iter.values) {
+		return nil
+	}
+	return append([]byte{}, iter.values[iter.pos]...)
+}
+
+func (iter *memoryIterator) Error() error {
+	return nil
+}
+
+func (iter *memoryIterator) Release() {
+	iter.keys, iter.values = nil, nil
+}
+
+func (db *memoryDb) Delete(key *[]byte) error {
+	db.mu.Lock()
+	delete(db.records, string(*key))
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *memoryDb) WriteBatch(batch *Batch) error {
+	db.mu.Lock()
+	db.applyBatch(batch.ops)
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *memoryDb) applyBatch(ops []batchOp) {
+	for _, op := range ops {
+		if op.Delete {
+			delete(db.records, string(op.Key))
+		} else {
+			db.write(op.Key, op.Value)
+		}
+	}
+}
+
+// Update runs f within a transaction, which prevents other writes until it completes.
+func (db *memoryDb) Update(f func(tx Transaction) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx := newBatchTransaction(db.read)
+	if err := f(tx); err != nil {
+		return err
+	}
+	db.applyBatch(tx.batch.ops)
+	return nil
+}
+
+func (db *memoryDb) Close() error {
+	return nil
+}
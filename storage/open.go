@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Schemes of the URIs identifying each type of DataStore.
+const (
+	LevelDbScheme    = "leveldb"
+	BerkeleyDbScheme = "berkeleydb"
+	SqliteScheme     = "sqlite"
+	MemoryScheme     = "memory"
+)
+
+// ParseURI splits uri into its scheme and path, reporting false if it does not begin with the
+// scheme of a supported DataStore.
+func ParseURI(uri string) (scheme, path string, ok bool) {
+	parts := strings.SplitN(uri, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	switch parts[0] {
+	case LevelDbScheme, BerkeleyDbScheme, SqliteScheme, MemoryScheme:
+		return parts[0], parts[1], true
+	default:
+		return "", "", false
+	}
+}
+
+// Open opens the DataStore identified by uri, which is of the form <scheme>:<path>, such as
+// leveldb:crux.db, berkeleydb:constellation or sqlite:crux.sqlite. An in-memory DataStore, which has
+// no path, is opened with memory:.
+func Open(uri string) (DataStore, error) {
+	if uri == MemoryScheme+":" {
+		return InitMemoryDb(), nil
+	}
+
+	parts := strings.SplitN(uri, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid storage: %s, expected <scheme>:<path>", uri)
+	}
+
+	switch parts[0] {
+	case LevelDbScheme:
+		return InitLevelDb(parts[1])
+	case BerkeleyDbScheme:
+		return InitBerkeleyDb(parts[1])
+	case SqliteScheme:
+		return InitSqliteDb(parts[1])
+	case MemoryScheme:
+		return nil, fmt.Errorf("invalid storage: %s, expected %s:", uri, MemoryScheme)
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme: %s", parts[0])
+	}
+}
@@ -0,0 +1,51 @@
+package storage_test
+
+import (
+	"github.com/blk-io/crux/storage"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestOpen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	for _, scheme := range []string{storage.LevelDbScheme, storage.SqliteScheme} {
+		db, err := storage.Open(scheme + ":" + path.Join(dbPath, "crux."+scheme))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	db, err := storage.Open(storage.MemoryScheme + ":")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, uri := range []string{"crux.db", "leveldb:", "memory:crux.db", "unknown:crux.db"} {
+		if _, err := storage.Open(uri); err == nil {
+			t.Errorf("No error returned opening invalid storage %s", uri)
+		}
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	scheme, dbPath, ok := storage.ParseURI("sqlite:crux.sqlite")
+	if !ok || scheme != storage.SqliteScheme || dbPath != "crux.sqlite" {
+		t.Errorf("Unexpected result parsing URI: %s, %s, %v", scheme, dbPath, ok)
+	}
+
+	// Constellation configuration files use dir:<path> for their storage
+	for _, uri := range []string{"crux.db", "dir:storage"} {
+		if _, _, ok = storage.ParseURI(uri); ok {
+			t.Errorf("%s parsed as a storage URI", uri)
+		}
+	}
+}
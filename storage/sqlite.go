@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/base64"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqliteSchema holds every record in the records table. Payloads additionally have a row in the
+// payloads table, and a row per recipient in the payload_recipients table, so that they can be
+// queried with SQL. Public keys and digests in these tables are base64 encoded, as they appear in
+// key files and transactions.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	key BLOB PRIMARY KEY,
+	value BLOB NOT NULL
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS payloads (
+	key BLOB PRIMARY KEY,
+	digest TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	created TEXT NOT NULL,
+	size INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS payloads_sender ON payloads (sender);
+CREATE INDEX IF NOT EXISTS payloads_created ON payloads (created);
+
+CREATE TABLE IF NOT EXISTS payload_recipients (
+	key BLOB NOT NULL,
+	recipient TEXT NOT NULL,
+	PRIMARY KEY (key, recipient)
+);
+CREATE INDEX IF NOT EXISTS payload_recipients_recipient ON payload_recipients (recipient);
+`
+
+// sqliteTimeFormat is the format in which creation times are stored, which is that of the SQLite
+// date and time functions, so they can be compared with expressions such as
+// datetime('now', '-7 days').
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// sqlitePageSize is the number of records read at a time by iterators, which do not hold a query
+// open between pages so that records can be written during iteration.
+const sqlitePageSize = 100
+
+type sqliteDb struct {
+	dbPath   string
+	conn     *sql.DB
+	mu       sync.Mutex // Guards describe
+	describe Describer
+}
+
+// InitSqliteDb opens the SQLite database at dbPath, creating it if it does not exist.
+//
+// Payloads are only recorded in the payloads and payload_recipients tables once a Describer has
+// been provided via SetDescriber.
+func InitSqliteDb(dbPath string) (*sqliteDb, error) {
+	// The write-ahead log allows the database to be queried while the node is writing to it
+	conn, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serialises writes, rather than them failing as the database is locked
+	conn.SetMaxOpenConns(1)
+
+	if _, err = conn.Exec(sqliteSchema); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sqliteDb{dbPath: dbPath, conn: conn}, nil
+}
+
+// SetDescriber provides the Describer used to populate the metadata of payloads as they are
+// written.
+func (db *sqliteDb) SetDescriber(d Describer) {
+	db.mu.Lock()
+	db.describe = d
+	db.mu.Unlock()
+}
+
+func (db *sqliteDb) describer() Describer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.describe
+}
+
+func (db *sqliteDb) Write(key *[]byte, value *[]byte) error {
+	return db.Update(func(tx Transaction) error {
+		return tx.Write(key, value)
+	})
+}
+
+func (db *sqliteDb) Read(key *[]byte) (*[]byte, error) {
+	return readSqlite(db.conn.QueryRow("SELECT value FROM records WHERE key = ?", *key))
+}
+
+func readSqlite(row *sql.Row) (*[]byte, error) {
+	var value []byte
+	err := row.Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (db *sqliteDb) ReadAll(f func(key, value *[]byte)) error {
+	return ReadRange(db, nil, func(key, value []byte) bool {
+		f(&key, &value)
+		return true
+	})
+}
+
+func (db *sqliteDb) NewIterator(r *Range) Iterator {
+	return &sqliteIterator{q: db.conn, r: r}
+}
+
+// sqliteQuerier is implemented by both connections and transactions.
+type sqliteQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type sqliteIterator struct {
+	q     sqliteQuerier
+	r     *Range
+	page  [][2][]byte
+	pos   int
+	done  bool // Whether the last page has been read
+	after []byte
+	key   []byte
+	value []byte
+	err   error
+}
+
+func (iter *sqliteIterator) Next() bool {
+	for iter.err == nil {
+		if iter.pos < len(iter.page) {
+			record := iter.page[iter.pos]
+			iter.pos += 1
+			iter.key, iter.value = record[0], record[1]
+			iter.after = iter.key
+			return true
+		}
+		if iter.done {
+			break
+		}
+		iter.err = iter.readPage()
+	}
+	iter.key, iter.value = nil, nil
+	return false
+}
+
+// readPage reads the records following the last one visited.
+func (iter *sqliteIterator) readPage() error {
+	var conditions []string
+	var args []interface{}
+	if iter.after != nil {
+		conditions = append(conditions, "key > ?")
+		args = append(args, iter.after)
+	} else if iter.r != nil && len(iter.r.Start) > 0 {
+		conditions = append(conditions, "key >= ?")
+		args = append(args, iter.r.Start)
+	}
+	if iter.r != nil && len(iter.r.Limit) > 0 {
+		conditions = append(conditions, "key < ?")
+		args = append(args, iter.r.Limit)
+	}
+
+	query := "SELECT key, value FROM records"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY key LIMIT ?"
+	args = append(args, sqlitePageSize)
+
+	rows, err := iter.q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	iter.page, iter.pos = iter.page[:0], 0
+	for rows.Next() {
+		var key, value []byte
+		if err = rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		iter.page = append(iter.page, [2][]byte{key, value})
+	}
+	iter.done = len(iter.page) < sqlitePageSize
+	return rows.Err()
+}
+
+func (iter *sqliteIterator) Key() []byte {
+	return iter.key
+}
+
+func (iter *sqliteIterator) Value() []byte {
+	return iter.value
+}
+
+func (iter *sqliteIterator) Error() error {
+	return iter.err
+}
+
+func (iter *sqliteIterator) Release() {
+	iter.page = nil
+}
+
+// Snapshot provides a read transaction on a separate connection to the database, which the
+// write-ahead log allows to continue to see the records as they were while others are written.
+func (db *sqliteDb) Snapshot() (Snapshot, error) {
+	conn, err := sql.Open("sqlite3", "file:"+db.dbPath+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(1)
+
+	tx, err := conn.Begin()
+	if err == nil {
+		// The snapshot is only established once the transaction first reads from the database
+		var count int
+		err = tx.QueryRow("SELECT COUNT(*) FROM (SELECT key FROM records LIMIT 1)").Scan(&count)
+		if err != nil {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sqliteSnapshot{conn: conn, tx: tx}, nil
+}
+
+type sqliteSnapshot struct {
+	conn *sql.DB
+	tx   *sql.Tx
+}
+
+func (s *sqliteSnapshot) NewIterator(r *Range) Iterator {
+	return &sqliteIterator{q: s.tx, r: r}
+}
+
+func (s *sqliteSnapshot) Release() {
+	s.tx.Rollback()
+	s.conn.Close()
+}
+
+func (db *sqliteDb) Delete(key *[]byte) error {
+	return db.Update(func(tx Transaction) error {
+		return tx.Delete(key)
+	})
+}
+
+func (db *sqliteDb) WriteBatch(batch *Batch) error {
+	return db.Update(func(tx Transaction) error {
+		for _, op := range batch.ops {
+			var err error
+			if op.Delete {
+				err = tx.Delete(&op.Key)
+			} else {
+				err = tx.Write(&op.Key, &op.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update runs f within a SQLite transaction. As the database has a single connection, f must only
+// access it via the Transaction.
+func (db *sqliteDb) Update(f func(tx Transaction) error) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(&sqliteTransaction{tx: tx, describe: db.describer()}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqliteTransaction struct {
+	tx       *sql.Tx
+	describe Describer
+}
+
+func (t *sqliteTransaction) Read(key *[]byte) (*[]byte, error) {
+	return readSqlite(t.tx.QueryRow("SELECT value FROM records WHERE key = ?", *key))
+}
+
+// Write writes the record, along with its metadata if it is a payload. The creation time of a
+// payload is retained if it is rewritten.
+func (t *sqliteTransaction) Write(key *[]byte, value *[]byte) error {
+	_, err := t.tx.Exec("INSERT OR REPLACE INTO records (key, value) VALUES (?, ?)",
+		*key, nonNil(*value))
+	if err != nil || t.describe == nil {
+		return err
+	}
+
+	meta, ok := t.describe(*key, *value)
+	if !ok {
+		return nil
+	}
+
+	sender := base64.StdEncoding.EncodeToString(meta.Sender)
+	_, err = t.tx.Exec(
+		"INSERT OR IGNORE INTO payloads (key, digest, sender, created, size) VALUES (?, ?, ?, ?, ?)",
+		*key, base64.StdEncoding.EncodeToString(*key), sender,
+		time.Now().UTC().Format(sqliteTimeFormat), len(*value))
+	if err != nil {
+		return err
+	}
+	_, err = t.tx.Exec("UPDATE payloads SET sender = ?, size = ? WHERE key = ?",
+		sender, len(*value), *key)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.tx.Exec("DELETE FROM payload_recipients WHERE key = ?", *key)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range meta.Recipients {
+		_, err = t.tx.Exec(
+			"INSERT OR IGNORE INTO payload_recipients (key, recipient) VALUES (?, ?)",
+			*key, base64.StdEncoding.EncodeToString(recipient))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sqliteTransaction) Delete(key *[]byte) error {
+	for _, table := range []string{"records", "payloads", "payload_recipients"} {
+		if _, err := t.tx.Exec("DELETE FROM "+table+" WHERE key = ?", *key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nonNil ensures that empty values are stored as empty blobs rather than NULL.
+func nonNil(value []byte) []byte {
+	if value == nil {
+		return []byte{}
+	}
+	return value
+}
+
+func (db *sqliteDb) Close() error {
+	return db.conn.Close()
+}
@@ -0,0 +1,91 @@
+package storage_test
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/blk-io/crux/storage"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// describeTestRecord treats records with a "payload/" key as payloads, whose value is the sender
+// followed by its recipients, separated by commas.
+func describeTestRecord(key, value []byte) (storage.Metadata, bool) {
+	if !bytes.HasPrefix(key, []byte("payload/")) {
+		return storage.Metadata{}, false
+	}
+	keys := bytes.Split(value, []byte(","))
+	return storage.Metadata{Sender: keys[0], Recipients: keys[1:]}, true
+}
+
+func TestSqliteMetadata(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestSqliteMetadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	dbFile := path.Join(dbPath, "crux.sqlite")
+	db, err := storage.Open(storage.SqliteScheme + ":" + dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.(storage.MetadataStore).SetDescriber(describeTestRecord)
+
+	records := map[string]string{
+		"payload/1": "sender,rcpt1,rcpt2",
+		"payload/2": "sender,rcpt2",
+		"payload/3": "other,rcpt1",
+		"partyinfo": "sender,rcpt1",
+	}
+	for k, v := range records {
+		key, value := []byte(k), []byte(v)
+		if err = db.Write(&key, &value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := []byte("payload/3")
+	if err = db.Delete(&deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Payloads sent to rcpt1 within the last week
+	rows, err := conn.Query(`
+		SELECT p.key, p.sender, p.size FROM payloads p
+		JOIN payload_recipients r ON r.key = p.key
+		WHERE r.recipient = ? AND p.created >= datetime('now', '-7 days')`,
+		"cmNwdDE=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var found []string
+	for rows.Next() {
+		var key []byte
+		var sender string
+		var size int
+		if err = rows.Scan(&key, &sender, &size); err != nil {
+			t.Fatal(err)
+		}
+		if sender != "c2VuZGVy" || size != len(records[string(key)]) {
+			t.Errorf("Unexpected metadata for %s, sender: %s, size: %d", key, sender, size)
+		}
+		found = append(found, string(key))
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0] != "payload/1" {
+		t.Errorf("Unexpected payloads found for recipient: %v", found)
+	}
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"io"
+)
+
+// SealedStreamHeader begins each stream sealed with a storage key, such as a backup archive of
+// encrypted storage.
+var SealedStreamHeader = []byte("crux-sealed-stream-1\n")
+
+// streamKeyContext separates the key sealing streams from the other keys derived from a storage
+// key.
+const streamKeyContext = "crux-storage-stream"
+
+// streamChunkSize is the maximum size of the plaintext of each chunk of a sealed stream.
+const streamChunkSize = 64 * 1024
+
+// Each chunk is sealed with a nonce made of a random prefix chosen for the stream, followed by the
+// index of the chunk, so chunks cannot be reordered or moved between streams.
+const streamPrefixSize = nacl.NonceSize - 8
+
+// Flags starting the plaintext of each chunk, so that truncated streams are detected.
+const (
+	chunkMore  = 0
+	chunkFinal = 1
+)
+
+// ErrUnsealable is returned when a sealed stream cannot be opened with any of the storage keys.
+var ErrUnsealable = errors.New("storage: unable to open sealed stream")
+
+// StreamSealer is implemented by stores which can seal streams of data derived from their records,
+// such as backup archives, with their keys.
+type StreamSealer interface {
+	// SealStream provides a writer sealing the data written to it before writing it to w. The
+	// stream is only complete once the writer is closed.
+	SealStream(w io.Writer) io.WriteCloser
+	// OpenStream provides a reader of the data sealed in the stream read from r.
+	OpenStream(r io.Reader) (io.Reader, error)
+}
+
+func (k storageKey) streamKey() nacl.Key {
+	key, _ := utils.ToKey(
+		utils.Sha3Hash(append([]byte(streamKeyContext), (*k.seal)[:]...))[:nacl.KeySize])
+	return key
+}
+
+// SealStream seals the stream with the current storage key.
+func (db *encryptedDb) SealStream(w io.Writer) io.WriteCloser {
+	return &streamWriter{
+		w:   w,
+		key: db.keys[0].streamKey(),
+		buf: make([]byte, 1, 1+streamChunkSize),
+	}
+}
+
+// OpenStream opens the stream with whichever storage key it was sealed with.
+func (db *encryptedDb) OpenStream(r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(SealedStreamHeader)+streamPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(SealedStreamHeader)], SealedStreamHeader) {
+		return nil, errors.New("storage: stream is not sealed")
+	}
+	stream := &streamReader{r: r}
+	copy(stream.nonce[:], header[len(SealedStreamHeader):])
+
+	// The first chunk determines which key the stream was sealed with
+	sealed, err := stream.readChunk()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range db.keys {
+		stream.key = k.streamKey()
+		if err = stream.open(sealed); err == nil {
+			return stream, nil
+		}
+	}
+	return nil, err
+}
+
+type streamWriter struct {
+	w       io.Writer
+	key     nacl.Key
+	nonce   [nacl.NonceSize]byte
+	index   uint64
+	buf     []byte // The flag of the current chunk, followed by its plaintext
+	started bool
+	err     error
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for s.err == nil && len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == cap(s.buf) {
+			s.writeChunk(chunkMore)
+		}
+	}
+	return written, s.err
+}
+
+// Close writes the final chunk of the stream, without closing the underlying writer.
+func (s *streamWriter) Close() error {
+	s.writeChunk(chunkFinal)
+	return s.err
+}
+
+func (s *streamWriter) writeChunk(flag byte) {
+	if s.err != nil {
+		return
+	}
+	if !s.started {
+		s.started = true
+		if _, s.err = io.ReadFull(rand.Reader, s.nonce[:streamPrefixSize]); s.err != nil {
+			return
+		}
+		header := append(append([]byte{}, SealedStreamHeader...), s.nonce[:streamPrefixSize]...)
+		if _, s.err = s.w.Write(header); s.err != nil {
+			return
+		}
+	}
+
+	s.buf[0] = flag
+	binary.BigEndian.PutUint64(s.nonce[streamPrefixSize:], s.index)
+	sealed := secretbox.Seal(make([]byte, 4), s.buf, &s.nonce, s.key)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	_, s.err = s.w.Write(sealed)
+	s.index += 1
+	s.buf = s.buf[:1]
+}
+
+type streamReader struct {
+	r     io.Reader
+	key   nacl.Key
+	nonce [nacl.NonceSize]byte
+	index uint64
+	chunk []byte // The unread plaintext of the current chunk
+	final bool
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.chunk) == 0 {
+		if s.final {
+			return 0, io.EOF
+		}
+		sealed, err := s.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		if err = s.open(sealed); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	return n, nil
+}
+
+func (s *streamReader) readChunk() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(s.r, length[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < 1+secretbox.Overhead || size > 1+streamChunkSize+secretbox.Overhead {
+		return nil, ErrUnsealable
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(s.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return sealed, nil
+}
+
+func (s *streamReader) open(sealed []byte) error {
+	binary.BigEndian.PutUint64(s.nonce[streamPrefixSize:], s.index)
+	chunk, ok := secretbox.Open(nil, sealed, &s.nonce, s.key)
+	if !ok {
+		return ErrUnsealable
+	}
+	s.index += 1
+	s.final = chunk[0] == chunkFinal
+	s.chunk = chunk[1:]
+	return nil
+}
@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSealedStream(t *testing.T) {
+	oldKey, newKey := nacl.NewKey(), nacl.NewKey()
+	sealer := storage.InitEncryptedDb(storage.InitMemoryDb(), oldKey)
+
+	// Spanning several chunks, ending with a partial one
+	data := make([]byte, 200*1024+17)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed bytes.Buffer
+	w := sealer.SealStream(&sealed)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed.Bytes(), storage.SealedStreamHeader) ||
+		bytes.Contains(sealed.Bytes(), data[:64]) {
+		t.Error("Stream has not been sealed")
+	}
+
+	// Streams sealed with a previous key can still be opened
+	opener := storage.InitEncryptedDb(storage.InitMemoryDb(), newKey, oldKey)
+	expectStream(t, opener, sealed.Bytes(), data)
+
+	if _, err := storage.InitEncryptedDb(storage.InitMemoryDb(), newKey).OpenStream(
+		bytes.NewReader(sealed.Bytes())); err != storage.ErrUnsealable {
+		t.Errorf("Stream opened with the wrong key, error: %v", err)
+	}
+
+	for _, length := range []int{len(storage.SealedStreamHeader), sealed.Len() / 2, sealed.Len() - 1} {
+		r, err := opener.OpenStream(bytes.NewReader(sealed.Bytes()[:length]))
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		if err == nil {
+			t.Errorf("Stream truncated to %d bytes opened without error", length)
+		}
+	}
+
+	tampered := append([]byte{}, sealed.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	r, err := opener.OpenStream(bytes.NewReader(tampered))
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	if err != storage.ErrUnsealable {
+		t.Errorf("Tampered stream opened, error: %v", err)
+	}
+}
+
+func expectStream(t *testing.T, opener storage.StreamSealer, sealed, expected []byte) {
+	r, err := opener.OpenStream(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, expected) {
+		t.Errorf("Opened stream of %d bytes does not match the %d bytes sealed",
+			len(opened), len(expected))
+	}
+}
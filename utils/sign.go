@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"github.com/agl/ed25519/edwards25519"
+	"github.com/kevinburke/nacl"
+)
+
+// SignatureSize is the length in bytes of signatures produced by Sign.
+const SignatureSize = 64
+
+// orderMinusOne is l - 1, where l is the order of the base point, which is -1 modulo l.
+var orderMinusOne = [32]byte{
+	0xec, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58, 0xd6, 0x9c, 0xf7, 0xa2, 0xde, 0xf9, 0xde, 0x14,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10,
+}
+
+// Sign creates a signature of message using the provided Curve25519 private key, allowing
+// holders of the corresponding public key to verify its origin.
+//
+// NaCl box keys are Montgomery form keys, which cannot be used directly for Ed25519 signatures,
+// so signatures are created using the XEdDSA scheme:
+// https://signal.org/docs/specifications/xeddsa/
+func Sign(privKey nacl.Key, message []byte) ([]byte, error) {
+	z := make([]byte, 64)
+	if _, err := rand.Read(z); err != nil {
+		return nil, err
+	}
+
+	var clamped [64]byte
+	copy(clamped[:], privKey[:])
+	clamped[0] &= 248
+	clamped[31] &= 127
+	clamped[31] |= 64
+	var a [32]byte
+	edwards25519.ScReduce(&a, &clamped)
+
+	// The Edwards form of the public key must have a sign bit of zero, as it cannot be recovered
+	// from the Montgomery form.
+	var A edwards25519.ExtendedGroupElement
+	var publicKey [32]byte
+	edwards25519.GeScalarMultBase(&A, &a)
+	A.ToBytes(&publicKey)
+	if publicKey[31]&0x80 != 0 {
+		var zero [32]byte
+		edwards25519.ScMulAdd(&a, &a, &orderMinusOne, &zero)
+		publicKey[31] &= 0x7f
+	}
+
+	// r = hash1(a || M || Z), where hash1 prefixes the input with 0xfe followed by 31 0xff bytes
+	h := sha512.New()
+	h.Write([]byte{0xfe})
+	h.Write(bytes.Repeat([]byte{0xff}, 31))
+	h.Write(a[:])
+	h.Write(message)
+	h.Write(z)
+	r := reduce(h.Sum(nil))
+
+	var R edwards25519.ExtendedGroupElement
+	var encodedR [32]byte
+	edwards25519.GeScalarMultBase(&R, &r)
+	R.ToBytes(&encodedR)
+
+	k := challenge(encodedR[:], publicKey[:], message)
+	var s [32]byte
+	edwards25519.ScMulAdd(&s, &k, &a, &r)
+
+	signature := make([]byte, 0, SignatureSize)
+	signature = append(signature, encodedR[:]...)
+	return append(signature, s[:]...), nil
+}
+
+// Verify reports whether signature is a valid signature of message created with the private
+// key corresponding to the provided Curve25519 public key.
+//
+// Signatures created by libsignal, which stores the sign bit of the Edwards form of the public key
+// in the top bit of the signature rather than clearing it, are also accepted. Sign always clears
+// the bit, so its signatures can be verified by libsignal too.
+func Verify(pubKey nacl.Key, message, signature []byte) bool {
+	if len(signature) != SignatureSize {
+		return false
+	}
+
+	publicKey, ok := edwardsPublicKey(pubKey)
+	if !ok {
+		return false
+	}
+	publicKey[31] |= signature[63] & 0x80
+	var minusA edwards25519.ExtendedGroupElement
+	if !minusA.FromBytes(&publicKey) {
+		return false
+	}
+	edwards25519.FeNeg(&minusA.X, &minusA.X)
+	edwards25519.FeNeg(&minusA.T, &minusA.T)
+
+	var s [32]byte
+	copy(s[:], signature[32:])
+	s[31] &= 0x7f
+	if !isCanonicalScalar(&s) {
+		return false
+	}
+
+	k := challenge(signature[:32], publicKey[:], message)
+
+	// R = sB - kA
+	var R edwards25519.ProjectiveGroupElement
+	var encodedR [32]byte
+	edwards25519.GeDoubleScalarMultVartime(&R, &k, &minusA, &s)
+	R.ToBytes(&encodedR)
+
+	return bytes.Equal(signature[:32], encodedR[:])
+}
+
+// edwardsPublicKey converts a Montgomery form public key to its Edwards form, with a sign bit of
+// zero.
+func edwardsPublicKey(pubKey nacl.Key) ([32]byte, bool) {
+	var u edwards25519.FieldElement
+	var encoded [32]byte
+	edwards25519.FeFromBytes(&u, pubKey)
+	edwards25519.FeToBytes(&encoded, &u)
+	if !bytes.Equal(encoded[:], pubKey[:]) {
+		// Non-canonical encoding
+		return encoded, false
+	}
+
+	// y = (u - 1) / (u + 1)
+	var one, numerator, denominator, y edwards25519.FieldElement
+	edwards25519.FeOne(&one)
+	edwards25519.FeSub(&numerator, &u, &one)
+	edwards25519.FeAdd(&denominator, &u, &one)
+	edwards25519.FeInvert(&denominator, &denominator)
+	edwards25519.FeMul(&y, &numerator, &denominator)
+
+	edwards25519.FeToBytes(&encoded, &y)
+	return encoded, true
+}
+
+func challenge(R, publicKey, message []byte) [32]byte {
+	h := sha512.New()
+	h.Write(R)
+	h.Write(publicKey)
+	h.Write(message)
+	return reduce(h.Sum(nil))
+}
+
+// reduce provides the 64 byte digest reduced modulo the order of the base point.
+func reduce(digest []byte) [32]byte {
+	var wide [64]byte
+	var reduced [32]byte
+	copy(wide[:], digest)
+	edwards25519.ScReduce(&reduced, &wide)
+	return reduced
+}
+
+// isCanonicalScalar reports whether the scalar is less than the order of the base point.
+func isCanonicalScalar(scalar *[32]byte) bool {
+	order := [4]uint64{0x5812631a5cf5d3ed, 0x14def9dea2f79cd6, 0, 0x1000000000000000}
+	for i := 3; i >= 0; i-- {
+		v := binary.LittleEndian.Uint64(scalar[i*8:])
+		if v > order[i] {
+			return false
+		} else if v < order[i] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	message := []byte("message")
+
+	// Around half of keys have an Edwards form with a sign bit of one, so cover both cases
+	for i := 0; i < 32; i++ {
+		pubKey, privKey, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature, err := Sign(privKey, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(signature) != SignatureSize {
+			t.Fatalf("Signature length is %d whereas %d is expected", len(signature), SignatureSize)
+		}
+
+		if !Verify(pubKey, message, signature) {
+			t.Fatalf("Signature %x not valid for key %x", signature, *pubKey)
+		}
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	pubKey, privKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("message")
+	signature, err := Sign(privKey, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Verify(pubKey, []byte("other message"), signature) {
+		t.Error("Signature should not be valid for a different message")
+	}
+
+	if Verify(otherKey, message, signature) {
+		t.Error("Signature should not be valid for a different key")
+	}
+
+	tampered := append([]byte{}, signature...)
+	tampered[0] ^= 1
+	if Verify(pubKey, message, tampered) {
+		t.Error("Tampered signature should not be valid")
+	}
+
+	if Verify(pubKey, message, signature[:SignatureSize-1]) {
+		t.Error("Truncated signature should not be valid")
+	}
+
+	// Adding the order of the base point to s gives an equivalent, but non-canonical, signature
+	order := []byte{
+		0xed, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58, 0xd6, 0x9c, 0xf7, 0xa2, 0xde, 0xf9, 0xde, 0x14,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10,
+	}
+	malleable := append([]byte{}, signature...)
+	var carry uint16
+	for i, b := range order {
+		sum := uint16(malleable[32+i]) + uint16(b) + carry
+		malleable[32+i] = byte(sum)
+		carry = sum >> 8
+	}
+	if Verify(pubKey, message, malleable) {
+		t.Error("Signature with a non-canonical scalar should not be valid")
+	}
+
+	var nonCanonical nacl.Key = new([nacl.KeySize]byte)
+	for i := range nonCanonical {
+		nonCanonical[i] = 0xff
+	}
+	if Verify(nonCanonical, message, signature) {
+		t.Error("Signature should not be valid for a non-canonical key")
+	}
+}
+
+// TestVerifyKnownAnswer checks a signature published with the Curve25519 tests of libsignal, which
+// signs Alice's ephemeral public key with her identity key.
+func TestVerifyKnownAnswer(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	privKey := decode("c097248412e58bf05df487968205132794178e367637f5818f81e0e6ce73e865")
+	var pubKey nacl.Key = new([nacl.KeySize]byte)
+	copy(pubKey[:], decode("ab7e717d4a163b7d9a1d8071dfe9dcf8cdcd1cea3339b6356be84d887e322c64"))
+	message := decode("05edce9d9c415ca78cb7252e72c2c4a554d3eb29485a0e1d503118d1a82d99fb4a")
+	signature := decode("5de88ca9a89b4a115da79109c67c9c7464a3e4180274f1cb8c63c2984e286dfb" +
+		"ede82deb9dcd9fae0bfbb821569b3d9001bd8130cd11d486cef047bd60b86e88")
+
+	if !Verify(pubKey, message, signature) {
+		t.Error("Published signature should be valid")
+	}
+
+	tampered := append([]byte{}, message...)
+	tampered[1] ^= 1
+	if Verify(pubKey, tampered, signature) {
+		t.Error("Published signature should not be valid for a different message")
+	}
+
+	// The signature carries the sign bit of the Edwards form of the key, which must be honoured
+	flipped := append([]byte{}, signature...)
+	flipped[63] ^= 0x80
+	if Verify(pubKey, message, flipped) {
+		t.Error("Published signature should not be valid with its sign bit cleared")
+	}
+
+	// Signatures created by Sign with the same key are valid too
+	var key [nacl.KeySize]byte
+	copy(key[:], privKey)
+	ours, err := Sign(&key, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify(pubKey, message, ours) || ours[63]&0x80 != 0 {
+		t.Errorf("Signature %x not valid for key %x", ours, *pubKey)
+	}
+}